@@ -0,0 +1,293 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// Numbers are Go integers and floats, and the arbitrary-precision *big.Int,
+// *big.Float and *big.Rat. The arithmetic_engine setting decides how they
+// are added, multiplied and divided:
+//
+// The bigdecimal engine, the default, computes exactly in decimal, as
+// FreeMarker does with BigDecimal: 0.1 + 0.2 is 0.3. Floats are taken as
+// the shortest decimal that reads back as them, so the float 0.1 is 0.1,
+// and decimal literals are exact. Integers stay ints unless they overflow,
+// and a quotient is rounded half up to at least 12 decimal places.
+//
+// The conservative engine computes with int64 and float64, which is faster,
+// but inexact. Big numbers are still computed with exactly.
+
+// Arithmetic engines.
+const (
+	bigDecimalEngine = iota
+	conservativeEngine
+)
+
+// arithmeticEngines maps the values of the arithmetic_engine setting to the
+// engines.
+var arithmeticEngines = map[string]int{
+	"bigdecimal":   bigDecimalEngine,
+	"conservative": conservativeEngine,
+}
+
+// minDivisionScale is the least number of decimal places a quotient is
+// rounded to by the bigdecimal engine.
+const minDivisionScale = 12
+
+var (
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+	bigRatType   = reflect.TypeOf(big.Rat{})
+)
+
+// isBigType reports whether typ is a big number type, or a pointer to one.
+func isBigType(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ == bigIntType || typ == bigFloatType || typ == bigRatType
+}
+
+// bigNumber returns the big number v, of bigKind, as a pointer.
+func bigNumber(v reflect.Value) interface{} {
+	if v.Kind() != reflect.Ptr {
+		if v.CanAddr() {
+			v = v.Addr()
+		} else {
+			p := reflect.New(v.Type())
+			p.Elem().Set(v)
+			v = p
+		}
+	}
+	if v.IsNil() {
+		return new(big.Rat)
+	}
+	return v.Interface()
+}
+
+// toRat returns the number v as a rational, and whether it is finite. A
+// float is taken as the shortest decimal that reads back as it.
+func toRat(v reflect.Value) (*big.Rat, bool) {
+	switch k, _ := basicKind(v); k {
+	case intKind:
+		return new(big.Rat).SetInt64(v.Int()), true
+	case uintKind:
+		return new(big.Rat).SetInt(new(big.Int).SetUint64(v.Uint())), true
+	case floatKind:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		bits := 64
+		if v.Kind() == reflect.Float32 {
+			bits = 32
+		}
+		r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, bits))
+		return r, true
+	}
+	switch x := bigNumber(v).(type) {
+	case *big.Int:
+		return new(big.Rat).SetInt(x), true
+	case *big.Float:
+		if x.IsInf() {
+			return nil, false
+		}
+		r, _ := new(big.Rat).SetString(x.Text('g', -1))
+		return r, true
+	case *big.Rat:
+		return x, true
+	}
+	return nil, false
+}
+
+// bigToFloat returns the big number v as a float64, possibly rounded.
+func bigToFloat(v reflect.Value) float64 {
+	switch x := bigNumber(v).(type) {
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(x).Float64()
+		return f
+	case *big.Float:
+		f, _ := x.Float64()
+		return f
+	}
+	f, _ := bigNumber(v).(*big.Rat).Float64()
+	return f
+}
+
+// ratValue returns the rational r as an int if it is one that fits,
+// otherwise as a *big.Rat.
+func ratValue(r *big.Rat) reflect.Value {
+	if r.IsInt() && r.Num().IsInt64() {
+		if n := r.Num().Int64(); int64(int(n)) == n {
+			return reflect.ValueOf(int(n))
+		}
+	}
+	return reflect.ValueOf(r)
+}
+
+// ratScale returns the number of decimal places of r, or -1 if its decimal
+// expansion doesn't terminate.
+func ratScale(r *big.Rat) int {
+	d := new(big.Int).Set(r.Denom())
+	var twos, fives int
+	two, five, m := big.NewInt(2), big.NewInt(5), new(big.Int)
+	for d.Cmp(one) != 0 {
+		switch {
+		case m.Mod(d, two).Sign() == 0:
+			d.Quo(d, two)
+			twos++
+		case m.Mod(d, five).Sign() == 0:
+			d.Quo(d, five)
+			fives++
+		default:
+			return -1
+		}
+	}
+	if twos > fives {
+		return twos
+	}
+	return fives
+}
+
+var one = big.NewInt(1)
+
+// roundRat rounds r half up to scale decimal places.
+func roundRat(r *big.Rat, scale int) *big.Rat {
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	num := new(big.Int).Mul(r.Num(), pow)
+	q, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(r.Num().Sign())))
+	}
+	return new(big.Rat).SetFrac(q, pow)
+}
+
+// exactArith evaluates x op y exactly.
+func (s *state) exactArith(op string, x, y reflect.Value) reflect.Value {
+	a, okx := toRat(x)
+	b, oky := toRat(y)
+	if !okx || !oky {
+		// NaN and the infinities have no exact value.
+		return s.floatArith(op, toFloat(x), toFloat(y))
+	}
+	r := new(big.Rat)
+	switch op {
+	case "+":
+		r.Add(a, b)
+	case "-":
+		r.Sub(a, b)
+	case "*":
+		r.Mul(a, b)
+	case "/":
+		if b.Sign() == 0 {
+			s.errorf("division by zero")
+		}
+		r.Quo(a, b)
+		scale := minDivisionScale
+		for _, x := range []*big.Rat{a, b} {
+			if sx := ratScale(x); sx > scale {
+				scale = sx
+			}
+		}
+		if sr := ratScale(r); sr < 0 || sr > scale {
+			r = roundRat(r, scale)
+		}
+	case "%":
+		if b.Sign() == 0 {
+			s.errorf("division by zero")
+		}
+		// The remainder of the division truncated to an integer.
+		q := new(big.Rat).Quo(a, b)
+		t := new(big.Int).Quo(q.Num(), q.Denom())
+		r.Sub(a, new(big.Rat).Mul(b, new(big.Rat).SetInt(t)))
+	}
+	return ratValue(r)
+}
+
+// floatArith evaluates x op y with floats.
+func (s *state) floatArith(op string, a, b float64) reflect.Value {
+	switch op {
+	case "+":
+		return reflect.ValueOf(a + b)
+	case "-":
+		return reflect.ValueOf(a - b)
+	case "*":
+		return reflect.ValueOf(a * b)
+	}
+	if b == 0 {
+		s.errorf("division by zero")
+	}
+	if op == "/" {
+		return reflect.ValueOf(a / b)
+	}
+	return reflect.ValueOf(math.Mod(a, b))
+}
+
+// intArith evaluates x op y on integers, and reports whether the result is
+// an integer that fits an int.
+func (s *state) intArith(op string, a, b int64) (int, bool) {
+	var r int64
+	switch op {
+	case "+":
+		r = a + b
+		if (r > a) != (b > 0) {
+			return 0, false
+		}
+	case "-":
+		r = a - b
+		if (r < a) != (b > 0) {
+			return 0, false
+		}
+	case "*":
+		if a == 0 || b == 0 {
+			return 0, true
+		}
+		r = a * b
+		if r/b != a || a == -1 && b == math.MinInt64 || b == -1 && a == math.MinInt64 {
+			return 0, false
+		}
+	case "/", "%":
+		if b == 0 {
+			s.errorf("division by zero")
+		}
+		if a == math.MinInt64 && b == -1 {
+			return 0, false
+		}
+		if op == "%" {
+			r = a % b
+		} else if a%b != 0 {
+			return 0, false
+		} else {
+			r = a / b
+		}
+	}
+	if int64(int(r)) != r {
+		return 0, false
+	}
+	return int(r), true
+}
+
+// isInt64 reports whether the integer v fits an int64.
+func isInt64(v reflect.Value) bool {
+	k, _ := basicKind(v)
+	return k == intKind || k == uintKind && v.Uint() <= math.MaxInt64
+}
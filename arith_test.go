@@ -0,0 +1,99 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestArithmetic(t *testing.T) {
+	third := big.NewRat(1, 3)
+	data := map[string]interface{}{
+		"prices": []float64{0.1, 0.2, 19.99, 5.01},
+		"f":      0.1,
+		"f32":    float32(0.1),
+		"bi":     new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil),
+		"bf":     big.NewFloat(2.5),
+		"third":  third,
+		"half":   *big.NewRat(1, 2),
+		"inf":    math.Inf(1),
+		"max":    math.MaxInt64,
+		"sum": func(prices []float64) float64 {
+			var sum float64
+			for _, p := range prices {
+				sum += p
+			}
+			return sum
+		},
+		"double": func(n int) int { return 2 * n },
+	}
+	tests := []struct {
+		name   string
+		engine string
+		input  string
+		output string
+		err    string
+	}{
+		{"exact", "", "${(0.1 + 0.2)?c} ${(f + 0.2)?c} ${(1.1 * 3)?c} ${(0.3 - 0.1)?c} ${(f32 * 3)?c}", "0.3 0.3 3.3 0.2 0.3", ""},
+		{"total", "", "${(prices[0] + prices[1] + prices[2] + prices[3])?c} ${sum(prices)?c}", "25.3 25.299999999999997", ""},
+		{"compare", "", "<#if 0.1 + 0.2 == 0.3>eq</#if> <#if f == 0.1>eq</#if> <#if (third < 0.34)>lt</#if>", "eq eq lt", ""},
+		{"integers", "", "${7/2} ${(6/2)?c} ${-7 % 3} ${7.5 % 2} ${(2.0 * 3)?c}", "3.5 3 -1 1.5 6", ""},
+		{"division", "", "${(1/3)?c} ${(2/3)?c} ${(1/3*3)?c} ${(1.00000000000001/3)?c}", "0.333333333333 0.666666666667 0.999999999999 0.33333333333334", ""},
+		{"overflow", "", "${(max + 1)?c} ${(max * max)?c} ${double(max / max)}", "9223372036854775808 85070591730234615847396907784232501249 2", ""},
+		{"literal", "", "${123456789012345678901234567890?c} ${(123456789012345678901234567890 + 1)?c} ${1e-20?c}",
+			"123456789012345678901234567890 123456789012345678901234567891 0.00000000000000000001", ""},
+		{"big", "", "${(bi + 1)?c} ${bi} ${(bf * 2)?c} ${third} ${(third * 3)?c} ${half} ${(half + bi)?c} ${-bf}",
+			"1000000000000000000000000000001 1,000,000,000,000,000,000,000,000,000,000 5 0.333 1 0.5 1000000000000000000000000000000.5 -2.5", ""},
+		{"big arguments", "", "${double(bi / bi)} ${double(bf * 2)}", "2 10", ""},
+		{"big compare", "", "<#if bi == bi + 0>eq</#if> <#if (bf > 2)>gt</#if> <#if half != 0.5>ne</#if>", "eq gt ", ""},
+		{"infinity", "", "${(inf + 1)?c} ${(1 / inf)?c}", "INF 0", ""},
+		{"range", "", "<#list 1..(4/2) as i>${i}</#list> ${[1, 2, 3][4/2]}", "12 3", ""},
+		{"conservative", "conservative", "${(0.1 + 0.2)?c} ${7/2} ${(max + 1)?c} ${(f * 3)?c} ${(bi + 1)?c}",
+			"0.30000000000000004 3.5 9223372036854775808 0.30000000000000004 1000000000000000000000000000001", ""},
+		{"conservative literal", "conservative", "${123456789012345678901234567890}", "", "overflows int"},
+		{"setting", "", `<#setting arithmetic_engine="conservative">${(0.1 + 0.2)?c} <#setting arithmeticEngine="bigdecimal">${(0.1 + 0.2)?c}`,
+			"0.30000000000000004 0.3", ""},
+		{"division by zero", "", "${1.5 / 0}", "", "division by zero"},
+		{"remainder by zero", "", "${bi % 0}", "", "division by zero"},
+		{"unknown engine", "", `<#setting arithmetic_engine="fast">`, "", `unknown arithmetic engine "fast"`},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.engine != "" {
+			if err := tmpl.SetSetting("arithmetic_engine", test.engine); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"reflect"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+// A builtin evaluates a built-in, such as x?string or x?string("yes", "no").
+// It evaluates the target and the arguments itself, so that it can decide
+// how, and whether, to evaluate them.
+type builtin func(s *state, n *parse.BuiltinNode) reflect.Value
+
+// builtinTable maps the names of the built-ins to their implementation.
+// The files implementing the built-ins add them in their init function.
+var builtinTable = make(map[string]builtin)
+
+// addBuiltins adds the built-ins to builtinTable.
+func addBuiltins(m map[string]builtin) {
+	for name, b := range m {
+		if builtinTable[name] != nil {
+			panic("built-in ?" + name + " defined twice")
+		}
+		builtinTable[name] = b
+	}
+}
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"string":           builtinString,
+		"then":             builtinThen,
+		"switch":           builtinSwitch,
+		"is_string":        isBuiltin(typeString),
+		"is_number":        isBuiltin(typeNumber),
+		"is_boolean":       isBuiltin(typeBoolean),
+		"is_date_like":     isBuiltin(typeDate),
+		"is_sequence":      isBuiltin(typeSequence),
+		"is_collection":    isBuiltin(typeCollection),
+		"is_enumerable":    isBuiltin(typeSequence | typeCollection),
+		"is_hash":          isBuiltin(typeHash),
+		"is_hash_ex":       isBuiltin(typeHashEx),
+		"is_method":        isBuiltin(typeMethod),
+		"is_macro":         isBuiltin(typeMacro),
+		"is_markup_output": isBuiltin(typeMarkup),
+	})
+}
+
+// evalBuiltin evaluates the built-in n.
+func (s *state) evalBuiltin(n *parse.BuiltinNode) reflect.Value {
+	b := builtinTable[n.Name]
+	if b == nil {
+		s.at(n)
+		s.errorf("unknown built-in ?%s", n.Name)
+	}
+	return b(s, n)
+}
+
+// target evaluates the target of the built-in n, which must not be missing.
+func (s *state) target(n *parse.BuiltinNode) reflect.Value {
+	v, _ := indirect(s.evalDefined(n.Target))
+	s.at(n)
+	return v
+}
+
+// checkArgs checks that the built-in n has from min to max arguments.
+func (s *state) checkArgs(n *parse.BuiltinNode, min, max int) {
+	switch {
+	case len(n.Args) >= min && len(n.Args) <= max:
+		return
+	case min == max && min == 0:
+		s.errorf("?%s doesn't take arguments", n.Name)
+	case min == max:
+		s.errorf("?%s takes %d argument(s), but got %d", n.Name, min, len(n.Args))
+	}
+	s.errorf("?%s takes from %d to %d arguments, but got %d", n.Name, min, max, len(n.Args))
+}
+
+// stringArg evaluates the argument i of the built-in n, which must be a
+// string.
+func (s *state) stringArg(n *parse.BuiltinNode, i int) string {
+	str := s.evalString(n.Args[i])
+	s.at(n)
+	return str
+}
+
+// intArg evaluates the argument i of the built-in n, which must be an
+// integer.
+func (s *state) intArg(n *parse.BuiltinNode, i int) int {
+	v := s.evalInt(n.Args[i])
+	s.at(n)
+	return v
+}
+
+// builtinString evaluates ?string, which converts a value to a string: a
+// date with the format set for its type, or with the format given as
+// argument or member, as in ?string("yyyy-MM-dd") or ?string.short, and a
+// boolean with boolean_format, or as one of the two strings given, as in
+// ?string("yes", "no").
+func builtinString(s *state, n *parse.BuiltinNode) reflect.Value {
+	v := s.target(n)
+	if b, ok := s.asBool(v); ok && len(n.Args) > 0 {
+		s.checkArgs(n, 2, 2)
+		if b {
+			return reflect.ValueOf(s.stringArg(n, 0))
+		}
+		return reflect.ValueOf(s.stringArg(n, 1))
+	}
+	if t, typ, ok := s.asDate(v); ok {
+		s.checkArgs(n, 0, 1)
+		if len(n.Args) == 0 {
+			return reflect.ValueOf(dateFormatter{s, t, typ})
+		}
+		str, err := s.formatDate(t, typ, s.stringArg(n, 0))
+		if err != nil {
+			s.errorf("%w", err)
+		}
+		return reflect.ValueOf(str)
+	}
+	if num, _ := indirect(s.unwrap(v, floatKind)); num.IsValid() {
+		if k, _ := basicKind(num); isNumberKind(k) {
+			s.checkArgs(n, 0, 1)
+			if len(n.Args) == 0 {
+				return reflect.ValueOf(numberFormatter{s, num})
+			}
+			str, err := s.formatNumber(num, s.stringArg(n, 0))
+			if err != nil {
+				s.errorf("%w", err)
+			}
+			return reflect.ValueOf(str)
+		}
+	}
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(s.toString(n.Target, v))
+}
+
+// builtinThen evaluates ?then, as in flag?then(a, b), which is a if the
+// boolean flag is true, and b otherwise. Only the value chosen is evaluated.
+func builtinThen(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 2, 2)
+	v := s.target(n)
+	b, ok := s.asBool(v)
+	if !ok {
+		s.targetError(n, v, "a boolean")
+	}
+	if b {
+		return s.evalExpr(n.Args[0])
+	}
+	return s.evalExpr(n.Args[1])
+}
+
+// builtinSwitch evaluates ?switch, as in
+// status?switch("A", "Active", "I", "Inactive", "Unknown"): the result
+// following the first case equal to the value, as with ==, or the last
+// argument, the default, if there is an odd number of them. Cases are
+// evaluated until one matches, and only the result chosen is evaluated.
+func builtinSwitch(s *state, n *parse.BuiltinNode) reflect.Value {
+	if len(n.Args) < 2 {
+		s.errorf("?switch takes at least 2 arguments, but got %d", len(n.Args))
+	}
+	v := s.target(n)
+	for i := 0; i+1 < len(n.Args); i += 2 {
+		c := s.evalDefined(n.Args[i])
+		s.at(n.Args[i])
+		if s.compare(n.Args[i], "==", v, c) {
+			return s.evalExpr(n.Args[i+1])
+		}
+	}
+	if len(n.Args)%2 == 0 {
+		s.at(n)
+		s.errorf("none of the cases of ?switch matches %s, and there is no default", n.Target)
+	}
+	return s.evalExpr(n.Args[len(n.Args)-1])
+}
+
+// asBool returns v as a bool, if it is a boolean.
+func (s *state) asBool(v reflect.Value) (b, ok bool) {
+	v, _ = indirect(s.unwrap(v, boolKind))
+	if v.Kind() != reflect.Bool {
+		return false, false
+	}
+	return v.Bool(), true
+}
+
+// isBuiltin returns the built-in testing whether a value is of one of the
+// types, such as ?is_string.
+func isBuiltin(types valueType) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 0, 0)
+		return reflect.ValueOf(s.typeOf(s.target(n))&types != 0)
+	}
+}
+
+// targetError reports that the built-in n can't be applied to v, the value
+// of its target.
+func (s *state) targetError(n *parse.BuiltinNode, v reflect.Value, expected string) {
+	s.errorf("?%s expects %s, but %s has evaluated to %s", n.Name, expected, n.Target, s.describe(v))
+}
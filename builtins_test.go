@@ -0,0 +1,186 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+type label struct{ Text string }
+
+func (l label) String() string { return l.Text }
+
+func TestTypeBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"str":    "s",
+		"num":    1.5,
+		"big":    big.NewInt(5),
+		"flag":   true,
+		"now":    time.Now(),
+		"day":    day("2020-01-01"),
+		"seq":    []int{1},
+		"pages":  &pages{total: 1, size: 1},
+		"m":      map[string]int{},
+		"props":  props{},
+		"broken": broken{},
+		"fn":     func() int { return 1 },
+		"join":   joiner("-"),
+		"price":  money{100},
+		"label":  label{"l"},
+	}
+	// The macro k prints 1 or 0 for each of the ?is_* built-ins.
+	const k = `<#macro k v><#list [v?is_string, v?is_number, v?is_boolean, v?is_date_like, v?is_sequence, v?is_collection, ` +
+		`v?is_enumerable, v?is_hash, v?is_hash_ex, v?is_method, v?is_macro, v?is_markup_output] as b><#if b>1<#else>0</#if></#list></#macro>`
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"string", "<@k v=str/>", "100000000000", ""},
+		{"number", "<@k v=num/><@k v=big/><@k v=1/>", "010000000000010000000000010000000000", ""},
+		{"boolean", "<@k v=flag/><@k v=false/>", "001000000000001000000000", ""},
+		{"date", "<@k v=now/><@k v=day/>", "000100000000000100000000", ""},
+		{"sequence", "<@k v=seq/><@k v=[1, 2]/>", "000010100000000010100000", ""},
+		{"collection", "<@k v=pages/>", "000001100000", ""},
+		{"lazy sequence", "<@k v=seq?filter(x -> true)/>", "000011100000", ""},
+		{"hash", "<@k v=m/><@k v=props/><@k v={'a': 1}/>", "000000011000000000011000000000011000", ""},
+		{"hash without keys", "<@k v=broken/>", "000000010000", ""},
+		{"method", "<@k v=fn/><@k v=join/>", "000000000100000000000100", ""},
+		{"macro", "<@k v=k/>", "000000000010", ""},
+		{"several types", "<@k v=price/><@k v=label/>", "110000000000100000011000", ""},
+		{"missing", "${nothing?is_string}", "", "nothing has evaluated to null or missing"},
+		{"expected a string", "${seq?upper_case}", "", "expected a string, but seq has evaluated to a sequence"},
+		{"expected a boolean", "<#if str></#if>", "", "condition must be a boolean, but str has evaluated to a string"},
+		{"expected a hash", "${price?keys}", "", "?keys expects a hash, but price has evaluated to a string+number"},
+		{"expected a listable", "<#list num as x></#list>", "", "expected a sequence or a hash, but num has evaluated to a number"},
+		{"expected numbers", "${m + 1}", "", "operator + needs numbers, but got an extended hash and a number"},
+		{"incomparable", "<#if str == seq></#if>", "", "can't compare a string with a sequence"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(k + test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestBooleanBuiltins(t *testing.T) {
+	yes := true
+	data := map[string]interface{}{
+		"t":   true,
+		"f":   false,
+		"ptr": &yes,
+		"n":   3,
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"c", "${t?c} ${f?c} ${ptr?c} ${(n > 2)?c}", "true false true true", ""},
+		{"string", `${t?string("yes", "no")} ${f?string("yes", "no")}`, "yes no", ""},
+		{"then", `${t?then("on", "off")} ${f?then("on", "off")} ${f?then(n, n + 1)}`, "on off 4", ""},
+		{"then is lazy", `${t?then("ok", missing)} ${f?then(missing.x, "ok")}`, "ok ok", ""},
+		{"then missing", `${f?then("on", missing)!"none"}`, "none", ""},
+		{"format", `<#setting boolean_format="yes,no">${t} ${f} ${t?string} ${"is " + f}`, "yes no yes is no", ""},
+		{"format c", `<#setting booleanFormat="c">${t} ${f}`, "true false", ""},
+		{"format c ignored", `<#setting boolean_format="Y,N">${t?c}`, "true", ""},
+		{"format empty string", `<#setting boolean_format=",off">[${t}] [${f}]`, "[] [off]", ""},
+		{"print", "${t}", "", `can't convert the boolean t to string automatically; use ?c or ?string("yes", "no"), or set boolean_format`},
+		{"concatenation", `${"x" + f}`, "", `can't convert the boolean "x"+f to string automatically`},
+		{"bad format", `<#setting boolean_format="yes">`, "", `boolean_format must be "c" or two strings separated by a comma, such as "yes,no", but got "yes"`},
+		{"string one argument", `${t?string("yes")}`, "", "?string takes 2 argument(s), but got 1"},
+		{"then not a boolean", `${n?then(1, 2)}`, "", "?then expects a boolean, but n has evaluated to a number"},
+		{"c not a boolean", `${"x"?c}`, "", "?c expects a number or a boolean, but \"x\" has evaluated to a string"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	data := map[string]interface{}{
+		"status": "I",
+		"n":      2,
+		"when":   time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"match", `${status?switch("A", "Active", "I", "Inactive", "Unknown")}`, "Inactive", ""},
+		{"default", `${"X"?switch("A", "Active", "I", "Inactive", "Unknown")}`, "Unknown", ""},
+		{"numbers", `${n?switch(1, "one", 2.0, "two")} ${(n * 1.5)?switch(3, "three")}`, "two three", ""},
+		{"booleans", `${(n > 1)?switch(true, "big", false, "small")}`, "big", ""},
+		{"dates", `${when?switch(when, "same")}`, "same", ""},
+		{"expressions", `${n?switch(n - 1, "a", n, "b")}`, "b", ""},
+		{"lazy results", `${status?switch("A", missing, "I", "ok", missing.x)}`, "ok", ""},
+		{"lazy cases", `${status?switch("I", "ok", missing, "no")}`, "ok", ""},
+		{"missing result", `${status?switch("I", missing)!"none"}`, "none", ""},
+		{"no match", `${status?switch("A", "Active")}`, "", "none of the cases of ?switch matches status, and there is no default"},
+		{"too few", `${status?switch("A")}`, "", "?switch takes at least 2 arguments, but got 1"},
+		{"mixed types", `${status?switch(1, "one")}`, "", "can't compare a string with a number"},
+		{"missing case", `${status?switch(missing, "x")}`, "", "missing has evaluated to null or missing"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
@@ -0,0 +1,620 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+// Dates are time.Time values and the values implementing DateModel. A
+// time.Time is a datetime, unless made a date or a time with ?date or
+// ?time.
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// dateValue is a date whose type is known, as made by ?date, ?time and
+// ?datetime.
+type dateValue struct {
+	t   time.Time
+	typ DateType
+}
+
+func (d dateValue) AsDate() (time.Time, error) { return d.t, nil }
+func (d dateValue) DateType() DateType         { return d.typ }
+
+// asDate returns the time and the type of the date v, and whether v is a
+// date.
+func (s *state) asDate(v reflect.Value) (time.Time, DateType, bool) {
+	v, isNil := indirect(v)
+	if !v.IsValid() || isNil {
+		return time.Time{}, UnknownDateType, false
+	}
+	if v.Type() == timeType {
+		return v.Interface().(time.Time), UnknownDateType, true
+	}
+	if m, ok := modelOf(v).(DateModel); ok {
+		t, err := m.AsDate()
+		if err != nil {
+			s.errorf("%w", err)
+		}
+		return t, m.DateType(), true
+	}
+	return time.Time{}, UnknownDateType, false
+}
+
+// formatDate formats the date t of type typ with the format, or the format
+// set for the type if format is "".
+func (s *state) formatDate(t time.Time, typ DateType, format string) (string, error) {
+	if format == "" {
+		format = s.settings.dateFormatFor(typ)
+	}
+	layout, err := dateLayoutFor(format, typ, s.settings.localeData())
+	if err != nil {
+		return "", err
+	}
+	return layout.format(t.In(s.settings.location()), typ), nil
+}
+
+// parseDate parses the date str of type typ with the format, or the format
+// set for the type if format is "".
+func (s *state) parseDate(str string, typ DateType, format string) (time.Time, error) {
+	if format == "" {
+		format = s.settings.dateFormatFor(typ)
+	}
+	layout, err := dateLayoutFor(format, typ, s.settings.localeData())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return layout.parse(str, s.settings.location())
+}
+
+// dateFormatFor returns the format set for dates of type typ.
+func (c *settings) dateFormatFor(typ DateType) string {
+	switch typ {
+	case DateOnly:
+		return c.dateFormat
+	case TimeOnly:
+		return c.timeFormat
+	}
+	return c.datetimeFormat
+}
+
+// stylePattern returns the pattern of the date style for dates of type typ
+// in the locale. A style is "short", "medium", "long" or "full"; for a
+// datetime, it can also be the style of the date and the style of the
+// time, such as "short_medium".
+func stylePattern(style string, typ DateType, loc *localeData) (string, bool) {
+	if style == "" {
+		style = "medium"
+	}
+	switch typ {
+	case DateOnly:
+		pattern, ok := loc.dateStyles[style]
+		return pattern, ok
+	case TimeOnly:
+		pattern, ok := loc.timeStyles[style]
+		return pattern, ok
+	}
+	dateStyle, timeStyle := style, style
+	if i := strings.IndexByte(style, '_'); i >= 0 {
+		dateStyle, timeStyle = style[:i], style[i+1:]
+	}
+	datePattern, ok1 := loc.dateStyles[dateStyle]
+	timePattern, ok2 := loc.timeStyles[timeStyle]
+	return datePattern + " " + timePattern, ok1 && ok2
+}
+
+// ISO 8601 accuracies.
+const (
+	isoHours = iota
+	isoMinutes
+	isoSeconds
+	isoMillis
+)
+
+// isoOptions tell how to format a date in ISO 8601.
+type isoOptions struct {
+	accuracy int
+	noZone   bool
+	utc      bool
+}
+
+// parseISOOptions parses the options of the "iso" format, such as the m and
+// nz of "iso m nz", or of the ?iso built-ins, such as ?iso_utc_m_nz.
+func parseISOOptions(options []string) (isoOptions, error) {
+	o := isoOptions{accuracy: isoSeconds}
+	for _, opt := range options {
+		switch opt {
+		case "h":
+			o.accuracy = isoHours
+		case "m":
+			o.accuracy = isoMinutes
+		case "s":
+			o.accuracy = isoSeconds
+		case "ms":
+			o.accuracy = isoMillis
+		case "nz":
+			o.noZone = true
+		case "u":
+			o.utc = true
+		default:
+			return o, fmt.Errorf("unknown ISO 8601 option %q", opt)
+		}
+	}
+	return o, nil
+}
+
+// layout returns the Go layout of the ISO 8601 format of dates of type
+// typ.
+func (o isoOptions) layout(typ DateType) string {
+	if typ == DateOnly {
+		return "2006-01-02"
+	}
+	layout := [...]string{"15", "15:04", "15:04:05", "15:04:05.000"}[o.accuracy]
+	if !o.noZone {
+		layout += "Z07:00"
+	}
+	if typ == TimeOnly {
+		return layout
+	}
+	return "2006-01-02T" + layout
+}
+
+// isoParseLayouts are the Go layouts of the ISO 8601 dates that can be
+// parsed, most precise first.
+var isoParseLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02T15Z07:00",
+	"2006-01-02T15",
+	"2006-01-02",
+	"15:04:05.999999999Z07:00",
+	"15:04:05.999999999",
+	"15:04Z07:00",
+	"15:04",
+}
+
+// layoutPart is a part of a compiled date pattern.
+type layoutPart struct {
+	text     string // a literal, or a Go layout
+	layout   bool   // whether text is a Go layout
+	fraction bool   // whether text is the Go layout of a fraction of seconds
+}
+
+// dateLayout is a compiled date format.
+type dateLayout struct {
+	parts []layoutPart
+	iso   *isoOptions // not nil for an ISO 8601 format
+	loc   *localeData
+}
+
+type dateLayoutKey struct {
+	format string
+	typ    DateType
+	locale string
+}
+
+// maxCachedDateLayouts bounds dateLayouts; when it is full, it is emptied.
+const maxCachedDateLayouts = 1000
+
+// dateLayouts caches the compiled date formats across executions.
+var dateLayouts = struct {
+	sync.Mutex
+	m map[dateLayoutKey]*dateLayout
+}{m: make(map[dateLayoutKey]*dateLayout)}
+
+// dateLayoutFor returns the compiled date format for dates of type typ in
+// the locale.
+func dateLayoutFor(format string, typ DateType, loc *localeData) (*dateLayout, error) {
+	if typ == UnknownDateType {
+		typ = DateTime
+	}
+	key := dateLayoutKey{format, typ, loc.tag}
+	dateLayouts.Lock()
+	l := dateLayouts.m[key]
+	dateLayouts.Unlock()
+	if l != nil {
+		return l, nil
+	}
+	l, err := compileDateLayout(format, typ, loc)
+	if err != nil {
+		return nil, err
+	}
+	l.loc = loc
+	dateLayouts.Lock()
+	if len(dateLayouts.m) >= maxCachedDateLayouts {
+		dateLayouts.m = make(map[dateLayoutKey]*dateLayout)
+	}
+	dateLayouts.m[key] = l
+	dateLayouts.Unlock()
+	return l, nil
+}
+
+// compileDateFormat checks that the format is valid for all types of dates.
+func compileDateFormat(format string, loc *localeData) (*dateLayout, error) {
+	return dateLayoutFor(format, DateTime, loc)
+}
+
+func compileDateLayout(format string, typ DateType, loc *localeData) (*dateLayout, error) {
+	if fields := strings.Fields(format); len(fields) > 0 && (fields[0] == "iso" || fields[0] == "xs") {
+		o, err := parseISOOptions(fields[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &dateLayout{iso: &o}, nil
+	}
+	pattern, ok := stylePattern(format, typ, loc)
+	if !ok {
+		pattern = format
+	}
+	return compileDatePattern(pattern)
+}
+
+// compileDatePattern compiles a pattern in the syntax of Java's
+// SimpleDateFormat, such as "yyyy-MM-dd HH:mm", into Go layouts.
+func compileDatePattern(pattern string) (*dateLayout, error) {
+	l := new(dateLayout)
+	literal := func(text string) {
+		if n := len(l.parts); n > 0 && !l.parts[n-1].layout {
+			l.parts[n-1].text += text
+			return
+		}
+		l.parts = append(l.parts, layoutPart{text: text})
+	}
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case c == '\'':
+			if i+1 < len(runes) && runes[i+1] == '\'' {
+				literal("'")
+				i += 2
+				continue
+			}
+			var text []rune
+			for i++; ; i++ {
+				if i == len(runes) {
+					return nil, fmt.Errorf("unterminated quoted text in the date pattern %q", pattern)
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						text = append(text, '\'')
+						i++
+						continue
+					}
+					break
+				}
+				text = append(text, runes[i])
+			}
+			literal(string(text))
+			i++
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+			n := 1
+			for i+n < len(runes) && runes[i+n] == c {
+				n++
+			}
+			part, err := patternLetter(c, n)
+			if err != nil {
+				return nil, fmt.Errorf("%v in the date pattern %q", err, pattern)
+			}
+			l.parts = append(l.parts, part)
+			i += n
+		default:
+			literal(string(c))
+			i++
+		}
+	}
+	return l, nil
+}
+
+// patternLetter returns the Go layout of n repetitions of the pattern
+// letter c.
+func patternLetter(c rune, n int) (layoutPart, error) {
+	pick := func(layouts ...string) layoutPart {
+		return layoutPart{text: layouts[min(n, len(layouts))-1], layout: true}
+	}
+	switch c {
+	case 'y':
+		if n == 2 {
+			return pick("06", "06"), nil
+		}
+		return pick("2006"), nil
+	case 'M', 'L':
+		return pick("1", "01", "Jan", "January"), nil
+	case 'd':
+		return pick("2", "02"), nil
+	case 'E':
+		return pick("Mon", "Mon", "Mon", "Monday"), nil
+	case 'H':
+		return pick("15"), nil
+	case 'h':
+		return pick("3", "03"), nil
+	case 'm':
+		return pick("4", "04"), nil
+	case 's':
+		return pick("5", "05"), nil
+	case 'S':
+		return layoutPart{text: "." + strings.Repeat("0", n), layout: true, fraction: true}, nil
+	case 'a':
+		return pick("PM"), nil
+	case 'z':
+		return pick("MST"), nil
+	case 'Z':
+		return pick("-0700"), nil
+	case 'X':
+		return pick("Z07", "Z0700", "Z07:00"), nil
+	}
+	return layoutPart{}, fmt.Errorf("unsupported letter %q", c)
+}
+
+// format formats the date t of type typ.
+func (l *dateLayout) format(t time.Time, typ DateType) string {
+	if l.iso != nil {
+		if l.iso.utc {
+			t = t.UTC()
+		}
+		return t.Format(l.iso.layout(typ))
+	}
+	var b strings.Builder
+	for _, part := range l.parts {
+		switch {
+		case part.fraction:
+			b.WriteString(t.Format(part.text)[1:])
+		case part.layout:
+			if name, ok := l.loc.name(part.text, t); ok {
+				b.WriteString(name)
+				continue
+			}
+			b.WriteString(t.Format(part.text))
+		default:
+			b.WriteString(part.text)
+		}
+	}
+	return b.String()
+}
+
+// parse parses the date str, in the time zone loc unless it has one.
+func (l *dateLayout) parse(str string, loc *time.Location) (time.Time, error) {
+	if l.iso != nil {
+		for _, layout := range isoParseLayouts {
+			if t, err := time.ParseInLocation(layout, str, loc); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("can't parse %q as an ISO 8601 date", str)
+	}
+	// Go would take literal text such as "Mon" or "15" for fields, so the
+	// literals are matched apart. Each run of fields between them ends at
+	// the first place where it parses and the next literal follows, and the
+	// runs are then parsed together.
+	value := l.loc.englishNames(str)
+	segments := l.parseSegments()
+	var layouts, fields []string
+	for i, seg := range segments {
+		if !seg.layout {
+			lit := l.loc.englishNames(seg.text)
+			if !strings.HasPrefix(value, lit) {
+				return time.Time{}, fmt.Errorf("can't parse %q as a date: expected %q", str, seg.text)
+			}
+			value = value[len(lit):]
+			continue
+		}
+		end := len(value)
+		if i+1 < len(segments) {
+			lit := l.loc.englishNames(segments[i+1].text)
+			for end = 0; end <= len(value); end++ {
+				if strings.HasPrefix(value[end:], lit) {
+					if _, err := time.Parse(seg.text, value[:end]); err == nil {
+						break
+					}
+				}
+			}
+			if end > len(value) {
+				_, err := time.Parse(seg.text, value)
+				return time.Time{}, fmt.Errorf("can't parse %q as a date: %v", str, err)
+			}
+		}
+		layouts = append(layouts, seg.text)
+		fields = append(fields, value[:end])
+		value = value[end:]
+	}
+	if value != "" {
+		return time.Time{}, fmt.Errorf("can't parse %q as a date: extra text %q", str, value)
+	}
+	t, err := time.ParseInLocation(strings.Join(layouts, " "), strings.Join(fields, " "), loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't parse %q as a date: %v", str, err)
+	}
+	return t, nil
+}
+
+// parseSegments returns the parts of l merged for parsing: the literals, and
+// the Go layouts of the runs of fields between them. A fraction of seconds
+// takes the point before it, which Go parses with it.
+func (l *dateLayout) parseSegments() []layoutPart {
+	var segments []layoutPart
+	for _, part := range l.parts {
+		text := part.text
+		n := len(segments)
+		if part.fraction {
+			if n > 0 && !segments[n-1].layout && strings.HasSuffix(segments[n-1].text, ".") {
+				if segments[n-1].text = strings.TrimSuffix(segments[n-1].text, "."); segments[n-1].text == "" {
+					segments = segments[:n-1]
+					n--
+				}
+			} else {
+				text = text[1:]
+			}
+		}
+		if n > 0 && segments[n-1].layout == part.layout {
+			segments[n-1].text += text
+			continue
+		}
+		segments = append(segments, layoutPart{text: text, layout: part.layout})
+	}
+	return segments
+}
+
+// dateFormatter is the value of ?string applied to a date. It is the date
+// formatted with the format set for its type, and its members are the date
+// formatted with other formats, as in ?string.short.
+type dateFormatter struct {
+	s   *state
+	t   time.Time
+	typ DateType
+}
+
+func (f dateFormatter) AsString() (string, error) {
+	return f.s.formatDate(f.t, f.typ, "")
+}
+
+func (f dateFormatter) Get(format string) (interface{}, error) {
+	return f.s.formatDate(f.t, f.typ, format)
+}
+
+// compareTime returns -1, 0 or +1 as x is before, at or after y.
+func compareTime(x, y time.Time) int {
+	switch {
+	case x.Before(y):
+		return -1
+	case x.After(y):
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"date":               dateBuiltin(DateOnly),
+		"time":               dateBuiltin(TimeOnly),
+		"datetime":           dateBuiltin(DateTime),
+		"long":               builtinLong,
+		"number_to_date":     numberToDate(DateOnly),
+		"number_to_time":     numberToDate(TimeOnly),
+		"number_to_datetime": numberToDate(DateTime),
+	})
+	// The ?iso built-ins, such as ?iso_utc_ms_nz.
+	for _, prefix := range []string{"iso", "iso_utc", "iso_local"} {
+		for _, accuracy := range []string{"", "_h", "_m", "_ms"} {
+			for _, zone := range []string{"", "_nz"} {
+				addBuiltins(map[string]builtin{prefix + accuracy + zone: builtinISO})
+			}
+		}
+	}
+}
+
+// dateBuiltin returns the built-in making a date of type typ out of a date
+// or a string, as ?date or ?date("yyyy-MM-dd").
+func dateBuiltin(typ DateType) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		v := s.target(n)
+		if t, _, ok := s.asDate(v); ok {
+			s.checkArgs(n, 0, 0)
+			return reflect.ValueOf(dateValue{t, typ})
+		}
+		if v = s.unwrap(v, stringKind); v.Kind() != reflect.String {
+			s.targetError(n, v, "a date or a string")
+		}
+		s.checkArgs(n, 0, 1)
+		format := ""
+		if len(n.Args) == 1 {
+			format = s.stringArg(n, 0)
+		}
+		t, err := s.parseDate(v.String(), typ, format)
+		if err != nil {
+			s.errorf("%w", err)
+		}
+		return reflect.ValueOf(dateValue{t, typ})
+	}
+}
+
+// builtinLong evaluates ?long: the number of milliseconds since the Unix
+// epoch of a date, or the integer part of a number.
+func builtinLong(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	v := s.target(n)
+	if t, _, ok := s.asDate(v); ok {
+		return reflect.ValueOf(t.UnixNano() / int64(time.Millisecond))
+	}
+	v, _ = indirect(s.unwrap(v, intKind))
+	switch k, _ := basicKind(v); k {
+	case intKind, uintKind:
+		return reflect.ValueOf(toInt64(v))
+	case floatKind, bigKind:
+		return reflect.ValueOf(int64(toFloat(v)))
+	}
+	s.targetError(n, v, "a date or a number")
+	panic("not reached")
+}
+
+// numberToDate returns the built-in making a date of type typ out of a
+// number of milliseconds since the Unix epoch.
+func numberToDate(typ DateType) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 0, 0)
+		v, _ := indirect(s.unwrap(s.target(n), intKind))
+		if k, _ := basicKind(v); !isNumberKind(k) {
+			s.targetError(n, v, "a number")
+		}
+		ms := int64(toFloat(v))
+		return reflect.ValueOf(dateValue{time.Unix(ms/1000, ms%1000*int64(time.Millisecond)), typ})
+	}
+}
+
+// builtinISO evaluates the ?iso built-ins: ?iso_utc and ?iso_local format
+// a date in ISO 8601 in UTC and in the time zone setting, ?iso(zone) in the
+// given time zone. The suffixes _h, _m and _ms set the accuracy, and _nz
+// leaves the time zone out.
+func builtinISO(s *state, n *parse.BuiltinNode) reflect.Value {
+	v := s.target(n)
+	t, typ, ok := s.asDate(v)
+	if !ok {
+		s.targetError(n, v, "a date")
+	}
+	options := strings.Split(n.Name, "_")[1:]
+	loc := s.settings.location()
+	switch {
+	case strings.HasPrefix(n.Name, "iso_utc"):
+		s.checkArgs(n, 0, 0)
+		loc, options = time.UTC, options[1:]
+	case strings.HasPrefix(n.Name, "iso_local"):
+		s.checkArgs(n, 0, 0)
+		options = options[1:]
+	default:
+		s.checkArgs(n, 1, 1)
+		var err error
+		if loc, err = parseTimeZone(s.stringArg(n, 0)); err != nil {
+			s.errorf("%w", err)
+		}
+	}
+	o, err := parseISOOptions(options)
+	if err != nil {
+		s.errorf("%w", err)
+	}
+	if typ == UnknownDateType {
+		typ = DateTime
+	}
+	return reflect.ValueOf(t.In(loc).Format(o.layout(typ)))
+}
@@ -0,0 +1,124 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDates(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	data := map[string]interface{}{
+		"t":   time.Date(2017, 3, 4, 15, 4, 5, 678000000, time.UTC),
+		"bt":  time.Date(2017, 3, 4, 15, 4, 5, 0, berlin),
+		"ptr": &time.Time{},
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"default", "${t}", "Mar 4, 2017 3:04:05 PM", ""},
+		{"types", "${t?date} | ${t?time} | ${t?datetime}", "Mar 4, 2017 | 3:04:05 PM | Mar 4, 2017 3:04:05 PM", ""},
+		{"styles", "${t?date?string.short} | ${t?date?string.long} | ${t?date?string.full} | ${t?time?string.short}",
+			"3/4/17 | March 4, 2017 | Saturday, March 4, 2017 | 3:04 PM", ""},
+		{"datetime styles", "${t?string.short_long} | ${t?string('medium_short')}", "3/4/17 3:04:05 PM UTC | Mar 4, 2017 3:04 PM", ""},
+		{"pattern", `${t?string("yyyy-MM-dd HH:mm:ss.SSS")}`, "2017-03-04 15:04:05.678", ""},
+		{"pattern letters", `${t?string("EEE, d MMM yy hh:mm a Z")}`, "Sat, 4 Mar 17 03:04 PM +0000", ""},
+		{"quoted", `${t?string("'at' h 'o''clock'''")}`, "at 3 o'clock'", ""},
+		{"iso", "${t?iso_utc} | ${t?date?iso_utc} | ${t?time?iso_utc}", "2017-03-04T15:04:05Z | 2017-03-04 | 15:04:05Z", ""},
+		{"iso accuracy", "${t?iso_utc_ms} | ${t?iso_utc_m} | ${t?iso_utc_h_nz}", "2017-03-04T15:04:05.678Z | 2017-03-04T15:04Z | 2017-03-04T15", ""},
+		{"iso zone", "${t?iso('Europe/Berlin')} | ${t?iso('GMT-02:30')}", "2017-03-04T16:04:05+01:00 | 2017-03-04T12:34:05-02:30", ""},
+		{"iso local", "<#setting time_zone='Europe/Berlin'>${t?iso_local} ${bt?iso_utc}", "2017-03-04T16:04:05+01:00 2017-03-04T14:04:05Z", ""},
+		{"settings", `<#setting date_format="dd.MM.yyyy"><#setting timeFormat="HH:mm"><#setting datetime_format="iso">${t?date} ${t?time} ${t}`,
+			"04.03.2017 15:04 2017-03-04T15:04:05Z", ""},
+		{"time zone", `<#setting time_zone="Europe/Berlin">${t?string("HH:mm z")}`, "16:04 CET", ""},
+		{"parse", `${"2017-03-04"?date("yyyy-MM-dd")?string.long} ${"21:30"?time("HH:mm")?string.short}`, "March 4, 2017 9:30 PM", ""},
+		{"parse setting", `<#setting date_format="dd.MM.yyyy">${"04.03.2017"?date?string("yyyy/MM/dd")}`, "2017/03/04", ""},
+		{"parse iso", `<#setting datetime_format="iso">${"2017-03-04T15:04:05+01:00"?datetime?iso_utc}`, "2017-03-04T14:04:05Z", ""},
+		{"parse literals", `${"Jan 2, 15 PM: 04.03.2017 10:30:05.120"?datetime("'Jan 2, 15 PM': dd.MM.yyyy HH:mm:ss.SSS")?iso_utc_ms}`,
+			"2017-03-04T10:30:05.120Z", ""},
+		{"parse literal mismatch", `${"at 2017"?date("'on' yyyy")}`, "", `can't parse "at 2017" as a date: expected "on "`},
+		{"long", "${t?long?c} ${1488639845678?number_to_datetime?iso_utc_ms}", "1488639845678 2017-03-04T15:04:05.678Z", ""},
+		{"compare", "<#if t?date == t>eq</#if><#if t < .now>past</#if>", "eqpast", ""},
+		{"pointer", "${ptr?iso_utc}", "0001-01-01T00:00:00Z", ""},
+		{"bad parse", `${"x"?date("yyyy")}`, "", `can't parse "x" as a date`},
+		{"bad pattern", `${t?string("yyyy-QQ")}`, "", `unsupported letter 'Q' in the date pattern "yyyy-QQ"`},
+		{"bad setting", `<#setting date_format="'">`, "", "unterminated quoted text"},
+		{"bad zone", `<#setting time_zone="Nowhere/Land">`, "", `unknown time zone "Nowhere/Land"`},
+		{"unknown setting", `<#setting nonsense="x">`, "", `unknown setting "nonsense"`},
+		{"not a date", `${1?iso_utc}`, "", "?iso_utc expects a date"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmpl.SetSetting("time_zone", "UTC"); err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestSetSetting(t *testing.T) {
+	tmpl := New("t")
+	if err := tmpl.SetSetting("dateFormat", "short"); err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.settings.dateFormat != "short" {
+		t.Errorf("date_format not set")
+	}
+	if err := tmpl.SetSetting("date_format", "yyyy-QQ"); err == nil {
+		t.Errorf("expected an error for a bad date format")
+	}
+}
+
+func TestDateLayoutCacheIsBounded(t *testing.T) {
+	loc, err := localeFor("en_US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxCachedDateLayouts+10; i++ {
+		if _, err := dateLayoutFor(fmt.Sprintf("yyyy '%d'", i), DateOnly, loc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dateLayouts.Lock()
+	n := len(dateLayouts.m)
+	dateLayouts.Unlock()
+	if n > maxCachedDateLayouts {
+		t.Errorf("%d date formats are cached, more than %d", n, maxCachedDateLayouts)
+	}
+}
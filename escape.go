@@ -0,0 +1,242 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"html":          markupBuiltin("HTML"),
+		"xhtml":         markupBuiltin("XHTML"),
+		"xml":           markupBuiltin("XML"),
+		"js_string":     escapeBuiltin(JSEscapeString),
+		"json_string":   escapeBuiltin(jsonEscapeString),
+		"rtf":           markupBuiltin("RTF"),
+		"url":           urlBuiltin(false),
+		"url_path":      urlBuiltin(true),
+		"no_esc":        builtinNoEsc,
+		"markup_string": builtinMarkupString,
+	})
+}
+
+// outputFormats are the escapings of the markup output formats of the
+// output_format setting, by name. The other output formats are
+// "undefined", the default, and "plainText", which escape nothing.
+var outputFormats = map[string]func(string) string{
+	"HTML":  HTMLEscapeString,
+	"XHTML": xhtmlEscaper.Replace,
+	"XML":   xmlEscaper.Replace,
+	"RTF":   rtfEscaper.Replace,
+}
+
+// checkOutputFormat checks that the output format is known.
+func checkOutputFormat(format string) error {
+	if _, ok := outputFormats[format]; !ok && format != "undefined" && format != "plainText" {
+		return fmt.Errorf("unknown output format %q; use HTML, XHTML, XML, RTF, plainText or undefined", format)
+	}
+	return nil
+}
+
+// markupOutput is a text in a markup output format, such as the value of
+// ?html when the output format is HTML. It is printed as it is, rather than
+// escaped again, and strings added to it are escaped.
+type markupOutput struct {
+	format string // a key of outputFormats
+	text   string
+}
+
+var markupType = reflect.TypeOf(markupOutput{})
+
+// asMarkup returns v as a markup output, and whether it is one.
+func asMarkup(v reflect.Value) (markupOutput, bool) {
+	if v = indirectInterface(v); v.IsValid() && v.Type() == markupType {
+		return v.Interface().(markupOutput), true
+	}
+	return markupOutput{}, false
+}
+
+// markupText returns the text of the markup output m, which the expression
+// n has evaluated to, for the output format.
+func (s *state) markupText(n parse.Node, m markupOutput) string {
+	if m.format != s.settings.outputFormat {
+		s.errorf("%s has evaluated to %s markup, which can't be printed with the output format %s", n, m.format, s.settings.outputFormatName())
+	}
+	return m.text
+}
+
+// escapeBuiltin returns the built-in escaping a string with escape.
+func escapeBuiltin(escape func(string) string) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 0, 0)
+		return reflect.ValueOf(escape(s.stringTarget(n)))
+	}
+}
+
+// markupBuiltin returns the built-in escaping a string for the markup
+// output format. If it is the output format, the result is a markup output,
+// so that it is not escaped again when printed.
+func markupBuiltin(format string) builtin {
+	escape := escapeBuiltin(outputFormats[format])
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		v := escape(s, n)
+		if format == s.settings.outputFormat {
+			return reflect.ValueOf(markupOutput{format, v.String()})
+		}
+		return v
+	}
+}
+
+// builtinNoEsc evaluates ?no_esc, which makes a string a markup output of
+// the output format, so that it is printed without escaping.
+func builtinNoEsc(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	v := s.target(n)
+	if m, ok := asMarkup(v); ok {
+		return reflect.ValueOf(m)
+	}
+	format := s.settings.outputFormat
+	if outputFormats[format] == nil {
+		s.errorf("?no_esc can only be used with a markup output format, but the output format is %s", s.settings.outputFormatName())
+	}
+	return reflect.ValueOf(markupOutput{format, s.toString(n.Target, v)})
+}
+
+// builtinMarkupString evaluates ?markup_string, the text of a markup
+// output.
+func builtinMarkupString(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	v := s.target(n)
+	m, ok := asMarkup(v)
+	if !ok {
+		s.targetError(n, v, "a markup output")
+	}
+	return reflect.ValueOf(m.text)
+}
+
+var (
+	xhtmlEscaper = strings.NewReplacer("<", "&lt;", ">", "&gt;", "&", "&amp;", `"`, "&quot;", "'", "&#39;")
+	xmlEscaper   = strings.NewReplacer("<", "&lt;", ">", "&gt;", "&", "&amp;", `"`, "&quot;", "'", "&apos;")
+	rtfEscaper   = strings.NewReplacer(`\`, `\\`, "{", `\{`, "}", `\}`)
+)
+
+// jsonEscapeString escapes s for a JSON string literal. The angle brackets
+// are escaped too, so that the literal can't end a <script> element, and
+// so are the line and paragraph separators, which JavaScript doesn't allow
+// in string literals before ES2019.
+func jsonEscapeString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '<', '>', '\u2028', '\u2029':
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			if r < ' ' || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+				continue
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// charsets are the charsets ?url can encode to, by their lower case names
+// and aliases.
+var charsets = map[string]func(r rune) (byte, bool){
+	"utf-8":      nil,
+	"utf8":       nil,
+	"iso-8859-1": latin1,
+	"latin1":     latin1,
+	"us-ascii":   ascii,
+	"ascii":      ascii,
+}
+
+func latin1(r rune) (byte, bool) { return byte(r), r <= 0xff }
+func ascii(r rune) (byte, bool)  { return byte(r), r < utf8.RuneSelf }
+
+// checkCharset checks that ?url supports the charset, which the
+// url_escaping_charset and output_encoding settings must be.
+func checkCharset(charset string) error {
+	if _, ok := charsets[strings.ToLower(charset)]; !ok {
+		return fmt.Errorf("unsupported charset %q; use UTF-8, ISO-8859-1 or US-ASCII", charset)
+	}
+	return nil
+}
+
+// urlBuiltin returns ?url(charset) or ?url_path(charset), which
+// percent-encode a string in the charset, by default the
+// url_escaping_charset setting, or the output_encoding setting, or UTF-8.
+// All the characters are encoded but the letters and digits of ASCII and
+// -_.!~*'(), and for ?url_path the slash.
+func urlBuiltin(path bool) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 0, 1)
+		str := s.stringTarget(n)
+		charset := s.settings.urlEscapingCharset()
+		if len(n.Args) == 1 {
+			charset = s.stringArg(n, 0)
+		}
+		if err := checkCharset(charset); err != nil {
+			s.errorf("?%s: %v", n.Name, err)
+		}
+		encode := charsets[strings.ToLower(charset)]
+		var b strings.Builder
+		var buf [utf8.UTFMax]byte
+		for _, r := range str {
+			switch {
+			case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+				strings.ContainsRune("-_.!~*'()", r), path && r == '/':
+				b.WriteRune(r)
+				continue
+			}
+			bytes := buf[:utf8.EncodeRune(buf[:], r)]
+			if encode != nil {
+				c, ok := encode(r)
+				if !ok {
+					// As in Java, what the charset can't encode becomes '?'.
+					c = '?'
+				}
+				bytes = []byte{c}
+			}
+			for _, c := range bytes {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		return reflect.ValueOf(b.String())
+	}
+}
@@ -0,0 +1,88 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEscapeBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"markup": `<a href="x?a=1&b='2'">`,
+		"js":     "It's \"quoted\"\n</script>",
+		"query":  "a b/ä&c=ő~",
+		"rtf":    `{\b bold}`,
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"html", "${markup?html}", "&lt;a href=&#34;x?a=1&amp;b=&#39;2&#39;&#34;&gt;", ""},
+		{"xhtml", "${markup?xhtml}", "&lt;a href=&quot;x?a=1&amp;b=&#39;2&#39;&quot;&gt;", ""},
+		{"xml", "${markup?xml}", "&lt;a href=&quot;x?a=1&amp;b=&apos;2&apos;&quot;&gt;", ""},
+		{"js string", "${js?js_string}", `It\'s \"quoted\"\u000A\x3C/script\x3E`, ""},
+		{"json string", "${js?json_string}", `It's \"quoted\"\n\u003C/script\u003E`, ""},
+		{"rtf", "${rtf?rtf}", `\{\\b bold\}`, ""},
+		{"url", "${query?url}", "a%20b%2F%C3%A4%26c%3D%C5%91~", ""},
+		{"url path", "${query?url_path}", "a%20b/%C3%A4%26c%3D%C5%91~", ""},
+		{"url charset", "${query?url('ISO-8859-1')}", "a%20b%2F%E4%26c%3D%3F~", ""},
+		{"url escaping charset", `<#setting url_escaping_charset="latin1">${query?url} ${.url_escaping_charset}`,
+			"a%20b%2F%E4%26c%3D%3F~ latin1", ""},
+		{"output encoding", `<#setting output_encoding="ISO-8859-1">${query?url_path} ${.output_encoding}`,
+			"a%20b/%E4%26c%3D%3F~ ISO-8859-1", ""},
+		{"default charset", "${.url_escaping_charset} ${.output_encoding!'unknown'}", "UTF-8 unknown", ""},
+		{"chained", "${markup?url?html}", "%3Ca%20href%3D%22x%3Fa%3D1%26b%3D&#39;2&#39;%22%3E", ""},
+		{"numbers", "${1234?url}", "1%2C234", ""},
+		{"bad charset", "${query?url('EBCDIC')}", "", `unsupported charset "EBCDIC"`},
+		{"bad setting", `<#setting url_escaping_charset="EBCDIC">`, "", `unsupported charset "EBCDIC"`},
+		{"bad output encoding", `<#setting output_encoding="EBCDIC">`, "", `unsupported charset "EBCDIC"`},
+		{"bad args", "${markup?html('x')}", "", "?html doesn't take arguments"},
+		{"auto-escaping", `<#setting output_format="HTML">${markup} ${markup?html} ${markup?no_esc} ${.output_format}`,
+			`&lt;a href=&#34;x?a=1&amp;b=&#39;2&#39;&#34;&gt; &lt;a href=&#34;x?a=1&amp;b=&#39;2&#39;&#34;&gt; <a href="x?a=1&b='2'"> HTML`, ""},
+		{"escaped twice", `<#setting output_format="XHTML">${markup?html} ${js?js_string}`,
+			`&amp;lt;a href=&amp;#34;x?a=1&amp;amp;b=&amp;#39;2&amp;#39;&amp;#34;&amp;gt; It\&#39;s \&quot;quoted\&quot;\u000A\x3C/script\x3E`, ""},
+		{"markup concatenation", `<#setting output_format="XML">${"<b>"?no_esc + rtf + "</b>"?no_esc}`, `<b>{\b bold}</b>`, ""},
+		{"markup types", `<#setting output_format="RTF"><#if rtf?rtf?is_markup_output && !rtf?is_markup_output>y</#if> ${rtf?rtf?markup_string?length}`, "y 12", ""},
+		{"plain text", `<#setting output_format="plainText">${markup}`, `<a href="x?a=1&b='2'">`, ""},
+		{"other markup", `<#macro m x><#setting output_format="XML">${x}</#macro><#setting output_format="HTML"><@m markup?no_esc/>`, "",
+			"x has evaluated to HTML markup, which can't be printed with the output format XML"},
+		{"no markup format", "${markup?no_esc}", "", "?no_esc can only be used with a markup output format, but the output format is undefined"},
+		{"adding markups", `<#macro m x><#setting output_format="XML">${x + markup?no_esc}</#macro><#setting output_format="HTML"><@m markup?no_esc/>`, "",
+			"can't add HTML markup and XML markup"},
+		{"bad output format", `<#setting output_format="PDF">`, "", `unknown output format "PDF"`},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+// The strings evaluated by ?eval, ?eval_json and ?interpret often come from
+// the data model, and may not be trusted. They are evaluated in the current
+// execution, so the member access policy, the object wrapper, the limits
+// and the cancellation of the context apply to them as to the template.
+// Each ?eval counts towards the call depth limit, and so does each call of
+// a fragment made by ?interpret, which stops a string that evaluates itself
+// from recursing forever.
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"eval":      builtinEval,
+		"eval_json": builtinEvalJSON,
+		"interpret": builtinInterpret,
+	})
+}
+
+// builtinEval evaluates ?eval, which evaluates a string as an expression,
+// as in "1 + x"?eval. The expression sees the variables of the place it is
+// evaluated in.
+func builtinEval(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	src := s.stringTarget(n)
+	expr, err := parse.ParseExpression(s.tmpl.Name()+"?eval", src)
+	if err != nil {
+		s.errorf("?eval can't parse %s: %w", n.Target, err)
+	}
+	s.enterCall()
+	depth := s.depth
+	defer func() { s.depth = depth }()
+	s.depth++
+	return s.evalExpr(expr)
+}
+
+// builtinEvalJSON evaluates ?eval_json, which parses a string as JSON.
+// Objects are hashes that keep the order of their keys, arrays are
+// sequences, and null is missing. Numbers are exact, as decimal literals
+// are: an int if they are integers that fit, a *big.Rat otherwise.
+func builtinEvalJSON(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	dec := json.NewDecoder(strings.NewReader(s.stringTarget(n)))
+	dec.UseNumber()
+	v, err := decodeJSON(dec)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errTrailingJSON
+		}
+	}
+	if err != nil {
+		s.errorf("?eval_json can't parse %s: %v", n.Target, err)
+	}
+	return reflect.ValueOf(v)
+}
+
+var errTrailingJSON = errors.New("unexpected data after the JSON value")
+
+// decodeJSON decodes the next JSON value of dec.
+func decodeJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			seq := []interface{}{}
+			for dec.More() {
+				v, err := decodeJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, v)
+			}
+			_, err := dec.Token()
+			return seq, err
+		}
+		h := NewOrderedHash()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			h.Set(key.(string), v)
+		}
+		_, err := dec.Token()
+		return h, err
+	case json.Number:
+		r, ok := new(big.Rat).SetString(string(tok))
+		if !ok {
+			return nil, fmt.Errorf("invalid number %s", tok)
+		}
+		return ratValue(r).Interface(), nil
+	}
+	return tok, nil
+}
+
+// builtinInterpret evaluates ?interpret, which parses a string as a
+// template, and returns it as a macro without parameters, as in
+// <@snippet?interpret />. The fragment is executed in the namespace of the
+// execution: it sees and defines the same macros. It is named after the
+// template it is interpreted in, or, for a fragment interpreted by another
+// one, after the template the outermost fragment is interpreted in.
+func builtinInterpret(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	src := s.stringTarget(n)
+	name := s.tmpl.Name()
+	if !strings.HasSuffix(name, "?interpret") {
+		name += "?interpret"
+	}
+	trees, err := parse.Parse(name, src)
+	if err != nil {
+		s.errorf("?interpret can't parse %s: %w", n.Target, err)
+	}
+	// The fragment isn't added to the associated templates, which
+	// executions running in parallel share.
+	tmpl := s.tmpl.New(name)
+	tmpl.Tree = trees[name]
+	m := &parse.MacroNode{NodeType: parse.NodeMacro, Name: name, Content: tmpl.Root}
+	return reflect.ValueOf(&macro{m, tmpl, true})
+}
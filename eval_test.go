@@ -0,0 +1,106 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvalBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"x":      21,
+		"expr":   "x * 2",
+		"self":   "self?eval",
+		"json":   `{"b": 0.1, "a": [1, 2.50, null], "c": 0.2, "big": 123456789012345678901234567890, "s": "é", "t": true, "n": null}`,
+		"snip":   `<#macro greet who>Hello ${who}!</#macro><@greet who=name/>`,
+		"loop":   `<#list 1..n as i>${i}</#list>`,
+		"broken": "<#if>",
+		"bad":    "${1 + true}",
+		"g":      Greeter{Name: "joe", Token: "t0k3n"},
+		"name":   "Ann",
+		"stars":  "<@star/>${name}<@star/>",
+		"token":  "${g.Token}",
+		"nested": "<@bad?interpret/>",
+	}
+	policy := SandboxPolicy()
+	policy.Denied = map[reflect.Type][]string{reflect.TypeOf(Greeter{}): {"Token"}}
+	tests := []struct {
+		name   string
+		input  string
+		policy MemberAccessPolicy
+		output string
+		err    string
+	}{
+		{"eval", `${"1 + 2"?eval} ${expr?eval} ${"[x, x + 1]"?eval?join("-")} ${"{'a': x}"?eval.a}`, nil, "3 42 21-22 21", ""},
+		{"eval locals", `<#list 1..3 as i>${"i * 10"?eval} </#list>`, nil, "10 20 30 ", ""},
+		{"eval lambda", `${"[1, 2, 3]?filter(i -> i > x / 10)"?eval?join(",")}`, nil, "3", ""},
+		{"eval missing", `${"nope"?eval!"none"}`, nil, "none", ""},
+		{"eval syntax", `${"1 +"?eval}`, nil, "", `?eval can't parse "1 +": template: eval syntax?eval:1:4: unexpected EOF in expression`},
+		{"eval error location", `${"x + true"?eval}`, nil, "", "eval error location?eval:1:0"},
+		{"eval policy", `${"g.Name"?eval} ${"g.Token"?eval}`, policy, "", "can't access Token of template.Greeter: denied by the member access policy"},
+		{"eval recursion", `${self?eval}`, nil, "", "exceeded the limit of 500 call depth"},
+		{"json", `${json?eval_json?keys?join(",")} ${json?eval_json.a?join(",", "", "")} ${json?eval_json.a[2]!"null"}`, nil,
+			"b,a,c,big,s,t,n 1,2.5 null", ""},
+		{"json exact", `<#setting number_format="computer">${json?eval_json.b + json?eval_json.c} ${json?eval_json.big} ${json?eval_json.big?is_number?c}`, nil,
+			"0.3 123456789012345678901234567890 true", ""},
+		{"json values", `${json?eval_json.s} ${json?eval_json.t?c} ${json?eval_json.n!"null"} ${"[]"?eval_json?size} ${"\"x\""?eval_json}`, nil,
+			"é true null 0 x", ""},
+		{"json syntax", `${"{'a': 1}"?eval_json}`, nil, "", `?eval_json can't parse "{'a': 1}": invalid character '\'' looking for beginning of value`},
+		{"json trailing", `${"[1] 2"?eval_json}`, nil, "", `?eval_json can't parse "[1] 2": unexpected data after the JSON value`},
+		{"json truncated", `${"[1, "?eval_json}`, nil, "", "?eval_json can't parse \"[1, \": unexpected end of JSON input"},
+		{"interpret", `<@snip?interpret/> <@greet who="Bob"/>`, nil, "Hello Ann! Hello Bob!", ""},
+		{"interpret namespace", `<#macro star>*</#macro><@stars?interpret/>`, nil, "*Ann*", ""},
+		{"interpret is a macro", `${snip?interpret?is_macro?c}`, nil, "true", ""},
+		{"interpret syntax", `<@broken?interpret/>`, nil, "", "?interpret can't parse broken: template: interpret syntax?interpret:1:5"},
+		{"interpret error location", `<@bad?interpret/>`, nil, "", "interpret error location?interpret:1:2"},
+		{"interpret nested", `<@nested?interpret/>`, nil, "", "interpret nested?interpret:1:2"},
+		{"interpret policy", `<@token?interpret/>`, policy, "", "can't access Token of template.Greeter"},
+		{"interpret arguments", `<@snip?interpret x=1/>`, nil, "", `has no parameter with name "x"`},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).SetMemberAccessPolicy(test.policy).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestInterpretLimits(t *testing.T) {
+	tmpl, err := New("limits").SetLimits(Limits{MaxInstructions: 50}).Parse(`<@loop?interpret/>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpl.Execute(new(bytes.Buffer), map[string]interface{}{"loop": "<#list 1..1000 as i>${i}</#list>"})
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Limit != LimitInstructions {
+		t.Errorf("expected the instruction limit to be exceeded, got %v", err)
+	}
+}
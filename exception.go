@@ -0,0 +1,112 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"io"
+)
+
+// An ExceptionHandler decides what happens when an instruction of a
+// template, such as an interpolation or a directive, fails to execute.
+//
+// HandleException is called with the error, which holds the FTL stack
+// trace, and the output of the template. If it returns nil, execution
+// carries on with the instruction following the failed one, so a handler
+// can, for example, log the error and write a replacement to w. Otherwise
+// execution stops and Execute returns the error it returned.
+//
+// The output of the failed instruction up to the error has already been
+// written.
+type ExceptionHandler interface {
+	HandleException(err ExecError, w io.Writer) error
+}
+
+// ExceptionHandlerFunc is an adapter to allow the use of ordinary functions
+// as exception handlers.
+type ExceptionHandlerFunc func(err ExecError, w io.Writer) error
+
+// HandleException calls f(err, w).
+func (f ExceptionHandlerFunc) HandleException(err ExecError, w io.Writer) error {
+	return f(err, w)
+}
+
+var (
+	// RethrowHandler stops execution at the first error. This is the default,
+	// and it is the handler to use in production, unless errors are to be
+	// handled in some custom way.
+	RethrowHandler ExceptionHandler = rethrowHandler{}
+
+	// DebugHandler writes the error with the FTL stack trace to the output
+	// and then stops execution. It is meant for development.
+	DebugHandler ExceptionHandler = debugHandler{}
+
+	// HTMLDebugHandler is like DebugHandler, but formats the error so that it
+	// is visible and readable when the output is HTML, even in the middle of
+	// a tag or a script.
+	HTMLDebugHandler ExceptionHandler = htmlDebugHandler{}
+
+	// IgnoreHandler skips the failed instruction and carries on with the
+	// next one, without reporting the error.
+	IgnoreHandler ExceptionHandler = ignoreHandler{}
+)
+
+type rethrowHandler struct{}
+
+func (rethrowHandler) HandleException(err ExecError, w io.Writer) error {
+	return err
+}
+
+type debugHandler struct{}
+
+func (debugHandler) HandleException(err ExecError, w io.Writer) error {
+	fmt.Fprintf(w, "FreeMarker template error (DEBUG mode; use RethrowHandler in production!):\n%s\n", err)
+	return err
+}
+
+// htmlDebugStart closes whatever the output might be in the middle of, so
+// that the error message shows.
+const htmlDebugStart = `<!-- FREEMARKER ERROR MESSAGE STARTS HERE --><!-- ]]> -->` +
+	`<script language=javascript>//"></script><script language=javascript>//'></script>` +
+	`</title></xmp></script></noscript></style></object></head></pre></table></form></table></table></table></a></u></i></b>` +
+	`<div align='left' style='background-color:#FFFF7C; display:block; border-top:double; padding:4px; margin:0; ` +
+	`font-family:Arial,sans-serif; color:#A80000; font-size:12px; font-style:normal; font-weight:normal; text-decoration:none'>` +
+	`<b style='font-size:12px; font-weight:bold'>FreeMarker template error (HTML_DEBUG mode; use RethrowHandler in production!)</b>` +
+	`<pre style='display:block; background:none; border:none; margin:0; padding:0; font-family:monospace; font-size:12px; color:#A80000'>`
+
+const htmlDebugEnd = `</pre></div></html>`
+
+type htmlDebugHandler struct{}
+
+func (htmlDebugHandler) HandleException(err ExecError, w io.Writer) error {
+	fmt.Fprintf(w, "%s%s%s", htmlDebugStart, HTMLEscapeString(err.Error()), htmlDebugEnd)
+	return err
+}
+
+type ignoreHandler struct{}
+
+func (ignoreHandler) HandleException(err ExecError, w io.Writer) error {
+	return nil
+}
+
+// handledError is the wrapper type used internally for the error returned
+// by an exception handler, so that the handlers of the instructions
+// enclosing the failed one do not handle it again. We strip the wrapper in
+// errRecover.
+type handledError struct {
+	Err error
+}
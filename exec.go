@@ -17,34 +17,58 @@
 package template
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"reflect"
 	"runtime"
 	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/moqmar/freemarker.go/parse"
 )
 
-// maxExecDepth specifies the maximum stack depth of templates within
-// templates. This limit is only practically reached by accidentally
-// recursive template invocations. This limit allows us to return
-// an error instead of triggering a stack overflow.
-const maxExecDepth = 16
+// maxExecDepth specifies the default maximum nesting depth of macro calls,
+// includes and ?eval. It is deep enough for recursive macros walking trees
+// such as menus or comment threads, and is only practically reached by
+// accidentally unbounded recursion. This limit allows us to return an error
+// instead of triggering a stack overflow.
+const maxExecDepth = 500
 
 // state represents the state of an execution. It's not part of the
 // template so that multiple executions of the same template
 // can execute in parallel.
 type state struct {
-	tmpl  *Template
-	wr    io.Writer
-	node  parse.Node // current node, for errors
-	vars  []variable // push-down stack of variable values.
-	depth int        // the height of the stack of executing templates.
+	tmpl     *Template                // template being executed, which changes on <#include>
+	main     *Template                // template Execute was called on
+	wr       io.Writer                // the output
+	node     parse.Node               // current node, for errors
+	instr    parse.Node               // current instruction, for the FTL stack trace
+	vars     []variable               // push-down stack of local variable values.
+	depth    int                      // the height of the stack of executing templates.
+	root     reflect.Value            // the data model
+	ns       map[string]reflect.Value // the namespace: macros defined by the templates
+	frames   []frame                  // the instructions being executed, outermost first
+	macro    string                   // name of the macro being executed, if any
+	caller   *caller                  // the call of the macro being executed, for <#nested>
+	onErr    ExceptionHandler         // handler of failed instructions; nil for RethrowHandler
+	errs     []ExecError              // the errors being recovered from by <#recover>, innermost last
+	done     <-chan struct{}          // closed when the context of the execution is done
+	ctx      context.Context          // the context of the execution, for the error ending it
+	limits   Limits                   // resource limits of the execution
+	wrapper  ObjectWrapper            // nil for DefaultObjectWrapper
+	members  memberCache              // the member table used last
+	policy   MemberAccessPolicy       // nil if all members are accessible
+	settings settings                 // the current settings
+	steps    int64                    // the number of instructions executed
+	output   int64                    // the number of bytes written
 }
 
-// variable holds the dynamic value of a variable such as $, $x etc.
+// variable holds the dynamic value of a local variable, such as a loop
+// variable or a macro parameter.
 type variable struct {
 	name  string
 	value reflect.Value
@@ -65,20 +89,20 @@ func (s *state) pop(mark int) {
 	s.vars = s.vars[0:mark]
 }
 
-// setVar overwrites the top-nth variable on the stack. Used by range iterations.
+// setVar overwrites the top-nth variable on the stack. Used by list iterations.
 func (s *state) setVar(n int, value reflect.Value) {
 	s.vars[len(s.vars)-n].value = value
 }
 
-// varValue returns the value of the named variable.
-func (s *state) varValue(name string) reflect.Value {
+// varValue returns the value of the named local variable, and whether it
+// is defined.
+func (s *state) varValue(name string) (reflect.Value, bool) {
 	for i := s.mark() - 1; i >= 0; i-- {
 		if s.vars[i].name == name {
-			return s.vars[i].value
+			return s.vars[i].value, true
 		}
 	}
-	s.errorf("undefined variable: %s", name)
-	return zero
+	return zero, false
 }
 
 var zero reflect.Value
@@ -88,6 +112,42 @@ func (s *state) at(node parse.Node) {
 	s.node = node
 }
 
+// frame is an instruction on the FTL stack, with the name of the macro it
+// appears in.
+type frame struct {
+	node  parse.Node
+	macro string
+}
+
+// enter pushes the instruction n on the FTL stack.
+func (s *state) enter(n parse.Node) {
+	s.frames = append(s.frames, frame{n, s.macro})
+}
+
+// leave pops the innermost instruction from the FTL stack.
+func (s *state) leave() {
+	s.frames = s.frames[:len(s.frames)-1]
+}
+
+// caller records the call of a macro: the content of the call and the state
+// it is executed in by <#nested>.
+type caller struct {
+	content *parse.ContentNode
+	tmpl    *Template
+	vars    []variable
+	macro   string
+	caller  *caller
+}
+
+// macro is the value of a variable defined by <#macro>.
+type macro struct {
+	*parse.MacroNode
+	tmpl     *Template // template defining the macro
+	fragment bool      // a template made by ?interpret, defining its macros when called
+}
+
+var macroType = reflect.TypeOf((*macro)(nil))
+
 // doublePercent returns the string with %'s replaced by %%, if necessary,
 // so it can be used safely inside a Printf format string.
 func doublePercent(str string) string {
@@ -97,24 +157,117 @@ func doublePercent(str string) string {
 	return str
 }
 
-// TODO: It would be nice if ExecError was more broken down, but
-// the way ErrorContext embeds the template name makes the
-// processing too clumsy.
-
 // ExecError is the custom error type returned when Execute has an
 // error evaluating its template. (If a write error occurs, the actual
 // error is returned; it will not be of type ExecError.)
 type ExecError struct {
-	Name string // Name of template.
-	Err  error  // Pre-formatted error.
+	Name  string  // Name of template.
+	Err   error   // Pre-formatted error, wrapping the error of a failed function call, if any.
+	Stack []Frame // The FTL stack trace, innermost instruction first.
 }
 
 func (e ExecError) Error() string {
-	return e.Err.Error()
+	if len(e.Stack) == 0 {
+		return e.Err.Error()
+	}
+	b := &bytes.Buffer{}
+	b.WriteString(e.Err.Error())
+	b.WriteString("\n\n")
+	writeStack(b, e.Stack)
+	return b.String()
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As.
+func (e ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Frame is an entry of the FTL stack trace: an instruction being executed
+// when an error occurred.
+type Frame struct {
+	Template    string // name of the template containing the instruction
+	Macro       string // name of the macro containing the instruction, if any
+	Line        int    // line of the instruction, starting at 1
+	Column      int    // column of the instruction in bytes, starting at 1
+	Instruction string // the instruction, such as #include "footer.ftl", @greet name="Joe" or #list users as user
+}
+
+func (f Frame) String() string {
+	if f.Macro != "" {
+		return fmt.Sprintf("%s  [in template %q in macro %q at line %d, column %d]", f.Instruction, f.Template, f.Macro, f.Line, f.Column)
+	}
+	return fmt.Sprintf("%s  [in template %q at line %d, column %d]", f.Instruction, f.Template, f.Line, f.Column)
+}
+
+// writeStack writes the FTL stack trace in the layout of FreeMarker. Calls
+// of macros and includes are marked with "-", and the directives enclosing
+// the failed instruction with "~".
+func writeStack(w io.Writer, stack []Frame) {
+	fmt.Fprintln(w, `FTL stack trace ("~" means nesting-related):`)
+	for i, f := range stack {
+		switch {
+		case i == 0:
+			fmt.Fprintf(w, "\t- Failed at: %s\n", f)
+		case strings.HasPrefix(f.Instruction, "#include"), strings.HasPrefix(f.Instruction, "@"),
+			strings.HasPrefix(f.Instruction, "#nested"):
+			fmt.Fprintf(w, "\t- Reached through: %s\n", f)
+		default:
+			fmt.Fprintf(w, "\t~ Reached through: %s\n", f)
+		}
+	}
+}
+
+// stack returns the FTL stack trace of the current instruction.
+func (s *state) stack() []Frame {
+	var stack []Frame
+	if s.instr != nil {
+		stack = append(stack, s.newFrame(s.instr, s.macro))
+	}
+	for i := len(s.frames) - 1; i >= 0; i-- {
+		if f := s.frames[i]; f.node != s.instr {
+			stack = append(stack, s.newFrame(f.node, f.macro))
+		}
+	}
+	return stack
+}
+
+func (s *state) newFrame(n parse.Node, macro string) Frame {
+	name, line, column := s.tmpl.Location(n)
+	return Frame{Template: name, Macro: macro, Line: line, Column: column, Instruction: instruction(n)}
+}
+
+// instruction describes the instruction n for the FTL stack trace.
+func instruction(n parse.Node) string {
+	switch n := n.(type) {
+	case *parse.IfNode:
+		return fmt.Sprintf("#if %s", n.Expr)
+	case *parse.ListNode:
+		return fmt.Sprintf("#list %s as %s", n.Expr, strings.Join(n.Vars, ", "))
+	case *parse.IncludeNode:
+		return fmt.Sprintf("#include %s", n.Name)
+	case *parse.UserDirectiveNode:
+		tag := strings.TrimPrefix(n.Tag(), "<")
+		return strings.TrimSuffix(strings.TrimSuffix(tag, ">"), "/")
+	case *parse.NestedNode:
+		return "#nested"
+	case *parse.AttemptNode:
+		return "#attempt"
+	}
+	return n.String()
 }
 
 // errorf records an ExecError and terminates processing.
 func (s *state) errorf(format string, args ...interface{}) {
+	panic(s.newError(format, args...))
+}
+
+// abortf records an ExecError and terminates processing, whatever the
+// exception handler and <#attempt>.
+func (s *state) abortf(format string, args ...interface{}) {
+	panic(abortError{s.newError(format, args...)})
+}
+
+func (s *state) newError(format string, args ...interface{}) ExecError {
 	name := doublePercent(s.tmpl.Name())
 	if s.node == nil {
 		format = fmt.Sprintf("template: %s: %s", name, format)
@@ -122,10 +275,80 @@ func (s *state) errorf(format string, args ...interface{}) {
 		location, context := s.tmpl.ErrorContext(s.node)
 		format = fmt.Sprintf("template: %s: executing %q at <%s>: %s", location, name, doublePercent(context), format)
 	}
-	panic(ExecError{
-		Name: s.tmpl.Name(),
-		Err:  fmt.Errorf(format, args...),
-	})
+	return ExecError{
+		Name:  s.tmpl.Name(),
+		Err:   fmt.Errorf(format, args...),
+		Stack: s.stack(),
+	}
+}
+
+// step accounts for the execution of an instruction or an iteration of a
+// loop, stopping the execution if its context is done or it exceeded its
+// instruction limit.
+func (s *state) step() {
+	if s.done != nil {
+		select {
+		case <-s.done:
+			s.abortf("execution stopped: %w", s.ctx.Err())
+		default:
+		}
+	}
+	s.steps++
+	if max := s.limits.MaxInstructions; max > 0 && s.steps > max {
+		s.abortf("%w", &LimitError{LimitInstructions, max})
+	}
+}
+
+// write writes text to the output, within the output limit.
+func (s *state) write(text []byte) {
+	s.count(len(text))
+	if _, err := s.wr.Write(text); err != nil {
+		s.writeError(err)
+	}
+}
+
+// writeString is like write, for a string.
+func (s *state) writeString(text string) {
+	s.count(len(text))
+	if _, err := io.WriteString(s.wr, text); err != nil {
+		s.writeError(err)
+	}
+}
+
+// count accounts for writing n bytes, within the output limit.
+func (s *state) count(n int) {
+	s.output += int64(n)
+	if max := s.limits.MaxOutputBytes; max > 0 && s.output > max {
+		s.abortf("%w", &LimitError{LimitOutputBytes, max})
+	}
+}
+
+// checkSize checks that a string of n bytes, about to be built, could be
+// written within the output limit, so that a built-in does not use up the
+// memory for a string that can't be output anyway.
+func (s *state) checkSize(n int64) {
+	if max := s.limits.MaxOutputBytes; max > 0 && n > max {
+		s.abortf("%w", &LimitError{LimitOutputBytes, max})
+	}
+}
+
+// enterCall checks that entering a macro or an included template stays
+// within the call depth limit.
+func (s *state) enterCall() {
+	max := s.limits.MaxCallDepth
+	if max == 0 {
+		max = maxExecDepth
+	}
+	if s.depth >= max {
+		s.abortf("%w", &LimitError{LimitCallDepth, int64(max)})
+	}
+}
+
+// missing reports that the expression n evaluated to a missing value and
+// terminates processing.
+func (s *state) missing(n parse.Node) {
+	s.at(n)
+	s.errorf("%s has evaluated to null or missing", n)
 }
 
 // writeError is the wrapper type used internally when Execute has an
@@ -152,6 +375,10 @@ func errRecover(errp *error) {
 			panic(e)
 		case writeError:
 			*errp = err.Err // Strip the wrapper.
+		case handledError:
+			*errp = err.Err // Strip the wrapper.
+		case abortError:
+			*errp = err.ExecError // Strip the wrapper.
 		case ExecError:
 			*errp = err // Keep the wrapper.
 		default:
@@ -177,6 +404,22 @@ func (t *Template) ExecuteTemplate(wr io.Writer, name string, data interface{})
 	return tmpl.Execute(wr, data)
 }
 
+// ExecuteTemplateLocale is like ExecuteTemplate, but executes the variant
+// of the template for the locale, as returned by LookupLocale, with the
+// locale setting set to locale.
+func (t *Template) ExecuteTemplateLocale(wr io.Writer, name, locale string, data interface{}) error {
+	t.init()
+	c := t.settings
+	if err := c.set("locale", locale); err != nil {
+		return fmt.Errorf("template: %v", err)
+	}
+	tmpl := t.LookupLocale(name, c.localeData().tag)
+	if tmpl == nil {
+		return fmt.Errorf("template: no template %q associated with template %q", name, t.name)
+	}
+	return tmpl.execute(context.Background(), wr, data, c)
+}
+
 // Execute applies a parsed template to the specified data object,
 // and writes the output to wr.
 // If an error occurs executing the template or writing its output,
@@ -187,83 +430,152 @@ func (t *Template) ExecuteTemplate(wr io.Writer, name string, data interface{})
 // If data is a reflect.Value, the template applies to the concrete
 // value that the reflect.Value holds, as in fmt.Print.
 func (t *Template) Execute(wr io.Writer, data interface{}) error {
-	return t.execute(wr, data)
+	return t.execute(context.Background(), wr, data, t.settings)
+}
+
+// ExecuteContext is like Execute, but stops the execution when ctx is done,
+// at the next interpolation, directive or iteration of a loop. The error
+// returned then is an ExecError wrapping ctx.Err(). The limits set with
+// SetLimits apply to both Execute and ExecuteContext.
+func (t *Template) ExecuteContext(ctx context.Context, wr io.Writer, data interface{}) error {
+	return t.execute(ctx, wr, data, t.settings)
 }
 
-func (t *Template) execute(wr io.Writer, data interface{}) (err error) {
+func (t *Template) execute(ctx context.Context, wr io.Writer, data interface{}, c settings) (err error) {
 	defer errRecover(&err)
 	value, ok := data.(reflect.Value)
 	if !ok {
 		value = reflect.ValueOf(data)
 	}
 	state := &state{
-		tmpl: t,
-		wr:   wr,
-		vars: []variable{{"$", value}},
+		tmpl:     t,
+		main:     t,
+		wr:       wr,
+		ns:       make(map[string]reflect.Value),
+		onErr:    t.exceptionHandler,
+		wrapper:  t.wrapper,
+		policy:   t.policy,
+		settings: c,
+		ctx:      ctx,
+		done:     ctx.Done(),
+		limits:   t.limits,
 	}
 	if t.Tree == nil || t.Root == nil {
 		state.errorf("%q is an incomplete or empty template", t.Name())
 	}
-	state.walk(value, t.Root)
+	state.root = state.wrap(value)
+	state.defineMacros(t)
+	state.walk(t.Root)
 	return
 }
 
+// defineMacros defines the macros of the template in the namespace. As in
+// FreeMarker, a macro can be called before its definition.
+func (s *state) defineMacros(t *Template) {
+	for _, n := range t.Root.Nodes {
+		if m, ok := n.(*parse.MacroNode); ok {
+			s.ns[m.Name] = reflect.ValueOf(&macro{m, t, false})
+		}
+	}
+}
+
 // Walk functions step through the major pieces of the template structure,
 // generating output as they go.
-func (s *state) walk(dot reflect.Value, node parse.Node) {
+func (s *state) walk(node parse.Node) {
 	s.at(node)
 	switch node := node.(type) {
-	case *parse.ExpressionNode:
-		// Do not pop variables so they persist until next end.
-		// Also, if the action declares variables, don't print the result.
-		//		val := s.evalPipeline(dot, node.Pipe)
-		//		if len(node.Pipe.Decl) == 0 {
-		//			s.printValue(node, val)
-		//		}
-	case *parse.IfNode:
-		//		s.walkIfOrWith(parse.NodeIf, dot, node.Pipe, node.List, node.ElseList)
 	case *parse.ContentNode:
 		for _, node := range node.Nodes {
-			s.walk(dot, node)
+			s.walk(node)
 		}
-	case *parse.ListNode:
-		s.walkRange(dot, node)
-		//	case *parse.TemplateNode:
-		//		s.walkTemplate(dot, node)
 	case *parse.TextNode:
-		if _, err := s.wr.Write(node.Text); err != nil {
-			s.writeError(err)
+		s.write(node.Text)
+	default:
+		s.instr = node
+		s.step()
+		if s.onErr != nil {
+			defer s.handle()
+		}
+		s.walkInstruction(node)
+	}
+}
+
+// handle passes the error of a failed instruction to the exception handler,
+// which decides whether execution carries on.
+func (s *state) handle() {
+	e := recover()
+	if e == nil {
+		return
+	}
+	err, ok := e.(ExecError)
+	if !ok {
+		panic(e)
+	}
+	if err := s.onErr.HandleException(err, s.wr); err != nil {
+		panic(handledError{err})
+	}
+}
+
+// walkInstruction walks an interpolation or a directive.
+func (s *state) walkInstruction(node parse.Node) {
+	switch node := node.(type) {
+	case *parse.InterpolationNode:
+		s.printValue(node.Expr, s.evalExpr(node.Expr))
+	case *parse.IfNode:
+		s.walkIf(node)
+	case *parse.ListNode:
+		s.walkList(node)
+	case *parse.IncludeNode:
+		s.walkInclude(node)
+	case *parse.MacroNode:
+		// Defined before execution by defineMacros.
+	case *parse.UserDirectiveNode:
+		s.walkUserDirective(node)
+	case *parse.NestedNode:
+		s.walkNested(node)
+	case *parse.AttemptNode:
+		s.walkAttempt(node)
+	case *parse.SettingNode:
+		value := s.evalString(node.Value)
+		s.at(node)
+		if err := s.settings.set(node.Name, value); err != nil {
+			s.errorf("%w", err)
 		}
-		//	case *parse.WithNode:
-		//		s.walkIfOrWith(parse.NodeWith, dot, node.Pipe, node.List, node.ElseList)
 	default:
 		s.errorf("unknown node: %s", node)
 	}
 }
 
-// walkIfOrWith walks an 'if' or 'with' node. The two control structures
-// are identical in behavior except that 'with' sets dot.
-func (s *state) walkIfOrWith(typ parse.NodeType, dot reflect.Value, pipe *parse.ExpressionNode, list, elseList *parse.ListNode) {
-	defer s.pop(s.mark())
-	val := s.evalCommand(dot, pipe)
-	truth, ok := isTrue(val)
-	if !ok {
-		s.errorf("if/with can't use %v", val)
+// walkIf walks an <#if> node.
+func (s *state) walkIf(n *parse.IfNode) {
+	val := s.evalExpr(n.Expr)
+	s.instr = n
+	if s.truth(n.Expr, val) {
+		s.enter(n)
+		defer s.leave()
+		s.walk(n.Content)
+	} else if n.ElseContent != nil {
+		s.enter(n)
+		defer s.leave()
+		s.walk(n.ElseContent)
+	}
+}
+
+// truth returns the value of a condition, which must be a boolean.
+func (s *state) truth(n parse.Node, val reflect.Value) bool {
+	val, isNil := indirect(s.unwrap(val, boolKind))
+	if !val.IsValid() || isNil {
+		s.missing(n)
 	}
-	if truth {
-		//		if typ == parse.NodeWith {
-		//			s.walk(val, list)
-		//		} else {
-		s.walk(dot, list)
-		//		}
-	} else if elseList != nil {
-		s.walk(dot, elseList)
+	if val.Kind() != reflect.Bool {
+		s.at(n)
+		s.errorf("condition must be a boolean, but %s has evaluated to %s", n, s.describe(val))
 	}
+	return val.Bool()
 }
 
 // IsTrue reports whether the value is 'true', in the sense of not the zero of its type,
-// and whether the value has a meaningful truth value. This is the definition of
-// truth used by if and other such actions.
+// and whether the value has a meaningful truth value.
 func IsTrue(val interface{}) (truth, ok bool) {
 	return isTrue(reflect.ValueOf(val))
 }
@@ -296,492 +608,1248 @@ func isTrue(val reflect.Value) (truth, ok bool) {
 	return truth, true
 }
 
-func (s *state) walkRange(dot reflect.Value, r *parse.ListNode) {
+// walkList walks a <#list> node. A sequence is listed with one loop
+// variable, a hash with two: the key and the value.
+func (s *state) walkList(r *parse.ListNode) {
+	if rng, ok := r.Expr.(*parse.RangeNode); ok && rng.To != nil {
+		s.walkRange(r, rng)
+		return
+	}
+	val, isNil := indirect(s.evalExpr(r.Expr))
+	if !val.IsValid() || isNil {
+		s.missing(r.Expr)
+	}
 	s.at(r)
-	defer s.pop(s.mark())
-	val, _ := indirect(s.evalCommand(dot, r.Expr))
+	s.instr = r
+	s.enter(r)
+	defer s.leave()
 	// mark top of stack before any variables in the body are pushed.
 	mark := s.mark()
-	oneIteration := func(index, elem reflect.Value) {
-		// Set top var (lexically the second if there are two) to the element.
-		//		if len(r.Pipe.Decl) > 0 {
-		//			s.setVar(1, elem)
-		//		}
-		// Set next var (lexically the first if there are two) to the index.
-		//		if len(r.Pipe.Decl) > 1 {
-		//			s.setVar(2, index)
-		//		}
-		s.walk(elem, r.Content)
-		s.pop(mark)
+	defer s.pop(mark)
+	for range r.Vars {
+		s.push("", zero)
+	}
+	for i, name := range r.Vars {
+		s.vars[mark+i].name = name
+	}
+	listed := false
+	if m := modelOf(val); m == nil || !s.listModel(r, m, &listed) {
+		s.listValue(r, val, &listed)
+	}
+	if !listed && r.ElseContent != nil {
+		s.walk(r.ElseContent)
 	}
+}
+
+// listValue lists a slice, an array, a map or a struct by reflection, recording in
+// listed whether there was an item.
+func (s *state) listValue(r *parse.ListNode, val reflect.Value, listed *bool) {
 	switch val.Kind() {
 	case reflect.Array, reflect.Slice:
-		if val.Len() == 0 {
-			break
+		if len(r.Vars) != 1 {
+			s.errorf("a sequence is listed with one loop variable, not %d", len(r.Vars))
 		}
 		for i := 0; i < val.Len(); i++ {
-			oneIteration(reflect.ValueOf(i), val.Index(i))
+			s.step()
+			s.setVar(1, s.wrap(val.Index(i)))
+			s.walk(r.Content)
+			*listed = true
 		}
-		return
-	case reflect.Map:
-		if val.Len() == 0 {
-			break
+	default:
+		keys, value, ok := s.hashKeys(val)
+		if !ok {
+			s.errorf("expected a sequence or a hash, but %s has evaluated to %s", r.Expr, s.describe(val))
 		}
-		for _, key := range sortKeys(val.MapKeys()) {
-			oneIteration(key, val.MapIndex(key))
+		if len(r.Vars) != 2 {
+			s.errorf("a hash is listed with two loop variables, the key and the value, not %d", len(r.Vars))
 		}
-		return
-	case reflect.Chan:
-		if val.IsNil() {
-			break
-		}
-		i := 0
-		for ; ; i++ {
-			elem, ok := val.Recv()
-			if !ok {
+		for i, key := range keys {
+			s.step()
+			s.setVar(2, reflect.ValueOf(key))
+			s.setVar(1, value(i))
+			s.walk(r.Content)
+			*listed = true
+		}
+	}
+}
+
+// listModel lists a sequence, collection or extended hash model, recording
+// in listed whether there was an item. It reports whether m is such a model
+// for the number of loop variables.
+func (s *state) listModel(r *parse.ListNode, m interface{}, listed *bool) bool {
+	if len(r.Vars) == 2 {
+		m, ok := m.(HashModelEx)
+		if !ok {
+			return false
+		}
+		keys, err := m.Keys()
+		if err != nil {
+			s.errorf("can't list the keys of %s: %w", r.Expr, err)
+		}
+		for _, key := range keys {
+			s.step()
+			s.setVar(2, reflect.ValueOf(key))
+			s.setVar(1, s.getKey(m, key))
+			s.walk(r.Content)
+			*listed = true
+		}
+		return true
+	}
+	// A collection is iterated even if it is a sequence too, so that the
+	// lazy results of ?filter and ?map stream.
+	switch m := m.(type) {
+	case CollectionModel:
+		it, err := m.Iterator()
+		if err != nil {
+			s.errorf("can't list %s: %w", r.Expr, err)
+		}
+		for {
+			more, err := it.HasNext()
+			if err != nil {
+				s.errorf("can't list %s: %w", r.Expr, err)
+			}
+			if !more {
 				break
 			}
-			oneIteration(reflect.ValueOf(i), elem)
+			s.step()
+			x, err := it.Next()
+			if err != nil {
+				s.errorf("can't list %s: %w", r.Expr, err)
+			}
+			s.setVar(1, s.wrap(valueOf(x)))
+			s.walk(r.Content)
+			*listed = true
 		}
-		if i == 0 {
-			break
+	case SequenceModel:
+		for i, n := 0, s.seqLen(m); i < n; i++ {
+			s.step()
+			s.setVar(1, s.seqIndex(m, i))
+			s.walk(r.Content)
+			*listed = true
 		}
-		return
-	case reflect.Invalid:
-		break // An invalid value is likely a nil map, etc. and acts like an empty map.
 	default:
-		s.errorf("range can't iterate over %v", val)
-	}
-	//	if r.ElseList != nil {
-	//		s.walk(dot, r.ElseList)
-	//	}
-}
-
-//func (s *state) walkTemplate(dot reflect.Value, t *parse.TemplateNode) {
-//	s.at(t)
-//	tmpl := s.tmpl.tmpl[t.Name]
-//	if tmpl == nil {
-//		s.errorf("template %q not defined", t.Name)
-//	}
-//	if s.depth == maxExecDepth {
-//		s.errorf("exceeded maximum template depth (%v)", maxExecDepth)
-//	}
-//	// Variables declared by the pipeline persist.
-//	dot = s.evalPipeline(dot, t.Pipe)
-//	newState := *s
-//	newState.depth++
-//	newState.tmpl = tmpl
-//	// No dynamic scoping: template invocations inherit no variables.
-//	newState.vars = []variable{{"$", dot}}
-//	newState.walk(dot, tmpl.Root)
-//}
-
-// Eval functions evaluate pipelines, commands, and their elements and extract
-// values from the data structure by examining fields, calling methods, and so on.
-// The printing of those values happens only through walk functions.
-
-func (s *state) evalCommand(dot reflect.Value, cmd *parse.ExpressionNode) reflect.Value {
-	firstWord := cmd.Nodes[0]
-	switch n := firstWord.(type) {
-	case *parse.IdentifierNode:
-		// Must be a function.
-		//		return s.evalFunction(dot, n, cmd, cmd.Args, final)
-	case *parse.ExpressionNode:
-		// Parenthesized pipeline. The arguments are all inside the pipeline; final is ignored.
-		return s.evalCommand(dot, n)
+		return false
+	}
+	return true
+}
+
+// walkRange walks a <#list> node listing a bounded range, without
+// materializing the range, which may be long when the listing is cut short
+// by a limit or a cancellation.
+func (s *state) walkRange(r *parse.ListNode, rng *parse.RangeNode) {
+	from, step, count := s.rangeSteps(rng)
+	s.at(r)
+	s.instr = r
+	if len(r.Vars) != 1 {
+		s.errorf("a sequence is listed with one loop variable, not %d", len(r.Vars))
+	}
+	s.enter(r)
+	defer s.leave()
+	mark := s.mark()
+	defer s.pop(mark)
+	s.push(r.Vars[0], zero)
+	for i := 0; i < count; i++ {
+		s.step()
+		s.setVar(1, reflect.ValueOf(from+i*step))
+		s.walk(r.Content)
+	}
+	if count == 0 && r.ElseContent != nil {
+		s.walk(r.ElseContent)
+	}
+}
+
+// walkInclude walks an <#include> node. The included template is executed
+// in the namespace of the including one.
+func (s *state) walkInclude(n *parse.IncludeNode) {
+	name := s.evalString(n.Name)
+	s.at(n)
+	tmpl := s.tmpl.LookupLocale(name, s.settings.localeData().tag)
+	if tmpl == nil {
+		s.errorf("template %q not found", name)
+	}
+	s.enterCall()
+	s.enter(n)
+	tmpl0, macro, depth := s.tmpl, s.macro, s.depth
+	defer func() {
+		s.tmpl, s.macro, s.depth = tmpl0, macro, depth
+		s.leave()
+	}()
+	s.tmpl, s.macro, s.depth = tmpl, "", s.depth+1
+	s.defineMacros(tmpl)
+	s.walk(tmpl.Root)
+}
+
+// walkUserDirective walks a call of a macro: <@name args>content</@name>.
+func (s *state) walkUserDirective(n *parse.UserDirectiveNode) {
+	val := s.evalExpr(n.Name)
+	s.at(n)
+	if !val.IsValid() {
+		s.errorf("macro %s is not defined", n.Name)
+	}
+	if val.Type() != macroType {
+		s.errorf("%s is not a macro, but %s", n.Name, val.Type())
 	}
+	m := val.Interface().(*macro)
+	s.enterCall()
+	s.instr = n
+	args := make([]reflect.Value, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = s.evalExpr(arg)
+		if !args[i].IsValid() {
+			s.missing(arg)
+		}
+	}
+	s.at(n)
+	s.instr = n
+	s.enter(n)
+
+	tmpl0, vars0, macro0, caller0, depth := s.tmpl, s.vars, s.macro, s.caller, s.depth
+	defer func() {
+		s.tmpl, s.vars, s.macro, s.caller, s.depth = tmpl0, vars0, macro0, caller0, depth
+		s.leave()
+	}()
+	s.caller = &caller{n.Content, s.tmpl, s.vars, s.macro, s.caller}
+	s.vars = s.bindParams(n, m, args)
+	s.tmpl, s.macro, s.depth = m.tmpl, m.Name, s.depth+1
+	if m.fragment {
+		s.defineMacros(m.tmpl)
+	}
+	s.walk(m.Content)
+}
 
-	s.at(firstWord)
+// bindParams returns the variables holding the parameters of the macro m
+// for the arguments of the call n. Missing parameters take their default
+// value, which is evaluated in the macro with the parameters before it.
+func (s *state) bindParams(n *parse.UserDirectiveNode, m *macro, args []reflect.Value) []variable {
+	vars := make([]variable, len(m.Params))
+	for i, p := range m.Params {
+		vars[i].name = p
+	}
+	var extra reflect.Value
+	switch {
+	case n.Named != nil:
+		rest := NewOrderedHash()
+	Named:
+		for i, name := range n.Named {
+			for j, p := range m.Params {
+				if p == name {
+					vars[j].value = args[i]
+					continue Named
+				}
+			}
+			if m.CatchAll == "" {
+				s.errorf("macro %q has no parameter with name %q", m.Name, name)
+			}
+			rest.Set(name, args[i].Interface())
+		}
+		extra = reflect.ValueOf(rest)
+	default:
+		if len(args) > len(m.Params) && m.CatchAll == "" {
+			s.errorf("macro %q only accepts %d parameters, but got %d", m.Name, len(m.Params), len(args))
+		}
+		rest := []interface{}{}
+		for i, arg := range args {
+			if i < len(m.Params) {
+				vars[i].value = arg
+				continue
+			}
+			rest = append(rest, arg.Interface())
+		}
+		extra = reflect.ValueOf(rest)
+	}
 
-	switch word := firstWord.(type) {
+	// Defaults are evaluated in the template defining the macro.
+	tmpl0, vars0 := s.tmpl, s.vars
+	defer func() { s.tmpl, s.vars = tmpl0, vars0 }()
+	s.tmpl = m.tmpl
+	for i, p := range m.Params {
+		if vars[i].value.IsValid() {
+			continue
+		}
+		if m.Defaults[i] == nil {
+			s.at(n)
+			s.errorf("macro %q requires parameter %q, which was not specified", m.Name, p)
+		}
+		s.vars = vars[:i]
+		vars[i].value = s.evalExpr(m.Defaults[i])
+	}
+	if m.CatchAll != "" {
+		vars = append(vars, variable{m.CatchAll, extra})
+	}
+	return vars
+}
+
+// walkNested walks a <#nested> node, which executes the content of the
+// macro call in the context of the caller.
+func (s *state) walkNested(n *parse.NestedNode) {
+	if s.caller == nil {
+		s.errorf("<#nested> used outside a macro")
+	}
+	c := s.caller
+	if c.content == nil {
+		return
+	}
+	s.enter(n)
+	tmpl0, vars0, macro0, caller0 := s.tmpl, s.vars, s.macro, s.caller
+	defer func() {
+		s.tmpl, s.vars, s.macro, s.caller = tmpl0, vars0, macro0, caller0
+		s.leave()
+	}()
+	s.tmpl, s.vars, s.macro, s.caller = c.tmpl, c.vars, c.macro, c.caller
+	s.walk(c.content)
+}
+
+// walkAttempt walks an <#attempt> node. The output of its content is
+// buffered, and discarded if the content fails; then the error is logged and
+// the <#recover> content executes instead. The exception handler does not
+// see errors in the content.
+func (s *state) walkAttempt(n *parse.AttemptNode) {
+	s.enter(n)
+	defer s.leave()
+	var b bytes.Buffer
+	if err, ok := s.attempt(n, &b); !ok {
+		s.tmpl.logAttemptError(err)
+		s.errs = append(s.errs, err)
+		defer func() { s.errs = s.errs[:len(s.errs)-1] }()
+		s.walk(n.RecoverContent)
+		return
+	}
+	if _, err := b.WriteTo(s.wr); err != nil {
+		s.writeError(err)
+	}
+}
+
+// attempt walks the content of an <#attempt> node, writing to b. It reports
+// whether the content executed without error.
+func (s *state) attempt(n *parse.AttemptNode, b *bytes.Buffer) (err ExecError, ok bool) {
+	wr, onErr := s.wr, s.onErr
+	defer func() {
+		s.wr, s.onErr = wr, onErr
+		if e := recover(); e != nil {
+			var isExecError bool
+			if err, isExecError = e.(ExecError); !isExecError {
+				panic(e)
+			}
+			ok = false
+		}
+	}()
+	s.wr, s.onErr = b, nil
+	s.walk(n.Content)
+	return err, true
+}
+
+// Eval functions evaluate expressions and extract values from the data
+// model by examining fields, calling methods, and so on. The printing of
+// those values happens only through walk functions.
+//
+// A missing value, such as an undefined variable or a map with no entry
+// for a key, is the zero reflect.Value. The expression using it decides
+// whether that is an error.
+
+// evalExpr evaluates the expression n.
+func (s *state) evalExpr(n parse.Node) reflect.Value {
+	s.at(n)
+	switch n := n.(type) {
 	case *parse.BoolNode:
-		return reflect.ValueOf(word.True)
-		//	case *parse.DotNode:
-		//		return dot
-	case *parse.NilNode:
-		s.errorf("nil is not a command")
+		return reflect.ValueOf(n.True)
 	case *parse.NumberNode:
-		return s.idealConstant(word)
+		return s.idealConstant(n)
 	case *parse.StringNode:
-		return reflect.ValueOf(word.Text)
+		return reflect.ValueOf(n.Text)
+	case *parse.IdentifierNode:
+		return s.lookup(n.Ident)
+	case *parse.ExpressionNode:
+		return s.evalOperator(n)
+	case *parse.IndexNode:
+		return s.evalIndex(n)
+	case *parse.CallNode:
+		return s.evalCall(n)
+	case *parse.BuiltinNode:
+		return s.evalBuiltin(n)
+	case *parse.DefaultNode:
+		if val := s.evalOptional(n.Expr); val.IsValid() {
+			return val
+		}
+		if n.Default == nil {
+			return reflect.ValueOf("")
+		}
+		return s.evalExpr(n.Default)
+	case *parse.ExistsNode:
+		return reflect.ValueOf(s.evalOptional(n.Expr).IsValid())
+	case *parse.RangeNode:
+		return s.evalRange(n)
+	case *parse.SequenceNode:
+		seq := make([]interface{}, len(n.Items))
+		for i, item := range n.Items {
+			seq[i] = s.evalDefined(item).Interface()
+		}
+		return reflect.ValueOf(seq)
+	case *parse.HashNode:
+		hash := NewOrderedHash()
+		for i, key := range n.Keys {
+			hash.Set(s.evalString(key), s.evalDefined(n.Values[i]).Interface())
+		}
+		return reflect.ValueOf(hash)
+	case *parse.SpecialVarNode:
+		return s.specialVar(n)
+	case *parse.LambdaNode:
+		s.errorf("the lambda %s can only be the argument of a built-in taking a function, such as ?filter", n)
 	}
-	s.errorf("can't evaluate command %q", firstWord)
+	s.errorf("can't evaluate %s", n)
 	panic("not reached")
 }
 
-// idealConstant is called to return the value of a number in a context where
-// we don't know the type. In that case, the syntax of the number tells us
-// its type, and we use Go rules to resolve. Note there is no such thing as
-// a uint ideal constant in this situation - the value must be of int type.
-func (s *state) idealConstant(constant *parse.NumberNode) reflect.Value {
-	// These are ideal constants but we don't know the type
-	// and we have no context.  (If it was a method argument,
-	// we'd know what we need.) The syntax guides us to some extent.
-	s.at(constant)
-	switch {
-	case constant.IsComplex:
-		return reflect.ValueOf(constant.Complex128) // incontrovertible.
-	case constant.IsFloat && !isHexConstant(constant.Text) && strings.ContainsAny(constant.Text, ".eE"):
-		return reflect.ValueOf(constant.Float64)
-	case constant.IsInt:
-		n := int(constant.Int64)
-		if int64(n) != constant.Int64 {
-			s.errorf("%s overflows int", constant.Text)
-		}
-		return reflect.ValueOf(n)
-	case constant.IsUint:
-		s.errorf("%s overflows int", constant.Text)
+// evalDefined evaluates the expression n, which must not be missing.
+func (s *state) evalDefined(n parse.Node) reflect.Value {
+	val := s.evalExpr(n)
+	if v, isNil := indirect(val); !v.IsValid() || isNil {
+		s.missing(n)
 	}
-	return zero
+	return val
 }
 
-func isHexConstant(s string) bool {
-	return len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X')
+// evalString evaluates the expression n, which must be a string.
+func (s *state) evalString(n parse.Node) string {
+	v := s.evalDefined(n)
+	val, _ := indirect(s.unwrap(v, stringKind))
+	if val.Kind() != reflect.String {
+		s.at(n)
+		s.errorf("expected a string, but %s has evaluated to %s", n, s.describe(v))
+	}
+	return val.String()
 }
 
-// evalFieldChain evaluates .X.Y.Z possibly followed by arguments.
-// dot is the environment in which to evaluate arguments, while
-// receiver is the value being walked along the chain.
-func (s *state) evalFieldChain(dot, receiver reflect.Value, node parse.Node, ident []string, args []parse.Node, final reflect.Value) reflect.Value {
-	n := len(ident)
-	for i := 0; i < n-1; i++ {
-		receiver = s.evalField(dot, ident[i], node, nil, zero, receiver)
+// evalOptional evaluates the operand of the default value and missing value
+// test operators. Any missing value on the way, such as the map holding a
+// missing key, makes the result missing rather than an error.
+func (s *state) evalOptional(n parse.Node) (val reflect.Value) {
+	switch n := n.(type) {
+	case *parse.ExpressionNode:
+		if n.Operator == "." {
+			recv, isNil := indirect(s.evalOptional(n.Nodes[0]))
+			if !recv.IsValid() || isNil {
+				return zero
+			}
+			return s.member(recv, n.Nodes[1].(*parse.IdentifierNode).Ident)
+		}
+	case *parse.IndexNode:
+		recv, isNil := indirect(s.evalOptional(n.Expr))
+		if !recv.IsValid() || isNil {
+			return zero
+		}
 	}
-	// Now if it's a method, it gets the arguments.
-	return s.evalField(dot, ident[n-1], node, args, final, receiver)
+	val, isNil := indirect(s.evalExpr(n))
+	if isNil {
+		return zero
+	}
+	return val
 }
 
-func (s *state) evalFunction(dot reflect.Value, node *parse.IdentifierNode, cmd parse.Node, args []parse.Node, final reflect.Value) reflect.Value {
-	s.at(node)
-	name := node.Ident
-	function, ok := findFunction(name, s.tmpl)
-	if !ok {
-		s.errorf("%q is not a defined function", name)
+// lookup returns the value of the variable name: a local variable, a macro,
+// a top-level variable of the data model or a function, in this order.
+func (s *state) lookup(name string) reflect.Value {
+	if val, ok := s.varValue(name); ok {
+		return val
 	}
-	return s.evalCall(dot, function, cmd, name, args, final)
+	if val, ok := s.ns[name]; ok {
+		return val
+	}
+	if root, isNil := indirect(s.root); root.IsValid() && !isNil {
+		if val := s.member(root, name); val.IsValid() {
+			return val
+		}
+	}
+	if fn, ok := findFunction(name, s.tmpl); ok {
+		if name == "call" && !s.canCallFuncs() && fn.Pointer() == builtinFuncs["call"].Pointer() {
+			return reflect.ValueOf(disabledFunc{fn.Type()})
+		}
+		return fn
+	}
+	return zero
 }
 
-// evalField evaluates an expression like (.Field) or (.Field arg1 arg2).
-// The 'final' argument represents the return value from the preceding
-// value of the pipeline, if any.
-func (s *state) evalField(dot reflect.Value, fieldName string, node parse.Node, args []parse.Node, final, receiver reflect.Value) reflect.Value {
-	if !receiver.IsValid() {
-		//		if s.tmpl.option.missingKey == mapError { // Treat invalid value as missing map key.
-		//			s.errorf("nil data; no entry for key %q", fieldName)
-		//		}
-		return zero
+// member returns the member name of the hash receiver: the member of a
+// HashModel, a method, a field of a struct or an entry of a map with string
+// keys. It returns the zero Value if there is no such member.
+func (s *state) member(receiver reflect.Value, name string) reflect.Value {
+	if m, ok := modelOf(receiver).(HashModel); ok {
+		return s.getKey(m, name)
 	}
-	typ := receiver.Type()
 	receiver, isNil := indirect(receiver)
-	// Unless it's an interface, need to get to a value of type *T to guarantee
-	// we see all methods of T and *T.
-	ptr := receiver
-	if ptr.Kind() != reflect.Interface && ptr.CanAddr() {
-		ptr = ptr.Addr()
-	}
-	if method := ptr.MethodByName(fieldName); method.IsValid() {
-		return s.evalCall(dot, method, node, fieldName, args, final)
-	}
-	hasArgs := len(args) > 1 || final.IsValid()
-	// It's not a method; must be a field of a struct or an element of a map.
-	switch receiver.Kind() {
-	case reflect.Struct:
-		tField, ok := receiver.Type().FieldByName(fieldName)
-		if ok {
-			if isNil {
-				s.errorf("nil pointer evaluating %s.%s", typ, fieldName)
-			}
-			field := receiver.FieldByIndex(tField.Index)
-			if tField.PkgPath != "" { // field is unexported
-				s.errorf("%s is an unexported field of struct type %s", fieldName, typ)
-			}
-			// If it's a function, we must call it.
-			if hasArgs {
-				s.errorf("%s has arguments but cannot be invoked as function", fieldName)
-			}
-			return field
+	if !receiver.IsValid() || isNil {
+		return zero
+	}
+	if v, ok := s.structMember(receiver, name); ok {
+		return v
+	}
+	if receiver.Kind() == reflect.Map {
+		if keyType := receiver.Type().Key(); keyType.Kind() == reflect.String {
+			return s.wrap(receiver.MapIndex(reflect.ValueOf(name).Convert(keyType)))
 		}
-	case reflect.Map:
-		if isNil {
-			s.errorf("nil pointer evaluating %s.%s", typ, fieldName)
+	}
+	return zero
+}
+
+// evalOperator evaluates a unary or binary operator, or the access to a
+// member with a dot.
+func (s *state) evalOperator(n *parse.ExpressionNode) reflect.Value {
+	if len(n.Nodes) == 1 {
+		x := s.evalDefined(n.Nodes[0])
+		s.at(n)
+		switch n.Operator {
+		case "!":
+			return reflect.ValueOf(!s.truth(n.Nodes[0], x))
+		case "-":
+			return s.arith(n, "-", reflect.ValueOf(0), x)
+		case "+":
+			return s.arith(n, "+", reflect.ValueOf(0), x)
 		}
-		// If it's a map, attempt to use the field name as a key.
-		nameVal := reflect.ValueOf(fieldName)
-		if nameVal.Type().AssignableTo(receiver.Type().Key()) {
-			if hasArgs {
-				s.errorf("%s is not a method but has arguments", fieldName)
-			}
-			result := receiver.MapIndex(nameVal)
-			if !result.IsValid() {
-				//				switch s.tmpl.option.missingKey {
-				//				case mapInvalid:
-				//					// Just use the invalid value.
-				//				case mapZeroValue:
-				//					result = reflect.Zero(receiver.Type().Elem())
-				//				case mapError:
-				//					s.errorf("map has no entry for key %q", fieldName)
-				//				}
+		s.errorf("unknown operator %s", n.Operator)
+	}
+
+	switch n.Operator {
+	case ".":
+		recv, isNil := indirect(s.evalExpr(n.Nodes[0]))
+		if !recv.IsValid() || isNil {
+			s.missing(n.Nodes[0])
+		}
+		s.at(n)
+		switch recv.Kind() {
+		case reflect.Map, reflect.Struct:
+		default:
+			if _, ok := modelOf(recv).(HashModel); !ok && recv.NumMethod() == 0 {
+				s.errorf("can't get member of %s, which is %s", n.Nodes[0], recv.Type())
 			}
-			return result
 		}
+		return s.member(recv, n.Nodes[1].(*parse.IdentifierNode).Ident)
+	case "&&":
+		if !s.truth(n.Nodes[0], s.evalExpr(n.Nodes[0])) {
+			return reflect.ValueOf(false)
+		}
+		return reflect.ValueOf(s.truth(n.Nodes[1], s.evalExpr(n.Nodes[1])))
+	case "||":
+		if s.truth(n.Nodes[0], s.evalExpr(n.Nodes[0])) {
+			return reflect.ValueOf(true)
+		}
+		return reflect.ValueOf(s.truth(n.Nodes[1], s.evalExpr(n.Nodes[1])))
 	}
-	s.errorf("can't evaluate field %s in type %s", fieldName, typ)
+
+	x := s.evalDefined(n.Nodes[0])
+	y := s.evalDefined(n.Nodes[1])
+	s.at(n)
+	switch n.Operator {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return reflect.ValueOf(s.compare(n, n.Operator, x, y))
+	case "+":
+		return s.add(n, x, y)
+	case "-", "*", "/", "%":
+		return s.arith(n, n.Operator, x, y)
+	}
+	s.errorf("unknown operator %s", n.Operator)
 	panic("not reached")
 }
 
-var (
-	errorType        = reflect.TypeOf((*error)(nil)).Elem()
-	fmtStringerType  = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
-	reflectValueType = reflect.TypeOf((*reflect.Value)(nil)).Elem()
-)
+// compare evaluates the comparison x op y. Numbers compare by value
+// regardless of their type, strings and booleans only for equality.
+func (s *state) compare(n parse.Node, op string, x, y reflect.Value) bool {
+	// A model is compared as the kind of the other operand, if it can.
+	ky, _ := basicKind(indirectInterface(y))
+	x, _ = indirect(s.unwrap(x, ky))
+	kx, _ := basicKind(x)
+	y, _ = indirect(s.unwrap(y, kx))
+	ky, _ = basicKind(y)
+	var c int
+	tx, _, xIsDate := s.asDate(x)
+	ty, _, yIsDate := s.asDate(y)
+	switch {
+	case xIsDate && yIsDate:
+		c = compareTime(tx, ty)
+	case isNumberKind(kx) && isNumberKind(ky):
+		c = compareNumbers(x, y)
+	case kx != ky || kx == invalidKind || kx == complexKind:
+		s.errorf("can't compare %s with %s", s.describe(x), s.describe(y))
+	case op != "==" && op != "!=":
+		s.errorf("can't use operator %s on %s", op, s.describe(x))
+	case kx == stringKind:
+		c = strings.Compare(x.String(), y.String())
+	case kx == boolKind:
+		if x.Bool() != y.Bool() {
+			c = 1
+		}
+	}
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func isNumberKind(k kind) bool {
+	return k == intKind || k == uintKind || k == floatKind || k == bigKind
+}
 
-// evalCall executes a function or method call. If it's a method, fun already has the receiver bound, so
-// it looks just like a function call. The arg list, if non-nil, includes (in the manner of the shell), arg[0]
-// as the function itself.
-func (s *state) evalCall(dot, fun reflect.Value, node parse.Node, name string, args []parse.Node, final reflect.Value) reflect.Value {
-	if args != nil {
-		args = args[1:] // Zeroth arg is function name/node; not passed to function.
+// compareNumbers returns -1, 0 or +1 as the number x is less than, equal
+// to or greater than the number y.
+func compareNumbers(x, y reflect.Value) int {
+	kx, _ := basicKind(x)
+	ky, _ := basicKind(y)
+	switch {
+	case kx == intKind && ky == intKind:
+		return compareInt64(x.Int(), y.Int())
+	case kx == uintKind && ky == uintKind:
+		return compareUint64(x.Uint(), y.Uint())
+	case kx == intKind && ky == uintKind:
+		if x.Int() < 0 {
+			return -1
+		}
+		return compareUint64(uint64(x.Int()), y.Uint())
+	case kx == uintKind && ky == intKind:
+		if y.Int() < 0 {
+			return 1
+		}
+		return compareUint64(x.Uint(), uint64(y.Int()))
+	case kx == bigKind || ky == bigKind:
+		rx, okx := toRat(x)
+		ry, oky := toRat(y)
+		if okx && oky {
+			return rx.Cmp(ry)
+		}
 	}
-	typ := fun.Type()
-	numIn := len(args)
-	if final.IsValid() {
-		numIn++
+	fx, fy := toFloat(x), toFloat(y)
+	switch {
+	case fx < fy:
+		return -1
+	case fx > fy:
+		return 1
 	}
-	numFixed := len(args)
-	if typ.IsVariadic() {
-		numFixed = typ.NumIn() - 1 // last arg is the variadic one.
-		if numIn < numFixed {
-			s.errorf("wrong number of args for %s: want at least %d got %d", name, typ.NumIn()-1, len(args))
+	return 0
+}
+
+func compareInt64(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func compareUint64(x, y uint64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch k, _ := basicKind(v); k {
+	case intKind:
+		return float64(v.Int())
+	case uintKind:
+		return float64(v.Uint())
+	case bigKind:
+		return bigToFloat(v)
+	}
+	return v.Float()
+}
+
+// add evaluates x + y: the sum of numbers, or the concatenation of strings,
+// sequences or hashes. A number added to a string is converted to a string.
+func (s *state) add(n parse.Node, x, y reflect.Value) reflect.Value {
+	x, _ = indirect(s.unwrap(x, invalidKind))
+	y, _ = indirect(s.unwrap(y, invalidKind))
+	mx, xIsMarkup := asMarkup(x)
+	my, yIsMarkup := asMarkup(y)
+	switch {
+	case xIsMarkup && yIsMarkup:
+		if mx.format != my.format {
+			s.errorf("can't add %s markup and %s markup", mx.format, my.format)
 		}
-	} else if numIn < typ.NumIn()-1 || !typ.IsVariadic() && numIn != typ.NumIn() {
-		s.errorf("wrong number of args for %s: want %d got %d", name, typ.NumIn(), len(args))
+		return reflect.ValueOf(markupOutput{mx.format, mx.text + my.text})
+	case xIsMarkup:
+		return reflect.ValueOf(markupOutput{mx.format, mx.text + outputFormats[mx.format](s.toString(n, y))})
+	case yIsMarkup:
+		return reflect.ValueOf(markupOutput{my.format, outputFormats[my.format](s.toString(n, x)) + my.text})
+	case x.Kind() == reflect.String || y.Kind() == reflect.String:
+		return reflect.ValueOf(s.toString(n, x) + s.toString(n, y))
 	}
-	if !goodFunc(typ) {
-		// TODO: This could still be a confusing error; maybe goodFunc should provide info.
-		s.errorf("can't call method/function %q with %d results", name, typ.NumOut())
+	if qx, ok := s.asSeq(x); ok {
+		if qy, ok := s.asSeq(y); ok {
+			items := make([]interface{}, 0, qx.len()+qy.len())
+			for _, q := range []seq{qx, qy} {
+				for i := 0; i < q.len(); i++ {
+					items = append(items, interfaceOf(q.raw(i)))
+				}
+			}
+			return reflect.ValueOf(items)
+		}
 	}
-	// Build the arg list.
-	argv := make([]reflect.Value, numIn)
-	// Args must be evaluated. Fixed args first.
-	i := 0
-	for ; i < numFixed && i < len(args); i++ {
-		argv[i] = s.evalArg(dot, typ.In(i), args[i])
+	if kx, vx, ok := s.hashKeys(x); ok {
+		if ky, vy, ok := s.hashKeys(y); ok {
+			// The keys of y come after those of x, except those x has,
+			// whose value y overrides.
+			hash := NewOrderedHash()
+			for i, key := range kx {
+				hash.Set(key, interfaceOf(vx(i)))
+			}
+			for i, key := range ky {
+				hash.Set(key, interfaceOf(vy(i)))
+			}
+			return reflect.ValueOf(hash)
+		}
 	}
-	// Now the ... args.
-	if typ.IsVariadic() {
-		argType := typ.In(typ.NumIn() - 1).Elem() // Argument is a slice.
-		for ; i < len(args); i++ {
-			argv[i] = s.evalArg(dot, argType, args[i])
-		}
-	}
-	// Add final value if necessary.
-	if final.IsValid() {
-		t := typ.In(typ.NumIn() - 1)
-		if typ.IsVariadic() {
-			if numIn-1 < numFixed {
-				// The added final argument corresponds to a fixed parameter of the function.
-				// Validate against the type of the actual parameter.
-				t = typ.In(numIn - 1)
-			} else {
-				// The added final argument corresponds to the variadic part.
-				// Validate against the type of the elements of the variadic slice.
-				t = t.Elem()
+	return s.arith(n, "+", x, y)
+}
+
+func isSequence(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+}
+
+// A valueType is the set of the types of template values a value is of,
+// which are independent of how the value is given: a Go string and a
+// ScalarModel are both strings. A value may be of several types, such as a
+// struct with a String method, which is both a hash and a string.
+type valueType uint
+
+const (
+	typeString valueType = 1 << iota
+	typeNumber
+	typeBoolean
+	typeDate
+	typeSequence
+	typeCollection // listable, but not by index
+	typeHash
+	typeHashEx // a hash whose keys can be listed
+	typeMethod
+	typeMacro
+	typeMarkup // markup output, such as ?html gives with the HTML output format
+)
+
+var valueTypeNames = []struct {
+	typ  valueType
+	name string
+}{
+	{typeString, "string"},
+	{typeNumber, "number"},
+	{typeBoolean, "boolean"},
+	{typeDate, "date"},
+	{typeSequence, "sequence"},
+	{typeCollection, "collection"},
+	{typeHashEx, "extended hash"},
+	{typeHash, "hash"},
+	{typeMethod, "method"},
+	{typeMacro, "macro"},
+	{typeMarkup, "markup output"},
+}
+
+// String returns the types with an article, as in "a string+hash".
+func (t valueType) String() string {
+	var names []string
+	for _, n := range valueTypeNames {
+		if t&n.typ != 0 && (n.typ != typeHash || t&typeHashEx == 0) {
+			names = append(names, n.name)
+		}
+	}
+	str := strings.Join(names, "+")
+	switch {
+	case str == "":
+		return "a value of no known type"
+	case strings.ContainsRune("aeiou", rune(str[0])):
+		return "an " + str
+	}
+	return "a " + str
+}
+
+// typeOf returns the types of the value v, or 0 if it is missing or of no
+// type templates know.
+func (s *state) typeOf(v reflect.Value) valueType {
+	v = indirectInterface(v)
+	if !v.IsValid() {
+		return 0
+	}
+	switch v.Type() {
+	case macroType, macroType.Elem():
+		return typeMacro
+	case disabledFuncType:
+		return typeMethod
+	case markupType:
+		return typeMarkup
+	}
+	var t valueType
+	if m := modelOf(v); m != nil {
+		for _, mt := range modelTypes {
+			if reflect.TypeOf(m).Implements(mt.iface) {
+				t |= mt.typ
 			}
 		}
-		argv[i] = s.validateType(final, t)
+		if t != 0 {
+			return t
+		}
 	}
-	result := fun.Call(argv)
-	// If we have an error that is not nil, stop execution and return that error to the caller.
-	if len(result) == 2 && !result[1].IsNil() {
-		s.at(node)
-		s.errorf("error calling %s: %s", name, result[1].Interface().(error))
+	v, isNil := indirect(v)
+	if isNil {
+		return 0
 	}
-	v := result[0]
-	if v.Type() == reflectValueType {
-		v = v.Interface().(reflect.Value)
+	if v.Type() == timeType {
+		return typeDate
 	}
-	return v
+	switch k, _ := basicKind(v); {
+	case k == stringKind:
+		return typeString
+	case isNumberKind(k):
+		return typeNumber
+	case k == boolKind:
+		return typeBoolean
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		t = typeSequence
+	case reflect.Map, reflect.Struct:
+		t = typeHash | typeHashEx
+	case reflect.Func:
+		t = typeMethod
+	}
+	if v.CanInterface() {
+		// Values with a String or Error method print as strings.
+		switch iface, _ := printableValue(v); iface.(type) {
+		case fmt.Stringer, error:
+			t |= typeString
+		}
+	}
+	return t
 }
 
-// canBeNil reports whether an untyped nil can be assigned to the type. See reflect.Zero.
-func canBeNil(typ reflect.Type) bool {
-	switch typ.Kind() {
-	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
-		return true
-	case reflect.Struct:
-		return typ == reflectValueType
+// modelTypes are the types of the values implementing the model interfaces.
+var modelTypes = []struct {
+	iface reflect.Type
+	typ   valueType
+}{
+	{reflect.TypeOf((*ScalarModel)(nil)).Elem(), typeString},
+	{reflect.TypeOf((*NumberModel)(nil)).Elem(), typeNumber},
+	{reflect.TypeOf((*BooleanModel)(nil)).Elem(), typeBoolean},
+	{reflect.TypeOf((*DateModel)(nil)).Elem(), typeDate},
+	{reflect.TypeOf((*SequenceModel)(nil)).Elem(), typeSequence},
+	{reflect.TypeOf((*CollectionModel)(nil)).Elem(), typeCollection},
+	{reflect.TypeOf((*HashModel)(nil)).Elem(), typeHash},
+	{reflect.TypeOf((*HashModelEx)(nil)).Elem(), typeHashEx},
+	{reflect.TypeOf((*MethodModel)(nil)).Elem(), typeMethod},
+}
+
+// describe describes the value v in an error message: by its types, as in
+// "a sequence", or else by its Go type.
+func (s *state) describe(v reflect.Value) string {
+	if t := s.typeOf(v); t != 0 {
+		return t.String()
 	}
-	return false
+	if v, isNil := indirect(v); v.IsValid() && !isNil {
+		return "a value of type " + v.Type().String()
+	}
+	return "missing"
 }
 
-// validateType guarantees that the value is valid and assignable to the type.
-func (s *state) validateType(value reflect.Value, typ reflect.Type) reflect.Value {
-	if !value.IsValid() {
-		if typ == nil || canBeNil(typ) {
-			// An untyped nil interface{}. Accept as a proper nil value.
-			return reflect.Zero(typ)
+// arith evaluates the arithmetic operation x op y on numbers with the
+// arithmetic engine. Integer operands give an integer result, unless a
+// division has a remainder.
+func (s *state) arith(n parse.Node, op string, x, y reflect.Value) reflect.Value {
+	x, _ = indirect(s.unwrap(x, floatKind))
+	y, _ = indirect(s.unwrap(y, floatKind))
+	kx, _ := basicKind(x)
+	ky, _ := basicKind(y)
+	if !isNumberKind(kx) || !isNumberKind(ky) {
+		s.errorf("operator %s needs numbers, but got %s and %s", op, s.describe(x), s.describe(y))
+	}
+	conservative := s.settings.arithmetic == conservativeEngine && kx != bigKind && ky != bigKind
+	if isInt64(x) && isInt64(y) {
+		if r, ok := s.intArith(op, toInt64(x), toInt64(y)); ok {
+			return reflect.ValueOf(r)
 		}
-		s.errorf("invalid value; expected %s", typ)
+		// An integer overflowing is computed with exactly by both engines.
+		conservative = conservative && op == "/"
 	}
-	if typ == reflectValueType && value.Type() != typ {
-		return reflect.ValueOf(value)
+	if conservative {
+		return s.floatArith(op, toFloat(x), toFloat(y))
 	}
-	if typ != nil && !value.Type().AssignableTo(typ) {
-		if value.Kind() == reflect.Interface && !value.IsNil() {
-			value = value.Elem()
-			if value.Type().AssignableTo(typ) {
-				return value
-			}
-			// fallthrough
+	return s.exactArith(op, x, y)
+}
+
+func toInt64(v reflect.Value) int64 {
+	if k, _ := basicKind(v); k == uintKind {
+		return int64(v.Uint())
+	}
+	return v.Int()
+}
+
+// evalIndex evaluates seq[i], string[i], hash[key] or a slice with a range
+// as the index, such as seq[1..3].
+func (s *state) evalIndex(n *parse.IndexNode) reflect.Value {
+	recv, isNil := indirect(s.evalExpr(n.Expr))
+	if !recv.IsValid() || isNil {
+		s.missing(n.Expr)
+	}
+	if r, ok := n.Index.(*parse.RangeNode); ok {
+		return s.slice(n, recv, r)
+	}
+	index, _ := indirect(s.evalDefined(n.Index))
+	s.at(n)
+	index = s.unwrap(index, invalidKind)
+	k, _ := basicKind(index)
+	m := modelOf(recv)
+	switch {
+	case k == stringKind:
+		if _, ok := m.(HashModel); !ok && recv.Kind() != reflect.Map && recv.Kind() != reflect.Struct {
+			s.errorf("can't get key %q of %s, which is %s", index.String(), n.Expr, recv.Type())
+		}
+		return s.member(recv, index.String())
+	case k == intKind || k == uintKind:
+		i := int(toInt64(index))
+		if m, ok := m.(SequenceModel); ok {
+			return s.seqIndex(m, i)
 		}
-		// Does one dereference or indirection work? We could do more, as we
-		// do with method receivers, but that gets messy and method receivers
-		// are much more constrained, so it makes more sense there than here.
-		// Besides, one is almost always all you need.
 		switch {
-		case value.Kind() == reflect.Ptr && value.Type().Elem().AssignableTo(typ):
-			value = value.Elem()
-			if !value.IsValid() {
-				s.errorf("dereference of nil pointer of type %s", typ)
+		case recv.Kind() == reflect.String:
+			runes := []rune(recv.String())
+			if i < 0 || i >= len(runes) {
+				s.errorf("index %d is out of bounds for a string of length %d", i, len(runes))
 			}
-		case reflect.PtrTo(value.Type()).AssignableTo(typ) && value.CanAddr():
-			value = value.Addr()
-		default:
-			s.errorf("wrong type for value; expected %s; got %s", typ, value.Type())
+			return reflect.ValueOf(string(runes[i]))
+		case isSequence(recv):
+			if i < 0 || i >= recv.Len() {
+				return zero
+			}
+			return s.wrap(recv.Index(i))
 		}
+		s.errorf("can't index %s, which is %s", n.Expr, recv.Type())
 	}
-	return value
+	s.errorf("can't index with %s, which is %s", n.Index, index.Type())
+	panic("not reached")
 }
 
-func (s *state) evalArg(dot reflect.Value, typ reflect.Type, n parse.Node) reflect.Value {
+// slice evaluates seq[range] or string[range].
+func (s *state) slice(n *parse.IndexNode, recv reflect.Value, r *parse.RangeNode) reflect.Value {
+	length := 0
+	m, isModel := modelOf(recv).(SequenceModel)
+	switch {
+	case isModel:
+		length = s.seqLen(m)
+	case recv.Kind() == reflect.String:
+		length = utf8.RuneCountInString(recv.String())
+	case isSequence(recv):
+		length = recv.Len()
+	default:
+		s.errorf("can't slice %s, which is %s", n.Expr, recv.Type())
+	}
+	from, to := s.rangeBounds(r, length)
 	s.at(n)
-	switch arg := n.(type) {
-	//	case *parse.DotNode:
-	//		return s.validateType(dot, typ)
-	case *parse.NilNode:
-		if canBeNil(typ) {
-			return reflect.Zero(typ)
+	if from < 0 || to > length || from > to {
+		s.errorf("range %s is out of bounds for length %d", r, length)
+	}
+	switch {
+	case isModel:
+		return reflect.ValueOf(slicedSeq{m, from, to})
+	case recv.Kind() == reflect.String:
+		return reflect.ValueOf(string([]rune(recv.String())[from:to]))
+	}
+	return recv.Slice(from, to)
+}
+
+// rangeBounds returns the start and the exclusive end of the ascending range
+// r. A right-unbounded range ends at length.
+func (s *state) rangeBounds(r *parse.RangeNode, length int) (from, to int) {
+	from = s.evalInt(r.From)
+	switch {
+	case r.To == nil:
+		to = length
+	case r.Operator == "..*":
+		to = from + s.evalInt(r.To)
+	case r.Operator == "..":
+		to = s.evalInt(r.To) + 1
+	default:
+		to = s.evalInt(r.To)
+	}
+	return from, to
+}
+
+// evalRange evaluates a range to the sequence of its numbers. As in
+// FreeMarker, a range whose end is before its start is descending.
+func (s *state) evalRange(r *parse.RangeNode) reflect.Value {
+	from, step, count := s.rangeSteps(r)
+	return reflect.ValueOf(rangeSeq{from, step, count})
+}
+
+// rangeSeq is the sequence of the numbers of a range. Its numbers are
+// computed when they are got, so a long range takes no memory.
+type rangeSeq struct {
+	from, step, count int
+}
+
+func (r rangeSeq) Len() (int, error) { return r.count, nil }
+
+func (r rangeSeq) Index(i int) (interface{}, error) { return r.from + i*r.step, nil }
+
+// slicedSeq is the part of a sequence model from an index to another.
+type slicedSeq struct {
+	m        SequenceModel
+	from, to int
+}
+
+func (r slicedSeq) Len() (int, error) { return r.to - r.from, nil }
+
+func (r slicedSeq) Index(i int) (interface{}, error) { return r.m.Index(r.from + i) }
+
+// rangeSteps evaluates the bounds of the range r, returning its first
+// element, the difference between consecutive elements and its length.
+func (s *state) rangeSteps(r *parse.RangeNode) (from, step, count int) {
+	if r.To == nil {
+		s.errorf("a right-unbounded range can only be used for slicing")
+	}
+	from, to := s.evalInt(r.From), s.evalInt(r.To)
+	step = 1
+	switch r.Operator {
+	case "..":
+		if to < from {
+			step = -1
 		}
-		s.errorf("cannot assign nil to %s", typ)
-		//	case *parse.FieldNode:
-		//		return s.validateType(s.evalFieldNode(dot, arg, []parse.Node{n}, zero), typ)
-	case *parse.IdentifierNode:
-		return s.validateType(s.evalFunction(dot, arg, arg, nil, zero), typ)
+		count = (to-from)*step + 1
+	case "..*":
+		if to < 0 {
+			step = -1
+		}
+		count = to * step
+	default:
+		if to < from {
+			step = -1
+		}
+		count = (to - from) * step
 	}
-	switch typ.Kind() {
-	case reflect.Bool:
-		return s.evalBool(typ, n)
-	case reflect.Complex64, reflect.Complex128:
-		return s.evalComplex(typ, n)
-	case reflect.Float32, reflect.Float64:
-		return s.evalFloat(typ, n)
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return s.evalInteger(typ, n)
-	case reflect.Interface:
-		if typ.NumMethod() == 0 {
-			return s.evalEmptyInterface(dot, n)
+	return from, step, count
+}
+
+// evalInt evaluates the expression n, which must be an integer.
+func (s *state) evalInt(n parse.Node) int {
+	val, _ := indirect(s.unwrap(s.evalDefined(n), intKind))
+	switch k, _ := basicKind(val); k {
+	case intKind, uintKind:
+		return int(toInt64(val))
+	case floatKind:
+		if f := val.Float(); f == float64(int(f)) {
+			return int(f)
 		}
-	case reflect.Struct:
-		if typ == reflectValueType {
-			return reflect.ValueOf(s.evalEmptyInterface(dot, n))
+	case bigKind:
+		if r, ok := toRat(val); ok && r.IsInt() && r.Num().IsInt64() && int64(int(r.Num().Int64())) == r.Num().Int64() {
+			return int(r.Num().Int64())
 		}
-	case reflect.String:
-		return s.evalString(typ, n)
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		return s.evalUnsignedInteger(typ, n)
 	}
-	s.errorf("can't handle %s for arg of type %s", n, typ)
+	s.at(n)
+	s.errorf("expected an integer, but %s has evaluated to %v", n, val)
 	panic("not reached")
 }
 
-func (s *state) evalBool(typ reflect.Type, n parse.Node) reflect.Value {
-	s.at(n)
-	if n, ok := n.(*parse.BoolNode); ok {
-		value := reflect.New(typ).Elem()
-		value.SetBool(n.True)
-		return value
+// specialVar returns the value of a special variable, such as .now.
+func (s *state) specialVar(n *parse.SpecialVarNode) reflect.Value {
+	switch n.Name {
+	case "now":
+		return reflect.ValueOf(dateValue{time.Now(), DateTime})
+	case "data_model":
+		return s.root
+	case "current_template_name":
+		return reflect.ValueOf(s.tmpl.Name())
+	case "main_template_name":
+		return reflect.ValueOf(s.main.Name())
+	case "locale":
+		return reflect.ValueOf(s.settings.localeData().tag)
+	case "lang":
+		return reflect.ValueOf(s.settings.localeData().language())
+	case "output_encoding":
+		if s.settings.outputEncoding == "" {
+			return reflect.Value{}
+		}
+		return reflect.ValueOf(s.settings.outputEncoding)
+	case "url_escaping_charset":
+		return reflect.ValueOf(s.settings.urlEscapingCharset())
+	case "output_format":
+		return reflect.ValueOf(s.settings.outputFormatName())
+	case "error":
+		if len(s.errs) == 0 {
+			s.errorf(".error can only be used inside <#recover>")
+		}
+		return reflect.ValueOf(s.errs[len(s.errs)-1].Err.Error())
 	}
-	s.errorf("expected bool; found %s", n)
+	s.errorf("unknown special variable .%s", n.Name)
 	panic("not reached")
 }
 
-func (s *state) evalString(typ reflect.Type, n parse.Node) reflect.Value {
-	s.at(n)
-	if n, ok := n.(*parse.StringNode); ok {
-		value := reflect.New(typ).Elem()
-		value.SetString(n.Text)
-		return value
+// idealConstant returns the value of the number literal constant: an int
+// if it is an integer that fits, otherwise a float for the conservative
+// arithmetic engine, and the exact value for the bigdecimal one.
+func (s *state) idealConstant(constant *parse.NumberNode) reflect.Value {
+	s.at(constant)
+	if constant.IsInt && int64(int(constant.Int64)) == constant.Int64 {
+		return reflect.ValueOf(int(constant.Int64))
 	}
-	s.errorf("expected string; found %s", n)
-	panic("not reached")
+	if s.settings.arithmetic == conservativeEngine {
+		if constant.Rat.IsInt() {
+			s.errorf("%s overflows int", constant.Text)
+		}
+		return reflect.ValueOf(constant.Float64)
+	}
+	return ratValue(constant.Rat)
 }
 
-func (s *state) evalInteger(typ reflect.Type, n parse.Node) reflect.Value {
+var (
+	errorType        = reflect.TypeOf((*error)(nil)).Elem()
+	fmtStringerType  = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	reflectValueType = reflect.TypeOf((*reflect.Value)(nil)).Elem()
+)
+
+// evalCall evaluates a call of a function or method, f(args).
+func (s *state) evalCall(n *parse.CallNode) reflect.Value {
+	fn := s.evalDefined(n.Func)
+	args := make([]reflect.Value, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = s.evalExpr(arg)
+	}
 	s.at(n)
-	if n, ok := n.(*parse.NumberNode); ok && n.IsInt {
-		value := reflect.New(typ).Elem()
-		value.SetInt(n.Int64)
-		return value
+	return s.callFunc(fn, n.Func.String(), args)
+}
+
+// callFunc calls fn, the value of the expression name, which must be a
+// function or a method model.
+func (s *state) callFunc(fn reflect.Value, name string, args []reflect.Value) reflect.Value {
+	if fn.Type() == macroType {
+		s.errorf("%s is a macro; call it as <@%s .../>", name, name)
 	}
-	s.errorf("expected integer; found %s", n)
-	panic("not reached")
+	if m, ok := modelOf(fn).(MethodModel); ok {
+		return s.callMethod(m, name, args)
+	}
+	if fn.Type() == disabledFuncType {
+		s.errorf("can't call %s: the member access policy doesn't allow calling func values", name)
+	}
+	return s.call(fn, name, args)
 }
 
-func (s *state) evalUnsignedInteger(typ reflect.Type, n parse.Node) reflect.Value {
-	s.at(n)
-	if n, ok := n.(*parse.NumberNode); ok && n.IsUint {
-		value := reflect.New(typ).Elem()
-		value.SetUint(n.Uint64)
-		return value
+// call executes a function or method call. If it's a method, fun already
+// has the receiver bound, so it looks just like a function call.
+func (s *state) call(fun reflect.Value, name string, args []reflect.Value) reflect.Value {
+	fun = indirectInterface(fun)
+	if fun.Kind() != reflect.Func {
+		s.errorf("%s is not a function, but %s", name, fun.Type())
 	}
-	s.errorf("expected unsigned integer; found %s", n)
-	panic("not reached")
+	typ := fun.Type()
+	numIn := typ.NumIn()
+	numFixed := numIn
+	if typ.IsVariadic() {
+		numFixed = numIn - 1 // last arg is the variadic one.
+		if len(args) < numFixed {
+			s.errorf("wrong number of args for %s: want at least %d got %d", name, numFixed, len(args))
+		}
+	} else if len(args) != numIn {
+		s.errorf("wrong number of args for %s: want %d got %d", name, numIn, len(args))
+	}
+	if !goodFunc(typ) {
+		// TODO: This could still be a confusing error; maybe goodFunc should provide info.
+		s.errorf("can't call method/function %q with %d results", name, typ.NumOut())
+	}
+	argv := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		argType := typ.In(min(i, numIn-1))
+		if i >= numFixed {
+			argType = argType.Elem()
+		}
+		argv[i] = s.convertArg(name, i, arg, argType)
+	}
+	result := fun.Call(argv)
+	// If we have an error that is not nil, stop execution and return that error to the caller.
+	if len(result) == 2 && !result[1].IsNil() {
+		s.errorf("error calling %s: %w", name, result[1].Interface().(error))
+	}
+	v := result[0]
+	if v.Type() == reflectValueType {
+		v = v.Interface().(reflect.Value)
+	}
+	return s.wrap(v)
 }
 
-func (s *state) evalFloat(typ reflect.Type, n parse.Node) reflect.Value {
-	s.at(n)
-	if n, ok := n.(*parse.NumberNode); ok && n.IsFloat {
-		value := reflect.New(typ).Elem()
-		value.SetFloat(n.Float64)
+// convertArg converts the ith argument of a call to the type of the
+// parameter. Numbers convert to any numeric type they fit in.
+func (s *state) convertArg(name string, i int, value reflect.Value, typ reflect.Type) reflect.Value {
+	if typ == reflectValueType {
+		return reflect.ValueOf(value)
+	}
+	if !value.IsValid() {
+		if canBeNil(typ) {
+			return reflect.Zero(typ)
+		}
+		s.errorf("arg %d of %s is missing; should be of type %s", i, name, typ)
+	}
+	if value.Type().AssignableTo(typ) {
 		return value
 	}
-	s.errorf("expected float; found %s", n)
+	if v := indirectInterface(value); v.IsValid() && v.Type().AssignableTo(typ) {
+		return v
+	}
+	if h, ok := interfaceOf(value).(*OrderedHash); ok && typ.Kind() == reflect.Map && typ.Key().Kind() == reflect.String {
+		// A hash literal passed for a map.
+		m := reflect.MakeMapWithSize(typ, len(h.keys))
+		for _, key := range h.keys {
+			v := s.convertArg(name, i, valueOf(h.values[key]), typ.Elem())
+			m.SetMapIndex(reflect.ValueOf(key).Convert(typ.Key()), v)
+		}
+		return m
+	}
+	k, _ := basicKind(value)
+	if k == bigKind {
+		// Pass a big number as the int or float it is.
+		r, _ := toRat(value)
+		if r != nil && r.IsInt() && r.Num().IsInt64() {
+			value = reflect.ValueOf(r.Num().Int64())
+		} else {
+			value = reflect.ValueOf(toFloat(value))
+		}
+		k, _ = basicKind(value)
+	}
+	if isNumberKind(k) && value.Type().ConvertibleTo(typ) {
+		switch typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if conv := value.Convert(typ); toFloat(conv) == toFloat(value) {
+				return conv
+			}
+		case reflect.Float32, reflect.Float64:
+			return value.Convert(typ)
+		}
+	}
+	s.errorf("arg %d of %s has type %s; should be %s", i, name, value.Type(), typ)
 	panic("not reached")
 }
 
-func (s *state) evalComplex(typ reflect.Type, n parse.Node) reflect.Value {
-	if n, ok := n.(*parse.NumberNode); ok && n.IsComplex {
-		value := reflect.New(typ).Elem()
-		value.SetComplex(n.Complex128)
-		return value
+func min(x, y int) int {
+	if x < y {
+		return x
 	}
-	s.errorf("expected complex; found %s", n)
-	panic("not reached")
+	return y
 }
 
-func (s *state) evalEmptyInterface(dot reflect.Value, n parse.Node) reflect.Value {
-	s.at(n)
-	switch n := n.(type) {
-	case *parse.BoolNode:
-		return reflect.ValueOf(n.True)
-		//	case *parse.DotNode:
-		//		return dot
-		//	case *parse.FieldNode:
-		//		return s.evalFieldNode(dot, n, nil, zero)
-	case *parse.IdentifierNode:
-		return s.evalFunction(dot, n, n, nil, zero)
-	case *parse.NilNode:
-		// NilNode is handled in evalArg, the only place that calls here.
-		s.errorf("evalEmptyInterface: nil (can't happen)")
-	case *parse.NumberNode:
-		return s.idealConstant(n)
-	case *parse.StringNode:
-		return reflect.ValueOf(n.Text)
-	case *parse.ExpressionNode:
-		return s.evalCommand(dot, n)
+// canBeNil reports whether an untyped nil can be assigned to the type. See reflect.Zero.
+func canBeNil(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return true
+	case reflect.Struct:
+		return typ == reflectValueType
 	}
-	s.errorf("can't handle assignment of %s to empty interface argument", n)
-	panic("not reached")
+	return false
 }
 
 // indirect returns the item at the end of indirection, and a bool to indicate if it's nil.
@@ -808,18 +1876,69 @@ func indirectInterface(v reflect.Value) reflect.Value {
 	return v.Elem()
 }
 
-// printValue writes the textual representation of the value to the output of
-// the template.
+// printValue writes the textual representation of the value of the
+// expression n to the output of the template.
 func (s *state) printValue(n parse.Node, v reflect.Value) {
 	s.at(n)
-	iface, ok := printableValue(v)
-	if !ok {
-		s.errorf("can't print %s of type %s", n, v.Type())
+	if m, ok := asMarkup(v); ok {
+		s.writeString(s.markupText(n, m))
+		return
 	}
-	_, err := fmt.Fprint(s.wr, iface)
-	if err != nil {
-		s.writeError(err)
+	str := s.toString(n, v)
+	if escape := outputFormats[s.settings.outputFormat]; escape != nil {
+		str = escape(str)
+	}
+	s.writeString(str)
+}
+
+// toString converts the value of the expression n to a string, as when it
+// is printed. Only strings, numbers, values with a String or Error method
+// and, if boolean_format is set, booleans can be converted.
+func (s *state) toString(n parse.Node, v reflect.Value) string {
+	if t, typ, ok := s.asDate(v); ok {
+		str, err := s.formatDate(t, typ, "")
+		if err != nil {
+			s.errorf("%w", err)
+		}
+		return str
+	}
+	v = indirectInterface(s.unwrap(v, stringKind))
+	if !v.IsValid() || v.Kind() == reflect.Ptr && v.IsNil() {
+		s.missing(n)
 	}
+	if !hasNoMethods(v.Type()) && !isBigType(v.Type()) {
+		iface, _ := printableValue(v)
+		switch iface := iface.(type) {
+		case fmt.Stringer:
+			s.checkMethod(v, "String")
+			return iface.String()
+		case error:
+			s.checkMethod(v, "Error")
+			return iface.Error()
+		}
+	}
+	v, _ = indirect(v)
+	switch k, _ := basicKind(v); k {
+	case stringKind:
+		return v.String()
+	case intKind, uintKind, floatKind, bigKind:
+		str, err := s.formatNumber(v, "")
+		if err != nil {
+			s.errorf("%w", err)
+		}
+		return str
+	case boolKind:
+		t, f, ok := s.settings.booleanStrings()
+		if !ok {
+			s.errorf("can't convert the boolean %s to string automatically; use ?c or ?string(\"yes\", \"no\"), or set boolean_format", n)
+		}
+		if v.Bool() {
+			return t
+		}
+		return f
+	}
+	s.errorf("expected a string, but %s has evaluated to %s", n, s.describe(v))
+	panic("not reached")
 }
 
 // printableValue returns the, possibly indirected, interface value inside v that
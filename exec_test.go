@@ -0,0 +1,287 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var debug = flag.Bool("debug", false, "show the errors produced by the tests")
+
+var errExec = errors.New("failed on purpose")
+
+type T struct {
+	Name  string
+	Items []string
+	Map   map[string]int
+	Ptr   *T
+}
+
+func (t *T) Greet(whom string) string {
+	return "Hi " + whom + ", I'm " + t.Name
+}
+
+func (t *T) Fail() (string, error) {
+	return "", errExec
+}
+
+var tVal = &T{
+	Name:  "Joe",
+	Items: []string{"a", "b", "c"},
+	Map:   map[string]int{"one": 1, "two": 2},
+}
+
+type execTest struct {
+	name   string
+	input  string
+	output string
+	data   interface{}
+	ok     bool
+}
+
+var execTests = []execTest{
+	{"empty", "", "", nil, true},
+	{"text", "some text", "some text", nil, true},
+	{"field", "${Name}", "Joe", tVal, true},
+	{"map key", "${Map.one} ${Map['two']}", "1 2", tVal, true},
+	{"method", "${Greet('Ann')}", "Hi Ann, I'm Joe", tVal, true},
+	{"arithmetic", "${1+2*3} ${(1+2)*3} ${7/2} ${7%3} ${-Map.one}", "7 9 3.5 1 -1", tVal, true},
+	{"concatenation", "${Name + '!'} ${'#' + 1}", "Joe! #1", tVal, true},
+	{"index", "${Items[1]} ${Name[0]} ${Items[1..2][0]} ${Name[1..]}", "b J b oe", tVal, true},
+	{"if", "<#if Name == 'Joe'>yes<#else>no</#if>", "yes", tVal, true},
+	{"elseif", "<#if Map.one gt 1>a<#elseif Map.one == 1>b<#else>c</#if>", "b", tVal, true},
+	{"and or not", "<#if !(Map.one == 1 && Map.two == 3) || false>yes</#if>", "yes", tVal, true},
+	{"list", "<#list Items as x>${x};</#list>", "a;b;c;", tVal, true},
+	{"list hash", "<#list Map as k, v>${k}=${v} </#list>", "one=1 two=2 ", tVal, true},
+	{"list else", "<#list [] as x>${x}<#else>none</#list>", "none", tVal, true},
+	{"list range", "<#list 1..3 as i>${i}</#list><#list 3..<1 as i>${i}</#list>", "12332", tVal, true},
+	{"default", "${missing!'d'} ${(Ptr.Name)!'none'} ${missing!}.", "d none .", tVal, true},
+	{"exists", "<#if missing??>yes<#else>no</#if>", "no", tVal, true},
+	{"macro", "<@m a=1/><#macro m a b=a+1>${a},${b}</#macro>", "1,2", tVal, true},
+	{"macro positional", "<#macro m a b>${a}${b}</#macro><@m 1, 2/>", "12", tVal, true},
+	{"macro catch-all", "<#macro m a rest...><#list rest as k, v>${k}${v}</#list></#macro><@m a=1 x=2/>", "x2", tVal, true},
+	{"nested", "<#macro m>[<#nested>]</#macro><#list Items as x><@m>${x}</@m></#list>", "[a][b][c]", tVal, true},
+	{"special var", "${.current_template_name}", "special var", tVal, true},
+
+	{"missing", "${missing}", "", tVal, false},
+	{"missing parent", "${Ptr.Name}", "", tVal, false},
+	{"boolean", "${Name == 'Joe'}", "", tVal, false},
+	{"non-boolean condition", "<#if Name>x</#if>", "", tVal, false},
+	{"bad comparison", "<#if Name == 1>x</#if>", "", tVal, false},
+	{"division by zero", "${1/0}", "", tVal, false},
+	{"undefined macro", "<@nope/>", "", tVal, false},
+	{"missing parameter", "<#macro m a>${a}</#macro><@m/>", "", tVal, false},
+	{"unknown parameter", "<#macro m a>${a}</#macro><@m a=1 b=2/>", "", tVal, false},
+}
+
+func TestExecute(t *testing.T) {
+	b := new(bytes.Buffer)
+	for _, test := range execTests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Errorf("%s: parse error: %s", test.name, err)
+			continue
+		}
+		b.Reset()
+		err = tmpl.Execute(b, test.data)
+		switch {
+		case !test.ok && err == nil:
+			t.Errorf("%s: expected error; got none", test.name)
+			continue
+		case test.ok && err != nil:
+			t.Errorf("%s: unexpected execute error: %s", test.name, err)
+			continue
+		case !test.ok && err != nil:
+			// expected error, got one
+			if *debug {
+				t.Logf("%s: %s\n\t%s", test.name, test.input, err)
+			}
+		}
+		if test.ok && b.String() != test.output {
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	tmpl := New("t")
+	tree, errs := tmpl.ParseAll("a${x +}b${y)}c${z}")
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors; got %v", errs)
+	}
+	if tree == nil || tree.Root.String() != "ab${z}" {
+		t.Errorf("unexpected partial tree: %v", tree)
+	}
+	if tmpl.Lookup("t") != nil {
+		t.Errorf("template with syntax errors was defined")
+	}
+
+	tree, errs = tmpl.ParseAll("${x}")
+	if errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if tree != tmpl.Tree || tmpl.Lookup("t") != tmpl {
+		t.Errorf("template was not defined")
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	tmpl, err := New("main.ftl").Parse(`<#macro outer x><@inner/></#macro>
+<#macro inner><#list Items as item>${item}${Ptr.Name}</#list></#macro>
+<#include "page.ftl">`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.New("page.ftl").Parse("page\n  <@outer x=1/>"); err != nil {
+		t.Fatal(err)
+	}
+	err = tmpl.Execute(new(bytes.Buffer), tVal)
+	var execErr ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("expected ExecError, got %v", err)
+	}
+	want := []Frame{
+		{"main.ftl", "inner", 2, 43, "${Ptr.Name}"},
+		{"main.ftl", "inner", 2, 15, "#list Items as item"},
+		{"main.ftl", "outer", 1, 17, "@inner"},
+		{"page.ftl", "", 2, 3, "@outer x=1"},
+		{"main.ftl", "", 3, 1, `#include "page.ftl"`},
+	}
+	if !reflect.DeepEqual(execErr.Stack, want) {
+		t.Errorf("wrong stack trace:\n%v\nexpected\n%v", execErr.Stack, want)
+	}
+	trace := `FTL stack trace ("~" means nesting-related):
+	- Failed at: ${Ptr.Name}  [in template "main.ftl" in macro "inner" at line 2, column 43]
+	~ Reached through: #list Items as item  [in template "main.ftl" in macro "inner" at line 2, column 15]
+	- Reached through: @inner  [in template "main.ftl" in macro "outer" at line 1, column 17]
+	- Reached through: @outer x=1  [in template "page.ftl" at line 2, column 3]
+	- Reached through: #include "page.ftl"  [in template "main.ftl" at line 3, column 1]
+`
+	if !strings.HasSuffix(err.Error(), "\n\n"+trace) {
+		t.Errorf("wrong error message:\n%s\nexpected it to end with\n%s", err, trace)
+	}
+}
+
+func TestExecErrorWrapsCause(t *testing.T) {
+	tmpl, err := New("t").Parse("${Fail()}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpl.Execute(new(bytes.Buffer), tVal)
+	if !errors.Is(err, errExec) {
+		t.Errorf("expected error wrapping %q, got %v", errExec, err)
+	}
+}
+
+func TestExceptionHandler(t *testing.T) {
+	const text = `a<#list Items as x>${x}${Ptr.Name}</#list>b${missing}c`
+	tests := []struct {
+		name    string
+		handler ExceptionHandler
+		output  string
+		ok      bool
+	}{
+		{"rethrow", RethrowHandler, "aa", false},
+		{"ignore", IgnoreHandler, "aabcbc", true},
+		{"custom", ExceptionHandlerFunc(func(err ExecError, w io.Writer) error {
+			fmt.Fprintf(w, "[%s:%d]", err.Stack[0].Instruction, len(err.Stack))
+			return nil
+		}), "aa[${Ptr.Name}:2]b[${Ptr.Name}:2]c[${Ptr.Name}:2]b[${missing}:1]c", true},
+		{"custom abort", ExceptionHandlerFunc(func(err ExecError, w io.Writer) error {
+			return errExec
+		}), "aa", false},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).SetExceptionHandler(test.handler).Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, tVal)
+		if test.ok != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if b.String() != test.output {
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestDebugHandlers(t *testing.T) {
+	for _, test := range []struct {
+		handler ExceptionHandler
+		want    string
+	}{
+		{DebugHandler, "FTL stack trace"},
+		{HTMLDebugHandler, "<pre style="},
+	} {
+		tmpl, err := New("t").SetExceptionHandler(test.handler).Parse("<${'<'+missing}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, tVal)
+		var execErr ExecError
+		if !errors.As(err, &execErr) {
+			t.Errorf("expected ExecError, got %v", err)
+		}
+		if !strings.Contains(b.String(), test.want) || !strings.Contains(b.String(), "missing has evaluated to null or missing") {
+			t.Errorf("the error is not in the output:\n%s", b)
+		}
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		logged string
+	}{
+		{"success", "a<#attempt>b${Name}<#recover>c</#attempt>d", "abJoed", ""},
+		{"failure", "a<#attempt>b${Ptr.Name}<#recover>c</#attempt>d", "acd", "Ptr has evaluated to null or missing"},
+		{"recover end", "<#attempt>${x}<#recover>r</#recover>", "r", "x has evaluated"},
+		{"error", "<#attempt>${1/0}<#recover>${.error}</#attempt>", "template: error:1:12: executing \"error\" at <1/0>: division by zero", "division by zero"},
+		{"nested", "<#attempt>a<#attempt>b${x}<#recover>c</#attempt>d${y}<#recover>e</#attempt>", "e", "y has evaluated"},
+		{"handler not used", "<#attempt>${x}<#recover>r</#attempt>", "r", "x has evaluated"},
+	}
+	for _, test := range tests {
+		logged := new(bytes.Buffer)
+		tmpl, err := New(test.name).SetAttemptLogger(log.New(logged, "", 0)).SetExceptionHandler(DebugHandler).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		if err := tmpl.Execute(b, tVal); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if b.String() != test.output {
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+		if !strings.Contains(logged.String(), test.logged) || test.logged == "" && logged.Len() > 0 {
+			t.Errorf("%s: expected a log of %q, got %q", test.name, test.logged, logged)
+		}
+	}
+}
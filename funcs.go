@@ -342,10 +342,15 @@ const (
 	floatKind
 	stringKind
 	uintKind
+	bigKind // *big.Int, *big.Float, *big.Rat, or the struct
 )
 
 func basicKind(v reflect.Value) (kind, error) {
 	switch v.Kind() {
+	case reflect.Struct, reflect.Ptr:
+		if isBigType(v.Type()) {
+			return bigKind, nil
+		}
 	case reflect.Bool:
 		return boolKind, nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
@@ -379,7 +384,12 @@ func eq(arg1 reflect.Value, arg2 ...reflect.Value) (bool, error) {
 			return false, err
 		}
 		truth := false
-		if k1 != k2 {
+		if k1 == bigKind || k2 == bigKind {
+			if !isNumberKind(k1) || !isNumberKind(k2) {
+				return false, errBadComparison
+			}
+			truth = compareNumbers(v1, v2) == 0
+		} else if k1 != k2 {
 			// Special case: Can compare integer values regardless of type's sign.
 			switch {
 			case k1 == intKind && k2 == uintKind:
@@ -434,7 +444,12 @@ func lt(arg1, arg2 reflect.Value) (bool, error) {
 		return false, err
 	}
 	truth := false
-	if k1 != k2 {
+	if k1 == bigKind || k2 == bigKind {
+		if !isNumberKind(k1) || !isNumberKind(k2) {
+			return false, errBadComparison
+		}
+		truth = compareNumbers(v1, v2) < 0
+	} else if k1 != k2 {
 		// Special case: Can compare integer values regardless of type's sign.
 		switch {
 		case k1 == intKind && k2 == uintKind:
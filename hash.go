@@ -0,0 +1,143 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"keys":   builtinKeys,
+		"values": builtinValues,
+	})
+}
+
+// OrderedHash is a hash whose keys are listed in the order they were first
+// set in, unlike the keys of a map, which are listed sorted. Hash literals
+// evaluate to one, and one can be put in the data model where the order of
+// the keys matters.
+type OrderedHash struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// NewOrderedHash returns an empty ordered hash.
+func NewOrderedHash() *OrderedHash {
+	return &OrderedHash{values: make(map[string]interface{})}
+}
+
+// Set sets the value of the key. A new key is added after the others; an
+// existing one keeps its place.
+func (h *OrderedHash) Set(key string, value interface{}) {
+	if _, ok := h.values[key]; !ok {
+		h.keys = append(h.keys, key)
+	}
+	h.values[key] = value
+}
+
+// Get returns the value of the key, or nil if it has none.
+func (h *OrderedHash) Get(key string) (interface{}, error) {
+	return h.values[key], nil
+}
+
+// Keys returns the keys in order.
+func (h *OrderedHash) Keys() ([]string, error) {
+	return h.keys, nil
+}
+
+// hashKeys returns the keys of the hash v, in the order it is listed in,
+// a function returning the value of the key i, and whether v is a hash
+// whose keys can be listed: an extended hash model, with its keys in its
+// order, a map, with its keys sorted, or a struct, with its fields in the
+// order they are declared in.
+func (s *state) hashKeys(v reflect.Value) (keys []string, value func(i int) reflect.Value, ok bool) {
+	if m, ok := modelOf(v).(HashModelEx); ok {
+		keys, err := m.Keys()
+		if err != nil {
+			s.errorf("can't list the keys: %w", err)
+		}
+		return keys, func(i int) reflect.Value { return s.getKey(m, keys[i]) }, true
+	}
+	if s.typeOf(v)&typeHashEx == 0 {
+		// Such as a hash model without keys, whose members are what Get
+		// returns, not its fields, or a struct that is a number model.
+		return nil, nil, false
+	}
+	v, _ = indirect(v)
+	if v.Kind() == reflect.Map {
+		mapKeys := sortKeys(v.MapKeys())
+		keys = make([]string, len(mapKeys))
+		for i, key := range mapKeys {
+			keys[i] = fmt.Sprint(key.Interface())
+		}
+		return keys, func(i int) reflect.Value { return s.wrap(v.MapIndex(mapKeys[i])) }, true
+	}
+	typ := v.Type()
+	table := membersOf(typ, s.tmpl.lowerCamelCase)
+	for _, name := range fieldNames(typ, s.tmpl.lowerCamelCase) {
+		if s.canAccess(typ, table[name]) {
+			keys = append(keys, name)
+		}
+	}
+	return keys, func(i int) reflect.Value {
+		value, _ := s.structMember(v, keys[i])
+		return value
+	}, true
+}
+
+// hashTarget evaluates the target of the built-in n, which must be a hash
+// whose keys can be listed.
+func (s *state) hashTarget(n *parse.BuiltinNode) ([]string, func(i int) reflect.Value) {
+	return s.targetKeys(n, s.target(n), "a hash")
+}
+
+// targetKeys returns the keys of v, the target of the built-in n, as
+// hashKeys does, reporting an error if v isn't a hash whose keys can be
+// listed; expected describes what n expects.
+func (s *state) targetKeys(n *parse.BuiltinNode, v reflect.Value, expected string) ([]string, func(i int) reflect.Value) {
+	keys, value, ok := s.hashKeys(v)
+	if !ok {
+		if s.isHash(v) {
+			s.errorf("?%s can't list the keys of %s, which is %T", n.Name, n.Target, modelOf(v))
+		}
+		s.targetError(n, v, expected)
+	}
+	return keys, value
+}
+
+// builtinKeys evaluates ?keys, the sequence of the keys of a hash.
+func builtinKeys(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	keys, _ := s.hashTarget(n)
+	return reflect.ValueOf(keys)
+}
+
+// builtinValues evaluates ?values, the sequence of the values of a hash,
+// in the order of ?keys.
+func builtinValues(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	keys, value := s.hashTarget(n)
+	values := make([]interface{}, len(keys))
+	for i := range keys {
+		values[i] = interfaceOf(value(i))
+	}
+	return reflect.ValueOf(values)
+}
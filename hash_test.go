@@ -0,0 +1,101 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type hashUser struct {
+	Name    string
+	Email   string `ftl:"mail"`
+	Secret  string `ftl:"-"`
+	age     int
+	Address struct{ City string }
+}
+
+func TestHashBuiltins(t *testing.T) {
+	ordered := NewOrderedHash()
+	ordered.Set("z", 1)
+	ordered.Set("a", 2)
+	ordered.Set("z", 3)
+	user := hashUser{Name: "Ann", Email: "ann@example.com", Secret: "x", age: 40}
+	user.Address.City = "Oslo"
+	data := map[string]interface{}{
+		"m":       map[string]int{"b": 2, "a": 1, "c": 3},
+		"user":    user,
+		"ordered": ordered,
+		"props":   props{{"b", "1"}, {"a", "2"}},
+		"broken":  broken{},
+		"sum": func(m map[string]int) int {
+			return m["a"] + m["b"]
+		},
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"map", "${m?keys?join(',')} ${m?values?join(',')} ${m?size}", "a,b,c 1,2,3 3", ""},
+		{"struct", "${user?keys?join(',')} ${user?values?size} ${user?size}", "Name,mail,Address 3 3", ""},
+		{"struct listing", "<#list user as k, v><#if k != 'Address'>${k}=${v};</#if></#list>", "Name=Ann;mail=ann@example.com;", ""},
+		{"hash model", "${props?keys?join(',')} ${props?values?join(',')} ${props?size}", "b,a 1,2 2", ""},
+		{"ordered hash", "${ordered?keys?join(',')} ${ordered?values?join(',')}", "z,a 3,2", ""},
+		{"hash literal", "${{'z': 1, 'a': 2, 'm': 3}?keys?join(',')} <#list {'z': 1, 'a': 2, 'm': 3} as k, v>${k}=${v};</#list>", "z,a,m z=1;a=2;m=3;", ""},
+		{"concatenation", "${({'a': 1, 'b': 2} + {'c': 3, 'a': 4})?keys?join(',')} ${({'a': 1} + {'a': 4}).a} ${(m + {'a': 9})?values?join(',')}",
+			"a,b,c 4 9,2,3", ""},
+		{"catch-all order", "<#macro m rest...><#list rest as k, v>${k}</#list></#macro><@m z=1 a=2/>", "za", ""},
+		{"literal for a map", "${sum({'a': 1, 'b': 2})}", "3", ""},
+		{"keys only", "<#list ordered?keys as k>${k}</#list>", "za", ""},
+		{"hash model without keys", "${broken?keys}", "", "?keys can't list the keys of broken, which is template.broken"},
+		{"not a hash", "${'abc'?values}", "", "?values expects a hash"},
+		{"size of a number", "${1?size}", "", "?size expects a sequence or a hash"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestStructKeysInLowerCamelCase(t *testing.T) {
+	tmpl, err := New("keys").SetLowerCamelCase(true).Parse("${user?keys?join(',')} ${user[user?keys?first]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	if err := tmpl.Execute(b, map[string]interface{}{"user": hashUser{Name: "Ann"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "name,mail,address Ann"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
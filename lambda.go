@@ -0,0 +1,276 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"reflect"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"filter":     builtinFilter,
+		"map":        builtinMap,
+		"take_while": builtinTakeWhile,
+		"drop_while": builtinDropWhile,
+	})
+}
+
+// A function is the argument of a higher-order built-in, such as ?filter:
+// a local lambda, or a Go function or method model taking one argument.
+type function struct {
+	s      *state
+	n      *parse.BuiltinNode // the built-in it is the argument of
+	arg    parse.Node         // the argument expression
+	lambda *parse.LambdaNode  // nil if fn is set
+	vars   []variable         // the variables the lambda sees
+	tmpl   *Template          // the template the lambda is in
+	fn     reflect.Value
+}
+
+// funcArg evaluates the argument i of the built-in n, which must be a
+// lambda or a function. A lambda keeps the variables it was defined with,
+// as it may be called later, when its result is listed.
+func (s *state) funcArg(n *parse.BuiltinNode, i int) *function {
+	f := &function{s: s, n: n, arg: n.Args[i]}
+	if l, ok := f.arg.(*parse.LambdaNode); ok {
+		f.lambda, f.vars, f.tmpl = l, s.vars[:len(s.vars):len(s.vars)], s.tmpl
+		return f
+	}
+	f.fn = s.evalDefined(f.arg)
+	s.at(n)
+	if _, ok := modelOf(f.fn).(MethodModel); !ok && indirectInterface(f.fn).Kind() != reflect.Func && f.fn.Type() != disabledFuncType {
+		s.errorf("?%s expects a lambda or a function, but %s has evaluated to %s", n.Name, f.arg, s.describe(f.fn))
+	}
+	return f
+}
+
+// call returns the result of the function for the item x. Each call
+// counts as an instruction.
+func (f *function) call(x reflect.Value) reflect.Value {
+	s := f.s
+	s.step()
+	if f.lambda == nil {
+		s.at(f.n)
+		return s.callFunc(f.fn, f.arg.String(), []reflect.Value{x})
+	}
+	tmpl, vars := s.tmpl, s.vars
+	defer func() { s.tmpl, s.vars = tmpl, vars }()
+	s.tmpl, s.vars = f.tmpl, append(f.vars, variable{f.lambda.Param, x})
+	return s.evalExpr(f.lambda.Body)
+}
+
+// test returns the result of the function for the item x, which must be a
+// boolean.
+func (f *function) test(x reflect.Value) bool {
+	v := f.call(x)
+	s := f.s
+	s.at(f.n)
+	b, _ := indirect(s.unwrap(v, boolKind))
+	if !b.IsValid() || b.Kind() != reflect.Bool {
+		if !b.IsValid() {
+			s.errorf("?%s expects %s to return a boolean, but it returned a missing value", f.n.Name, f.arg)
+		}
+		s.errorf("?%s expects %s to return a boolean, but it returned %s", f.n.Name, f.arg, s.describe(v))
+	}
+	return b.Bool()
+}
+
+// An iteration returns the next item and true, or false at the end.
+type iteration func() (reflect.Value, bool)
+
+// source evaluates the target of the built-in n, which must be a sequence
+// or a collection, and returns a function starting an iteration over its
+// items. A collection is iterated rather than listed into a slice, so that
+// the lazy results of ?filter and ?map chain without materializing. Each
+// item counts as an iteration of a loop.
+func (s *state) source(n *parse.BuiltinNode) func() iteration {
+	v := s.target(n)
+	if m, ok := modelOf(v).(CollectionModel); ok {
+		return func() iteration {
+			it, err := m.Iterator()
+			if err != nil {
+				s.errorf("can't list %s: %w", n.Target, err)
+			}
+			return func() (reflect.Value, bool) {
+				s.step()
+				more, err := it.HasNext()
+				if err == nil && more {
+					var x interface{}
+					if x, err = it.Next(); err == nil {
+						return s.wrap(valueOf(x)), true
+					}
+				}
+				if err != nil {
+					s.errorf("can't list %s: %w", n.Target, err)
+				}
+				return zero, false
+			}
+		}
+	}
+	q, ok := s.asSeq(v)
+	if !ok {
+		s.targetError(n, v, "a sequence")
+	}
+	return func() iteration {
+		i := 0
+		return func() (reflect.Value, bool) {
+			s.step()
+			if i >= q.len() {
+				return zero, false
+			}
+			i++
+			return q.index(i - 1), true
+		}
+	}
+}
+
+// lazySeq is the result of ?filter, ?map, ?take_while and ?drop_while. It
+// is computed item by item as it is listed, and it is only computed as a
+// whole, once, when it is used as a sequence, as with ?size or [i].
+type lazySeq struct {
+	open  func() iteration
+	items *[]interface{} // the items, once computed
+}
+
+func newLazySeq(open func() iteration) lazySeq {
+	return lazySeq{open, new([]interface{})}
+}
+
+func (l lazySeq) Iterator() (ModelIterator, error) {
+	return &lazyIterator{next: l.open()}, nil
+}
+
+func (l lazySeq) Len() (int, error) {
+	return len(l.computed()), nil
+}
+
+func (l lazySeq) Index(i int) (interface{}, error) {
+	return l.computed()[i], nil
+}
+
+func (l lazySeq) computed() []interface{} {
+	if *l.items == nil {
+		items := []interface{}{}
+		next := l.open()
+		for {
+			x, ok := next()
+			if !ok {
+				break
+			}
+			items = append(items, interfaceOf(x))
+		}
+		*l.items = items
+	}
+	return *l.items
+}
+
+// lazyIterator iterates over a lazySeq.
+type lazyIterator struct {
+	next    iteration
+	item    reflect.Value
+	more    bool
+	fetched bool // whether item is the next item
+}
+
+func (it *lazyIterator) HasNext() (bool, error) {
+	if !it.fetched {
+		it.item, it.more = it.next()
+		it.fetched = true
+	}
+	return it.more, nil
+}
+
+func (it *lazyIterator) Next() (interface{}, error) {
+	it.HasNext()
+	it.fetched = false
+	return interfaceOf(it.item), nil
+}
+
+// builtinFilter evaluates ?filter(f), the items for which f returns true.
+func builtinFilter(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	src, f := s.source(n), s.funcArg(n, 0)
+	return reflect.ValueOf(newLazySeq(func() iteration {
+		next := src()
+		return func() (reflect.Value, bool) {
+			for {
+				x, ok := next()
+				if !ok || f.test(x) {
+					return x, ok
+				}
+			}
+		}
+	}))
+}
+
+// builtinMap evaluates ?map(f), the results of f for the items.
+func builtinMap(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	src, f := s.source(n), s.funcArg(n, 0)
+	return reflect.ValueOf(newLazySeq(func() iteration {
+		next := src()
+		return func() (reflect.Value, bool) {
+			x, ok := next()
+			if !ok {
+				return zero, false
+			}
+			return f.call(x), true
+		}
+	}))
+}
+
+// builtinTakeWhile evaluates ?take_while(f), the items before the first
+// one for which f returns false.
+func builtinTakeWhile(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	src, f := s.source(n), s.funcArg(n, 0)
+	return reflect.ValueOf(newLazySeq(func() iteration {
+		next, done := src(), false
+		return func() (reflect.Value, bool) {
+			if done {
+				return zero, false
+			}
+			x, ok := next()
+			if ok && f.test(x) {
+				return x, true
+			}
+			done = true
+			return zero, false
+		}
+	}))
+}
+
+// builtinDropWhile evaluates ?drop_while(f), the items from the first one
+// for which f returns false on.
+func builtinDropWhile(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	src, f := s.source(n), s.funcArg(n, 0)
+	return reflect.ValueOf(newLazySeq(func() iteration {
+		next, dropping := src(), true
+		return func() (reflect.Value, bool) {
+			for {
+				x, ok := next()
+				if !ok || !dropping || !f.test(x) {
+					dropping = false
+					return x, ok
+				}
+			}
+		}
+	}))
+}
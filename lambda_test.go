@@ -0,0 +1,131 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"nums":   []int{1, 2, 3, 4, 5, 6},
+		"pages":  &pages{total: 5, size: 2},
+		"double": func(x int) int { return 2 * x },
+		"isOdd":  func(x int) bool { return x%2 == 1 },
+		"wrap":   joiner("-"),
+		"people": []map[string]interface{}{
+			{"name": "Al", "age": 17},
+			{"name": "Bob", "age": 42},
+			{"name": "Cy", "age": 30},
+		},
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"filter", "<#list nums?filter(x -> x % 2 == 0) as x>${x} </#list>", "2 4 6 ", ""},
+		{"map", "${nums?map(x -> x * 10)?join(',')}", "10,20,30,40,50,60", ""},
+		{"parenthesized parameter", "${nums?map((x) -> x + 1)?first}", "2", ""},
+		{"chain", "<#list people?filter(p -> p.age >= 18)?map(p -> p.name) as name>${name} </#list>", "Bob Cy ", ""},
+		{"take while", "${nums?take_while(x -> x < 4)?join(',')} ${nums?take_while(x -> x > 4)?size}", "1,2,3 0", ""},
+		{"drop while", "${nums?drop_while(x -> x < 4)?join(',')} ${[1, 5, 1]?drop_while(x -> x < 2)?join(',')}", "4,5,6 5,1", ""},
+		{"as a sequence", "${nums?filter(x -> x > 2)?size} ${nums?filter(x -> x > 2)[0]} ${nums?map(x -> -x)?reverse?first} ${nums?filter(x -> x > 9)?first!'none'}",
+			"4 3 -6 none", ""},
+		{"collection", "${pages?map(x -> x * x)?join(',')}", "0,1,4,9,16", ""},
+		{"Go functions", "${nums?filter(isOdd)?map(double)?join(',')}", "2,6,10", ""},
+		{"method model", "${nums?take_while(x -> x < 3)?map(wrap)?join(',')}", "1,2", ""},
+		{"outer variables", "<#list [1, 2] as k>${[1, 2, 3]?filter(x -> x > k)?join(',')};</#list>", "2,3;3;", ""},
+		{"lambda scope in a macro", "<#macro show items><#list items as i>${i}</#list>|${items?size}</#macro><#list [1] as limit><@show items=nums?filter(x -> x > limit * 4)/></#list>",
+			"56|2", ""},
+		{"not a boolean", "${nums?filter(x -> x)?size}", "", "?filter expects x -> x to return a boolean, but it returned a number"},
+		{"not a function", "${nums?map(1)?size}", "", "?map expects a lambda or a function, but 1 has evaluated to a number"},
+		{"lambda elsewhere", "${nums?join(x -> x)}", "", "the lambda x -> x can only be the argument of a built-in taking a function"},
+		{"not a sequence", "${'abc'?filter(x -> true)}", "", "?filter expects a sequence"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+// TestLazyPipeline checks that a pipeline is computed item by item as it is
+// listed, so that only the pages of the collection it needs get loaded.
+func TestLazyPipeline(t *testing.T) {
+	p := &pages{total: 1000, size: 10}
+	tmpl, err := New("lazy").Parse("<#list pages?filter(x -> x % 2 == 0)?take_while(x -> x < 15) as x>${x} </#list>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	if err := tmpl.Execute(b, map[string]interface{}{"pages": p}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "0 2 4 6 8 10 12 14 "; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if p.loaded != 2 {
+		t.Errorf("expected 2 pages to be loaded, got %d", p.loaded)
+	}
+}
+
+// TestLazyBuiltins checks that built-ins needing only some of the items of a
+// lazy sequence stop computing it once they have them.
+func TestLazyBuiltins(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"${pages?filter(x -> x > 12)?first}", "13"},
+		{"${pages?map(x -> x * 2)?seq_contains(24)?c}", "true"},
+		{"${pages?filter(x -> x % 2 == 0)?seq_index_of(14)}", "7"},
+		{"${pages?take_while(x -> x < 19)?join(',')?length}", "46"},
+		{"${pages?filter(x -> x < 20)?take_while(x -> x < 15)?max}", "14"},
+	}
+	for _, test := range tests {
+		p := &pages{total: 1000, size: 10}
+		tmpl, err := New("lazy").Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		if err := tmpl.Execute(b, map[string]interface{}{"pages": p}); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.output {
+			t.Errorf("%s: expected %q, got %q", test.input, test.output, b)
+		}
+		if p.loaded != 2 {
+			t.Errorf("%s: expected 2 pages to be loaded, got %d", test.input, p.loaded)
+		}
+	}
+}
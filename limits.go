@@ -0,0 +1,64 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import "fmt"
+
+// Limits bounds the resources an execution of a template may use, for
+// templates that are not trusted. A zero field means no limit, except for
+// MaxCallDepth.
+type Limits struct {
+	// MaxInstructions is the number of interpolations and directives that
+	// may be executed, counting each iteration of a loop.
+	MaxInstructions int64
+
+	// MaxOutputBytes is the number of bytes the template may write. Output
+	// that <#attempt> discards counts too, and ?left_pad and ?right_pad
+	// can't build longer strings.
+	MaxOutputBytes int64
+
+	// MaxCallDepth is the nesting depth of macro calls, includes and
+	// ?eval. Zero means the default of 500, which recursive macros only
+	// reach when their recursion doesn't end.
+	MaxCallDepth int
+}
+
+// Names of the limits, as reported by LimitError.
+const (
+	LimitInstructions = "instructions"
+	LimitOutputBytes  = "output bytes"
+	LimitCallDepth    = "call depth"
+)
+
+// LimitError is the error wrapped by the ExecError returned when an
+// execution exceeds one of its Limits. Exception handlers and <#attempt>
+// can't recover from it.
+type LimitError struct {
+	Limit string // LimitInstructions, LimitOutputBytes or LimitCallDepth
+	Max   int64  // the value of the limit
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("exceeded the limit of %d %s", e.Max, e.Limit)
+}
+
+// abortError is the wrapper type used internally for errors that stop
+// execution whatever the exception handler and <#attempt>, such as a
+// cancellation or an exceeded limit. We strip the wrapper in errRecover.
+type abortError struct {
+	ExecError
+}
@@ -0,0 +1,144 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestExecuteContextCanceled(t *testing.T) {
+	tmpl, err := New("cancel").Parse("a<#list 1..1000000000 as i>${i}</#list>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := new(bytes.Buffer)
+	err = tmpl.ExecuteContext(ctx, b, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancellation, got %v", err)
+	}
+	if _, ok := err.(ExecError); !ok {
+		t.Errorf("expected an ExecError, got %T", err)
+	}
+	if b.String() != "a" {
+		t.Errorf("unexpected output %q", b)
+	}
+}
+
+func TestExecuteContextDeadlineInLambda(t *testing.T) {
+	tmpl, err := New("deadline").Parse("${(1..1000000000)?filter(x -> x < 0)?size}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = tmpl.ExecuteContext(ctx, ioutil.Discard, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestExecuteContextDeadlineInSequenceBuiltins(t *testing.T) {
+	for _, input := range []string{
+		`${(1..1000000000)?join(",")?length}`,
+		"${(1..1000000000)?sort?first}",
+		"${(1..1000000000)?seq_contains(0)?c}",
+		"${(1..1000000000)?seq_index_of(0)}",
+		"${(1..1000000000)?min}",
+	} {
+		tmpl, err := New("deadline").Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err = tmpl.ExecuteContext(ctx, ioutil.Discard, nil)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected the deadline to be exceeded, got %v", input, err)
+		}
+	}
+}
+
+func TestLimitsInCollections(t *testing.T) {
+	tmpl, err := New("collection").SetLimits(Limits{MaxInstructions: 100}).Parse("${pages?size}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpl.Execute(ioutil.Discard, map[string]interface{}{"pages": &pages{total: 1000000000, size: 10}})
+	var lerr *LimitError
+	if !errors.As(err, &lerr) || lerr.Limit != LimitInstructions {
+		t.Errorf("expected the instruction limit to be exceeded, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		limits Limits
+		limit  string // the limit exceeded, if any
+	}{
+		{"instructions", "<#list 1..1000000000 as i>${i}</#list>", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"instructions ok", "<#list 1..10 as i>${i}</#list>", Limits{MaxInstructions: 21}, ""},
+		{"output", "<#list 1..1000000000 as i>xxxxxxxx</#list>", Limits{MaxOutputBytes: 1000}, LimitOutputBytes},
+		{"output ok", "<#list 1..10 as i>x</#list>", Limits{MaxOutputBytes: 10}, ""},
+		{"interpolated output", "<#list 1..1000000000 as i>${'xxxxxxxx'}</#list>", Limits{MaxOutputBytes: 1000}, LimitOutputBytes},
+		{"interpolated output ok", "<#list 1..10 as i>${i}</#list>", Limits{MaxOutputBytes: 11}, ""},
+		{"padding", `${"a"?left_pad(1000000000, "-")}`, Limits{MaxOutputBytes: 1000}, LimitOutputBytes},
+		{"long range", "${(1..1000000000)?size}", Limits{}, ""},
+		{"join", `${(1..1000000000)?join(",")}`, Limits{MaxInstructions: 100}, LimitInstructions},
+		{"joined size", `${(1..1000000000)?join(",")}`, Limits{MaxOutputBytes: 1000}, LimitOutputBytes},
+		{"sort", "${(1..1000000000)?sort?first}", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"seq_contains", "${(1..1000000000)?seq_contains(0)?c}", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"seq_index_of", "${(1..1000000000)?seq_index_of(0)}", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"seq_last_index_of", "${(1..1000000000)?seq_last_index_of(0)}", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"max", "${(1..1000000000)?max}", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"sort_by", `${(1..1000000000)?map(x -> {"a": x})?sort_by("a")?first.a}`, Limits{MaxInstructions: 100}, LimitInstructions},
+		{"lazy first", "${(1..1000000000)?filter(x -> x > 1)?first}", Limits{MaxInstructions: 100}, ""},
+		{"lazy seq_contains", "${(1..1000000000)?map(x -> x * 2)?seq_contains(10)?c}", Limits{MaxInstructions: 100}, ""},
+		{"call depth", "<#macro m><@m/></#macro><@m/>", Limits{MaxCallDepth: 5}, LimitCallDepth},
+		{"default call depth", "<#macro m><@m/></#macro><@m/>", Limits{}, LimitCallDepth},
+		{"deep recursion", "<#macro m n><#if n gt 0><@m n-1/></#if></#macro><@m 300/>", Limits{}, ""},
+		{"deep recursion limited", "<#macro m n><#if n gt 0><@m n-1/></#if></#macro><@m 300/>", Limits{MaxCallDepth: 100}, LimitCallDepth},
+		{"filter", "${(1..1000000000)?filter(x -> x < 0)?size}", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"map", "<#list (1..1000000000)?map(x -> x * 2) as x></#list>", Limits{MaxInstructions: 100}, LimitInstructions},
+		{"not swallowed by handler", "<#list 1..1000 as i>${x!}</#list>", Limits{MaxInstructions: 10}, LimitInstructions},
+		{"not swallowed by attempt", "<#attempt><#list 1..1000 as i>${i}</#list><#recover>r</#attempt>", Limits{MaxInstructions: 10}, LimitInstructions},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).SetExceptionHandler(IgnoreHandler).SetLimits(test.limits).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tmpl.Execute(ioutil.Discard, nil)
+		var lerr *LimitError
+		switch {
+		case test.limit == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.limit != "" && !errors.As(err, &lerr):
+			t.Errorf("%s: expected a LimitError, got %v", test.name, err)
+		case test.limit != "" && lerr.Limit != test.limit:
+			t.Errorf("%s: expected the %s limit to be exceeded, got %v", test.name, test.limit, err)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// A locale is given as language_COUNTRY, such as de_DE, or only as a
+// language, such as de. The locale decides how numbers and dates are
+// formatted, how ?upper_case and ?lower_case convert letters, and which
+// variant of a template is used; see LookupLocale.
+
+// defaultLocale is the locale executions start with, unless the locale
+// setting is set.
+const defaultLocale = "en_US"
+
+// localeData holds how values are presented in a locale.
+type localeData struct {
+	tag           string // such as "de_DE"
+	numbers       numberSymbols
+	currency      string // the pattern of the currency format
+	percent       string // the pattern of the percent format
+	months        [12]string
+	shortMonths   [12]string
+	weekdays      [7]string // Sunday first
+	shortWeekdays [7]string
+	ampm          [2]string
+	dateStyles    map[string]string
+	timeStyles    map[string]string
+	upper, lower  unicode.SpecialCase // nil for the standard case mapping
+	letters       string              // the accented letters sorting after their base letter
+}
+
+// languages are the locales of the supported languages.
+var languages = map[string]*localeData{
+	"en": {
+		tag:           "en_US",
+		numbers:       numberSymbols{decimal: ".", grouping: ","},
+		currency:      "¤#,##0.00",
+		percent:       "#,##0%",
+		months:        [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		shortMonths:   [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		weekdays:      [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		shortWeekdays: [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		ampm:          [2]string{"AM", "PM"},
+		dateStyles:    map[string]string{"short": "M/d/yy", "medium": "MMM d, yyyy", "long": "MMMM d, yyyy", "full": "EEEE, MMMM d, yyyy"},
+		timeStyles:    map[string]string{"short": "h:mm a", "medium": "h:mm:ss a", "long": "h:mm:ss a z", "full": "h:mm:ss a z"},
+	},
+	"de": {
+		tag:           "de_DE",
+		numbers:       numberSymbols{decimal: ",", grouping: "."},
+		currency:      "#,##0.00 ¤",
+		percent:       "#,##0 %",
+		months:        [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		shortMonths:   [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		weekdays:      [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		shortWeekdays: [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		ampm:          [2]string{"AM", "PM"},
+		dateStyles:    map[string]string{"short": "dd.MM.yy", "medium": "dd.MM.yyyy", "long": "d. MMMM yyyy", "full": "EEEE, d. MMMM yyyy"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm' Uhr 'z"},
+	},
+	"fr": {
+		tag:           "fr_FR",
+		numbers:       numberSymbols{decimal: ",", grouping: "\u00a0"},
+		currency:      "#,##0.00 ¤",
+		percent:       "#,##0 %",
+		months:        [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		shortMonths:   [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		weekdays:      [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		shortWeekdays: [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		ampm:          [2]string{"AM", "PM"},
+		dateStyles:    map[string]string{"short": "dd/MM/yy", "medium": "d MMM yyyy", "long": "d MMMM yyyy", "full": "EEEE d MMMM yyyy"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+	},
+	"es": {
+		tag:           "es_ES",
+		numbers:       numberSymbols{decimal: ",", grouping: "."},
+		currency:      "#,##0.00 ¤",
+		percent:       "#,##0 %",
+		months:        [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		shortMonths:   [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		weekdays:      [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		shortWeekdays: [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		ampm:          [2]string{"a. m.", "p. m."},
+		dateStyles:    map[string]string{"short": "d/M/yy", "medium": "d MMM yyyy", "long": "d 'de' MMMM 'de' yyyy", "full": "EEEE, d 'de' MMMM 'de' yyyy"},
+		timeStyles:    map[string]string{"short": "H:mm", "medium": "H:mm:ss", "long": "H:mm:ss z", "full": "H:mm:ss z"},
+		letters:       "ñ",
+	},
+	"it": {
+		tag:           "it_IT",
+		numbers:       numberSymbols{decimal: ",", grouping: "."},
+		currency:      "#,##0.00 ¤",
+		percent:       "#,##0%",
+		months:        [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		shortMonths:   [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		weekdays:      [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		shortWeekdays: [7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+		ampm:          [2]string{"AM", "PM"},
+		dateStyles:    map[string]string{"short": "dd/MM/yy", "medium": "d MMM yyyy", "long": "d MMMM yyyy", "full": "EEEE d MMMM yyyy"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+	},
+	"pt": {
+		tag:           "pt_PT",
+		numbers:       numberSymbols{decimal: ",", grouping: "."},
+		currency:      "#,##0.00 ¤",
+		percent:       "#,##0%",
+		months:        [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		shortMonths:   [12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		weekdays:      [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		shortWeekdays: [7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+		ampm:          [2]string{"AM", "PM"},
+		dateStyles:    map[string]string{"short": "dd/MM/yy", "medium": "d 'de' MMM 'de' yyyy", "long": "d 'de' MMMM 'de' yyyy", "full": "EEEE, d 'de' MMMM 'de' yyyy"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+	},
+	"nl": {
+		tag:           "nl_NL",
+		numbers:       numberSymbols{decimal: ",", grouping: "."},
+		currency:      "¤ #,##0.00",
+		percent:       "#,##0%",
+		months:        [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		shortMonths:   [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		weekdays:      [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		shortWeekdays: [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+		ampm:          [2]string{"a.m.", "p.m."},
+		dateStyles:    map[string]string{"short": "dd-MM-yy", "medium": "d MMM yyyy", "long": "d MMMM yyyy", "full": "EEEE d MMMM yyyy"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+	},
+	"pl": {
+		tag:           "pl_PL",
+		numbers:       numberSymbols{decimal: ",", grouping: "\u00a0"},
+		currency:      "#,##0.00 ¤",
+		percent:       "#,##0%",
+		months:        [12]string{"stycznia", "lutego", "marca", "kwietnia", "maja", "czerwca", "lipca", "sierpnia", "września", "października", "listopada", "grudnia"},
+		shortMonths:   [12]string{"sty", "lut", "mar", "kwi", "maj", "cze", "lip", "sie", "wrz", "paź", "lis", "gru"},
+		weekdays:      [7]string{"niedziela", "poniedziałek", "wtorek", "środa", "czwartek", "piątek", "sobota"},
+		shortWeekdays: [7]string{"niedz.", "pon.", "wt.", "śr.", "czw.", "pt.", "sob."},
+		ampm:          [2]string{"AM", "PM"},
+		dateStyles:    map[string]string{"short": "dd.MM.yyyy", "medium": "d MMM yyyy", "long": "d MMMM yyyy", "full": "EEEE, d MMMM yyyy"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+		letters:       "ąćęłńóśźż",
+	},
+	"ru": {
+		tag:           "ru_RU",
+		numbers:       numberSymbols{decimal: ",", grouping: "\u00a0"},
+		currency:      "#,##0.00 ¤",
+		percent:       "#,##0 %",
+		months:        [12]string{"января", "февраля", "марта", "апреля", "мая", "июня", "июля", "августа", "сентября", "октября", "ноября", "декабря"},
+		shortMonths:   [12]string{"янв.", "февр.", "мар.", "апр.", "мая", "июн.", "июл.", "авг.", "сент.", "окт.", "нояб.", "дек."},
+		weekdays:      [7]string{"воскресенье", "понедельник", "вторник", "среда", "четверг", "пятница", "суббота"},
+		shortWeekdays: [7]string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"},
+		ampm:          [2]string{"AM", "PM"},
+		dateStyles:    map[string]string{"short": "dd.MM.yy", "medium": "d MMM yyyy 'г.'", "long": "d MMMM yyyy 'г.'", "full": "EEEE, d MMMM yyyy 'г.'"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+	},
+	"tr": {
+		tag:           "tr_TR",
+		numbers:       numberSymbols{decimal: ",", grouping: "."},
+		currency:      "¤#,##0.00",
+		percent:       "%#,##0",
+		months:        [12]string{"Ocak", "Şubat", "Mart", "Nisan", "Mayıs", "Haziran", "Temmuz", "Ağustos", "Eylül", "Ekim", "Kasım", "Aralık"},
+		shortMonths:   [12]string{"Oca", "Şub", "Mar", "Nis", "May", "Haz", "Tem", "Ağu", "Eyl", "Eki", "Kas", "Ara"},
+		weekdays:      [7]string{"Pazar", "Pazartesi", "Salı", "Çarşamba", "Perşembe", "Cuma", "Cumartesi"},
+		shortWeekdays: [7]string{"Paz", "Pzt", "Sal", "Çar", "Per", "Cum", "Cmt"},
+		ampm:          [2]string{"ÖÖ", "ÖS"},
+		dateStyles:    map[string]string{"short": "d.MM.yyyy", "medium": "d MMM yyyy", "long": "d MMMM yyyy", "full": "d MMMM yyyy EEEE"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+		upper:         unicode.TurkishCase,
+		lower:         unicode.TurkishCase,
+		letters:       "çğöşü",
+	},
+	"ja": {
+		tag:           "ja_JP",
+		numbers:       numberSymbols{decimal: ".", grouping: ","},
+		currency:      "¤#,##0",
+		percent:       "#,##0%",
+		months:        [12]string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"},
+		shortMonths:   [12]string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"},
+		weekdays:      [7]string{"日曜日", "月曜日", "火曜日", "水曜日", "木曜日", "金曜日", "土曜日"},
+		shortWeekdays: [7]string{"日", "月", "火", "水", "木", "金", "土"},
+		ampm:          [2]string{"午前", "午後"},
+		dateStyles:    map[string]string{"short": "yyyy/MM/dd", "medium": "yyyy/MM/dd", "long": "yyyy年M月d日", "full": "yyyy年M月d日EEEE"},
+		timeStyles:    map[string]string{"short": "H:mm", "medium": "H:mm:ss", "long": "H:mm:ss z", "full": "H時mm分ss秒 z"},
+	},
+	"zh": {
+		tag:           "zh_CN",
+		numbers:       numberSymbols{decimal: ".", grouping: ","},
+		currency:      "¤#,##0.00",
+		percent:       "#,##0%",
+		months:        [12]string{"一月", "二月", "三月", "四月", "五月", "六月", "七月", "八月", "九月", "十月", "十一月", "十二月"},
+		shortMonths:   [12]string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"},
+		weekdays:      [7]string{"星期日", "星期一", "星期二", "星期三", "星期四", "星期五", "星期六"},
+		shortWeekdays: [7]string{"周日", "周一", "周二", "周三", "周四", "周五", "周六"},
+		ampm:          [2]string{"上午", "下午"},
+		dateStyles:    map[string]string{"short": "yy-M-d", "medium": "yyyy-M-d", "long": "yyyy年M月d日", "full": "yyyy年M月d日 EEEE"},
+		timeStyles:    map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"},
+	},
+}
+
+// currencies are the currency symbols and codes of the countries.
+var currencies = map[string][2]string{
+	"US": {"$", "USD"},
+	"CA": {"$", "CAD"},
+	"AU": {"$", "AUD"},
+	"MX": {"$", "MXN"},
+	"GB": {"£", "GBP"},
+	"CH": {"CHF", "CHF"},
+	"BR": {"R$", "BRL"},
+	"PL": {"zł", "PLN"},
+	"RU": {"₽", "RUB"},
+	"TR": {"₺", "TRY"},
+	"JP": {"￥", "JPY"},
+	"CN": {"¥", "CNY"},
+}
+
+// euroCountries are the countries whose currency is the euro.
+var euroCountries = "AT BE DE EE ES FI FR GR IE IT LT LU LV MT NL PT SI SK"
+
+// countryVariants change the data of a language for a country, where it
+// differs from the country of the language's default locale.
+var countryVariants = map[string]func(d *localeData){
+	"en_GB": func(d *localeData) {
+		d.dateStyles = map[string]string{"short": "dd/MM/yyyy", "medium": "d MMM yyyy", "long": "d MMMM yyyy", "full": "EEEE, d MMMM yyyy"}
+		d.timeStyles = map[string]string{"short": "HH:mm", "medium": "HH:mm:ss", "long": "HH:mm:ss z", "full": "HH:mm:ss z"}
+	},
+	"de_CH": func(d *localeData) {
+		d.numbers.decimal, d.numbers.grouping = ".", "’"
+		d.currency = "¤ #,##0.00"
+	},
+	"pt_BR": func(d *localeData) {
+		d.currency = "¤ #,##0.00"
+	},
+}
+
+var localeTag = regexp.MustCompile(`^([a-zA-Z]{2,3})(?:[_-]([a-zA-Z]{2}|[0-9]{3}))?(?:[_-]([0-9a-zA-Z]+))?$`)
+
+// maxCachedLocales bounds locales; when it is full, it is emptied.
+const maxCachedLocales = 1000
+
+// locales caches the data of the locales across executions, by the locale
+// as it is given.
+var locales = struct {
+	sync.Mutex
+	m map[string]*localeData
+}{m: make(map[string]*localeData)}
+
+// localeFor returns the data of the locale, such as "de_DE" or "de-DE".
+// Locales of languages that aren't supported are accepted, but present
+// values as in English.
+func localeFor(locale string) (*localeData, error) {
+	if locale == "" {
+		locale = defaultLocale
+	}
+	locales.Lock()
+	cached := locales.m[locale]
+	locales.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	m := localeTag.FindStringSubmatch(locale)
+	if m == nil {
+		return nil, fmt.Errorf("malformed locale %q", locale)
+	}
+	lang, country, variant := strings.ToLower(m[1]), strings.ToUpper(m[2]), m[3]
+	base, ok := languages[lang]
+	if !ok {
+		base = languages["en"]
+	}
+	d := *base
+	d.tag = lang
+	if country != "" {
+		d.tag += "_" + country
+	}
+	if variant != "" {
+		d.tag += "_" + variant
+	}
+	if country == "" && ok {
+		country = base.tag[strings.IndexByte(base.tag, '_')+1:]
+	}
+	if c, ok := currencies[country]; ok {
+		d.numbers.currencySymbol, d.numbers.currencyCode = c[0], c[1]
+	} else if country != "" && strings.Contains(euroCountries, country) {
+		d.numbers.currencySymbol, d.numbers.currencyCode = "€", "EUR"
+	} else {
+		d.numbers.currencySymbol, d.numbers.currencyCode = "¤", "XXX"
+	}
+	if variant, ok := countryVariants[lang+"_"+country]; ok {
+		variant(&d)
+	}
+	d.numbers = d.numbers.override(defaultNumberSymbols)
+	locales.Lock()
+	if len(locales.m) >= maxCachedLocales {
+		locales.m = make(map[string]*localeData)
+	}
+	locales.m[locale] = &d
+	locales.Unlock()
+	return &d, nil
+}
+
+// language returns the language of the locale.
+func (d *localeData) language() string {
+	if i := strings.IndexByte(d.tag, '_'); i >= 0 {
+		return d.tag[:i]
+	}
+	return d.tag
+}
+
+// name returns the localized name the Go layout of a month, a weekday or
+// AM/PM stands for in t, and whether the layout is one of these.
+func (d *localeData) name(layout string, t time.Time) (string, bool) {
+	switch layout {
+	case "January":
+		return d.months[t.Month()-1], true
+	case "Jan":
+		return d.shortMonths[t.Month()-1], true
+	case "Monday":
+		return d.weekdays[t.Weekday()], true
+	case "Mon":
+		return d.shortWeekdays[t.Weekday()], true
+	case "PM":
+		return d.ampm[t.Hour()/12], true
+	}
+	return "", false
+}
+
+// englishNames replaces the localized names of months, weekdays and AM/PM
+// in str with the English ones, so that str can be parsed with a Go layout.
+func (d *localeData) englishNames(str string) string {
+	en := languages["en"]
+	if d.language() == "en" {
+		return str
+	}
+	var pairs [][2]string
+	for i := range d.months {
+		pairs = append(pairs, [2]string{d.months[i], en.months[i]}, [2]string{d.shortMonths[i], en.shortMonths[i]})
+	}
+	for i := range d.weekdays {
+		pairs = append(pairs, [2]string{d.weekdays[i], en.weekdays[i]}, [2]string{d.shortWeekdays[i], en.shortWeekdays[i]})
+	}
+	pairs = append(pairs, [2]string{d.ampm[0], "AM"}, [2]string{d.ampm[1], "PM"})
+	// Replace the longest names first, as short names are often prefixes
+	// of the long ones.
+	sort.SliceStable(pairs, func(i, j int) bool { return len(pairs[i][0]) > len(pairs[j][0]) })
+	var oldnew []string
+	for _, p := range pairs {
+		oldnew = append(oldnew, p[0], p[1])
+	}
+	return strings.NewReplacer(oldnew...).Replace(str)
+}
+
+// toUpper and toLower convert the case of str as in the locale.
+func (d *localeData) toUpper(str string) string {
+	if d.upper != nil {
+		return strings.ToUpperSpecial(d.upper, str)
+	}
+	return strings.ToUpper(str)
+}
+
+func (d *localeData) toLower(str string) string {
+	if d.lower != nil {
+		return strings.ToLowerSpecial(d.lower, str)
+	}
+	return strings.ToLower(str)
+}
+
+// baseLetters maps the accented and ligature letters to the letters they
+// sort as.
+var baseLetters = func() map[rune]string {
+	m := make(map[rune]string)
+	for base, letters := range map[string]string{
+		"a": "àáâãäåāăą", "c": "çćĉċč", "d": "ďđ", "e": "èéêëēĕėęě",
+		"g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ",
+		"l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏő", "r": "ŕŗř",
+		"s": "śŝşš", "t": "ţťŧ", "u": "ùúûüũūŭůűų", "w": "ŵ", "y": "ýÿŷ",
+		"z": "źżž", "ss": "ß", "ae": "æ", "oe": "œ", "th": "þ",
+	} {
+		for _, r := range letters {
+			m[r] = base
+		}
+	}
+	return m
+}()
+
+// collate returns -1, 0 or +1 as a sorts before, with or after b in the
+// locale. As with a collator, letters are first compared without their
+// accents and case, then with their accents, then with their case, lower
+// case first; the letters of d.letters sort after their base letter.
+func (d *localeData) collate(a, b string) int {
+	if c := strings.Compare(d.collationKey(a), d.collationKey(b)); c != 0 {
+		return c
+	}
+	la, lb := d.toLower(a), d.toLower(b)
+	if c := strings.Compare(la, lb); c != 0 {
+		return c
+	}
+	if c := strings.Compare(swapCase(a), swapCase(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// collationKey returns str in lower case without accents, so that strings
+// compare by their letters alone.
+func (d *localeData) collationKey(str string) string {
+	var b strings.Builder
+	for _, r := range d.toLower(str) {
+		switch base, ok := baseLetters[r]; {
+		case ok && strings.ContainsRune(d.letters, r):
+			b.WriteString(base)
+			b.WriteRune(unicode.MaxRune)
+		case ok:
+			b.WriteString(base)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// swapCase swaps the case of the letters of str.
+func swapCase(str string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, str)
+}
+
+// localizedNames returns the names of the variants of the template name
+// for the locale, most specific first: for mail.ftl and de_DE, they are
+// mail_de_DE.ftl, mail_de.ftl and mail.ftl.
+func localizedNames(name, locale string) []string {
+	ext := path.Ext(name)
+	base := name[:len(name)-len(ext)]
+	parts := strings.FieldsFunc(locale, func(r rune) bool { return r == '_' || r == '-' })
+	names := make([]string, 0, len(parts)+1)
+	for i := len(parts); i > 0; i-- {
+		names = append(names, base+"_"+strings.Join(parts[:i], "_")+ext)
+	}
+	return append(names, name)
+}
+
+// LookupLocale is like Lookup, but returns the variant of the template for
+// the locale, such as de_DE, if there is one: it looks up mail_de_DE.ftl,
+// then mail_de.ftl, then mail.ftl for the name mail.ftl. <#include> looks up
+// templates in the same way, for the locale setting.
+func (t *Template) LookupLocale(name, locale string) *Template {
+	for _, name := range localizedNames(name, locale) {
+		if tmpl := t.Lookup(name); tmpl != nil && tmpl.Tree != nil {
+			return tmpl
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocales(t *testing.T) {
+	data := map[string]interface{}{
+		"x": 1234567.891,
+		"t": time.Date(2017, 3, 4, 15, 4, 5, 0, time.UTC),
+	}
+	tests := []struct {
+		name   string
+		locale string
+		input  string
+		output string
+		err    string
+	}{
+		{"default", "", "${.locale} ${.lang} ${x} ${x?string.currency} ${t}", "en_US en 1,234,567.891 $1,234,567.89 Mar 4, 2017 3:04:05 PM", ""},
+		{"german", "de_DE", "${.locale} ${.lang} ${x} ${x?string.currency} ${0.5?string.percent} ${t?date?string.full} ${t?time}",
+			"de_DE de 1.234.567,891 1.234.567,89 € 50 % Samstag, 4. März 2017 15:04:05", ""},
+		{"swiss german", "de-CH", "${x} ${x?string.currency}", "1’234’567.891 CHF 1’234’567.89", ""},
+		{"language only", "fr", "${.locale} ${x?string.currency} ${t?string.long}", "fr 1\u00a0234\u00a0567,89 € 4 mars 2017 15:04:05 UTC", ""},
+		{"british", "en_GB", "${x?string.currency} ${t?date?string.short}", "£1,234,567.89 04/03/2017", ""},
+		{"japanese", "ja_JP", "${1234?string.currency} ${t?date?string.long} ${t?string('a h:mm')}", "￥1,234 2017年3月4日 午後 3:04", ""},
+		{"other language", "xx_YY", "${.locale} ${x} ${t?date}", "xx_YY 1,234,567.891 Mar 4, 2017", ""},
+		{"names", "es", `${t?string("EEE d MMM")}`, "sáb 4 mar", ""},
+		{"parse", "de", `${"4. März 2017"?date("d. MMMM yyyy")?iso_utc} ${"Mi 01.03.2017"?date("EE dd.MM.yyyy")?iso_utc}`, "2017-03-04 2017-03-01", ""},
+		{"setting", "", `<#setting locale="de_DE">${x} <#setting locale="en">${x}`, "1.234.567,891 1,234,567.891", ""},
+		{"pattern symbols", "de_DE", `${x?string("#,##0.0")} ${x?c}`, "1.234.567,9 1234567.891", ""},
+		{"case", "en_US", `${"Iıİi"?upper_case} ${"TITLE"?lower_case}`, "IIİI title", ""},
+		{"turkish case", "tr_TR", `${"Iıİi"?upper_case} ${"TITLE"?lower_case}`, "IIİİ tıtle", ""},
+		{"bad locale", "", `<#setting locale="de DE">`, "", `malformed locale "de DE"`},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmpl.SetSetting("time_zone", "UTC"); err != nil {
+			t.Fatal(err)
+		}
+		if test.locale != "" {
+			if err := tmpl.SetSetting("locale", test.locale); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestLocalizedLookup(t *testing.T) {
+	set := New("set")
+	for name, text := range map[string]string{
+		"mail.ftl":          `<#include "footer.ftl">`,
+		"mail_de.ftl":       `Hallo<#include "footer.ftl">`,
+		"mail_de_AT.ftl":    `Servus<#include "footer.ftl">`,
+		"footer.ftl":        ` (${.locale})`,
+		"footer_de_AT.ftl":  ` (${.locale}, ${1000})`,
+		"dir.d/page.ftl":    "page",
+		"dir.d/page_fr.ftl": "page fr",
+	} {
+		if _, err := set.New(name).Parse(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name, locale, output string
+	}{
+		{"mail.ftl", "de_DE", "Hallo (de_DE)"},
+		{"mail.ftl", "de_AT", "Servus (de_AT, 1.000)"},
+		{"mail.ftl", "de", "Hallo (de)"},
+		{"mail.ftl", "fr_FR", " (fr_FR)"},
+		{"dir.d/page.ftl", "fr_CA", "page fr"},
+		{"dir.d/page.ftl", "it", "page"},
+	}
+	for _, test := range tests {
+		b := new(bytes.Buffer)
+		if err := set.ExecuteTemplateLocale(b, test.name, test.locale, nil); err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.name, test.locale, err)
+			continue
+		}
+		if b.String() != test.output {
+			t.Errorf("%s %s: expected %q, got %q", test.name, test.locale, test.output, b.String())
+		}
+	}
+	if tmpl := set.LookupLocale("mail.ftl", "de_CH"); tmpl == nil || tmpl.Name() != "mail_de.ftl" {
+		t.Errorf("LookupLocale: expected mail_de.ftl, got %v", tmpl)
+	}
+	if err := set.ExecuteTemplateLocale(new(bytes.Buffer), "none.ftl", "de", nil); err == nil {
+		t.Errorf("expected an error for a missing template")
+	}
+}
+
+func TestLocaleCacheIsBounded(t *testing.T) {
+	for i := 0; i < maxCachedLocales+10; i++ {
+		if _, err := localeFor(fmt.Sprintf("de_DE_v%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locales.Lock()
+	n := len(locales.m)
+	locales.Unlock()
+	if n > maxCachedLocales {
+		t.Errorf("%d locales are cached, more than %d", n, maxCachedLocales)
+	}
+}
@@ -0,0 +1,335 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"reflect"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The members of a Go value, as seen by templates, are its exported methods
+// and fields, by their Go names, and:
+//
+//   - a field tagged `ftl:"name"` is exposed as name instead of its Go name;
+//     a field tagged `ftl:"-"` is hidden,
+//   - a getter, a method GetName with no arguments, is also exposed as the
+//     property name, whose value is the result of the getter,
+//   - if lower camel case names are on, the methods and untagged fields are
+//     also exposed by their Go names in lower camel case, such as userName
+//     for UserName.
+//
+// Names are put in lower camel case the way Java beans are: the first letter
+// is lowered, unless the first two letters are upper case, so URL stays URL.
+// The Go names win over the derived ones, and shallower fields over the
+// fields promoted from embedded structs.
+
+type memberKind int
+
+const (
+	memberField  memberKind = iota // a struct field
+	memberMethod                   // a method, as a function value
+	memberGetter                   // the result of a getter method
+)
+
+// memberInfo locates a member of the values of a type.
+type memberInfo struct {
+	kind      memberKind
+	goName    string       // the name of the field or method in Go
+	owner     reflect.Type // the struct type declaring a promoted member
+	index     []int        // the index sequence of a field
+	method    int          // the index of a method of T, or -1 if only *T has it
+	ptrMethod int          // the index of a method of *T
+}
+
+// memberTable maps the names of the members of a type to their location.
+type memberTable map[string]*memberInfo
+
+type memberKey struct {
+	typ        reflect.Type
+	lowerCamel bool
+}
+
+// memberTables caches the member tables, by memberKey.
+var memberTables sync.Map
+
+// membersOf returns the member table of typ, which is not a pointer type.
+func membersOf(typ reflect.Type, lowerCamel bool) memberTable {
+	key := memberKey{typ, lowerCamel}
+	if m, ok := memberTables.Load(key); ok {
+		return m.(memberTable)
+	}
+	m, _ := memberTables.LoadOrStore(key, newMemberTable(typ, lowerCamel))
+	return m.(memberTable)
+}
+
+func newMemberTable(typ reflect.Type, lowerCamel bool) memberTable {
+	m := make(memberTable)
+	add := func(name string, info *memberInfo) {
+		if _, ok := m[name]; !ok && name != "" {
+			m[name] = info
+		}
+	}
+	ptr := reflect.PtrTo(typ)
+	var methods []*memberInfo
+	for i := 0; i < ptr.NumMethod(); i++ {
+		meth := ptr.Method(i)
+		info := &memberInfo{kind: memberMethod, goName: meth.Name, owner: methodOwner(typ, meth.Name), method: -1, ptrMethod: i}
+		if vm, ok := typ.MethodByName(meth.Name); ok {
+			info.method = vm.Index
+		}
+		add(meth.Name, info)
+		methods = append(methods, info)
+	}
+	var fields []string // the untagged fields
+	if typ.Kind() == reflect.Struct {
+		for _, f := range structFields(typ) {
+			add(f.name, &memberInfo{kind: memberField, goName: f.goName, owner: f.owner, index: f.index})
+			if !f.tagged {
+				fields = append(fields, f.name)
+			}
+		}
+	}
+	for i, info := range methods {
+		meth := ptr.Method(i)
+		if isGetter(meth) {
+			getter := *info
+			getter.kind = memberGetter
+			add(decapitalize(meth.Name[len("Get"):]), &getter)
+		}
+	}
+	if lowerCamel {
+		for i, info := range methods {
+			add(decapitalize(ptr.Method(i).Name), info)
+		}
+		for _, name := range fields {
+			add(decapitalize(name), m[name])
+		}
+	}
+	return m
+}
+
+// fieldNameLists caches the results of fieldNames, by memberKey.
+var fieldNameLists sync.Map
+
+// fieldNames returns the names of the fields of the struct type typ, which
+// are its keys as a hash, in the order they are declared in. An untagged
+// field is named in lower camel case if lower camel case names are on.
+func fieldNames(typ reflect.Type, lowerCamel bool) []string {
+	key := memberKey{typ, lowerCamel}
+	if names, ok := fieldNameLists.Load(key); ok {
+		return names.([]string)
+	}
+	table := membersOf(typ, lowerCamel)
+	var names []string
+	for _, f := range structFields(typ) {
+		name := f.name
+		if info := table[name]; info == nil || info.kind != memberField || info.goName != f.goName {
+			continue
+		}
+		if lower := decapitalize(name); lowerCamel && !f.tagged && table[lower] == table[name] {
+			name = lower
+		}
+		names = append(names, name)
+	}
+	cached, _ := fieldNameLists.LoadOrStore(key, names)
+	return cached.([]string)
+}
+
+// isGetter reports whether the method of a pointer type is a getter.
+func isGetter(meth reflect.Method) bool {
+	name := meth.Name
+	if len(name) <= len("Get") || name[:len("Get")] != "Get" {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(name[len("Get"):])
+	return unicode.IsUpper(r) && meth.Type.NumIn() == 1 && goodFunc(meth.Type)
+}
+
+// decapitalize returns name in lower camel case.
+func decapitalize(name string) string {
+	r0, n0 := utf8.DecodeRuneInString(name)
+	r1, _ := utf8.DecodeRuneInString(name[n0:])
+	if unicode.IsUpper(r0) && unicode.IsUpper(r1) {
+		return name
+	}
+	return string(unicode.ToLower(r0)) + name[n0:]
+}
+
+type structField struct {
+	name   string
+	goName string
+	owner  reflect.Type // the struct type declaring the field
+	index  []int
+	tagged bool
+}
+
+// structFields returns the exported fields of the struct type typ,
+// including the promoted ones, without the hidden ones. A shallower field
+// hides a deeper one of the same name.
+func structFields(typ reflect.Type) []structField {
+	var fields []structField
+	seen := make(map[string]bool)
+	visited := make(map[reflect.Type]bool)
+	level := []structField{{}}
+	types := []reflect.Type{typ}
+	for len(level) > 0 {
+		var next []structField
+		var nextTypes []reflect.Type
+		found := make(map[string]bool)
+		for i, parent := range level {
+			t := types[i]
+			if visited[t] {
+				continue
+			}
+			visited[t] = true
+			for j := 0; j < t.NumField(); j++ {
+				f := t.Field(j)
+				index := append(append([]int(nil), parent.index...), j)
+				if f.Anonymous {
+					et := f.Type
+					if et.Kind() == reflect.Ptr {
+						et = et.Elem()
+					}
+					if et.Kind() == reflect.Struct && f.Tag.Get("ftl") == "" {
+						next = append(next, structField{index: index})
+						nextTypes = append(nextTypes, et)
+					}
+				}
+				if f.PkgPath != "" {
+					continue
+				}
+				name, tagged := f.Name, false
+				if tag := f.Tag.Get("ftl"); tag != "" {
+					name, tagged = tag, true
+				}
+				if name == "-" || seen[name] {
+					continue
+				}
+				found[name] = true
+				fields = append(fields, structField{name, f.Name, t, index, tagged})
+			}
+		}
+		for name := range found {
+			seen[name] = true
+		}
+		level, types = next, nextTypes
+	}
+	return fields
+}
+
+// methodOwner returns the shallowest struct embedded in typ, directly or
+// not, whose methods include the method name, or else typ. That's the type
+// declaring the method, unless a shallower type declares one of the same
+// name.
+func methodOwner(typ reflect.Type, name string) reflect.Type {
+	owner, level := typ, []reflect.Type{typ}
+	for depth := 0; len(level) > 0 && depth < 8; depth++ {
+		var next []reflect.Type
+		for _, t := range level {
+			if t.Kind() != reflect.Struct {
+				continue
+			}
+			for i := 0; i < t.NumField(); i++ {
+				if f := t.Field(i); f.Anonymous {
+					et := f.Type
+					if et.Kind() == reflect.Ptr {
+						et = et.Elem()
+					}
+					if _, ok := reflect.PtrTo(et).MethodByName(name); ok {
+						next = append(next, et)
+					}
+				}
+			}
+		}
+		if len(next) > 0 {
+			owner = next[0]
+		}
+		level = next
+	}
+	return owner
+}
+
+// fieldByIndex returns the nested field of v with the index sequence, or
+// the zero Value if it is promoted through a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return zero
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// memberCache remembers the member table used last by an execution, which
+// saves looking it up in memberTables when listing values of the same type.
+type memberCache struct {
+	typ   reflect.Type
+	table memberTable
+}
+
+// hasNoMethods reports, cheaply, whether the values of typ surely have no
+// methods, even when addressable: unnamed types other than pointers,
+// structs and interfaces, and the predeclared types.
+func hasNoMethods(typ reflect.Type) bool {
+	if typ.PkgPath() != "" {
+		return false
+	}
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Struct, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// structMember returns the member name of receiver, which is neither a
+// pointer nor an interface, and whether it has one.
+func (s *state) structMember(receiver reflect.Value, name string) (reflect.Value, bool) {
+	typ := receiver.Type()
+	if s.members.typ != typ {
+		s.members = memberCache{typ, membersOf(typ, s.tmpl.lowerCamelCase)}
+	}
+	info := s.members.table[name]
+	if info == nil {
+		return zero, false
+	}
+	if !s.canAccess(typ, info) {
+		s.errorf("can't access %s of %s: denied by the member access policy", name, typ)
+	}
+	if info.kind == memberField {
+		return s.wrap(fieldByIndex(receiver, info.index)), true
+	}
+	// Need to get to a value of type *T to see all methods of T and *T.
+	var method reflect.Value
+	switch {
+	case receiver.CanAddr():
+		method = receiver.Addr().Method(info.ptrMethod)
+	case info.method >= 0:
+		method = receiver.Method(info.method)
+	default:
+		return zero, false
+	}
+	if info.kind == memberGetter {
+		return s.call(method, name, nil), true
+	}
+	return s.wrapObject(method), true
+}
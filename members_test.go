@@ -0,0 +1,211 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type Base struct {
+	ID      int
+	Created string
+}
+
+type Audit struct {
+	By string
+}
+
+type Account struct {
+	Base
+	*Audit
+	UserName string
+	Email    string `ftl:"mail"`
+	Password string `ftl:"-"`
+	URL      string
+	Created  string // hides Base.Created
+	secret   string
+}
+
+func (a *Account) GetDisplayName() string { return "@" + a.UserName }
+func (a Account) GetSecret() string       { return a.secret }
+func (a *Account) GetTwo(x int) int       { return 2 * x } // not a getter: it has an argument
+
+func TestMembers(t *testing.T) {
+	acct := &Account{
+		Base:     Base{ID: 7, Created: "base"},
+		UserName: "joe",
+		Email:    "joe@example.com",
+		Password: "hunter2",
+		URL:      "http://example.com",
+		Created:  "today",
+		secret:   "s",
+	}
+	tests := []struct {
+		name       string
+		input      string
+		lowerCamel bool
+		output     string
+	}{
+		{"go names", "${a.UserName} ${a.ID} ${a.Created} ${a.Base.Created}", false, "joe 7 today base"},
+		{"tag", "${a.mail} ${a.Email!'hidden'}", false, "joe@example.com hidden"},
+		{"hidden", "${a.Password!'hidden'} ${a.password!'hidden'}", true, "hidden hidden"},
+		{"getter", "${a.displayName} ${a.secret} ${a.GetDisplayName()}", false, "@joe s @joe"},
+		{"not a getter", "${a.two!'none'} ${a.GetTwo(2)}", false, "none 4"},
+		{"lower camel off", "${a.userName!'none'}", false, "none"},
+		{"lower camel", "${a.userName} ${a.id!'ID'} ${a.URL} ${a.getTwo(3)}", true, "joe ID http://example.com 6"},
+		{"nil embedded", "${a.By!'nobody'}", false, "nobody"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).SetLowerCamelCase(test.lowerCamel).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		if err := tmpl.Execute(b, map[string]interface{}{"a": acct}); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if b.String() != test.output {
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestMemberTableCached(t *testing.T) {
+	typ := reflect.TypeOf(Account{})
+	if m1, m2 := membersOf(typ, true), membersOf(typ, true); reflect.ValueOf(m1).Pointer() != reflect.ValueOf(m2).Pointer() {
+		t.Error("member table built twice")
+	}
+}
+
+func TestDecapitalize(t *testing.T) {
+	for name, want := range map[string]string{"UserName": "userName", "URL": "URL", "X": "x", "ID": "ID", "Id": "id"} {
+		if got := decapitalize(name); got != want {
+			t.Errorf("decapitalize(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+type row struct {
+	ID       int
+	Name     string
+	Email    string
+	Active   bool
+	Balance  float64
+	Tags     []string
+	Manager  *row
+	metadata map[string]string
+}
+
+func (r *row) GetInitial() string { return r.Name[:1] }
+
+const tableTemplate = `<table>
+<#list rows as r>
+<tr><td>${r.ID}</td><td>${r.Name}</td><td>${r.initial}</td><td>${r.Email}</td><td><#if r.Active>yes<#else>no</#if></td><td>${r.Balance}</td><td>${(r.Manager.Name)!"-"}</td></tr>
+</#list>
+</table>
+`
+
+func tableRows(n int) []*row {
+	boss := &row{ID: 0, Name: "Boss"}
+	rows := make([]*row, n)
+	for i := range rows {
+		rows[i] = &row{ID: i + 1, Name: "User", Email: "user@example.com", Active: i%2 == 0, Balance: float64(i) / 4, Manager: boss}
+	}
+	return rows
+}
+
+func BenchmarkTable10k(b *testing.B) {
+	tmpl, err := New("table").Parse(tableTemplate)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := map[string]interface{}{"rows": tableRows(10000)}
+	var buf bytes.Buffer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTable10kParallel(b *testing.B) {
+	tmpl, err := New("table").Parse(tableTemplate)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := map[string]interface{}{"rows": tableRows(10000)}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var buf bytes.Buffer
+		for pb.Next() {
+			buf.Reset()
+			if err := tmpl.ExecuteTemplate(&buf, "table", data); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestMembersConcurrent(t *testing.T) {
+	tmpl, err := New("table").Parse(tableTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{"rows": tableRows(100)}
+	var want bytes.Buffer
+	if err := tmpl.Execute(&want, data); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			var b bytes.Buffer
+			err := tmpl.ExecuteTemplate(&b, "table", data)
+			if err == nil && b.String() != want.String() {
+				err = fmt.Errorf("unexpected output %q", b.String())
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+type labels map[key]string
+
+type key string
+
+func TestNamedMapKeys(t *testing.T) {
+	tmpl, err := New("keys").Parse("${l.a}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, map[string]interface{}{"l": labels{"a": "A"}}); err != nil || b.String() != "A" {
+		t.Errorf("got %q, %v", b.String(), err)
+	}
+}
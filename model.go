@@ -0,0 +1,222 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"reflect"
+	"time"
+)
+
+// The model interfaces let Go types control how their values appear in
+// templates, like the TemplateModel interfaces of FreeMarker. A value
+// implementing none of them is adapted by reflection: structs and maps are
+// hashes, slices and arrays are sequences, and so on. A value may implement
+// several of them, such as a hash that is also a string.
+//
+// The values returned by the model methods are themselves adapted the same
+// way; a nil value is a missing value.
+
+// HashModel is a value whose members are got by name, as in ${user.name}
+// or ${user["name"]}.
+type HashModel interface {
+	Get(key string) (interface{}, error)
+}
+
+// HashModelEx is a HashModel that can list its keys, so that it can be
+// listed with <#list hash as key, value>. The values are got with Get.
+type HashModelEx interface {
+	HashModel
+	Keys() ([]string, error)
+}
+
+// SequenceModel is a value whose items are got by index, as in ${seq[0]},
+// and which can be listed.
+type SequenceModel interface {
+	Len() (int, error)
+	Index(i int) (interface{}, error)
+}
+
+// CollectionModel is a value that can only be listed, item after item,
+// such as a lazily loaded collection.
+type CollectionModel interface {
+	Iterator() (ModelIterator, error)
+}
+
+// ModelIterator iterates over the items of a CollectionModel.
+type ModelIterator interface {
+	HasNext() (bool, error)
+	Next() (interface{}, error)
+}
+
+// ScalarModel is a value that is a string.
+type ScalarModel interface {
+	AsString() (string, error)
+}
+
+// NumberModel is a value that is a number. AsNumber returns a value of a Go
+// numeric type.
+type NumberModel interface {
+	AsNumber() (interface{}, error)
+}
+
+// BooleanModel is a value that is a boolean.
+type BooleanModel interface {
+	AsBool() (bool, error)
+}
+
+// DateType tells which parts of a date are meaningful.
+type DateType int
+
+const (
+	UnknownDateType DateType = iota // unknown whether it's a date, a time or both
+	DateOnly                        // a date without a time of day
+	TimeOnly                        // a time of day without a date
+	DateTime                        // both a date and a time of day
+)
+
+// DateModel is a value that is a date, a time or both.
+type DateModel interface {
+	AsDate() (time.Time, error)
+	DateType() DateType
+}
+
+// MethodModel is a value that can be called, as in ${format(x, "short")}.
+// The arguments are the values of the argument expressions, nil for a
+// missing one.
+type MethodModel interface {
+	Exec(args []interface{}) (interface{}, error)
+}
+
+// modelOf returns the Go value of v to test against the model interfaces,
+// taking its address if it can so the methods with a pointer receiver count.
+// It returns nil if v has no usable value.
+func modelOf(v reflect.Value) interface{} {
+	v = indirectInterface(v)
+	if !v.IsValid() || hasNoMethods(v.Type()) {
+		return nil
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		v = v.Addr()
+	}
+	if !v.CanInterface() || v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// valueOf adapts the result of a model method.
+func valueOf(x interface{}) reflect.Value {
+	if x == nil {
+		return zero
+	}
+	return reflect.ValueOf(x)
+}
+
+// unwrap returns the Go value of v if it is a scalar, number, boolean or
+// date model, or else v. When v is of several of these, the one matching
+// the kind wanted, if any, wins; then they are tried in that order.
+func (s *state) unwrap(v reflect.Value, want kind) reflect.Value {
+	m := modelOf(v)
+	if m == nil {
+		return v
+	}
+	var (
+		x   interface{}
+		err error
+	)
+	switch {
+	case want == boolKind && isBooleanModel(m):
+		x, err = m.(BooleanModel).AsBool()
+	case isNumberKind(want) && isNumberModel(m):
+		x, err = m.(NumberModel).AsNumber()
+	default:
+		switch m := m.(type) {
+		case ScalarModel:
+			x, err = m.AsString()
+		case NumberModel:
+			x, err = m.AsNumber()
+		case BooleanModel:
+			x, err = m.AsBool()
+		case DateModel:
+			x, err = m.AsDate()
+		default:
+			return v
+		}
+	}
+	if err != nil {
+		s.errorf("%w", err)
+	}
+	if x == nil {
+		s.errorf("%T has no value", m)
+	}
+	return reflect.ValueOf(x)
+}
+
+func isBooleanModel(m interface{}) bool {
+	_, ok := m.(BooleanModel)
+	return ok
+}
+
+func isNumberModel(m interface{}) bool {
+	_, ok := m.(NumberModel)
+	return ok
+}
+
+// getKey returns the member key of the hash model m.
+func (s *state) getKey(m HashModel, key string) reflect.Value {
+	x, err := m.Get(key)
+	if err != nil {
+		s.errorf("can't get %q: %w", key, err)
+	}
+	return s.wrap(valueOf(x))
+}
+
+// seqIndex returns the item i of the sequence model m, or the zero Value if
+// i is out of bounds.
+func (s *state) seqIndex(m SequenceModel, i int) reflect.Value {
+	if i < 0 || i >= s.seqLen(m) {
+		return zero
+	}
+	x, err := m.Index(i)
+	if err != nil {
+		s.errorf("can't get item %d: %w", i, err)
+	}
+	return s.wrap(valueOf(x))
+}
+
+func (s *state) seqLen(m SequenceModel) int {
+	n, err := m.Len()
+	if err != nil {
+		s.errorf("can't get the length: %w", err)
+	}
+	return n
+}
+
+// callMethod calls the method model m.
+func (s *state) callMethod(m MethodModel, name string, args []reflect.Value) reflect.Value {
+	argv := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg = indirectInterface(arg); arg.IsValid() && arg.CanInterface() {
+			argv[i] = arg.Interface()
+		}
+	}
+	x, err := m.Exec(argv)
+	if err != nil {
+		s.errorf("error calling %s: %w", name, err)
+	}
+	return s.wrap(valueOf(x))
+}
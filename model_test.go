@@ -0,0 +1,173 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pages is a collection loaded lazily, a page at a time.
+type pages struct {
+	total, size int
+	loaded      int // the number of pages loaded
+}
+
+func (p *pages) Iterator() (ModelIterator, error) {
+	return &pageIterator{p: p}, nil
+}
+
+type pageIterator struct {
+	p    *pages
+	page []int
+	next int // the index of the next item
+}
+
+func (it *pageIterator) HasNext() (bool, error) {
+	return it.next < it.p.total, nil
+}
+
+func (it *pageIterator) Next() (interface{}, error) {
+	if i := it.next % it.p.size; i == 0 {
+		it.page = it.page[:0]
+		for j := it.next; j < it.next+it.p.size && j < it.p.total; j++ {
+			it.page = append(it.page, j)
+		}
+		it.p.loaded++
+	}
+	x := it.page[it.next%it.p.size]
+	it.next++
+	return x, nil
+}
+
+// props is an ordered hash.
+type props [][2]string
+
+func (p props) Get(key string) (interface{}, error) {
+	for _, kv := range p {
+		if kv[0] == key {
+			return kv[1], nil
+		}
+	}
+	return nil, nil
+}
+
+func (p props) Keys() ([]string, error) {
+	keys := make([]string, len(p))
+	for i, kv := range p {
+		keys[i] = kv[0]
+	}
+	return keys, nil
+}
+
+// squares is the sequence of the squares of the first n integers.
+type squares int
+
+func (n squares) Len() (int, error)                { return int(n), nil }
+func (n squares) Index(i int) (interface{}, error) { return i * i, nil }
+
+type money struct{ cents int }
+
+func (m money) AsNumber() (interface{}, error) { return float64(m.cents) / 100, nil }
+func (m money) AsString() (string, error) {
+	return fmt.Sprintf("$%d.%02d", m.cents/100, m.cents%100), nil
+}
+
+type switchModel bool
+
+func (f switchModel) AsBool() (bool, error) { return bool(f), nil }
+
+type day string
+
+func (d day) AsDate() (time.Time, error) { return time.Parse("2006-01-02", string(d)) }
+func (d day) DateType() DateType         { return DateOnly }
+
+type joiner string
+
+func (j joiner) Exec(args []interface{}) (interface{}, error) {
+	var parts []string
+	for _, arg := range args {
+		parts = append(parts, fmt.Sprint(arg))
+	}
+	return strings.Join(parts, string(j)), nil
+}
+
+var errBroken = errors.New("broken")
+
+type broken struct{}
+
+func (broken) Get(key string) (interface{}, error) { return nil, errBroken }
+
+func TestModels(t *testing.T) {
+	data := map[string]interface{}{
+		"pages":   &pages{total: 5, size: 2},
+		"empty":   &pages{size: 2},
+		"props":   props{{"b", "1"}, {"a", "2"}},
+		"squares": squares(4),
+		"price":   money{1250},
+		"yes":     switchModel(true),
+		"day":     day("2017-03-04"),
+		"join":    joiner("-"),
+		"broken":  broken{},
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"collection", "<#list pages as p>${p}</#list>", "01234"},
+		{"empty collection", "<#list empty as p>${p}<#else>none</#list>", "none"},
+		{"hash member", "${props.a}${props['b']}", "21"},
+		{"missing hash member", "${props.c!'-'}<#if props.c??>?</#if>", "-"},
+		{"hash listing", "<#list props as k, v>${k}=${v};</#list>", "b=1;a=2;"},
+		{"sequence", "<#list squares as x>${x},</#list>${squares[3]}${squares[4]!'-'}", "0,1,4,9,9-"},
+		{"sequence slice", "<#list squares[1..2] as x>${x}</#list>", "14"},
+		{"scalar", "${price}", "$12.50"},
+		{"number", "${price * 2}<#if (price > 12)>big</#if>", "25big"},
+		{"boolean", "<#if yes>y</#if><#if !yes>n</#if>", "y"},
+		{"date", "${day?iso_utc}", "2017-03-04"},
+		{"method", "${join('a', 1, x!)}", "a-1-"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		if err := tmpl.Execute(b, data); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if b.String() != test.output {
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+	if loaded := data["pages"].(*pages).loaded; loaded != 3 {
+		t.Errorf("expected 3 pages loaded, got %d", loaded)
+	}
+	tmpl, err := New("broken").Parse("${broken.x}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpl.Execute(new(bytes.Buffer), data); !errors.Is(err, errBroken) {
+		t.Errorf("expected the error of the model, got %v", err)
+	}
+}
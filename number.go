@@ -0,0 +1,838 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+// Numbers are formatted with the number_format setting, or the format given
+// to ?string. A format is "number", the default, "currency", "percent",
+// "computer", which is the format of ?c, or a pattern in the syntax of
+// Java's DecimalFormat, such as "#,##0.00;(#)", optionally followed by
+// options after ";;", as in "0.0;; roundingMode=halfUp multiplier=1000".
+
+// numberSymbols are the symbols used to format numbers.
+type numberSymbols struct {
+	decimal        string
+	grouping       string
+	minus          string
+	percent        string
+	perMille       string
+	infinity       string
+	nan            string
+	currencySymbol string
+	currencyCode   string
+}
+
+// defaultNumberSymbols are the symbols a locale doesn't set.
+var defaultNumberSymbols = numberSymbols{
+	decimal:        ".",
+	grouping:       ",",
+	minus:          "-",
+	percent:        "%",
+	perMille:       "‰",
+	infinity:       "∞",
+	nan:            "NaN",
+	currencySymbol: "$",
+	currencyCode:   "USD",
+}
+
+// Rounding modes, named as in Java's RoundingMode.
+const (
+	roundHalfEven = iota
+	roundHalfUp
+	roundHalfDown
+	roundUp
+	roundDown
+	roundCeiling
+	roundFloor
+	roundUnnecessary
+)
+
+var roundingModes = map[string]int{
+	"halfEven":    roundHalfEven,
+	"halfUp":      roundHalfUp,
+	"halfDown":    roundHalfDown,
+	"up":          roundUp,
+	"down":        roundDown,
+	"ceiling":     roundCeiling,
+	"floor":       roundFloor,
+	"unnecessary": roundUnnecessary,
+}
+
+// affixPart is a part of the prefix or the suffix of a number format: a
+// literal, or a symbol such as the percent sign.
+type affixPart struct {
+	text   string
+	symbol byte // 0 for a literal, or one of '%', 'm' (per mille), '$' (currency symbol), 'C' (currency code), '-'
+}
+
+// numberFormat is a compiled number format.
+type numberFormat struct {
+	posPrefix, posSuffix []affixPart
+	negPrefix, negSuffix []affixPart
+	hasNegative          bool // whether the pattern has a negative subpattern
+	minInt               int
+	minFrac, maxFrac     int
+	grouping             int // the size of the groups of integer digits, or 0
+	shift                int // the power of ten the number is multiplied by
+	multiplier           float64
+	rounding             int
+	symbols              numberSymbols // the symbols set in the options
+}
+
+// numberFormats caches the compiled number patterns.
+var numberFormats sync.Map
+
+// compileNumberFormat returns the compiled number format, with the patterns
+// of the named formats of the locale; it is nil for the computer format.
+func compileNumberFormat(format string, loc *localeData) (*numberFormat, error) {
+	switch format {
+	case "", "number":
+		format = "#,##0.###"
+	case "currency":
+		format = loc.currency
+	case "percent":
+		format = loc.percent
+	case "computer", "c":
+		return nil, nil
+	}
+	if f, ok := numberFormats.Load(format); ok {
+		return f.(*numberFormat), nil
+	}
+	f, err := parseNumberPattern(format)
+	if err != nil {
+		return nil, fmt.Errorf("%v in the number format %q", err, format)
+	}
+	numberFormats.Store(format, f)
+	return f, nil
+}
+
+func parseNumberPattern(format string) (*numberFormat, error) {
+	f := &numberFormat{multiplier: 1}
+	pattern, options := format, ""
+	if i := strings.Index(format, ";;"); i >= 0 {
+		pattern, options = format[:i], format[i+2:]
+	}
+	rest, err := f.parseSubpattern(pattern, true)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		neg := &numberFormat{multiplier: 1}
+		if rest, err = neg.parseSubpattern(rest, false); err != nil {
+			return nil, err
+		}
+		if rest != "" {
+			return nil, fmt.Errorf("more than two subpatterns")
+		}
+		f.negPrefix, f.negSuffix, f.hasNegative = neg.posPrefix, neg.posSuffix, true
+	}
+	for _, opt := range strings.Fields(options) {
+		eq := strings.IndexByte(opt, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("option %q isn't name=value", opt)
+		}
+		name, value := opt[:eq], strings.Trim(opt[eq+1:], `'"`)
+		switch name {
+		case "roundingMode":
+			mode, ok := roundingModes[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown rounding mode %q", value)
+			}
+			f.rounding = mode
+		case "multiplier":
+			m, err := strconv.ParseFloat(value, 64)
+			if err != nil || m == 0 {
+				return nil, fmt.Errorf("bad multiplier %q", value)
+			}
+			f.multiplier = m
+		case "decimalSeparator":
+			f.symbols.decimal = value
+		case "groupingSeparator":
+			f.symbols.grouping = value
+		case "minusSign":
+			f.symbols.minus = value
+		case "infinity":
+			f.symbols.infinity = value
+		case "nan":
+			f.symbols.nan = value
+		case "currencySymbol":
+			f.symbols.currencySymbol = value
+		case "currencyCode":
+			f.symbols.currencyCode = value
+		default:
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+	}
+	return f, nil
+}
+
+// parseSubpattern parses the positive subpattern, or only the prefix and
+// suffix of the negative one, returning the text after the ';' ending it.
+func (f *numberFormat) parseSubpattern(pattern string, positive bool) (rest string, err error) {
+	const (
+		inPrefix = iota
+		inNumber
+		inSuffix
+	)
+	phase := inPrefix
+	var prefix, suffix []affixPart
+	var zeros, hashes, fracZeros, fracHashes int
+	lastComma := -1 // the number of integer digits before the last ','
+	inFraction := false
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		if phase == inPrefix || phase == inSuffix {
+			var part affixPart
+			switch c {
+			case '#', '0', ',', '.':
+				if phase == inPrefix {
+					phase = inNumber
+					i--
+					continue
+				}
+				return "", fmt.Errorf("unexpected %q in the suffix", c)
+			case ';':
+				rest = string(runes[i+1:])
+				runes = runes[:i]
+				continue
+			case '\'':
+				j := i + 1
+				for j < len(runes) && runes[j] != '\'' {
+					j++
+				}
+				if j == len(runes) {
+					return "", fmt.Errorf("unterminated quote")
+				}
+				text := string(runes[i+1 : j])
+				if text == "" {
+					text = "'"
+				}
+				part.text, i = text, j
+			case '%':
+				part.symbol = '%'
+				f.shift = 2
+			case '‰':
+				part.symbol = 'm'
+				f.shift = 3
+			case '¤':
+				part.symbol = '$'
+				if i+1 < len(runes) && runes[i+1] == '¤' {
+					part.symbol = 'C'
+					i++
+				}
+			case '-':
+				part.symbol = '-'
+			default:
+				part.text = string(c)
+			}
+			if phase == inPrefix {
+				prefix = append(prefix, part)
+			} else {
+				suffix = append(suffix, part)
+			}
+			continue
+		}
+		switch c {
+		case '#':
+			if inFraction {
+				fracHashes++
+			} else {
+				hashes++
+			}
+		case '0':
+			if inFraction {
+				if fracHashes > 0 {
+					return "", fmt.Errorf("'0' after '#' in the fraction")
+				}
+				fracZeros++
+			} else {
+				zeros++
+			}
+		case ',':
+			if inFraction {
+				return "", fmt.Errorf("grouping separator in the fraction")
+			}
+			lastComma = zeros + hashes
+		case '.':
+			if inFraction {
+				return "", fmt.Errorf("more than one decimal separator")
+			}
+			inFraction = true
+		case 'E':
+			return "", fmt.Errorf("scientific notation is not supported")
+		default:
+			phase = inSuffix
+			i--
+		}
+	}
+	if positive {
+		if zeros+hashes+fracZeros+fracHashes == 0 {
+			return "", fmt.Errorf("no digits")
+		}
+		f.minInt, f.minFrac, f.maxFrac = zeros, fracZeros, fracZeros+fracHashes
+		if lastComma >= 0 {
+			f.grouping = zeros + hashes - lastComma
+		}
+	}
+	f.posPrefix, f.posSuffix = prefix, suffix
+	return rest, nil
+}
+
+// decimal is a number in decimal: 0.digits * 10**point.
+type decimal struct {
+	neg    bool
+	digits []byte // without leading or trailing zeros
+	point  int
+}
+
+// maxRatDigits is the number of decimal places of a rational, such as 1/3,
+// whose decimal expansion doesn't terminate.
+const maxRatDigits = 32
+
+// decimalOf converts a finite number to a decimal.
+func decimalOf(v reflect.Value) decimal {
+	var d decimal
+	var s string
+	switch k, _ := basicKind(v); k {
+	case intKind:
+		n := v.Int()
+		d.neg = n < 0
+		s = strconv.FormatUint(absInt64(n), 10)
+		d.point = len(s)
+	case uintKind:
+		s = strconv.FormatUint(v.Uint(), 10)
+		d.point = len(s)
+	case bigKind:
+		r, _ := toRat(v)
+		d.neg = r.Sign() < 0
+		scale := ratScale(r)
+		if scale < 0 {
+			// The decimal expansion doesn't terminate; enough of it.
+			scale = maxRatDigits
+		}
+		str := new(big.Rat).Abs(r).FloatString(scale)
+		if i := strings.IndexByte(str, '.'); i >= 0 {
+			s, d.point = str[:i]+str[i+1:], i
+		} else {
+			s, d.point = str, len(str)
+		}
+	default:
+		f := v.Float()
+		d.neg = f < 0
+		bits := 64
+		if v.Kind() == reflect.Float32 {
+			bits = 32
+		}
+		e := strconv.FormatFloat(math.Abs(f), 'e', -1, bits)
+		mant, exp := e[:strings.IndexByte(e, 'e')], e[strings.IndexByte(e, 'e')+1:]
+		s = strings.Replace(mant, ".", "", 1)
+		x, _ := strconv.Atoi(exp)
+		d.point = x + 1
+	}
+	d.digits = []byte(strings.TrimRight(s, "0"))
+	if lead := len(d.digits) - len(strings.TrimLeft(string(d.digits), "0")); lead > 0 {
+		d.digits = d.digits[lead:]
+		d.point -= lead
+	}
+	if len(d.digits) == 0 {
+		d.point = 0
+	}
+	return d
+}
+
+func absInt64(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
+
+// round rounds d to frac fraction digits with the rounding mode.
+func (d *decimal) round(frac int, mode int) error {
+	keep := d.point + frac
+	if keep >= len(d.digits) {
+		return nil
+	}
+	digits := d.digits
+	if keep < 0 {
+		// Pad with leading zeros, so that the last kept digit exists.
+		digits = append([]byte(strings.Repeat("0", -keep)), digits...)
+		keep = 0
+	}
+	kept, dropped := append([]byte(nil), digits[:keep]...), digits[keep:]
+	// The last digit of d isn't zero, so neither is the dropped part.
+	var cmpHalf int // the dropped part compared with half a unit of the last kept digit
+	switch {
+	case dropped[0] > '5' || dropped[0] == '5' && len(dropped) > 1:
+		cmpHalf = 1
+	case dropped[0] < '5':
+		cmpHalf = -1
+	}
+	inc := false
+	switch mode {
+	case roundUp:
+		inc = true
+	case roundCeiling:
+		inc = !d.neg
+	case roundFloor:
+		inc = d.neg
+	case roundHalfUp:
+		inc = cmpHalf >= 0
+	case roundHalfDown:
+		inc = cmpHalf > 0
+	case roundHalfEven:
+		inc = cmpHalf > 0 || cmpHalf == 0 && len(kept) > 0 && (kept[len(kept)-1]-'0')%2 == 1
+	case roundUnnecessary:
+		return fmt.Errorf("rounding necessary to format %s", d)
+	}
+	point := -frac + len(kept)
+	if inc {
+		i := len(kept) - 1
+		for ; i >= 0 && kept[i] == '9'; i-- {
+			kept[i] = '0'
+		}
+		if i >= 0 {
+			kept[i]++
+		} else {
+			kept = append([]byte{'1'}, kept...)
+			point++
+		}
+	}
+	str := strings.TrimLeft(string(kept), "0")
+	point -= len(kept) - len(str)
+	d.digits = []byte(strings.TrimRight(str, "0"))
+	d.point = point
+	if len(d.digits) == 0 {
+		d.point = 0 // but keep the sign, as Java prints -0.0001 as -0.00
+	}
+	return nil
+}
+
+func (d decimal) String() string {
+	var b strings.Builder
+	if d.neg {
+		b.WriteByte('-')
+	}
+	if digits := d.intDigits(); digits != "" {
+		b.WriteString(digits)
+	} else {
+		b.WriteByte('0')
+	}
+	if frac := d.fracDigits(); frac != "" {
+		b.WriteByte('.')
+		b.WriteString(frac)
+	}
+	return b.String()
+}
+
+// intDigits returns the digits of the integer part of d, "" for 0.
+func (d decimal) intDigits() string {
+	switch {
+	case d.point <= 0:
+		return ""
+	case d.point >= len(d.digits):
+		return string(d.digits) + strings.Repeat("0", d.point-len(d.digits))
+	}
+	return string(d.digits[:d.point])
+}
+
+// fracDigits returns the digits of the fraction part of d, without the
+// trailing zeros.
+func (d decimal) fracDigits() string {
+	switch {
+	case d.point >= len(d.digits):
+		return ""
+	case d.point < 0:
+		return strings.Repeat("0", -d.point) + string(d.digits)
+	}
+	return string(d.digits[d.point:])
+}
+
+// format formats the number v with the symbols.
+func (f *numberFormat) format(v reflect.Value, sym numberSymbols) (string, error) {
+	sym = f.symbols.override(sym)
+	if x, ok := nonFinite(v); ok {
+		if math.IsNaN(x) {
+			return sym.nan, nil
+		}
+		return f.affixed(x < 0, sym.infinity, sym), nil
+	}
+	if f.multiplier != 1 {
+		r, _ := toRat(v)
+		m, _ := toRat(reflect.ValueOf(f.multiplier))
+		v = reflect.ValueOf(new(big.Rat).Mul(r, m))
+	}
+	d := decimalOf(v)
+	if len(d.digits) > 0 {
+		d.point += f.shift
+	}
+	if err := d.round(f.maxFrac, f.rounding); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	digits := d.intDigits()
+	if len(digits) < f.minInt {
+		digits = strings.Repeat("0", f.minInt-len(digits)) + digits
+	}
+	frac := d.fracDigits()
+	if len(frac) < f.minFrac {
+		frac += strings.Repeat("0", f.minFrac-len(frac))
+	}
+	if digits == "" && frac == "" {
+		digits = "0"
+	}
+	for i, c := range digits {
+		if i > 0 && f.grouping > 0 && (len(digits)-i)%f.grouping == 0 {
+			b.WriteString(sym.grouping)
+		}
+		b.WriteRune(c)
+	}
+	if frac != "" {
+		b.WriteString(sym.decimal)
+		b.WriteString(frac)
+	}
+	return f.affixed(d.neg, b.String(), sym), nil
+}
+
+// affixed adds the prefix and the suffix to the formatted absolute value.
+func (f *numberFormat) affixed(neg bool, number string, sym numberSymbols) string {
+	prefix, suffix := f.posPrefix, f.posSuffix
+	if neg && f.hasNegative {
+		prefix, suffix = f.negPrefix, f.negSuffix
+	}
+	var b strings.Builder
+	if neg && !f.hasNegative {
+		b.WriteString(sym.minus)
+	}
+	writeAffix(&b, prefix, sym)
+	b.WriteString(number)
+	writeAffix(&b, suffix, sym)
+	return b.String()
+}
+
+func writeAffix(b *strings.Builder, affix []affixPart, sym numberSymbols) {
+	for _, part := range affix {
+		switch part.symbol {
+		case '%':
+			b.WriteString(sym.percent)
+		case 'm':
+			b.WriteString(sym.perMille)
+		case '$':
+			b.WriteString(sym.currencySymbol)
+		case 'C':
+			b.WriteString(sym.currencyCode)
+		case '-':
+			b.WriteString(sym.minus)
+		default:
+			b.WriteString(part.text)
+		}
+	}
+}
+
+// override returns sym with the symbols set in c.
+func (c numberSymbols) override(sym numberSymbols) numberSymbols {
+	for _, p := range [][2]*string{
+		{&sym.decimal, &c.decimal},
+		{&sym.grouping, &c.grouping},
+		{&sym.minus, &c.minus},
+		{&sym.infinity, &c.infinity},
+		{&sym.nan, &c.nan},
+		{&sym.currencySymbol, &c.currencySymbol},
+		{&sym.currencyCode, &c.currencyCode},
+	} {
+		if *p[1] != "" {
+			*p[0] = *p[1]
+		}
+	}
+	return sym
+}
+
+// formatComputer formats the number v in the computer format: the shortest
+// decimal representation that reads back as the same number, without
+// grouping or exponent.
+func formatComputer(v reflect.Value) string {
+	switch k, _ := basicKind(v); k {
+	case intKind:
+		return strconv.FormatInt(v.Int(), 10)
+	case uintKind:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	if x, ok := nonFinite(v); ok {
+		switch {
+		case math.IsNaN(x):
+			return "NaN"
+		case x > 0:
+			return "INF"
+		}
+		return "-INF"
+	}
+	return decimalOf(v).String()
+}
+
+// nonFinite returns the number v as a float if it is NaN or infinite.
+func nonFinite(v reflect.Value) (float64, bool) {
+	var x float64
+	switch k, _ := basicKind(v); k {
+	case floatKind:
+		x = v.Float()
+	case bigKind:
+		if f, ok := bigNumber(v).(*big.Float); !ok || !f.IsInf() {
+			return 0, false
+		}
+		x = bigToFloat(v)
+	default:
+		return 0, false
+	}
+	return x, math.IsNaN(x) || math.IsInf(x, 0)
+}
+
+// formatNumber formats the number v with the format, or the number_format
+// setting if format is "".
+func (s *state) formatNumber(v reflect.Value, format string) (string, error) {
+	if format == "" {
+		format = s.settings.numberFormat
+	}
+	loc := s.settings.localeData()
+	f, err := compileNumberFormat(format, loc)
+	if err != nil {
+		return "", err
+	}
+	if f == nil {
+		return formatComputer(v), nil
+	}
+	return f.format(v, loc.numbers)
+}
+
+// numberFormatter is the value of ?string applied to a number. It is the
+// number formatted with the number_format setting, and its members are the
+// number formatted with other formats, as in ?string.percent.
+type numberFormatter struct {
+	s *state
+	v reflect.Value
+}
+
+func (f numberFormatter) AsString() (string, error) {
+	return f.s.formatNumber(f.v, "")
+}
+
+func (f numberFormatter) Get(format string) (interface{}, error) {
+	return f.s.formatNumber(f.v, format)
+}
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"c":           builtinC,
+		"round":       roundBuiltin(roundRatHalfUp),
+		"floor":       roundBuiltin(floorRat),
+		"ceiling":     roundBuiltin(ceilingRat),
+		"int":         roundBuiltin(truncRat),
+		"abs":         builtinAbs,
+		"is_nan":      builtinIsNaN,
+		"is_infinite": builtinIsInfinite,
+		"lower_abc":   abcBuiltin('a'),
+		"upper_abc":   abcBuiltin('A'),
+		"roman":       builtinRoman,
+	})
+}
+
+// numberTarget evaluates the target of the built-in n, which must be a
+// number.
+func (s *state) numberTarget(n *parse.BuiltinNode) reflect.Value {
+	v, _ := indirect(s.unwrap(s.target(n), floatKind))
+	if k, _ := basicKind(v); !isNumberKind(k) {
+		s.targetError(n, v, "a number")
+	}
+	return v
+}
+
+// builtinC evaluates ?c, which formats a number or a boolean for computers
+// rather than humans, such as in a URL, in JavaScript or in JSON. Booleans
+// are true or false, whatever boolean_format is.
+func builtinC(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	v := s.target(n)
+	if b, ok := s.asBool(v); ok {
+		return reflect.ValueOf(strconv.FormatBool(b))
+	}
+	v, _ = indirect(s.unwrap(v, floatKind))
+	if k, _ := basicKind(v); !isNumberKind(k) {
+		s.targetError(n, v, "a number or a boolean")
+	}
+	return reflect.ValueOf(formatComputer(v))
+}
+
+// roundBuiltin returns the built-in that converts a number to an integer
+// with round. Integers are returned as they are, and the result is an int if
+// it fits, otherwise a *big.Rat.
+func roundBuiltin(round func(r *big.Rat) *big.Int) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 0, 0)
+		v := s.numberTarget(n)
+		if k, _ := basicKind(v); k == intKind || k == uintKind {
+			return v
+		}
+		r, ok := toRat(v)
+		if !ok {
+			s.errorf("?%s expects a finite number, but %s has evaluated to %s", n.Name, n.Target, formatComputer(v))
+		}
+		return ratValue(new(big.Rat).SetInt(round(r)))
+	}
+}
+
+// floorRat returns the greatest integer not greater than r.
+func floorRat(r *big.Rat) *big.Int {
+	// Euclidean division rounds towards minus infinity for a positive
+	// divisor, and the denominator is always positive.
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+// ceilingRat returns the least integer not less than r.
+func ceilingRat(r *big.Rat) *big.Int {
+	i := floorRat(new(big.Rat).Neg(r))
+	return i.Neg(i)
+}
+
+// roundRatHalfUp returns the integer nearest to r, and the greater one if
+// r is halfway between two, as FreeMarker does: 2.5 is 3, and -2.5 is -2.
+func roundRatHalfUp(r *big.Rat) *big.Int {
+	return floorRat(new(big.Rat).Add(r, big.NewRat(1, 2)))
+}
+
+// truncRat returns the integer part of r.
+func truncRat(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// builtinAbs evaluates ?abs, the absolute value of a number. The result is
+// of the type of the number, unless it doesn't fit, as the absolute value
+// of the least int64.
+func builtinAbs(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	v := s.numberTarget(n)
+	switch k, _ := basicKind(v); k {
+	case intKind:
+		x := v.Int()
+		if x >= 0 {
+			return v
+		}
+		abs := reflect.New(v.Type()).Elem()
+		if abs.SetInt(-x); -x > 0 && abs.Int() == -x {
+			return abs
+		}
+		return ratValue(new(big.Rat).SetInt(new(big.Int).Neg(big.NewInt(x))))
+	case floatKind:
+		return reflect.ValueOf(math.Abs(v.Float())).Convert(v.Type())
+	case bigKind:
+		switch x := bigNumber(v).(type) {
+		case *big.Int:
+			return reflect.ValueOf(new(big.Int).Abs(x))
+		case *big.Float:
+			return reflect.ValueOf(new(big.Float).Abs(x))
+		case *big.Rat:
+			return reflect.ValueOf(new(big.Rat).Abs(x))
+		}
+	}
+	return v
+}
+
+// builtinIsNaN evaluates ?is_nan, which tells whether a number is NaN.
+func builtinIsNaN(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	x, ok := nonFinite(s.numberTarget(n))
+	return reflect.ValueOf(ok && math.IsNaN(x))
+}
+
+// builtinIsInfinite evaluates ?is_infinite, which tells whether a number is
+// positive or negative infinity.
+func builtinIsInfinite(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	x, ok := nonFinite(s.numberTarget(n))
+	return reflect.ValueOf(ok && math.IsInf(x, 0))
+}
+
+// ordinalTarget evaluates the target of the built-in n, which must be an
+// integer from 1 to max, or at least 1 if max is 0.
+func (s *state) ordinalTarget(n *parse.BuiltinNode, max int) int {
+	v := s.numberTarget(n)
+	r, ok := toRat(v)
+	if !ok || !r.IsInt() || !r.Num().IsInt64() || int64(int(r.Num().Int64())) != r.Num().Int64() {
+		s.errorf("?%s expects an integer, but %s has evaluated to %s", n.Name, n.Target, formatComputer(v))
+	}
+	i := int(r.Num().Int64())
+	switch {
+	case max > 0 && (i < 1 || i > max):
+		s.errorf("?%s expects a number from 1 to %d, but got %d", n.Name, max, i)
+	case i < 1:
+		s.errorf("?%s expects a number of at least 1, but got %d", n.Name, i)
+	}
+	return i
+}
+
+// abcBuiltin returns the built-in that converts a number to letters, as
+// numbered lists do: 1 is a, 26 is z, 27 is aa, and so on, with the letters
+// from first.
+func abcBuiltin(first byte) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 0, 0)
+		i := s.ordinalTarget(n, 0)
+		var b []byte
+		for ; i > 0; i = (i - 1) / 26 {
+			b = append(b, first+byte((i-1)%26))
+		}
+		for l, r := 0, len(b)-1; l < r; l, r = l+1, r-1 {
+			b[l], b[r] = b[r], b[l]
+		}
+		return reflect.ValueOf(string(b))
+	}
+}
+
+// romanNumerals are the values of the Roman numerals, and of the pairs
+// written with subtraction, from the greatest.
+var romanNumerals = []struct {
+	value   int
+	numeral string
+}{
+	{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"},
+	{100, "C"}, {90, "XC"}, {50, "L"}, {40, "XL"},
+	{10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"},
+}
+
+// builtinRoman evaluates ?roman, which converts a number from 1 to 3999 to
+// Roman numerals.
+func builtinRoman(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	i := s.ordinalTarget(n, 3999)
+	var b strings.Builder
+	for _, r := range romanNumerals {
+		for ; i >= r.value; i -= r.value {
+			b.WriteString(r.numeral)
+		}
+	}
+	return reflect.ValueOf(b.String())
+}
@@ -0,0 +1,149 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestNumbers(t *testing.T) {
+	data := map[string]interface{}{
+		"big":   1234567.891,
+		"n":     -1234.5,
+		"i":     1000000,
+		"u":     uint8(200),
+		"f32":   float32(0.1),
+		"small": 0.000012,
+		"nan":   math.NaN(),
+		"inf":   math.Inf(-1),
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"default", "${big} ${n} ${i} ${u}", "1,234,567.891 -1,234.5 1,000,000 200", ""},
+		{"default rounding", "${1.23456} ${0.0005} ${0.0015}", "1.235 0 0.002", ""},
+		{"concatenation", `${"n=" + i}`, "n=1,000,000", ""},
+		{"pattern", `${big?string("0.00")} ${3?string("000")} ${0.5?string("#")} ${0.25?string("#.#")}`, "1234567.89 003 0 .2", ""},
+		{"grouping", `${big?string("#,##0.##")} ${i?string("#,####")}`, "1,234,567.89 100,0000", ""},
+		{"negative subpattern", `${n?string("#,##0.##;(#)")} ${1?string("#;(#)")}`, "(1,234.5) 1", ""},
+		{"affixes", `${n?string("'#'0.0' EUR'")} ${5?string("-0")}`, "-#1234.5 EUR -5", ""},
+		{"named", "${0.256?string.percent} ${big?string.currency} ${big?string.number} ${big?string.computer}",
+			"26% $1,234,567.89 1,234,567.891 1234567.891", ""},
+		{"per mille", `${0.0123?string("0.#‰")}`, "12.3‰", ""},
+		{"currency code", `${1?string("¤¤ 0.00")}`, "USD 1.00", ""},
+		{"rounding modes", `${2.5?string("0")} ${3.5?string("0")} ${2.5?string("0;; roundingMode=halfUp")} ` +
+			`${(-2.1)?string("0;; roundingMode=floor")} ${2.1?string("0;; roundingMode=ceiling")} ${2.9?string("0;; roundingMode=down")} ` +
+			`${2.01?string("0.0;; roundingMode=up")} ${2.5?string("0;; roundingMode=halfDown")}`,
+			"2 4 3 -3 3 2 2.1 2", ""},
+		{"round to zero", `${(-0.001)?string("0.00")} ${0.009?string("0.00")} ${0.4?string("#;; roundingMode=up")}`, "-0.00 0.01 1", ""},
+		{"negative rounded to zero", `${(-0.0001)?string("0.00;(0.00)")} ${(-0.4)?string("#")} ${0?string("0.00")}`, "(0.00) -0 0.00", ""},
+		{"carry", `${9.999?string("0.00")} ${999.9?string("#,##0")}`, "10.00 1,000", ""},
+		{"options", `${big?string("#,##0.00;; decimalSeparator=',' groupingSeparator='.'")} ${1.5?string("0;; multiplier=1000")}`,
+			"1.234.567,89 1500", ""},
+		{"computer", "${big?c} ${i?c} ${small?c} ${f32?c} ${1e21?c} ${nan?c} ${inf?c}",
+			"1234567.891 1000000 0.000012 0.1 1000000000000000000000 NaN -INF", ""},
+		{"special", "${nan} ${inf}", "NaN -∞", ""},
+		{"setting", `<#setting number_format="0.0">${big} <#setting numberFormat="computer">${big} ${i}`, "1234567.9 1234567.891 1000000", ""},
+		{"setting percent", `<#setting number_format="percent">${0.5}`, "50%", ""},
+		{"unnecessary", `${1.5?string("0;; roundingMode=unnecessary")}`, "", "rounding necessary to format 1.5"},
+		{"exponent", `${1?string("0.0E0")}`, "", `scientific notation is not supported in the number format "0.0E0"`},
+		{"bad option", `${1?string("0;; rounding=up")}`, "", `unknown option "rounding"`},
+		{"bad setting", `<#setting number_format="0.#0">`, "", "'0' after '#' in the fraction"},
+		{"not a number", `${"x"?c}`, "", "?c expects a number"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestNumberBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"i8":   int8(-128),
+		"min":  int64(math.MinInt64),
+		"u":    uint16(7),
+		"f32":  float32(-2.5),
+		"huge": 1e30,
+		"bigi": big.NewInt(-42),
+		"bigr": big.NewRat(-7, 2),
+		"bigf": big.NewFloat(2.5),
+		"nan":  math.NaN(),
+		"inf":  math.Inf(1),
+		"binf": new(big.Float).SetInf(true),
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"round half up", "${2.5?round} ${(-2.5)?round} ${1.4999?round} ${(-0.5)?round} ${f32?round} ${bigr?round} ${bigf?round}",
+			"3 -2 1 0 -2 -3 3", ""},
+		{"floor and ceiling", "${2.7?floor} ${(-2.1)?floor} ${2.1?ceiling} ${(-2.7)?ceiling} ${bigr?floor} ${bigr?ceiling}",
+			"2 -3 3 -2 -4 -3", ""},
+		{"int", "${2.9?int} ${(-2.9)?int} ${bigr?int} ${u?int} ${i8?int}", "2 -2 -3 7 -128", ""},
+		{"integers unchanged", "${7?round} ${u?floor} ${bigi?ceiling} ${min?c?length}", "7 7 -42 20", ""},
+		{"big result", "${huge?round?c}", "1000000000000000000000000000000", ""},
+		{"abs", "${(-3)?abs} ${3?abs} ${(-1.5)?abs} ${f32?abs} ${u?abs} ${bigi?abs} ${bigr?abs?c} ${i8?abs} ${min?abs?c}",
+			"3 3 1.5 2.5 7 42 3.5 128 9223372036854775808", ""},
+		{"is_nan", "<#list [nan, inf, 1, bigf] as x><#if x?is_nan>1<#else>0</#if></#list>", "1000", ""},
+		{"is_infinite", "<#list [inf, binf, nan, 1.5] as x><#if x?is_infinite>1<#else>0</#if></#list>", "1100", ""},
+		{"abc", "${1?lower_abc} ${26?lower_abc} ${27?lower_abc} ${52?upper_abc} ${703?upper_abc} ${2.0?lower_abc}", "a z aa AZ AAA b", ""},
+		{"roman", "${1?roman} ${4?roman} ${9?roman} ${14?roman} ${1994?roman} ${3999?roman}", "I IV IX XIV MCMXCIV MMMCMXCIX", ""},
+		{"round nan", "${nan?round}", "", "?round expects a finite number, but nan has evaluated to NaN"},
+		{"abc zero", "${0?lower_abc}", "", "?lower_abc expects a number of at least 1, but got 0"},
+		{"abc fraction", "${1.5?upper_abc}", "", "?upper_abc expects an integer, but 1.5 has evaluated to 1.5"},
+		{"roman range", "${4000?roman}", "", "?roman expects a number from 1 to 3999, but got 4000"},
+		{"not a number", `${"1"?abs}`, "", "?abs expects a number"},
+		{"arguments", "${1.5?round(1)}", "", "?round doesn't take arguments"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
@@ -53,21 +53,25 @@ func (i item) String() string {
 
 const (
 	LowestPrec  = 0 // non-operators
-	UnaryPrec   = 6
-	HighestPrec = 7
+	UnaryPrec   = 7
+	HighestPrec = 8
 )
 
+// precedence returns the operator precedence of the binary operator i.
+// If i is not a binary operator, the result is LowestPrec.
 func (i item) precedence() int {
 	switch i.typ {
-	case itemLowestPrecOpt:
-		return LowestPrec
-	case itemEq, itemNeq, itemLess, itemLessEq:
+	case itemOr:
+		return 1
+	case itemAnd:
+		return 2
+	case itemEq, itemNeq, itemAssign, itemLess, itemLessEq, itemGreater, itemGreaterEq:
 		return 3
-	case itemAdd, itemMinus:
+	case itemRange, itemRangeExclusive, itemRangeLimited:
 		return 4
-	case itemMultiply, itemDivide:
+	case itemAdd, itemMinus:
 		return 5
-	case itemDot:
+	case itemMultiply, itemDivide, itemModulo:
 		return 6
 	}
 
@@ -79,32 +83,67 @@ type itemType int
 
 // Make the types pretty print.
 var itemName = map[itemType]string{
-	itemError:          "error",
-	itemBool:           "bool",
-	itemEOF:            "EOF",
-	itemIdentifier:     "identifier",
-	itemEq:             "==",
-	itemNeq:            "!=",
-	itemAdd:            "+",
-	itemMinus:          "-",
-	itemMultiply:       "*",
-	itemDivide:         "/",
-	itemLess:           "<",
-	itemLessEq:         "<=",
-	itemDot:            ".",
-	itemCharConstant:   "char",
-	itemStringConstant: "string",
-	itemNumber:         "number",
-	itemLeftParen:      "(",
-	itemRightParen:     ")",
-	itemSpace:          "space",
-	itemText:           "text",
+	itemError:              "error",
+	itemBool:               "bool",
+	itemEOF:                "EOF",
+	itemIdentifier:         "identifier",
+	itemEq:                 "==",
+	itemNeq:                "!=",
+	itemAdd:                "+",
+	itemMinus:              "-",
+	itemMultiply:           "*",
+	itemDivide:             "/",
+	itemModulo:             "%",
+	itemLess:               "<",
+	itemLessEq:             "<=",
+	itemGreater:            ">",
+	itemGreaterEq:          ">=",
+	itemAnd:                "&&",
+	itemOr:                 "||",
+	itemNot:                "!",
+	itemAssign:             "=",
+	itemBuiltin:            "?",
+	itemExists:             "??",
+	itemRange:              "..",
+	itemRangeExclusive:     "..<",
+	itemRangeLimited:       "..*",
+	itemDot:                ".",
+	itemArrow:              "->",
+	itemCharConstant:       "char",
+	itemStringConstant:     "string",
+	itemNumber:             "number",
+	itemComma:              ",",
+	itemColon:              ":",
+	itemEllipsis:           "...",
+	itemLeftParen:          "(",
+	itemRightParen:         ")",
+	itemLeftBracket:        "[",
+	itemRightBracket:       "]",
+	itemLeftBrace:          "{",
+	itemRightBrace:         "}",
+	itemSpace:              "space",
+	itemText:               "text",
+	itemLeftInterpolation:  "${",
+	itemRightInterpolation: "}",
+	itemStartDirective:     "<#",
+	itemCloseDirective:     ">",
+	itemEmptyDirective:     "/>",
+	itemEndDirective:       "</#",
+	itemStartUserDirective: "<@",
+	itemEndUserDirective:   "</@",
 
 	// directives
-	itemDirectiveIf:     "if",
-	itemDirectiveElseif: "elseif",
-	itemDirectiveElse:   "else",
-	itemDirectiveList:   "list",
+	itemDirectiveInclude: "include",
+	itemDirectiveMacro:   "macro",
+	itemDirectiveIf:      "if",
+	itemDirectiveElseif:  "elseif",
+	itemDirectiveElse:    "else",
+	itemDirectiveList:    "list",
+	itemDirectiveNested:  "nested",
+	itemDirectiveAttempt: "attempt",
+	itemDirectiveRecover: "recover",
+	itemDirectiveSetting: "setting",
+	itemAs:               "as",
 }
 
 func (i itemType) String() string {
@@ -122,33 +161,53 @@ const (
 	itemEOF                            // EOF
 	itemIdentifier                     // alphanumeric identifier
 	itemText                           // plain text
-	itemNumber                         // simple number, including imaginary
+	itemNumber                         // simple number
 	itemCharConstant                   // character constant
 	itemStringConstant                 // string constant
 	itemSpace                          // run of spaces separating arguments
 
 	_itemOperatorBeg
-	itemAdd           // +
-	itemMinus         // -
-	itemMultiply      // *
-	itemDivide        // /
-	itemLess          // <
-	itemLessEq        // <=
-	itemGreater       // gt
-	itemGreaterEq     // gte
-	itemEq            // ==
-	itemNeq           // !=
-	itemDot           // .
-	itemLowestPrecOpt // "#"
+	itemAdd            // +
+	itemMinus          // -
+	itemMultiply       // *
+	itemDivide         // /
+	itemModulo         // %
+	itemLess           // < or lt
+	itemLessEq         // <= or lte
+	itemGreater        // gt, or > inside parentheses
+	itemGreaterEq      // gte, or >= inside parentheses
+	itemEq             // ==
+	itemNeq            // !=
+	itemAnd            // &&
+	itemOr             // ||
+	itemNot            // !, also the default value operator
+	itemAssign         // =
+	itemBuiltin        // ?
+	itemExists         // ??
+	itemRange          // ..
+	itemRangeExclusive // ..< or ..!
+	itemRangeLimited   // ..*
+	itemDot            // .
+	itemArrow          // ->, in a lambda
 	_itemOperatorEnd
 
 	itemLeftInterpolation  // ${
 	itemRightInterpolation // }
 	itemStartDirective     // <#
 	itemCloseDirective     // >
+	itemEmptyDirective     // />
 	itemEndDirective       // </#
+	itemStartUserDirective // <@
+	itemEndUserDirective   // </@
 	itemLeftParen          // (
 	itemRightParen         // )
+	itemLeftBracket        // [
+	itemRightBracket       // ]
+	itemLeftBrace          // {
+	itemRightBrace         // }
+	itemComma              // ,
+	itemColon              // :
+	itemEllipsis           // ...
 
 	_itemDirectiveBeg
 	itemDirectiveInclude // include directive
@@ -157,6 +216,10 @@ const (
 	itemDirectiveElseif  // elseif directive
 	itemDirectiveElse    // else directive
 	itemDirectiveList    // list directive
+	itemDirectiveNested  // nested directive
+	itemDirectiveAttempt // attempt directive
+	itemDirectiveRecover // recover directive
+	itemDirectiveSetting // setting directive
 	itemAs               // keyword in list directive
 	_itemDirectiveEnd
 )
@@ -168,10 +231,19 @@ var directives = map[string]itemType{
 	"elseif":  itemDirectiveElseif,
 	"else":    itemDirectiveElse,
 	"list":    itemDirectiveList,
-	"as":      itemAs,
+	"nested":  itemDirectiveNested,
+	"attempt": itemDirectiveAttempt,
+	"recover": itemDirectiveRecover,
+	"setting": itemDirectiveSetting,
+}
+
+var keywords = map[string]itemType{
+	"as": itemAs,
 }
 
 var comparators = map[string]itemType{
+	"lt":  itemLess,
+	"lte": itemLessEq,
 	"gt":  itemGreater,
 	"gte": itemGreaterEq,
 }
@@ -186,16 +258,21 @@ type stateFn func(*lexer) stateFn
 
 // lexer holds the state of the scanner.
 type lexer struct {
-	name       string    // the name of the input; used only for error reports
-	input      string    // the string being scanned
-	state      stateFn   // the next lexing function to enter
-	pos        Pos       // current position in the input
-	start      Pos       // start position of this item
-	width      Pos       // width of last rune read from input
-	lastPos    Pos       // position of most recent item returned by nextItem
-	items      chan item // channel of scanned items
-	parenDepth int       // nesting depth of ( ) exprs
-	line       int       // 1+number of newlines seen
+	name          string    // the name of the input; used only for error reports
+	input         string    // the string being scanned
+	state         stateFn   // the next lexing function to enter
+	pos           Pos       // current position in the input
+	start         Pos       // start position of this item
+	width         Pos       // width of last rune read from input
+	lastPos       Pos       // position of most recent item returned by nextItem
+	items         chan item // channel of scanned items
+	parenDepth    int       // nesting depth of ( ) and [ ] exprs
+	braceDepth    int       // nesting depth of { } hash literals
+	interpolation bool      // scanning an interpolation rather than a directive
+	expression    bool      // scanning a lone expression, up to the end of the input
+	resync        bool      // keep scanning after an error instead of stopping
+	line          int       // 1+number of newlines seen
+	startLine     int       // start line of this item
 }
 
 // next returns the next rune in the input.
@@ -234,15 +311,22 @@ func (l *lexer) backup() {
 
 // emit passes an item back to the client.
 func (l *lexer) emit(t itemType) {
-	// fmt.Println("emit", l.input[l.start:l.pos])
-	l.items <- item{t, l.start, l.input[l.start:l.pos], l.line}
+	l.items <- item{t, l.start, l.input[l.start:l.pos], l.startLine}
 
 	l.start = l.pos
+	l.startLine = l.line
 }
 
 // ignore skips over the pending input before this point.
 func (l *lexer) ignore() {
 	l.start = l.pos
+	l.startLine = l.line
+}
+
+// skip advances over n bytes of input that need no scanning, keeping the line count.
+func (l *lexer) skip(n int) {
+	l.line += strings.Count(l.input[l.pos:l.pos+Pos(n)], "\n")
+	l.pos += Pos(n)
 }
 
 // accept consumes the next rune if it's from the valid set.
@@ -263,8 +347,13 @@ func (l *lexer) acceptRun(valid string) {
 
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
+// If the lexer resyncs after errors, scanning instead continues at the next
+// interpolation or directive.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...), l.line}
+	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...), l.startLine}
+	if l.resync {
+		return lexResync
+	}
 	return nil
 }
 
@@ -286,10 +375,47 @@ func (l *lexer) drain() {
 // lex creates a new scanner for the input string.
 func lex(name, input string) *lexer {
 	l := &lexer{
-		name:  name,
-		input: input,
-		items: make(chan item),
-		line:  1,
+		name:      name,
+		input:     input,
+		items:     make(chan item),
+		line:      1,
+		startLine: 1,
+	}
+
+	go l.run()
+
+	return l
+}
+
+// lexResyncing creates a new scanner for the input string that reports an
+// error and carries on with the next interpolation or directive, rather than
+// stopping at the first error.
+func lexResyncing(name, input string) *lexer {
+	l := &lexer{
+		name:      name,
+		input:     input,
+		items:     make(chan item),
+		resync:    true,
+		line:      1,
+		startLine: 1,
+	}
+
+	go l.run()
+
+	return l
+}
+
+// lexExpr creates a new scanner for the input string, which is a lone
+// expression rather than a template, as evaluated by ?eval.
+func lexExpr(name, input string) *lexer {
+	l := &lexer{
+		name:          name,
+		input:         input,
+		items:         make(chan item),
+		interpolation: true,
+		expression:    true,
+		line:          1,
+		startLine:     1,
 	}
 
 	go l.run()
@@ -299,7 +425,11 @@ func lex(name, input string) *lexer {
 
 // run runs the state machine for the lexer.
 func (l *lexer) run() {
-	for l.state = lexText; l.state != nil; {
+	start := lexText
+	if l.expression {
+		start = lexExpression
+	}
+	for l.state = start; l.state != nil; {
 		l.state = l.state(l)
 	}
 
@@ -313,67 +443,91 @@ const (
 	rightComment       = "-->"
 	startDirective     = "<#"
 	endDirective       = "</#"
+	startUserDirective = "<@"
+	endUserDirective   = "</@"
 	closeDirective     = ">"
+	emptyDirective     = "/>"
 )
 
 // State functions.
 
-// lexText scans until an opening interpolation "${", comment "<#--", directive "<#" or "</#".
-func lexText(l *lexer) stateFn {
-	l.width = 0
-
-	if x := strings.Index(l.input[l.pos:], leftInterpolation); x >= 0 {
-		l.pos += Pos(x)
-		if l.pos > l.start {
-			l.emit(itemText)
+// nextBoundary returns the offset from the current position of the first
+// opening interpolation "${", comment "<#--", directive "<#" or "</#", or
+// user-defined directive "<@" or "</@", or -1 if there is none.
+func (l *lexer) nextBoundary() int {
+	for x := 0; ; {
+		i := strings.IndexAny(l.input[int(l.pos)+x:], "$<")
+		if i < 0 {
+			return -1
 		}
-
-		return lexInterpolation
-	}
-
-	if x := strings.Index(l.input[l.pos:], leftComment); x >= 0 {
-		l.pos += Pos(x)
-		if l.pos > l.start {
-			l.emit(itemText)
+		x += i
+		rest := l.input[int(l.pos)+x:]
+		if strings.HasPrefix(rest, leftInterpolation) || strings.HasPrefix(rest, startDirective) ||
+			strings.HasPrefix(rest, endDirective) || strings.HasPrefix(rest, startUserDirective) ||
+			strings.HasPrefix(rest, endUserDirective) {
+			return x
 		}
-
-		return lexComment
+		x++
 	}
+}
 
-	if x := strings.Index(l.input[l.pos:], startDirective); x >= 0 {
-		l.pos += Pos(x)
-		if l.pos > l.start {
-			l.emit(itemText)
-		}
+// lexText scans until an opening interpolation "${", comment "<#--", directive "<#" or "</#",
+// or user-defined directive "<@" or "</@".
+func lexText(l *lexer) stateFn {
+	l.width = 0
 
-		return lexDirective
-	}
+	x := l.nextBoundary()
+	if x < 0 {
+		l.skip(len(l.input) - int(l.pos))
 
-	if x := strings.Index(l.input[l.pos:], endDirective); x >= 0 {
-		l.pos += Pos(x)
+		// Correctly reached EOF.
 		if l.pos > l.start {
 			l.emit(itemText)
 		}
 
-		return lexDirective
-	}
+		l.emit(itemEOF)
 
-	l.pos = Pos(len(l.input))
+		return nil
+	}
 
-	// Correctly reached EOF.
+	l.skip(x)
 	if l.pos > l.start {
 		l.emit(itemText)
 	}
 
-	l.emit(itemEOF)
+	switch rest := l.input[l.pos:]; {
+	case strings.HasPrefix(rest, leftInterpolation):
+		return lexInterpolation
+	case strings.HasPrefix(rest, leftComment):
+		return lexComment
+	case strings.HasPrefix(rest, startUserDirective), strings.HasPrefix(rest, endUserDirective):
+		return lexUserDirective
+	}
 
-	return nil
+	return lexDirective
+}
+
+// lexResync skips the input following an error up to the next opening
+// interpolation or directive, forgetting any unbalanced brackets.
+func lexResync(l *lexer) stateFn {
+	l.parenDepth = 0
+	l.braceDepth = 0
+
+	if x := l.nextBoundary(); x >= 0 {
+		l.skip(x)
+	} else {
+		l.skip(len(l.input) - int(l.pos))
+	}
+	l.ignore()
+
+	return lexText
 }
 
 // lexInterpolation scans the interpolation "${".
 func lexInterpolation(l *lexer) stateFn {
 	l.pos += Pos(len(leftInterpolation))
 	l.emit(itemLeftInterpolation)
+	l.interpolation = true
 
 	return lexExpression
 }
@@ -384,10 +538,13 @@ func lexComment(l *lexer) stateFn {
 
 	i := strings.Index(l.input[l.pos:], rightComment)
 	if i < 0 {
+		l.start = l.pos - Pos(len(leftComment))
+		l.skip(len(l.input) - int(l.pos)) // the rest of the input is commented out
+
 		return l.errorf("unclosed comment")
 	}
 
-	l.pos += Pos(i + len(rightComment))
+	l.skip(i + len(rightComment))
 	l.ignore() // skip the whole comment text
 
 	return lexText
@@ -398,18 +555,41 @@ func lexComment(l *lexer) stateFn {
 func lexExpression(l *lexer) stateFn {
 	r := l.next()
 	switch {
-	case r == eof || isEndOfLine(r):
+	case r == eof:
+		if l.expression {
+			l.emit(itemEOF)
+
+			return nil
+		}
+		if l.interpolation {
+			return l.errorf("unclosed interpolation")
+		}
+
 		return l.errorf("unclosed directive")
-	case isSpace(r):
+	case isSpace(r) || isEndOfLine(r):
 		return lexSpace
 	case r == '.':
+		if l.accept(".") {
+			switch {
+			case l.accept("."):
+				l.emit(itemEllipsis)
+			case l.accept("<!"):
+				l.emit(itemRangeExclusive)
+			case l.accept("*"):
+				l.emit(itemRangeLimited)
+			default:
+				l.emit(itemRange)
+			}
+
+			return lexExpression
+		}
 		// special look-ahead for ".field" so we don't break l.backup().
 		if l.pos < Pos(len(l.input)) {
 			r := l.input[l.pos]
 			if r < '0' || '9' < r {
 				l.emit(itemDot)
 
-				return lexDirective
+				return lexExpression
 			}
 		}
 
@@ -418,10 +598,22 @@ func lexExpression(l *lexer) stateFn {
 		l.backup()
 
 		return lexNumber
+	case r == 'r' && (l.peek() == '"' || l.peek() == '\''):
+		return lexRawString
 	case r == '"':
 		return lexString
 	case r == '\'':
 		return lexChar
+	case !l.expression && r == '<' && strings.ContainsRune("#@", l.peek()),
+		!l.expression && r == '<' && (strings.HasPrefix(l.input[l.pos:], "/#") || strings.HasPrefix(l.input[l.pos:], "/@")):
+		// A directive starts here, so the interpolation or directive before it
+		// was never closed.
+		l.backup()
+		if l.interpolation {
+			return l.errorf("unclosed interpolation")
+		}
+
+		return l.errorf("unclosed directive")
 	case r == '!' || r == '=' || r == '<':
 		l.backup()
 
@@ -430,6 +622,46 @@ func lexExpression(l *lexer) stateFn {
 		l.backup()
 
 		return lexIdentifier // gt, gte are identifiers
+	case r == '+':
+		l.emit(itemAdd)
+	case r == '-':
+		if l.accept(">") {
+			l.emit(itemArrow)
+		} else {
+			l.emit(itemMinus)
+		}
+	case r == '*':
+		l.emit(itemMultiply)
+	case r == '%':
+		l.emit(itemModulo)
+	case r == '/':
+		if l.peek() == '>' && !l.interpolation && l.parenDepth == 0 {
+			l.next()
+			l.emit(itemEmptyDirective)
+
+			return lexText
+		}
+		l.emit(itemDivide)
+	case r == '&':
+		if !l.accept("&") {
+			return l.errorf("unexpected %#U, use && for logical and", r)
+		}
+		l.emit(itemAnd)
+	case r == '|':
+		if !l.accept("|") {
+			return l.errorf("unexpected %#U, use || for logical or", r)
+		}
+		l.emit(itemOr)
+	case r == '?':
+		if l.accept("?") {
+			l.emit(itemExists)
+		} else {
+			l.emit(itemBuiltin)
+		}
+	case r == ',':
+		l.emit(itemComma)
+	case r == ':':
+		l.emit(itemColon)
 	case r == '(':
 		l.emit(itemLeftParen)
 		l.parenDepth++
@@ -440,11 +672,42 @@ func lexExpression(l *lexer) stateFn {
 		if l.parenDepth < 0 {
 			return l.errorf("unexpected right paren %#U", r)
 		}
+	case r == '[':
+		l.emit(itemLeftBracket)
+		l.parenDepth++
+	case r == ']':
+		l.emit(itemRightBracket)
+		l.parenDepth--
+
+		if l.parenDepth < 0 {
+			return l.errorf("unexpected right bracket %#U", r)
+		}
+	case r == '{':
+		l.emit(itemLeftBrace)
+		l.braceDepth++
 	case r == '>':
+		if l.interpolation || l.parenDepth > 0 {
+			if l.accept("=") {
+				l.emit(itemGreaterEq)
+			} else {
+				l.emit(itemGreater)
+			}
+
+			return lexExpression
+		}
 		l.emit(itemCloseDirective)
 
 		return lexText
 	case r == '}':
+		if l.braceDepth > 0 {
+			l.emit(itemRightBrace)
+			l.braceDepth--
+
+			return lexExpression
+		}
+		if !l.interpolation || l.expression {
+			return l.errorf("unexpected right brace %#U", r)
+		}
 		l.emit(itemRightInterpolation)
 
 		return lexText
@@ -455,17 +718,44 @@ func lexExpression(l *lexer) stateFn {
 	return lexExpression
 }
 
-// lexDirective scans the directive inside FTL tags.
+// lexDirective scans the start of an FTL tag and the directive name.
 func lexDirective(l *lexer) stateFn {
 	if strings.HasPrefix(l.input[l.pos:], startDirective) {
 		l.pos += Pos(len(startDirective))
 		l.emit(itemStartDirective)
-	}
-
-	if strings.HasPrefix(l.input[l.pos:], endDirective) {
+	} else {
 		l.pos += Pos(len(endDirective))
 		l.emit(itemEndDirective)
 	}
+	l.interpolation = false
+
+	for isAlphaNumeric(l.peek()) {
+		l.next()
+	}
+	word := l.input[l.start:l.pos]
+	switch {
+	case word == "":
+		return l.errorf("missing directive name")
+	case directives[word] > _itemDirectiveBeg:
+		l.emit(directives[word])
+	default:
+		l.emit(itemIdentifier) // the parser reports the unknown directive
+	}
+
+	return lexExpression
+}
+
+// lexUserDirective scans the start "<@" or end "</@" of a user-defined
+// directive call. The name of the directive is an expression.
+func lexUserDirective(l *lexer) stateFn {
+	if strings.HasPrefix(l.input[l.pos:], startUserDirective) {
+		l.pos += Pos(len(startUserDirective))
+		l.emit(itemStartUserDirective)
+	} else {
+		l.pos += Pos(len(endUserDirective))
+		l.emit(itemEndUserDirective)
+	}
+	l.interpolation = false
 
 	return lexExpression
 }
@@ -473,13 +763,13 @@ func lexDirective(l *lexer) stateFn {
 // lexSpace scans a run of space characters.
 // One space has already been seen.
 func lexSpace(l *lexer) stateFn {
-	for isSpace(l.peek()) {
+	for r := l.peek(); isSpace(r) || isEndOfLine(r); r = l.peek() {
 		l.next()
 	}
 
 	l.emit(itemSpace)
 
-	return lexDirective
+	return lexExpression
 }
 
 // lexIdentifier scans an alphanumeric.
@@ -498,8 +788,8 @@ Loop:
 			}
 
 			switch {
-			case directives[word] > _itemDirectiveBeg && directives[word] < _itemDirectiveEnd:
-				l.emit(directives[word])
+			case keywords[word] > _itemDirectiveBeg && keywords[word] < _itemDirectiveEnd:
+				l.emit(keywords[word])
 			case comparators[word] > _itemOperatorBeg && comparators[word] < _itemOperatorEnd:
 				l.emit(comparators[word])
 			case word == "true", word == "false":
@@ -512,7 +802,7 @@ Loop:
 		}
 	}
 
-	return lexDirective
+	return lexExpression
 }
 
 // atTerminator reports whether the input is at valid termination character to
@@ -524,7 +814,8 @@ func (l *lexer) atTerminator() bool {
 	}
 
 	switch r {
-	case eof, '.', ',', '|', ':', ')', '(', '>', '}':
+	case eof, '.', ',', '|', ':', ')', '(', '>', '}', ']', '[', '{',
+		'?', '!', '=', '<', '+', '-', '*', '/', '%', '&':
 
 		return true
 	}
@@ -532,32 +823,30 @@ func (l *lexer) atTerminator() bool {
 	return false
 }
 
-// lexComparator scans a comparator.
+// lexComparator scans a comparator, the logical not or the assignment.
 func lexComparator(l *lexer) stateFn {
-	comparatorStart := l.next()
-	r := l.peek()
-	if r != '=' && r != ' ' {
-		return l.errorf("unexpected comparator %#U", r)
-	}
-
-	comparator := string(comparatorStart)
-	if r == '=' {
-		r := l.next()
-		comparator += string(r)
-	}
-
-	switch comparator {
-	case "==":
-		l.emit(itemEq)
-	case "!=":
-		l.emit(itemNeq)
-	case "<":
-		l.emit(itemLess)
-	case "<=":
-		l.emit(itemLessEq)
+	switch l.next() {
+	case '!':
+		if l.accept("=") {
+			l.emit(itemNeq)
+		} else {
+			l.emit(itemNot)
+		}
+	case '=':
+		if l.accept("=") {
+			l.emit(itemEq)
+		} else {
+			l.emit(itemAssign)
+		}
+	case '<':
+		if l.accept("=") {
+			l.emit(itemLessEq)
+		} else {
+			l.emit(itemLess)
+		}
 	}
 
-	return lexDirective
+	return lexExpression
 }
 
 // lexChar scans a character constant.
@@ -579,7 +868,7 @@ Loop:
 
 	l.emit(itemCharConstant)
 
-	return lexDirective
+	return lexExpression
 }
 
 // lexString scans a string constant.
@@ -601,10 +890,26 @@ Loop:
 
 	l.emit(itemStringConstant)
 
-	return lexDirective
+	return lexExpression
+}
+
+// lexRawString scans a raw string constant, r"..." or r'...'.
+// The r prefix has already been seen.
+func lexRawString(l *lexer) stateFn {
+	quote := l.next()
+	for {
+		switch l.next() {
+		case eof:
+			return l.errorf("unterminated raw string")
+		case quote:
+			l.emit(itemStringConstant)
+
+			return lexExpression
+		}
+	}
 }
 
-// lexNumber scans a number: decimal, octal, hex, float, or imaginary. This
+// lexNumber scans a number: decimal, octal, hex or float. This
 // isn't a perfect number scanner - for instance it accepts "." and "0x0.2"
 // and "089" - but when it's wrong the input is invalid and the parser (via
 // strconv) will notice.
@@ -612,17 +917,10 @@ func lexNumber(l *lexer) stateFn {
 	if !l.scanNumber() {
 		return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
 	}
-	if sign := l.peek(); sign == '+' || sign == '-' {
-		// Complex: 1+2i. No spaces, must end in 'i'.
-		if !l.scanNumber() || l.input[l.pos-1] != 'i' {
-			return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
-		}
-		//		l.emit(itemComplex)
-	} else {
-		l.emit(itemNumber)
-	}
+	// A sign after the number is an operator, as in 1+2.
+	l.emit(itemNumber)
 
-	return lexDirective
+	return lexExpression
 }
 
 func (l *lexer) scanNumber() bool {
@@ -634,15 +932,15 @@ func (l *lexer) scanNumber() bool {
 		digits = "0123456789abcdefABCDEF"
 	}
 	l.acceptRun(digits)
-	if l.accept(".") {
+	// A dot not followed by a digit is not part of the number, as in 1..3.
+	if rest := l.input[l.pos:]; len(rest) > 1 && rest[0] == '.' && strings.IndexByte(digits, rest[1]) >= 0 {
+		l.next()
 		l.acceptRun(digits)
 	}
 	if l.accept("eE") {
 		l.accept("+-")
 		l.acceptRun("0123456789")
 	}
-	// Is it imaginary?
-	l.accept("i")
 	// Next thing mustn't be alphanumeric.
 	if isAlphaNumeric(l.peek()) {
 		l.next()
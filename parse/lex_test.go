@@ -205,6 +205,25 @@ var lexTests = []lexTest{
 		mkItem(itemText, "hello"),
 		mkItem(itemError, `unclosed comment`),
 	}},
+	{"lambda", "${a?map(x->x-1)}", []item{
+		tLinter,
+		mkItem(itemIdentifier, "a"),
+		mkItem(itemBuiltin, "?"),
+		mkItem(itemIdentifier, "map"),
+		tLpar,
+		mkItem(itemIdentifier, "x"),
+		mkItem(itemArrow, "->"),
+		mkItem(itemIdentifier, "x"),
+		mkItem(itemMinus, "-"),
+		mkItem(itemNumber, "1"),
+		tRpar,
+		tRinter,
+		tEOF,
+	}},
+	{"imaginary number", "${1i}", []item{
+		tLinter,
+		mkItem(itemError, `bad number syntax: "1i"`),
+	}},
 }
 
 // collect gathers the emitted items into a slice.
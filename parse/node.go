@@ -19,6 +19,7 @@ package parse
 import (
 	"bytes"
 	"fmt"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -70,6 +71,24 @@ const (
 	nodeEnd                           // end action. Not added to tree
 
 	NodeTemplate // template invocation action
+
+	NodeIndex         // dynamic key lookup, a[b]
+	NodeCall          // method call, f(a, b)
+	NodeBuiltin       // built-in, a?b or a?b(c)
+	NodeDefault       // default value operator, a!b
+	NodeExists        // missing value test, a??
+	NodeRange         // numerical range, a..b
+	NodeSequence      // sequence literal, [a, b]
+	NodeHash          // hash literal, {a: b}
+	NodeSpecialVar    // special variable, .name
+	NodeInclude       // include directive
+	NodeMacro         // macro definition
+	NodeUserDirective // user-defined directive call, <@name/>
+	NodeNested        // nested directive
+	NodeAttempt       // attempt directive
+	nodeRecover       // recover directive. Not added to tree
+	NodeSetting       // setting directive
+	NodeLambda        // lambda, x -> expr
 )
 
 // Nodes.
@@ -145,16 +164,18 @@ func (t *TextNode) Copy() Node {
 	return &TextNode{tr: t.tr, NodeType: NodeText, Pos: t.Pos, Text: append([]byte{}, t.Text...)}
 }
 
+// ExpressionNode holds an operator and its operands: one for a unary
+// expression such as "!a", two for a binary expression such as "a+b".
 type ExpressionNode struct {
 	NodeType
 	Pos
 	tr       *Tree
-	operator itemType
+	Operator string // "+", "-", "*", "/", "%", "==", "!=", "<", "<=", ">", ">=", "&&", "||", "!" or "."
 	Nodes    []Node // two nodes at most, binary expression, such as "a+b"
 }
 
-func (t *Tree) newExpression(pos Pos, optr itemType) *ExpressionNode {
-	return &ExpressionNode{tr: t, NodeType: NodeExpression, Pos: pos, operator: optr}
+func (t *Tree) newExpression(pos Pos, optr string) *ExpressionNode {
+	return &ExpressionNode{tr: t, NodeType: NodeExpression, Pos: pos, Operator: optr}
 }
 
 func (c *ExpressionNode) append(node Node) {
@@ -163,11 +184,14 @@ func (c *ExpressionNode) append(node Node) {
 
 func (c *ExpressionNode) String() string {
 	s := ""
+	if len(c.Nodes) == 1 {
+		s = c.Operator
+	}
 	for i, node := range c.Nodes {
 		if i > 0 {
-			s += c.operator.String()
+			s += c.Operator
 		}
-		if node, ok := node.(*ExpressionNode); ok {
+		if node, ok := node.(*ExpressionNode); ok && (i > 0 || c.Operator != ".") {
 			s += "(" + node.String() + ")"
 			continue
 		}
@@ -184,7 +208,7 @@ func (c *ExpressionNode) CopyExpr() *ExpressionNode {
 	if c == nil {
 		return c
 	}
-	n := c.tr.newExpression(c.Pos, c.operator)
+	n := c.tr.newExpression(c.Pos, c.Operator)
 	for _, c := range c.Nodes {
 		n.append(c.Copy())
 	}
@@ -277,22 +301,22 @@ func (b *BoolNode) Copy() Node {
 	return b.tr.newBool(b.Pos, b.True)
 }
 
-// NumberNode holds a number: signed or unsigned integer, float, or complex.
-// The value is parsed and stored under all the types that can represent the value.
-// This simulates in a small amount of code the behavior of Go's ideal constants.
+// NumberNode holds a number: a signed or unsigned integer, or a decimal
+// number. The value is parsed and stored under all the types that can
+// represent the value. This simulates in a small amount of code the
+// behavior of Go's ideal constants.
 type NumberNode struct {
 	NodeType
 	Pos
-	tr         *Tree
-	IsInt      bool       // Number has an integral value.
-	IsUint     bool       // Number has an unsigned integral value.
-	IsFloat    bool       // Number has a floating-point value.
-	IsComplex  bool       // Number is complex.
-	Int64      int64      // The signed integer value.
-	Uint64     uint64     // The unsigned integer value.
-	Float64    float64    // The floating-point value.
-	Complex128 complex128 // The complex value.
-	Text       string     // The original textual representation from the input.
+	tr      *Tree
+	IsInt   bool     // Number has an integral value.
+	IsUint  bool     // Number has an unsigned integral value.
+	IsFloat bool     // Number has a floating-point value.
+	Int64   int64    // The signed integer value.
+	Uint64  uint64   // The unsigned integer value.
+	Float64 float64  // The floating-point value, possibly rounded.
+	Rat     *big.Rat // The exact value.
+	Text    string   // The original textual representation from the input.
 }
 
 func (t *Tree) newNumber(pos Pos, text string, typ itemType) (*NumberNode, error) {
@@ -312,25 +336,8 @@ func (t *Tree) newNumber(pos Pos, text string, typ itemType) (*NumberNode, error
 		n.IsUint = true
 		n.Float64 = float64(rune) // odd but those are the rules.
 		n.IsFloat = true
+		n.Rat = new(big.Rat).SetInt64(n.Int64)
 		return n, nil
-		//	case itemComplex:
-		//		// fmt.Sscan can parse the pair, so let it do the work.
-		//		if _, err := fmt.Sscan(text, &n.Complex128); err != nil {
-		//			return nil, err
-		//		}
-		//		n.IsComplex = true
-		//		n.simplifyComplex()
-		//		return n, nil
-	}
-	// Imaginary constants can only be complex unless they are zero.
-	if len(text) > 0 && text[len(text)-1] == 'i' {
-		f, err := strconv.ParseFloat(text[:len(text)-1], 64)
-		if err == nil {
-			n.IsComplex = true
-			n.Complex128 = complex(0, f)
-			n.simplifyComplex()
-			return n, nil
-		}
 	}
 	// Do integer test first so we get 0x123 etc.
 	u, err := strconv.ParseUint(text, 0, 64) // will fail for -0; fixed below.
@@ -351,28 +358,25 @@ func (t *Tree) newNumber(pos Pos, text string, typ itemType) (*NumberNode, error
 	if n.IsInt {
 		n.IsFloat = true
 		n.Float64 = float64(n.Int64)
+		n.Rat = new(big.Rat).SetInt64(n.Int64)
 	} else if n.IsUint {
 		n.IsFloat = true
 		n.Float64 = float64(n.Uint64)
-	} else {
-		f, err := strconv.ParseFloat(text, 64)
-		if err == nil {
-			// If we parsed it as a float but it looks like an integer,
-			// it's a huge number too large to fit in an int. Reject it.
-			if !strings.ContainsAny(text, ".eE") {
-				return nil, fmt.Errorf("integer overflow: %q", text)
-			}
-			n.IsFloat = true
-			n.Float64 = f
-			// If a floating-point extraction succeeded, extract the int if needed.
-			if !n.IsInt && float64(int64(f)) == f {
-				n.IsInt = true
-				n.Int64 = int64(f)
-			}
-			if !n.IsUint && float64(uint64(f)) == f {
-				n.IsUint = true
-				n.Uint64 = uint64(f)
-			}
+		n.Rat = new(big.Rat).SetInt(new(big.Int).SetUint64(n.Uint64))
+	} else if r, ok := new(big.Rat).SetString(text); ok {
+		// A number too large for an integer, or a decimal number, such as
+		// 0.1, which the float only approximates.
+		n.Rat = r
+		n.IsFloat = true
+		n.Float64, _ = r.Float64()
+		// If a floating-point extraction succeeded, extract the int if needed.
+		if r.IsInt() && r.Num().IsInt64() {
+			n.IsInt = true
+			n.Int64 = r.Num().Int64()
+		}
+		if r.IsInt() && r.Num().IsUint64() {
+			n.IsUint = true
+			n.Uint64 = r.Num().Uint64()
 		}
 	}
 	if !n.IsInt && !n.IsUint && !n.IsFloat {
@@ -381,23 +385,6 @@ func (t *Tree) newNumber(pos Pos, text string, typ itemType) (*NumberNode, error
 	return n, nil
 }
 
-// simplifyComplex pulls out any other types that are represented by the complex number.
-// These all require that the imaginary part be zero.
-func (n *NumberNode) simplifyComplex() {
-	n.IsFloat = imag(n.Complex128) == 0
-	if n.IsFloat {
-		n.Float64 = real(n.Complex128)
-		n.IsInt = float64(int64(n.Float64)) == n.Float64
-		if n.IsInt {
-			n.Int64 = int64(n.Float64)
-		}
-		n.IsUint = float64(uint64(n.Float64)) == n.Float64
-		if n.IsUint {
-			n.Uint64 = uint64(n.Float64)
-		}
-	}
-}
-
 func (n *NumberNode) String() string {
 	return n.Text
 }
@@ -425,7 +412,7 @@ func (t *Tree) newString(pos Pos, text string) *StringNode {
 }
 
 func (s *StringNode) String() string {
-	return s.Text
+	return strconv.Quote(s.Text)
 }
 
 func (s *StringNode) tree() *Tree {
@@ -436,6 +423,315 @@ func (s *StringNode) Copy() Node {
 	return s.tr.newString(s.Pos, s.Text)
 }
 
+// IndexNode holds a dynamic key lookup, such as a[b] or a[1..3].
+type IndexNode struct {
+	NodeType
+	Pos
+	tr    *Tree
+	Expr  Node // The value being indexed.
+	Index Node // The key, index or range.
+}
+
+func (t *Tree) newIndex(pos Pos, expr, index Node) *IndexNode {
+	return &IndexNode{tr: t, NodeType: NodeIndex, Pos: pos, Expr: expr, Index: index}
+}
+
+func (i *IndexNode) String() string {
+	return fmt.Sprintf("%s[%s]", i.Expr, i.Index)
+}
+
+func (i *IndexNode) tree() *Tree {
+	return i.tr
+}
+
+func (i *IndexNode) Copy() Node {
+	return i.tr.newIndex(i.Pos, i.Expr.Copy(), i.Index.Copy())
+}
+
+// CallNode holds a method call, such as f(a, b).
+type CallNode struct {
+	NodeType
+	Pos
+	tr   *Tree
+	Func Node   // The method being called.
+	Args []Node // The arguments in lexical order.
+}
+
+func (t *Tree) newCall(pos Pos, fn Node, args []Node) *CallNode {
+	return &CallNode{tr: t, NodeType: NodeCall, Pos: pos, Func: fn, Args: args}
+}
+
+func (c *CallNode) String() string {
+	return fmt.Sprintf("%s(%s)", c.Func, joinNodes(c.Args, ", "))
+}
+
+func (c *CallNode) tree() *Tree {
+	return c.tr
+}
+
+func (c *CallNode) Copy() Node {
+	return c.tr.newCall(c.Pos, c.Func.Copy(), copyNodes(c.Args))
+}
+
+// BuiltinNode holds a built-in applied to a value, such as a?size or
+// a?substring(1, 2). Args is nil if the built-in is not followed by a
+// parenthesized argument list.
+type BuiltinNode struct {
+	NodeType
+	Pos
+	tr     *Tree
+	Target Node   // The value the built-in is applied to.
+	Name   string // The name of the built-in.
+	Args   []Node // The arguments, if any.
+}
+
+func (t *Tree) newBuiltin(pos Pos, target Node, name string, args []Node) *BuiltinNode {
+	return &BuiltinNode{tr: t, NodeType: NodeBuiltin, Pos: pos, Target: target, Name: name, Args: args}
+}
+
+func (b *BuiltinNode) String() string {
+	if b.Args == nil {
+		return fmt.Sprintf("%s?%s", b.Target, b.Name)
+	}
+	return fmt.Sprintf("%s?%s(%s)", b.Target, b.Name, joinNodes(b.Args, ", "))
+}
+
+func (b *BuiltinNode) tree() *Tree {
+	return b.tr
+}
+
+func (b *BuiltinNode) Copy() Node {
+	return b.tr.newBuiltin(b.Pos, b.Target.Copy(), b.Name, copyNodes(b.Args))
+}
+
+// DefaultNode holds the default value operator, such as a!b, or a! with no
+// default value.
+type DefaultNode struct {
+	NodeType
+	Pos
+	tr      *Tree
+	Expr    Node // The value that may be missing.
+	Default Node // The value used instead; nil if omitted.
+}
+
+func (t *Tree) newDefault(pos Pos, expr, def Node) *DefaultNode {
+	return &DefaultNode{tr: t, NodeType: NodeDefault, Pos: pos, Expr: expr, Default: def}
+}
+
+func (d *DefaultNode) String() string {
+	if d.Default == nil {
+		return fmt.Sprintf("%s!", d.Expr)
+	}
+	return fmt.Sprintf("%s!%s", d.Expr, d.Default)
+}
+
+func (d *DefaultNode) tree() *Tree {
+	return d.tr
+}
+
+func (d *DefaultNode) Copy() Node {
+	var def Node
+	if d.Default != nil {
+		def = d.Default.Copy()
+	}
+	return d.tr.newDefault(d.Pos, d.Expr.Copy(), def)
+}
+
+// ExistsNode holds the missing value test, such as a??.
+type ExistsNode struct {
+	NodeType
+	Pos
+	tr   *Tree
+	Expr Node // The value that may be missing.
+}
+
+func (t *Tree) newExists(pos Pos, expr Node) *ExistsNode {
+	return &ExistsNode{tr: t, NodeType: NodeExists, Pos: pos, Expr: expr}
+}
+
+func (e *ExistsNode) String() string {
+	return fmt.Sprintf("%s??", e.Expr)
+}
+
+func (e *ExistsNode) tree() *Tree {
+	return e.tr
+}
+
+func (e *ExistsNode) Copy() Node {
+	return e.tr.newExists(e.Pos, e.Expr.Copy())
+}
+
+// RangeNode holds a numerical range: a..b, a..<b, a..*n or the right-unbounded a.. .
+type RangeNode struct {
+	NodeType
+	Pos
+	tr       *Tree
+	From     Node   // The start of the range.
+	To       Node   // The end of the range, or its size for "..*"; nil if unbounded.
+	Operator string // "..", "..<" or "..*".
+}
+
+func (t *Tree) newRange(pos Pos, from, to Node, optr string) *RangeNode {
+	return &RangeNode{tr: t, NodeType: NodeRange, Pos: pos, From: from, To: to, Operator: optr}
+}
+
+func (r *RangeNode) String() string {
+	if r.To == nil {
+		return fmt.Sprintf("%s%s", r.From, r.Operator)
+	}
+	return fmt.Sprintf("%s%s%s", r.From, r.Operator, r.To)
+}
+
+func (r *RangeNode) tree() *Tree {
+	return r.tr
+}
+
+func (r *RangeNode) Copy() Node {
+	var to Node
+	if r.To != nil {
+		to = r.To.Copy()
+	}
+	return r.tr.newRange(r.Pos, r.From.Copy(), to, r.Operator)
+}
+
+// SequenceNode holds a sequence literal, such as [a, b].
+type SequenceNode struct {
+	NodeType
+	Pos
+	tr    *Tree
+	Items []Node // The items in lexical order.
+}
+
+func (t *Tree) newSequence(pos Pos, items []Node) *SequenceNode {
+	return &SequenceNode{tr: t, NodeType: NodeSequence, Pos: pos, Items: items}
+}
+
+func (s *SequenceNode) String() string {
+	return fmt.Sprintf("[%s]", joinNodes(s.Items, ", "))
+}
+
+func (s *SequenceNode) tree() *Tree {
+	return s.tr
+}
+
+func (s *SequenceNode) Copy() Node {
+	return s.tr.newSequence(s.Pos, copyNodes(s.Items))
+}
+
+// HashNode holds a hash literal, such as {"a": 1, "b": 2}.
+type HashNode struct {
+	NodeType
+	Pos
+	tr     *Tree
+	Keys   []Node // The key expressions in lexical order.
+	Values []Node // The value expressions, parallel to Keys.
+}
+
+func (t *Tree) newHash(pos Pos, keys, values []Node) *HashNode {
+	return &HashNode{tr: t, NodeType: NodeHash, Pos: pos, Keys: keys, Values: values}
+}
+
+func (h *HashNode) String() string {
+	b := &bytes.Buffer{}
+	b.WriteString("{")
+	for i := range h.Keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(b, "%s: %s", h.Keys[i], h.Values[i])
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func (h *HashNode) tree() *Tree {
+	return h.tr
+}
+
+func (h *HashNode) Copy() Node {
+	return h.tr.newHash(h.Pos, copyNodes(h.Keys), copyNodes(h.Values))
+}
+
+// LambdaNode holds a local lambda, such as x -> x.price > 10, which may
+// only be an argument of the built-ins taking a function.
+type LambdaNode struct {
+	NodeType
+	Pos
+	tr    *Tree
+	Param string // The name of the parameter.
+	Body  Node   // The expression evaluated with the parameter set.
+}
+
+func (t *Tree) newLambda(pos Pos, param string, body Node) *LambdaNode {
+	return &LambdaNode{tr: t, NodeType: NodeLambda, Pos: pos, Param: param, Body: body}
+}
+
+func (l *LambdaNode) String() string {
+	return fmt.Sprintf("%s -> %s", l.Param, l.Body)
+}
+
+func (l *LambdaNode) tree() *Tree {
+	return l.tr
+}
+
+func (l *LambdaNode) Copy() Node {
+	return l.tr.newLambda(l.Pos, l.Param, l.Body.Copy())
+}
+
+// SpecialVarNode holds a special variable, such as .now or .locale.
+type SpecialVarNode struct {
+	NodeType
+	Pos
+	tr   *Tree
+	Name string // The variable name, without the leading dot.
+}
+
+func (t *Tree) newSpecialVar(pos Pos, name string) *SpecialVarNode {
+	return &SpecialVarNode{tr: t, NodeType: NodeSpecialVar, Pos: pos, Name: name}
+}
+
+func (s *SpecialVarNode) String() string {
+	return "." + s.Name
+}
+
+func (s *SpecialVarNode) tree() *Tree {
+	return s.tr
+}
+
+func (s *SpecialVarNode) Copy() Node {
+	return s.tr.newSpecialVar(s.Pos, s.Name)
+}
+
+// joinNodes returns the string forms of nodes separated by sep.
+func joinNodes(nodes []Node, sep string) string {
+	s := make([]string, len(nodes))
+	for i, n := range nodes {
+		s[i] = n.String()
+	}
+	return strings.Join(s, sep)
+}
+
+// copyNodes returns deep copies of nodes.
+// copyNode returns a copy of n, or nil if n is nil, as it may be in a tree
+// holding what could be parsed of an erroneous template.
+func copyNode(n Node) Node {
+	if n == nil {
+		return nil
+	}
+	return n.Copy()
+}
+
+func copyNodes(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+	n := make([]Node, len(nodes))
+	for i, node := range nodes {
+		n[i] = node.Copy()
+	}
+	return n
+}
+
 // endNode represents an </# directive.
 // It does not appear in the final parse tree.
 type endNode struct {
@@ -450,7 +746,7 @@ func (t *Tree) newEnd(pos Pos, iden string) *endNode {
 }
 
 func (e *endNode) String() string {
-	return "</#" + e.identifier + ">"
+	return endTag(e.identifier)
 }
 
 func (e *endNode) tree() *Tree {
@@ -461,15 +757,17 @@ func (e *endNode) Copy() Node {
 	return e.tr.newEnd(e.Pos, e.identifier)
 }
 
-// elseNode represents an {{else}} action. Does not appear in the final tree.
+// elseNode represents an <#else> or <#elseif expr> directive. Does not
+// appear in the final tree.
 type elseNode struct {
 	NodeType
 	Pos
-	tr *Tree
+	tr   *Tree
+	Expr Node // condition of an <#elseif>; nil for <#else>
 }
 
-func (t *Tree) newElse(pos Pos) *elseNode {
-	return &elseNode{tr: t, NodeType: nodeElse, Pos: pos}
+func (t *Tree) newElse(pos Pos, expr Node) *elseNode {
+	return &elseNode{tr: t, NodeType: nodeElse, Pos: pos, Expr: expr}
 }
 
 func (e *elseNode) Type() NodeType {
@@ -477,7 +775,10 @@ func (e *elseNode) Type() NodeType {
 }
 
 func (e *elseNode) String() string {
-	return "{{else}}"
+	if e.Expr != nil {
+		return fmt.Sprintf("<#elseif %s>", e.Expr)
+	}
+	return "<#else>"
 }
 
 func (e *elseNode) tree() *Tree {
@@ -485,7 +786,34 @@ func (e *elseNode) tree() *Tree {
 }
 
 func (e *elseNode) Copy() Node {
-	return e.tr.newElse(e.Pos)
+	if e.Expr == nil {
+		return e.tr.newElse(e.Pos, nil)
+	}
+	return e.tr.newElse(e.Pos, e.Expr.Copy())
+}
+
+// recoverNode represents a <#recover> directive. Does not appear in the
+// final tree.
+type recoverNode struct {
+	NodeType
+	Pos
+	tr *Tree
+}
+
+func (t *Tree) newRecover(pos Pos) *recoverNode {
+	return &recoverNode{tr: t, NodeType: nodeRecover, Pos: pos}
+}
+
+func (r *recoverNode) String() string {
+	return "<#recover>"
+}
+
+func (r *recoverNode) tree() *Tree {
+	return r.tr
+}
+
+func (r *recoverNode) Copy() Node {
+	return r.tr.newRecover(r.Pos)
 }
 
 // InterpolationNode represents a ${expr}.
@@ -493,11 +821,11 @@ type InterpolationNode struct {
 	NodeType
 	Pos
 	tr   *Tree
-	Expr *ExpressionNode
+	Expr Node
 }
 
-func (t *Tree) newInterpolation(pos Pos, expr *ExpressionNode) *InterpolationNode {
-	return &InterpolationNode{tr: t, NodeType: NodeIf, Pos: pos, Expr: expr}
+func (t *Tree) newInterpolation(pos Pos, expr Node) *InterpolationNode {
+	return &InterpolationNode{tr: t, NodeType: NodeInterpolation, Pos: pos, Expr: expr}
 }
 
 func (interpolationNode *InterpolationNode) String() string {
@@ -509,7 +837,7 @@ func (interpolationNode *InterpolationNode) tree() *Tree {
 }
 
 func (i *InterpolationNode) Copy() Node {
-	return i.tr.newInterpolation(i.Pos, i.Expr.CopyExpr())
+	return i.tr.newInterpolation(i.Pos, copyNode(i.Expr))
 }
 
 // IfNode represents a <#if> directive.
@@ -517,17 +845,20 @@ type IfNode struct {
 	NodeType
 	Pos
 	tr          *Tree
-	Expr        *ExpressionNode
+	Expr        Node
 	Content     *ContentNode
 	ElseContent *ContentNode
 }
 
-func (t *Tree) newIf(pos Pos, expr *ExpressionNode, content, elseContent *ContentNode) *IfNode {
+func (t *Tree) newIf(pos Pos, expr Node, content, elseContent *ContentNode) *IfNode {
 	return &IfNode{tr: t, NodeType: NodeIf, Pos: pos,
 		Expr: expr, Content: content, ElseContent: elseContent}
 }
 
 func (ifNode *IfNode) String() string {
+	if ifNode.ElseContent != nil {
+		return fmt.Sprintf("<#if %s>%s<#else>%s</#if>", ifNode.Expr, ifNode.Content, ifNode.ElseContent)
+	}
 	return fmt.Sprintf("<#if %s>%s</#if>", ifNode.Expr, ifNode.Content)
 }
 
@@ -536,7 +867,7 @@ func (ifNode *IfNode) tree() *Tree {
 }
 
 func (i *IfNode) Copy() Node {
-	return i.tr.newIf(i.Pos, i.Expr.CopyExpr(), i.Content.CopyContent(), i.ElseContent.CopyContent())
+	return i.tr.newIf(i.Pos, copyNode(i.Expr), i.Content.CopyContent(), i.ElseContent.CopyContent())
 }
 
 // ListNode represents a <#list> directive.
@@ -544,18 +875,22 @@ type ListNode struct {
 	NodeType
 	Pos
 	tr          *Tree
-	Expr        *ExpressionNode
+	Expr        Node
+	Vars        []string // loop variable names: the item, or the key and the value of a hash
 	Content     *ContentNode
 	ElseContent *ContentNode
 }
 
-func (t *Tree) newList(pos Pos, expr *ExpressionNode, content *ContentNode, elseContent *ContentNode) *ListNode {
+func (t *Tree) newList(pos Pos, expr Node, vars []string, content *ContentNode, elseContent *ContentNode) *ListNode {
 	return &ListNode{tr: t, NodeType: NodeList, Pos: pos,
-		Expr: expr, Content: content, ElseContent: elseContent}
+		Expr: expr, Vars: vars, Content: content, ElseContent: elseContent}
 }
 
 func (t *ListNode) String() string {
-	return fmt.Sprintf("<#list %s>%s</#list>", t.Expr, t.Content)
+	if t.ElseContent != nil {
+		return fmt.Sprintf("<#list %s as %s>%s<#else>%s</#list>", t.Expr, strings.Join(t.Vars, ", "), t.Content, t.ElseContent)
+	}
+	return fmt.Sprintf("<#list %s as %s>%s</#list>", t.Expr, strings.Join(t.Vars, ", "), t.Content)
 }
 
 func (t *ListNode) tree() *Tree {
@@ -563,5 +898,211 @@ func (t *ListNode) tree() *Tree {
 }
 
 func (l *ListNode) Copy() Node {
-	return l.tr.newList(l.Pos, l.Expr.CopyExpr(), l.Content.CopyContent(), l.ElseContent.CopyContent())
+	return l.tr.newList(l.Pos, copyNode(l.Expr), append([]string{}, l.Vars...), l.Content.CopyContent(), l.ElseContent.CopyContent())
+}
+
+// IncludeNode represents an <#include> directive.
+type IncludeNode struct {
+	NodeType
+	Pos
+	tr   *Tree
+	Name Node // The expression evaluating to the name of the included template.
+}
+
+func (t *Tree) newInclude(pos Pos, name Node) *IncludeNode {
+	return &IncludeNode{tr: t, NodeType: NodeInclude, Pos: pos, Name: name}
+}
+
+func (i *IncludeNode) String() string {
+	return fmt.Sprintf("<#include %s>", i.Name)
+}
+
+func (i *IncludeNode) tree() *Tree {
+	return i.tr
+}
+
+func (i *IncludeNode) Copy() Node {
+	return i.tr.newInclude(i.Pos, copyNode(i.Name))
+}
+
+// MacroNode represents a <#macro> definition.
+type MacroNode struct {
+	NodeType
+	Pos
+	tr       *Tree
+	Name     string
+	Params   []string // parameter names in declaration order
+	Defaults []Node   // default value expressions, parallel to Params; nil for required parameters
+	CatchAll string   // name of the catch-all parameter, if any
+	Content  *ContentNode
+}
+
+func (t *Tree) newMacro(pos Pos, name string, params []string, defaults []Node, catchAll string, content *ContentNode) *MacroNode {
+	return &MacroNode{tr: t, NodeType: NodeMacro, Pos: pos,
+		Name: name, Params: params, Defaults: defaults, CatchAll: catchAll, Content: content}
+}
+
+func (m *MacroNode) String() string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "<#macro %s", m.Name)
+	for i, p := range m.Params {
+		if m.Defaults[i] != nil {
+			fmt.Fprintf(b, " %s=%s", p, m.Defaults[i])
+			continue
+		}
+		fmt.Fprintf(b, " %s", p)
+	}
+	if m.CatchAll != "" {
+		fmt.Fprintf(b, " %s...", m.CatchAll)
+	}
+	fmt.Fprintf(b, ">%s</#macro>", m.Content)
+	return b.String()
+}
+
+func (m *MacroNode) tree() *Tree {
+	return m.tr
+}
+
+func (m *MacroNode) Copy() Node {
+	defaults := make([]Node, len(m.Defaults))
+	for i, d := range m.Defaults {
+		if d != nil {
+			defaults[i] = d.Copy()
+		}
+	}
+	return m.tr.newMacro(m.Pos, m.Name, append([]string{}, m.Params...), defaults, m.CatchAll, m.Content.CopyContent())
+}
+
+// UserDirectiveNode represents a call of a user-defined directive, such as a
+// macro: <@name arg=value/> or <@name arg1, arg2>content</@name>.
+type UserDirectiveNode struct {
+	NodeType
+	Pos
+	tr      *Tree
+	Name    Node         // The expression evaluating to the directive.
+	Named   []string     // names of the arguments, parallel to Args; nil if they are positional
+	Args    []Node       // argument expressions
+	Content *ContentNode // nil for an empty <@name/>
+}
+
+func (t *Tree) newUserDirective(pos Pos, name Node, named []string, args []Node, content *ContentNode) *UserDirectiveNode {
+	return &UserDirectiveNode{tr: t, NodeType: NodeUserDirective, Pos: pos,
+		Name: name, Named: named, Args: args, Content: content}
+}
+
+// Tag returns the start tag of the call, without its content.
+func (u *UserDirectiveNode) Tag() string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "<@%s", u.Name)
+	for i, arg := range u.Args {
+		switch {
+		case u.Named != nil:
+			fmt.Fprintf(b, " %s=%s", u.Named[i], arg)
+		case i == 0:
+			fmt.Fprintf(b, " %s", arg)
+		default:
+			fmt.Fprintf(b, ", %s", arg)
+		}
+	}
+	if u.Content == nil {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">")
+	}
+	return b.String()
+}
+
+func (u *UserDirectiveNode) String() string {
+	if u.Content == nil {
+		return u.Tag()
+	}
+	return fmt.Sprintf("%s%s</@%s>", u.Tag(), u.Content, u.Name)
+}
+
+func (u *UserDirectiveNode) tree() *Tree {
+	return u.tr
+}
+
+func (u *UserDirectiveNode) Copy() Node {
+	var named []string
+	if u.Named != nil {
+		named = append([]string{}, u.Named...)
+	}
+	return u.tr.newUserDirective(u.Pos, copyNode(u.Name), named, copyNodes(u.Args), u.Content.CopyContent())
+}
+
+// NestedNode represents a <#nested> directive, which executes the content of
+// the call of the macro it appears in.
+type NestedNode struct {
+	NodeType
+	Pos
+	tr *Tree
+}
+
+func (t *Tree) newNested(pos Pos) *NestedNode {
+	return &NestedNode{tr: t, NodeType: NodeNested, Pos: pos}
+}
+
+func (n *NestedNode) String() string {
+	return "<#nested>"
+}
+
+func (n *NestedNode) tree() *Tree {
+	return n.tr
+}
+
+func (n *NestedNode) Copy() Node {
+	return n.tr.newNested(n.Pos)
+}
+
+// AttemptNode represents an <#attempt> directive, whose content is replaced
+// by the content of its <#recover> if it fails to execute.
+type AttemptNode struct {
+	NodeType
+	Pos
+	tr             *Tree
+	Content        *ContentNode
+	RecoverContent *ContentNode
+}
+
+func (t *Tree) newAttempt(pos Pos, content, recoverContent *ContentNode) *AttemptNode {
+	return &AttemptNode{tr: t, NodeType: NodeAttempt, Pos: pos, Content: content, RecoverContent: recoverContent}
+}
+
+func (a *AttemptNode) String() string {
+	return fmt.Sprintf("<#attempt>%s<#recover>%s</#attempt>", a.Content, a.RecoverContent)
+}
+
+func (a *AttemptNode) tree() *Tree {
+	return a.tr
+}
+
+func (a *AttemptNode) Copy() Node {
+	return a.tr.newAttempt(a.Pos, a.Content.CopyContent(), a.RecoverContent.CopyContent())
+}
+
+// SettingNode represents a <#setting> directive, which changes a setting,
+// such as date_format, for the rest of the execution.
+type SettingNode struct {
+	NodeType
+	Pos
+	tr    *Tree
+	Name  string
+	Value Node
+}
+
+func (t *Tree) newSetting(pos Pos, name string, value Node) *SettingNode {
+	return &SettingNode{tr: t, NodeType: NodeSetting, Pos: pos, Name: name, Value: value}
+}
+
+func (s *SettingNode) String() string {
+	return fmt.Sprintf("<#setting %s=%s>", s.Name, s.Value)
+}
+
+func (s *SettingNode) tree() *Tree {
+	return s.tr
+}
+
+func (s *SettingNode) Copy() Node {
+	return s.tr.newSetting(s.Pos, s.Name, copyNode(s.Value))
 }
@@ -33,11 +33,35 @@ type Tree struct {
 	Name      string       // name of the template represented by the tree
 	ParseName string       // name of the top-level template during parsing, for error messages
 	Root      *ContentNode // top-level root of the tree
+	Mode      Mode         // parsing mode
+	Errors    []*Error     // syntax errors found, if Mode has AllErrors set
 	text      string       // text parsed to create the template (or its parent)
 	lex       *lexer
 	token     [3]item // three-token lookahead for parser
 	peekCount int
 	treeSet   map[string]*Tree
+	blocks    []string // names of the block directives being parsed, innermost last
+	pending   Node     // end tag of an enclosing block, found while recovering from an error
+}
+
+// A Mode value is a set of flags (or 0). Modes control parser behavior.
+type Mode uint
+
+const (
+	AllErrors Mode = 1 << iota // report all syntax errors, not just the first
+)
+
+// Error describes a syntax error found while parsing a template.
+type Error struct {
+	Name   string // name of the template being parsed
+	Pos    Pos    // byte position of the error in the template text
+	Line   int    // line number, starting at 1
+	Column int    // column number in bytes, starting at 1
+	Msg    string // description of the error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("template: %s:%d:%d: %s", e.Name, e.Line, e.Column, e.Msg)
 }
 
 // Copy returns a copy of the Tree. Any parsing state is discarded.
@@ -67,6 +91,37 @@ func Parse(name, text string) (map[string]*Tree, error) {
 	return treeSet, err
 }
 
+// ParseAll is like Parse but does not stop at the first syntax error. After
+// an error the parser resynchronizes at the next interpolation or directive,
+// so every error is reported, in input order. The returned trees hold what
+// could be parsed; they are meant for inspection by tools such as linters
+// and should not be executed if any error is reported.
+func ParseAll(name, text string) (map[string]*Tree, []*Error) {
+	treeSet := make(map[string]*Tree)
+	t := New(name)
+	t.Mode = AllErrors
+	t.text = text
+	t.Parse(text, treeSet)
+
+	return treeSet, t.Errors
+}
+
+// ParseExpression parses text, which is a lone expression, such as the
+// string ?eval evaluates. The nodes refer to a tree with the given name,
+// for the location of errors.
+func ParseExpression(name, text string) (expr Node, err error) {
+	t := New(name)
+	defer t.recover(&err)
+	t.ParseName = name
+	t.startParse(lexExpr(name, text), nil)
+	t.text = text
+	expr = t.expression("expression")
+	t.expect(itemEOF, "expression")
+	t.stopParse()
+
+	return expr, nil
+}
+
 // next returns the next token.
 func (t *Tree) next() item {
 	if t.peekCount > 0 {
@@ -170,11 +225,57 @@ func (t *Tree) ErrorContext(n Node) (location, context string) {
 	return fmt.Sprintf("%s:%d:%d", tree.ParseName, lineNum, byteNum), context
 }
 
+// Location returns the name of the template the node was parsed from and
+// the position of the node in it, as line and column numbers starting at 1.
+// The column is counted in bytes.
+func (t *Tree) Location(n Node) (name string, line, column int) {
+	pos := int(n.Position())
+	tree := n.tree()
+	if tree == nil {
+		tree = t
+	}
+	text := tree.text[:pos]
+
+	return tree.ParseName, 1 + strings.Count(text, "\n"), pos - strings.LastIndex(text, "\n")
+}
+
+// newError returns a syntax error at the given position of the text being parsed.
+func (t *Tree) newError(pos Pos, format string, args ...interface{}) *Error {
+	if int(pos) > len(t.text) {
+		pos = Pos(len(t.text))
+	}
+	text := t.text[:pos]
+
+	return &Error{
+		Name:   t.ParseName,
+		Pos:    pos,
+		Line:   1 + strings.Count(text, "\n"),
+		Column: len(text) - strings.LastIndex(text, "\n"),
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
 // errorf formats the error and terminates processing.
 func (t *Tree) errorf(format string, args ...interface{}) {
-	t.Root = nil
-	format = fmt.Sprintf("template: %s:%d: %s", t.ParseName, t.token[0].line, format)
-	panic(fmt.Errorf(format, args...))
+	t.errorAt(t.token[0].pos, format, args...)
+}
+
+// errorAt formats the error at the given position and terminates processing.
+func (t *Tree) errorAt(pos Pos, format string, args ...interface{}) {
+	if t.Mode&AllErrors == 0 {
+		t.Root = nil
+	}
+	panic(t.newError(pos, format, args...))
+}
+
+// report formats the error at the given position. Unless all errors are
+// being reported, it terminates processing like errorAt; otherwise the error
+// is recorded and parsing continues.
+func (t *Tree) report(pos Pos, format string, args ...interface{}) {
+	if t.Mode&AllErrors == 0 {
+		t.errorAt(pos, format, args...)
+	}
+	t.Errors = append(t.Errors, t.newError(pos, format, args...))
 }
 
 // error terminates processing.
@@ -204,7 +305,10 @@ func (t *Tree) expectOneOf(expected1, expected2 itemType, context string) item {
 
 // unexpected complains about the token and terminates processing.
 func (t *Tree) unexpected(token item, context string) {
-	t.errorf("unexpected %s in %s", token, context)
+	if token.typ == itemError {
+		t.errorAt(token.pos, "%s", token.val)
+	}
+	t.errorAt(token.pos, "unexpected %s in %s", token, context)
 }
 
 // recover is the handler that turns panics into returns from the top level of Parse.
@@ -215,6 +319,9 @@ func (t *Tree) recover(errp *error) {
 			panic(e)
 		}
 		if t != nil {
+			if err, ok := e.(*Error); ok && t.Mode&AllErrors != 0 {
+				t.Errors = append(t.Errors, err)
+			}
 			t.lex.drain()
 			t.stopParse()
 		}
@@ -222,11 +329,55 @@ func (t *Tree) recover(errp *error) {
 	}
 }
 
+// recoverTo calls parse, which parses part of the input. If all errors are
+// being reported, a syntax error raised by parse is recorded and the input is
+// skipped up to, but not including, the next token for which sync returns
+// true. Otherwise the error terminates processing as usual.
+func (t *Tree) recoverTo(sync func(itemType) bool, parse func()) {
+	if t.Mode&AllErrors == 0 {
+		parse()
+		return
+	}
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		err, ok := e.(*Error)
+		if !ok {
+			panic(e)
+		}
+		t.Errors = append(t.Errors, err)
+		for token := t.next(); !sync(token.typ); token = t.next() {
+		}
+		t.backup()
+	}()
+	parse()
+}
+
+// atBoundary reports whether a token of type typ starts an element of the
+// template content, where the parser can resume after an error.
+func atBoundary(typ itemType) bool {
+	switch typ {
+	case itemText, itemLeftInterpolation, itemStartDirective, itemEndDirective, itemEOF:
+		return true
+	}
+	return false
+}
+
+// atTagEnd reports whether a token of type typ ends a start tag, or else
+// starts an element of the template content.
+func atTagEnd(typ itemType) bool {
+	return typ == itemCloseDirective || typ == itemEmptyDirective || atBoundary(typ)
+}
+
 // startParse initializes the parser, using the lexer.
 func (t *Tree) startParse(lex *lexer, treeSet map[string]*Tree) {
 	t.Root = nil
 	t.lex = lex
 	t.treeSet = treeSet
+	t.blocks = nil
+	t.pending = nil
 }
 
 // stopParse terminates parsing.
@@ -236,17 +387,25 @@ func (t *Tree) stopParse() {
 }
 
 // Parse parses the template definition string to construct a representation of
-// the template for execution. If either action delimiter string is empty, the
-// default ("{{" or "}}") is used. Embedded template definitions are added to
-// the treeSet map.
+// the template for execution. Embedded template definitions are added to
+// the treeSet map. If t.Mode has AllErrors set, parsing carries on after
+// syntax errors, collecting them in t.Errors, and the first one is returned.
 func (t *Tree) Parse(text string, treeSet map[string]*Tree) (tree *Tree, err error) {
 	defer t.recover(&err)
 	t.ParseName = t.Name
-	t.startParse(lex(t.Name, text), treeSet)
+	if t.Mode&AllErrors != 0 {
+		t.startParse(lexResyncing(t.Name, text), treeSet)
+	} else {
+		t.startParse(lex(t.Name, text), treeSet)
+	}
 	t.text = text
+	t.Errors = nil
 	t.parse()
 	t.add()
 	t.stopParse()
+	if len(t.Errors) > 0 {
+		return t, t.Errors[0]
+	}
 	return t, nil
 }
 
@@ -258,7 +417,7 @@ func (t *Tree) add() {
 		return
 	}
 	if !IsEmptyTree(t.Root) {
-		t.errorf("template: multiple definition of template %q", t.Name)
+		t.errorf("multiple definition of template %q", t.Name)
 	}
 }
 
@@ -275,7 +434,13 @@ func IsEmptyTree(n Node) bool {
 			}
 		}
 		return true
+	case *InterpolationNode:
+	case *IncludeNode:
 	case *ListNode:
+	case *AttemptNode:
+	case *MacroNode:
+	case *NestedNode:
+	case *UserDirectiveNode:
 	case *TextNode:
 		return len(bytes.TrimSpace(n.Text)) == 0
 	default:
@@ -291,12 +456,14 @@ func (t *Tree) parse() {
 	t.Root = t.newContent(t.peek().pos)
 
 	for t.peek().typ != itemEOF {
-		switch n := t.textOrInterpolationOrDirective(); n.Type() {
-		case nodeEnd, nodeElse:
-			t.errorf("unexpected %s", n)
-		default:
-			t.Root.append(n)
-		}
+		t.recoverTo(atBoundary, func() {
+			switch n := t.textOrInterpolationOrDirective(); n.Type() {
+			case nodeEnd, nodeElse, nodeRecover:
+				t.errorAt(n.Position(), "unexpected %s", n)
+			default:
+				t.Root.append(n)
+			}
+		})
 	}
 }
 
@@ -313,7 +480,7 @@ func (t *Tree) parseDefinition() {
 	}
 	//	t.expect(itemRightDelim, context)
 	var end Node
-	t.Root, end = t.itemContent()
+	t.Root, end = t.itemContent(context)
 	if end.Type() != nodeEnd {
 		t.errorf("unexpected %s in %s", end, context)
 	}
@@ -321,23 +488,70 @@ func (t *Tree) parseDefinition() {
 	t.stopParse()
 }
 
-func (t *Tree) itemContent() (content *ContentNode, next Node) {
+// itemContent parses the content of the block directive named context up to
+// its end tag or an <#else>, <#elseif> or <#recover>, which is returned as next.
+func (t *Tree) itemContent(context string) (content *ContentNode, next Node) {
 	content = t.newContent(t.peekNonSpace().pos)
 
-	for t.peekNonSpace().typ != itemEOF {
-		n := t.textOrInterpolationOrDirective()
+	t.blocks = append(t.blocks, context)
+	defer func() { t.blocks = t.blocks[:len(t.blocks)-1] }()
+
+	for t.pending == nil && t.peekNonSpace().typ != itemEOF {
+		var n Node
+		t.recoverTo(atBoundary, func() { n = t.textOrInterpolationOrDirective() })
+		if n == nil {
+			continue
+		}
 
 		switch n.Type() {
-		case nodeEnd, nodeElse:
+		case nodeEnd, nodeElse, nodeRecover:
 			return content, n
 		}
 
 		content.append(n)
 	}
+	if t.pending != nil {
+		next, t.pending = t.pending, nil
+		return content, next
+	}
 
-	t.errorf("unexpected EOF")
+	pos := t.peek().pos
+	t.report(pos, "unexpected EOF; missing %s", endTag(context))
 
-	return
+	return content, t.newEnd(pos, context)
+}
+
+// endOf checks that next, which ended the content of the block directive
+// named context, is the end tag of that directive. When reporting all errors,
+// the end tag of an enclosing directive is kept for that directive, so a
+// single missing end tag does not unbalance the rest of the template.
+func (t *Tree) endOf(next Node, context string) {
+	end, ok := next.(*endNode)
+	if ok && (end.identifier == context || end.identifier == "@" && strings.HasPrefix(context, "@")) {
+		return
+	}
+	if !ok {
+		t.report(next.Position(), "unexpected %s in %s", next, context)
+		return
+	}
+	for _, block := range t.blocks {
+		if block == end.identifier {
+			t.report(end.Pos, "missing %s before %s", endTag(context), end)
+			t.pending = end
+			return
+		}
+	}
+	t.report(end.Pos, "unexpected %s; expected %s", end, endTag(context))
+}
+
+// endTag returns the end tag of the block directive named context: the
+// name of a directive such as "if", or "@" and the name of a user-defined
+// directive.
+func endTag(context string) string {
+	if strings.HasPrefix(context, "@") {
+		return "</" + context + ">"
+	}
+	return "</#" + context + ">"
 }
 
 func (t *Tree) textOrInterpolationOrDirective() Node {
@@ -349,12 +563,32 @@ func (t *Tree) textOrInterpolationOrDirective() Node {
 	case itemLeftInterpolation:
 		return t.interpolation(token.pos)
 	case itemStartDirective:
-		return t.directive()
+		return t.directive(token.pos)
 	case itemEndDirective:
-		token = t.next() // consumes an identifier, such as "if"
-		token = t.next() // consumes a close directive token ">"
+		name := t.next() // consumes an identifier, such as "if"
+		if name.typ != itemIdentifier && (name.typ <= _itemDirectiveBeg || name.typ >= _itemDirectiveEnd) {
+			t.unexpected(name, "end directive")
+		}
+		t.expect(itemCloseDirective, "end directive")
+
+		return t.newEnd(token.pos, name.val)
+	case itemStartUserDirective:
+		return t.userDirective(token.pos)
+	case itemEndUserDirective:
+		// The name is optional: </@> ends any user-defined directive.
+		name := "@"
+		for {
+			token := t.nextNonSpace()
+			if token.typ == itemCloseDirective {
+				break
+			}
+			if token.typ != itemIdentifier && token.typ != itemDot && token.typ != itemBuiltin {
+				t.unexpected(token, "end directive")
+			}
+			name += token.val
+		}
 
-		return t.newEnd(token.pos, token.val)
+		return t.newEnd(token.pos, name)
 	default:
 		t.unexpected(token, "input")
 	}
@@ -363,157 +597,602 @@ func (t *Tree) textOrInterpolationOrDirective() Node {
 }
 
 // Interpolation:
+//
 //	${expr}
+//
 // ${ is past.
 func (t *Tree) interpolation(pos Pos) Node {
-	expr := t.expression("interpolation")
+	const context = "interpolation"
+	expr := t.expression(context)
+	t.expect(itemRightInterpolation, context)
 
 	return t.newInterpolation(pos, expr)
 }
 
-func (t *Tree) directive() Node {
-	switch token := t.nextNonSpace(); token.typ {
+// directive parses a directive. The start of the tag, at pos, is past.
+func (t *Tree) directive(pos Pos) Node {
+	switch token := t.next(); token.typ {
 	case itemDirectiveIf:
-		return t.ifControl()
+		return t.ifControl(pos)
+	case itemDirectiveElseif:
+		return t.newElse(pos, t.condition("elseif"))
 	case itemDirectiveElse:
-		return t.elseControl()
+		return t.elseControl(pos)
+	case itemDirectiveList:
+		return t.listControl(pos)
+	case itemDirectiveInclude:
+		return t.includeControl(pos)
+	case itemDirectiveMacro:
+		return t.macroControl(pos)
+	case itemDirectiveAttempt:
+		return t.attemptControl(pos)
+	case itemDirectiveSetting:
+		return t.settingControl(pos)
+	case itemDirectiveRecover:
+		t.header(func() {
+			t.expect(itemCloseDirective, "recover")
+		})
+		return t.newRecover(pos)
+	case itemDirectiveNested:
+		t.header(func() {
+			t.expectOneOf(itemCloseDirective, itemEmptyDirective, "nested")
+		})
+		return t.newNested(pos)
+	case itemIdentifier:
+		t.errorAt(token.pos, "unknown directive #%s", token.val)
+	default:
+		t.unexpected(token, "directive")
 	}
 
-	t.backup()
-	token := t.peek()
-
-	fmt.Println("directive", token)
-
 	return nil
 }
 
-func (t *Tree) expression(context string) *ExpressionNode {
-	operatorStack := &stack{}
-	lowestPrecOperator := item{
-		typ: itemLowestPrecOpt,
-		val: "#",
+// header parses the rest of a start tag with parse. When reporting all
+// errors, an error in the tag skips to its end, so that the content of the
+// directive is still parsed; empty reports whether that end was "/>".
+func (t *Tree) header(parse func()) (empty bool) {
+	t.recoverTo(atTagEnd, parse)
+	if typ := t.peek().typ; typ == itemCloseDirective || typ == itemEmptyDirective {
+		t.next()
+		return typ == itemEmptyDirective
 	}
-	operatorStack.push(&lowestPrecOperator)
+	return false
+}
 
-	operandStack := &stack{}
+// condition parses the expression and the end of the start tag of the
+// directive named context.
+func (t *Tree) condition(context string) (expr Node) {
+	t.header(func() {
+		expr = t.expression(context)
+		t.expect(itemCloseDirective, context)
+	})
 
-	for {
-		token := t.nextNonSpace()
+	return expr
+}
 
-		switch token.typ {
-		case itemCloseDirective, itemRightInterpolation:
-			topOperator := operatorStack.pop()
-			bottomOperator := operatorStack.pop()
-			if nil == bottomOperator || &lowestPrecOperator != bottomOperator.(*item) {
-				t.unexpected(token, context)
+// expression parses an expression. Operators bind by precedence, from the
+// logical operators (lowest) to the multiplicative ones (highest):
+//
+//	||
+//	&&
+//	== != = < <= > >= lt lte gt gte
+//	.. ..< ..! ..*
+//	+ -
+//	* / %
+//
+// Unary !, - and + apply to a primary expression with its suffixes.
+func (t *Tree) expression(context string) Node {
+	return t.binaryExpr(LowestPrec+1, context)
+}
+
+func (t *Tree) binaryExpr(prec1 int, context string) Node {
+	x := t.unaryExpr(context)
+	for {
+		op := t.peekNonSpace()
+		oprec := op.precedence()
+		if oprec < prec1 {
+			return x
+		}
+		t.nextNonSpace()
+
+		switch op.typ {
+		case itemRange:
+			// The end of a ".." range is optional.
+			var y Node
+			if startsOperand(t.peekNonSpace().typ) {
+				y = t.binaryExpr(oprec+1, context)
 			}
+			x = t.newRange(x.Position(), x, y, op.typ.String())
+		case itemRangeExclusive, itemRangeLimited:
+			x = t.newRange(x.Position(), x, t.binaryExpr(oprec+1, context), op.typ.String())
+		default:
+			expr := t.newExpression(x.Position(), operator(op))
+			expr.append(x)
+			expr.append(t.binaryExpr(oprec+1, context))
+			x = expr
+		}
+	}
+}
+
+// operator returns the canonical spelling of the operator token.
+func operator(op item) string {
+	if op.typ == itemAssign {
+		return "=="
+	}
 
-			expr := t.newExpression(token.pos, topOperator.(*item).typ)
-			second := operandStack.pop().(Node)
-			first := operandStack.pop().(Node)
-			expr.append(first)
-			expr.append(second)
-
-			return expr
-		case itemBool:
-			boolean := t.newBool(token.pos, token.val == "true")
-			operandStack.push(boolean)
-		case itemCharConstant, itemNumber:
-			number, err := t.newNumber(token.pos, token.val, token.typ)
+	return op.typ.String()
+}
+
+// startsOperand reports whether a token of type typ can start an operand.
+func startsOperand(typ itemType) bool {
+	switch typ {
+	case itemBool, itemNumber, itemCharConstant, itemStringConstant, itemIdentifier,
+		itemLeftParen, itemLeftBracket, itemLeftBrace, itemDot, itemNot, itemAdd, itemMinus:
+		return true
+	}
+	return false
+}
+
+func (t *Tree) unaryExpr(context string) Node {
+	switch token := t.peekNonSpace(); token.typ {
+	case itemNot, itemAdd, itemMinus:
+		t.nextNonSpace()
+		x := t.unaryExpr(context)
+		if n, ok := x.(*NumberNode); ok && token.typ == itemMinus && !strings.HasPrefix(n.Text, "-") {
+			// Fold the sign into a number literal.
+			number, err := t.newNumber(token.pos, "-"+n.Text, itemNumber)
 			if err != nil {
-				t.error(err)
+				t.errorAt(token.pos, "%s", err)
 			}
-			operandStack.push(number)
-		case itemIdentifier:
-			iden := t.newIdentifier(token.pos, token.val)
-			operandStack.push(iden)
-		case itemStringConstant:
-			str := t.newString(token.pos, token.val)
-			operandStack.push(str)
-		case itemAdd, itemMinus, itemMultiply, itemDivide, itemLess, itemLessEq, itemEq, itemNeq, itemDot:
-			topOperator := operatorStack.peek()
-			if lowestPrecOperator == topOperator || token.precedence() >= topOperator.(*item).precedence() {
-				operatorStack.push(&token)
+			return number
+		}
+		expr := t.newExpression(token.pos, token.typ.String())
+		expr.append(x)
 
-				continue
-			}
+		return expr
+	}
+
+	return t.primaryExpr(context)
+}
 
-			operExpr := t.newExpression(token.pos, topOperator.(*item).typ)
-			second := operandStack.pop().(Node)
-			first := operandStack.pop().(Node)
-			operExpr.append(first)
-			operExpr.append(second)
-			operandStack.push(operExpr)
+// primaryExpr parses a literal, a variable or a parenthesized expression,
+// followed by any number of suffixes:
+//
+//	.name [key] (args) ?builtin ?builtin(args) !default ! ??
+func (t *Tree) primaryExpr(context string) Node {
+	var x Node
 
-			t.backup()
+	switch token := t.nextNonSpace(); token.typ {
+	case itemBool:
+		x = t.newBool(token.pos, token.val == "true")
+	case itemNumber:
+		number, err := t.newNumber(token.pos, token.val, token.typ)
+		if err != nil {
+			t.errorAt(token.pos, "%s", err)
+		}
+		x = number
+	case itemStringConstant, itemCharConstant:
+		s, err := unquote(token.val)
+		if err != nil {
+			t.errorAt(token.pos, "%s", err)
+		}
+		x = t.newString(token.pos, s)
+	case itemIdentifier:
+		x = t.newIdentifier(token.pos, token.val)
+	case itemLeftParen:
+		x = t.expression(context)
+		t.expect(itemRightParen, context)
+	case itemLeftBracket:
+		x = t.newSequence(token.pos, t.expressionList(itemRightBracket, context))
+	case itemLeftBrace:
+		x = t.hashLiteral(token.pos, context)
+	case itemDot:
+		name := t.expect(itemIdentifier, context)
+		x = t.newSpecialVar(token.pos, name.val)
+	default:
+		t.unexpected(token, context)
+	}
+
+	for {
+		switch token := t.peekNonSpace(); token.typ {
+		case itemDot:
+			t.nextNonSpace()
+			expr := t.newExpression(x.Position(), ".")
+			expr.append(x)
+			expr.append(t.memberName(context))
+			x = expr
+		case itemLeftBracket:
+			t.nextNonSpace()
+			index := t.expression(context)
+			t.expect(itemRightBracket, context)
+			x = t.newIndex(x.Position(), x, index)
+		case itemLeftParen:
+			t.nextNonSpace()
+			x = t.newCall(x.Position(), x, t.expressionList(itemRightParen, context))
+		case itemBuiltin:
+			t.nextNonSpace()
+			name := t.next()
+			if name.typ != itemIdentifier {
+				t.unexpected(name, context)
+			}
+			var args []Node
+			if t.peek().typ == itemLeftParen {
+				t.next()
+				args = t.builtinArgs(context)
+			}
+			x = t.newBuiltin(x.Position(), x, name.val, args)
+		case itemExists:
+			t.nextNonSpace()
+			x = t.newExists(x.Position(), x)
+		case itemNot:
+			t.nextNonSpace()
+			var def Node
+			if startsOperand(t.peekNonSpace().typ) {
+				def = t.expression(context)
+			}
+			x = t.newDefault(x.Position(), x, def)
 		default:
-			t.unexpected(token, context)
+			return x
 		}
 	}
 }
 
-func (t *Tree) parseControl(allowElseIf bool, context string) (pos Pos, expr *ExpressionNode, list, elseList *ContentNode) {
-	expr = t.expression(context)
+// memberName parses the name after a dot, which may also be a keyword.
+func (t *Tree) memberName(context string) Node {
+	token := t.next()
+	switch {
+	case token.typ == itemIdentifier, token.typ == itemBool, token.typ == itemAs,
+		comparators[token.val] != 0:
+		return t.newIdentifier(token.pos, token.val)
+	}
+	t.unexpected(token, context)
 
-	var next Node
-	list, next = t.itemContent()
+	return nil
+}
 
-	switch next.Type() {
-	case nodeEnd: // done
-	case nodeElse:
-		if allowElseIf {
-			// Special case for "else if". If the "else" is followed immediately by an "if",
-			// the elseControl will have left the "if" token pending. Treat
-			//	{{if a}}_{{else if b}}_{{end}}
-			// as
-			//	{{if a}}_{{else}}{{if b}}_{{end}}{{end}}.
-			// To do this, parse the if as usual and stop at it {{end}}; the subsequent{{end}}
-			// is assumed. This technique works even for long if-else-if chains.
-			// TODO: Should we allow else-if in with and range?
-			if t.peek().typ == itemDirectiveIf {
-				t.next() // Consume the "if" token.
-				elseList = t.newContent(next.Position())
-				elseList.append(t.ifControl())
-				// Do not consume the next item - only one {{end}} required.
-				break
+// expressionList parses comma-separated expressions up to and including the
+// closing token of type end. The opening token is past.
+func (t *Tree) expressionList(end itemType, context string) []Node {
+	list := []Node{}
+	if t.peekNonSpace().typ == end {
+		t.nextNonSpace()
+		return list
+	}
+	for {
+		list = append(list, t.expression(context))
+		if t.expectOneOf(itemComma, end, context).typ == end {
+			return list
+		}
+	}
+}
+
+// builtinArgs parses the arguments of a built-in up to and including the
+// closing parenthesis, which unlike those of a call may be lambdas:
+//
+//	x -> expr
+//	(x) -> expr
+//
+// The opening parenthesis is past.
+func (t *Tree) builtinArgs(context string) []Node {
+	list := []Node{}
+	if t.peekNonSpace().typ == itemRightParen {
+		t.nextNonSpace()
+		return list
+	}
+	for {
+		x := t.expression(context)
+		if arrow := t.peekNonSpace(); arrow.typ == itemArrow {
+			t.nextNonSpace()
+			param, ok := x.(*IdentifierNode)
+			if !ok {
+				t.errorAt(arrow.pos, "the parameter of a lambda must be a name, not %s", x)
 			}
+			x = t.newLambda(x.Position(), param.Ident, t.expression(context))
 		}
-		elseList, next = t.itemContent()
-		if next.Type() != nodeEnd {
-			t.errorf("expected end; found %s", next)
+		list = append(list, x)
+		if t.expectOneOf(itemComma, itemRightParen, context).typ == itemRightParen {
+			return list
 		}
 	}
+}
 
-	return expr.Position(), expr, list, elseList
+// hashLiteral parses {key: value, ...}. The opening brace at pos is past.
+func (t *Tree) hashLiteral(pos Pos, context string) Node {
+	var keys, values []Node
+	if t.peekNonSpace().typ == itemRightBrace {
+		t.nextNonSpace()
+		return t.newHash(pos, keys, values)
+	}
+	for {
+		keys = append(keys, t.expression(context))
+		t.expect(itemColon, context)
+		values = append(values, t.expression(context))
+		if t.expectOneOf(itemComma, itemRightBrace, context).typ == itemRightBrace {
+			return t.newHash(pos, keys, values)
+		}
+	}
 }
 
 // If:
+//
 //	<#if expr>itemContent</#if>
 //	<#if expr>itemContent<#elseif expr>itemContent<#else>itemContent</#if>
+//
 // If keyword is past.
-func (t *Tree) ifControl() Node {
-	return t.newIf(t.parseControl(true, "if"))
+func (t *Tree) ifControl(pos Pos) Node {
+	return t.ifChain(pos, t.condition("if"))
+}
+
+// ifChain parses the content of an <#if> or <#elseif> whose condition is
+// past, and the rest of the chain up to </#if>.
+func (t *Tree) ifChain(pos Pos, expr Node) *IfNode {
+	const context = "if"
+	list, next := t.itemContent(context)
+
+	var elseList *ContentNode
+	if e, ok := next.(*elseNode); ok {
+		if e.Expr != nil {
+			// Treat
+			//	<#if a>_<#elseif b>_</#if>
+			// as
+			//	<#if a>_<#else><#if b>_</#if></#if>.
+			// The nested if consumes the only </#if>.
+			elseList = t.newContent(e.Pos)
+			elseList.append(t.ifChain(e.Pos, e.Expr))
+
+			return t.newIf(pos, expr, list, elseList)
+		}
+		elseList, next = t.itemContent(context)
+	}
+	t.endOf(next, context)
+
+	return t.newIf(pos, expr, list, elseList)
 }
 
 // List:
-//	<#list expr}}itemContent</#list>
-// Range keyword is past.
-func (t *Tree) listControl() Node {
-	return t.newList(t.parseControl(false, "list"))
+//
+//	<#list expr as item>itemContent</#list>
+//	<#list expr as key, value>itemContent<#else>itemContent</#list>
+//
+// List keyword is past.
+func (t *Tree) listControl(pos Pos) Node {
+	const context = "list"
+	var expr Node
+	var vars []string
+	t.header(func() {
+		expr = t.expression(context)
+		t.expect(itemAs, context)
+		vars = append(vars, t.expect(itemIdentifier, context).val)
+		if t.peekNonSpace().typ == itemComma {
+			t.nextNonSpace()
+			vars = append(vars, t.expect(itemIdentifier, context).val)
+		}
+		t.expect(itemCloseDirective, context)
+	})
+
+	list, next := t.itemContent(context)
+
+	var elseList *ContentNode
+	if e, ok := next.(*elseNode); ok {
+		if e.Expr != nil {
+			t.report(e.Pos, "unexpected %s in %s", e, context)
+		}
+		elseList, next = t.itemContent(context)
+	}
+	t.endOf(next, context)
+
+	return t.newList(pos, expr, vars, list, elseList)
+}
+
+// Attempt:
+//
+//	<#attempt>itemContent<#recover>itemContent</#attempt>
+//
+// Attempt keyword is past. The end tag may also be </#recover>.
+func (t *Tree) attemptControl(pos Pos) Node {
+	const context = "attempt"
+	t.header(func() {
+		t.expect(itemCloseDirective, context)
+	})
+
+	content, next := t.itemContent(context)
+	if next.Type() != nodeRecover {
+		t.report(next.Position(), "missing <#recover> before %s", next)
+		t.endOf(next, context)
+		return t.newAttempt(pos, content, t.newContent(next.Position()))
+	}
+	recoverContent, next := t.itemContent(context)
+	if end, ok := next.(*endNode); ok && end.identifier == "recover" {
+		return t.newAttempt(pos, content, recoverContent)
+	}
+	t.endOf(next, context)
+
+	return t.newAttempt(pos, content, recoverContent)
 }
 
 // Else:
-//	{{else}}
+//
+//	<#else>
+//
 // Else keyword is past.
-func (t *Tree) elseControl() Node {
-	// Special case for "else if".
-	peek := t.peekNonSpace()
-	if peek.typ == itemDirectiveIf {
-		// We see "{{else if ... " but in effect rewrite it to {{else}}{{if ... ".
-		return t.newElse(peek.pos)
+func (t *Tree) elseControl(pos Pos) Node {
+	t.header(func() {
+		t.expectOneOf(itemCloseDirective, itemEmptyDirective, "else")
+	})
+
+	return t.newElse(pos, nil)
+}
+
+// Include:
+//
+//	<#include expr>
+//
+// Include keyword is past.
+func (t *Tree) includeControl(pos Pos) Node {
+	const context = "include"
+	var name Node
+	t.header(func() {
+		name = t.expression(context)
+		t.expectOneOf(itemCloseDirective, itemEmptyDirective, context)
+	})
+
+	return t.newInclude(pos, name)
+}
+
+// Setting:
+//
+//	<#setting name=value>
+//
+// Setting keyword is past.
+func (t *Tree) settingControl(pos Pos) Node {
+	const context = "setting"
+	var name string
+	var value Node
+	t.header(func() {
+		name = t.expect(itemIdentifier, context).val
+		t.expect(itemAssign, context)
+		value = t.expression(context)
+		t.expectOneOf(itemCloseDirective, itemEmptyDirective, context)
+	})
+
+	return t.newSetting(pos, name, value)
+}
+
+// Macro:
+//
+//	<#macro name param1 param2=default others...>itemContent</#macro>
+//
+// Macro keyword is past.
+func (t *Tree) macroControl(pos Pos) Node {
+	const context = "macro"
+	var name, catchAll string
+	var params []string
+	var defaults []Node
+	t.header(func() {
+		token := t.nextNonSpace()
+		switch token.typ {
+		case itemIdentifier:
+			name = token.val
+		case itemStringConstant, itemCharConstant:
+			s, err := unquote(token.val)
+			if err != nil {
+				t.errorAt(token.pos, "%s", err)
+			}
+			name = s
+		default:
+			t.unexpected(token, context)
+		}
+		for {
+			token := t.nextNonSpace()
+			switch token.typ {
+			case itemCloseDirective:
+				return
+			case itemComma:
+				continue
+			case itemIdentifier:
+			default:
+				t.unexpected(token, context)
+			}
+			if catchAll != "" {
+				t.errorAt(token.pos, "catch-all parameter %s must be the last parameter", catchAll)
+			}
+			switch t.peekNonSpace().typ {
+			case itemEllipsis:
+				t.nextNonSpace()
+				catchAll = token.val
+			case itemAssign:
+				t.nextNonSpace()
+				params = append(params, token.val)
+				defaults = append(defaults, t.expression(context))
+			default:
+				params = append(params, token.val)
+				defaults = append(defaults, nil)
+			}
+		}
+	})
+
+	content, next := t.itemContent(context)
+	t.endOf(next, context)
+
+	return t.newMacro(pos, name, params, defaults, catchAll, content)
+}
+
+// User-defined directive call:
+//
+//	<@name arg1=expr arg2=expr/>
+//	<@name expr, expr>itemContent</@name>
+//
+// <@ is past.
+func (t *Tree) userDirective(pos Pos) Node {
+	const context = "user-defined directive"
+	var name Node
+	var named []string
+	var args []Node
+	var empty bool
+	skipped := t.header(func() {
+		token := t.expect(itemIdentifier, context)
+		name = t.newIdentifier(token.pos, token.val)
+	Name:
+		for {
+			switch t.peek().typ {
+			case itemDot:
+				t.next()
+				expr := t.newExpression(name.Position(), ".")
+				expr.append(name)
+				expr.append(t.memberName(context))
+				name = expr
+			case itemBuiltin:
+				// As in <@snippet?interpret/>, without arguments.
+				t.next()
+				builtin := t.expect(itemIdentifier, context)
+				name = t.newBuiltin(name.Position(), name, builtin.val, nil)
+			default:
+				break Name
+			}
+		}
+		for {
+			token := t.nextNonSpace()
+			switch token.typ {
+			case itemCloseDirective:
+				return
+			case itemEmptyDirective:
+				empty = true
+				return
+			case itemComma:
+				if len(args) == 0 {
+					t.unexpected(token, context)
+				}
+				token = t.nextNonSpace()
+			}
+			if token.typ == itemIdentifier && (named != nil || len(args) == 0) {
+				if next := t.peekNonSpace(); next.typ == itemAssign {
+					t.nextNonSpace()
+					named = append(named, token.val)
+					args = append(args, t.expression(context))
+					continue
+				}
+				t.backup2(token)
+			} else {
+				t.backup()
+			}
+			if named != nil {
+				t.errorAt(token.pos, "positional argument after named arguments in %s", context)
+			}
+			args = append(args, t.expression(context))
+		}
+	})
+	if empty || skipped {
+		return t.newUserDirective(pos, name, named, args, nil)
+	}
+
+	label := "@"
+	if name != nil {
+		label += name.String()
 	}
-	token := t.expect(itemCloseDirective, "else")
-	return t.newElse(token.pos)
+	content, next := t.itemContent(label)
+	t.endOf(next, label)
+
+	return t.newUserDirective(pos, name, named, args, content)
 }
 
 func (t *Tree) parseTemplateName(token item, context string) (name string) {
@@ -530,6 +1209,69 @@ func (t *Tree) parseTemplateName(token item, context string) (name string) {
 	return
 }
 
+// unquote interprets s as an FTL string literal: "..." or '...' with
+// backslash escapes, or the raw r"..." or r'...'.
+func unquote(s string) (string, error) {
+	if strings.HasPrefix(s, "r") && len(s) >= 3 {
+		return s[2 : len(s)-1], nil
+	}
+	if len(s) < 2 || s[0] != s[len(s)-1] {
+		return "", fmt.Errorf("malformed string literal: %s", s)
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("malformed string literal: escape at end of string")
+		}
+		switch c = s[i]; c {
+		case '"', '\'', '\\', '`', '{', '=':
+			b = append(b, c)
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'l':
+			b = append(b, '<')
+		case 'g':
+			b = append(b, '>')
+		case 'a':
+			b = append(b, '&')
+		case 'x':
+			j := i + 1
+			for j < len(s) && j < i+5 && strings.IndexByte("0123456789abcdefABCDEF", s[j]) >= 0 {
+				j++
+			}
+			if j == i+1 {
+				return "", fmt.Errorf("malformed string literal: \\x must be followed by hexadecimal digits")
+			}
+			r, _ := strconv.ParseUint(s[i+1:j], 16, 32)
+			b = append(b, string(rune(r))...)
+			i = j - 1
+		default:
+			return "", fmt.Errorf("malformed string literal: unknown escape sequence \\%c", c)
+		}
+	}
+
+	return string(b), nil
+}
+
 type stack struct {
 	items []interface{}
 	count int
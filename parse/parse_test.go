@@ -22,13 +22,6 @@ import (
 	"testing"
 )
 
-func mkItem(typ itemType, text string) item {
-	return item{
-		typ: typ,
-		val: text,
-	}
-}
-
 func TestStack(t *testing.T) {
 	e1 := mkItem(itemNumber, "1")
 	e2 := mkItem(itemAdd, "+")
@@ -71,15 +64,36 @@ const (
 )
 
 var parseTests = []parseTest{
-	//	{"empty", "", noError, ``},
-	//	{"comment", "hello-<#--\n\n\n-->-world", noError, `"hello-""-world"`},
-	//	{"spaces", " \t\n", noError, `" \t\n"`},
-	//	{"text", "some text", noError, `"some text"`},
-	//	{"interpolation iden", "hello${abc}world", noError, `"hello"${abc}"world"`},
+	{"empty", "", noError, ``},
+	{"comment", "hello-<#--\n\n\n-->-world", noError, `"hello-""-world"`},
+	{"spaces", " \t\n", noError, `" \t\n"`},
+	{"text", "some text", noError, `"some text"`},
+	{"interpolation iden", "hello${abc}world", noError, `"hello"${abc}"world"`},
 	{"interpolation iden.", "hello${a.b}world", noError, `"hello"${a.b}"world"`},
-	//	{"true if", "<#if true></#if>", noError, `<#if true></#if>`},
-	//	{"simple if", "<#if a == b>true content</#if>following content", noError,
-	//		`<#if a==b>"true content"</#if>"following content"`},
+	{"true if", "<#if true></#if>", noError, `<#if true></#if>`},
+	{"simple if", "<#if a == b>true content</#if>following content", noError,
+		`<#if a==b>"true content"</#if>"following content"`},
+	{"if else", "<#if a>x<#else>y</#if>", noError, `<#if a>"x"<#else>"y"</#if>`},
+	{"elseif", "<#if a>x<#elseif b>y<#else>z</#if>", noError,
+		`<#if a>"x"<#else><#if b>"y"<#else>"z"</#if></#if>`},
+	{"list", "<#list xs as x>${x}</#list>", noError, `<#list xs as x>${x}</#list>`},
+	{"user directive", `<@greet name="x" n=1/>`, noError, `<@greet name="x" n=1/>`},
+	{"user directive content", `<@m.greet "x", 1>c<#nested></@>`, noError, `<@m.greet "x", 1>"c"<#nested></@m.greet>`},
+	{"attempt", "<#attempt>${a}<#recover>b</#attempt>", noError, `<#attempt>${a}<#recover>"b"</#attempt>`},
+	{"attempt recover end", "<#attempt>a<#recover>b</#recover>", noError, `<#attempt>"a"<#recover>"b"</#attempt>`},
+	{"setting", `<#setting date_format="yyyy">`, noError, `<#setting date_format="yyyy">`},
+	{"setting without value", "<#setting locale>", hasError, ``},
+	{"lambda", "${xs?filter(x -> x.n > 1)?map((x) -> x.n)}", noError, `${xs?filter(x -> (x.n)>1)?map(x -> x.n)}`},
+	{"lambda with a bad parameter", "${xs?filter(x.n -> x)}", hasError, ``},
+	{"lambda outside a built-in", "${f(x -> x)}", hasError, ``},
+	{"unclosed if", "<#if a>x", hasError, ``},
+	{"attempt without recover", "<#attempt>a</#attempt>", hasError, ``},
+	{"stray recover", "<#recover>", hasError, ``},
+	{"user directive built-in", `<@snippet?interpret/><@m?x (1)>c</@m?x>`, noError, `<@snippet?interpret/><@m?x 1>"c"</@m?x>`},
+	{"wrong user directive end", "<@a>x</@b>", hasError, ``},
+	{"unclosed interpolation", "${a", hasError, ``},
+	{"unknown directive", "<#foo>", hasError, ``},
+	{"stray end", "</#if>", hasError, ``},
 }
 
 func testParse(doCopy bool, t *testing.T) {
@@ -146,7 +160,7 @@ func TestIsEmpty(t *testing.T) {
 }
 
 func TestErrorContextWithTreeCopy(t *testing.T) {
-	tree, err := New("root").Parse("{{if true}}{{end}}", make(map[string]*Tree))
+	tree, err := New("root").Parse("<#if true></#if>", make(map[string]*Tree))
 	if err != nil {
 		t.Fatalf("unexpected tree parse failure: %v", err)
 	}
@@ -160,3 +174,88 @@ func TestErrorContextWithTreeCopy(t *testing.T) {
 		t.Errorf("wrong error location want %q got %q", wantContext, gotContext)
 	}
 }
+
+type parseAllTest struct {
+	name   string
+	input  string
+	errors []string // errors reported, in order
+	result string   // the partial tree
+}
+
+var parseAllTests = []parseAllTest{
+	{"no errors", "a${b}c", nil, `"a"${b}"c"`},
+	{"bad interpolations", "a${x +}b${y}c${z)}", []string{
+		`template: t:1:7: unexpected "}" in interpolation`,
+		`template: t:1:17: unexpected ")" in interpolation`,
+	}, `"a""b"${y}"c"`},
+	{"bad directive", "<#foo bar>${1}<#if a>${b b}</#if>", []string{
+		`template: t:1:3: unknown directive #foo`,
+		`template: t:1:26: unexpected "b" in interpolation`,
+	}, `${1}<#if a></#if>`},
+	{"missing end", "<#if a><#list xs as x>${x}</#if>after${ok}", []string{
+		`template: t:1:27: missing </#list> before </#if>`,
+	}, `<#if a><#list xs as x>${x}</#list></#if>"after"${ok}`},
+	{"unclosed interpolation", "${a\n<#if x>y</#if>${", []string{
+		`template: t:2:1: unclosed interpolation`,
+		`template: t:2:17: unclosed interpolation`,
+	}, `<#if x>"y"</#if>`},
+	{"unclosed if", "<#if a>x", []string{
+		`template: t:1:9: unexpected EOF; missing </#if>`,
+	}, `<#if a>"x"</#if>`},
+}
+
+func TestParseAll(t *testing.T) {
+	textFormat = "%q"
+	defer func() { textFormat = "%s" }()
+	for _, test := range parseAllTests {
+		trees, errs := ParseAll("t", test.input)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.errors) {
+			t.Errorf("%s: got errors\n\t%q\nexpected\n\t%q", test.name, got, test.errors)
+		}
+		if result := trees["t"].Root.String(); result != test.result {
+			t.Errorf("%s: got\n\t%v\nexpected\n\t%v", test.name, result, test.result)
+		}
+	}
+}
+
+func TestParseStopsAtFirstError(t *testing.T) {
+	_, err := Parse("t", "${x +}${y)}")
+	if err == nil || err.Error() != `template: t:1:6: unexpected "}" in interpolation` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		input  string
+		result string
+		err    string
+	}{
+		{"1 + x", "1+x", ""},
+		{" {'a': [1, 2]}\n", `{"a": [1, 2]}`, ""},
+		{"x > 1 && y?size < 3", "(x>1)&&(y?size<3)", ""},
+		{"items?filter(i -> i.n > 1)", "items?filter(i -> (i.n)>1)", ""},
+		{"", "", `template: e:1:1: unexpected EOF in expression`},
+		{"1 2", "", `template: e:1:3: unexpected "2" in expression`},
+		{"(1", "", `template: e:1:3: unexpected EOF in expression`},
+		{"x}", "", `template: e:1:2: unexpected right brace U+007D '}'`},
+		{"${x}", "", `template: e:1:1: unrecognized character in action: U+0024 '$'`},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpression("e", test.input)
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: expected error %q, got %v", test.input, test.err, err)
+			}
+		case err != nil:
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+		case expr.String() != test.result:
+			t.Errorf("%q: got %s, expected %s", test.input, expr, test.result)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"reflect"
+	"strings"
+)
+
+// A MemberAccessPolicy decides which members of the values of the data
+// model templates may access, for templates that are not trusted. Members
+// are the methods and fields exposed by reflection; the values implementing
+// the model interfaces, such as HashModel, and the entries of maps are not
+// subject to the policy.
+type MemberAccessPolicy interface {
+	// CanAccess reports whether templates may access the method or field
+	// with the Go name name of the values of typ, which is not a pointer
+	// type. A member promoted from an embedded struct is accessible only if
+	// both the type of the value and the embedded type declaring it allow
+	// it.
+	CanAccess(typ reflect.Type, name string) bool
+
+	// CanCallFuncs reports whether templates may call the func values of
+	// the data model, such as the func fields of a struct, and use the call
+	// function. The functions added with Funcs can always be called.
+	CanCallFuncs() bool
+}
+
+// AccessPolicy is a configurable MemberAccessPolicy.
+type AccessPolicy struct {
+	// BlockedPackages are the import paths of the packages whose types have
+	// no accessible members. A package blocks its subpackages too, so "net"
+	// blocks "net/http".
+	BlockedPackages []string
+
+	// Allowed lists the only accessible members of some types, by their Go
+	// names. The types may be given as pointer types.
+	Allowed map[reflect.Type][]string
+
+	// Denied lists inaccessible members of some types, by their Go names.
+	Denied map[reflect.Type][]string
+
+	// AllowFuncCalls allows calling the func values of the data model.
+	AllowFuncCalls bool
+}
+
+// SandboxPolicy returns an AccessPolicy blocking the packages giving access
+// to the system, the network or the internals of the program, for templates
+// edited by untrusted users. Calling func values is not allowed.
+func SandboxPolicy() *AccessPolicy {
+	return &AccessPolicy{
+		BlockedPackages: []string{
+			"database/sql",
+			"io/ioutil",
+			"net",
+			"os",
+			"plugin",
+			"reflect",
+			"runtime",
+			"syscall",
+			"unsafe",
+		},
+	}
+}
+
+// CanAccess implements MemberAccessPolicy.
+func (p *AccessPolicy) CanAccess(typ reflect.Type, name string) bool {
+	pkg := typ.PkgPath()
+	for _, blocked := range p.BlockedPackages {
+		if pkg == blocked || strings.HasPrefix(pkg, blocked+"/") {
+			return false
+		}
+	}
+	if names, ok := lookupMembers(p.Allowed, typ); ok && !containsString(names, name) {
+		return false
+	}
+	if names, ok := lookupMembers(p.Denied, typ); ok && containsString(names, name) {
+		return false
+	}
+	return true
+}
+
+// CanCallFuncs implements MemberAccessPolicy.
+func (p *AccessPolicy) CanCallFuncs() bool {
+	return p.AllowFuncCalls
+}
+
+// lookupMembers returns the members listed for typ or *typ.
+func lookupMembers(m map[reflect.Type][]string, typ reflect.Type) ([]string, bool) {
+	if names, ok := m[typ]; ok {
+		return names, true
+	}
+	names, ok := m[reflect.PtrTo(typ)]
+	return names, ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// disabledFunc replaces the func values of the data model when the member
+// access policy doesn't allow calling them.
+type disabledFunc struct {
+	typ reflect.Type
+}
+
+var disabledFuncType = reflect.TypeOf(disabledFunc{})
+
+// canAccess reports whether the member access policy allows the access to
+// the member of the values of typ.
+func (s *state) canAccess(typ reflect.Type, info *memberInfo) bool {
+	if s.policy == nil {
+		return true
+	}
+	return s.policy.CanAccess(typ, info.goName) && (info.owner == typ || s.policy.CanAccess(info.owner, info.goName))
+}
+
+// checkMethod stops with an error if the member access policy denies the
+// access to the method name of v, which the engine calls implicitly, as
+// String when printing v.
+func (s *state) checkMethod(v reflect.Value, name string) {
+	if s.policy == nil {
+		return
+	}
+	typ := v.Type()
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if !s.policy.CanAccess(typ, name) {
+		s.errorf("can't call the %s method of %s: denied by the member access policy", name, typ)
+	}
+}
+
+// canCallFuncs reports whether the member access policy allows calling the
+// func values of the data model.
+func (s *state) canCallFuncs() bool {
+	return s.policy == nil || s.policy.CanCallFuncs()
+}
@@ -0,0 +1,88 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type Greeter struct {
+	Name  string
+	Token string
+	Hook  func() string
+}
+
+func (g Greeter) Hello() string { return "hello " + g.Name }
+func (g Greeter) Reset() string { return "reset" }
+
+type Page struct {
+	Greeter
+	Title string
+}
+
+func TestMemberAccessPolicy(t *testing.T) {
+	g := Greeter{Name: "joe", Token: "t0k3n", Hook: func() string { return "hooked" }}
+	data := map[string]interface{}{
+		"g":    g,
+		"page": &Page{Greeter: g, Title: "home"},
+		"file": os.Stdout,
+		"fn":   func() string { return "called" },
+		"typ":  reflect.TypeOf(0),
+	}
+	policy := SandboxPolicy()
+	policy.Denied = map[reflect.Type][]string{reflect.TypeOf(Greeter{}): {"Token", "Reset"}}
+	tests := []struct {
+		name   string
+		input  string
+		policy MemberAccessPolicy
+		output string
+		err    string
+	}{
+		{"no policy", "${g.Token} ${file.Name()} ${g.Hook()} ${call(fn)}", nil, "t0k3n /dev/stdout hooked called", ""},
+		{"allowed", "${g.Name} ${g.Hello()} ${page.Title}", policy, "joe hello joe home", ""},
+		{"denied field", "${g.Token}", policy, "", "can't access Token of template.Greeter: denied by the member access policy"},
+		{"denied method", "${g.Reset()}", policy, "", "can't access Reset of template.Greeter"},
+		{"denied promoted", "${page.Token}", policy, "", "can't access Token of template.Page"},
+		{"denied with default", "${g.Token!'x'}", policy, "", "denied by the member access policy"},
+		{"blocked package", "${file.Name()}", policy, "", "can't access Name of os.File"},
+		{"blocked printing", "${typ}", policy, "", "can't call the String method of reflect.rtype"},
+		{"func field", "${g.Hook()}", policy, "", "can't call g.Hook: the member access policy doesn't allow calling func values"},
+		{"call function", "${call(fn)}", policy, "", "can't call call"},
+		{"whitelist", "${g.Name}", &AccessPolicy{Allowed: map[reflect.Type][]string{reflect.TypeOf(&Greeter{}): {"Hello"}}}, "", "can't access Name"},
+		{"whitelist allowed", "${g.Hello()}", &AccessPolicy{Allowed: map[reflect.Type][]string{reflect.TypeOf(&Greeter{}): {"Hello"}}}, "hello joe", ""},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).SetMemberAccessPolicy(test.policy).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
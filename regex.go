@@ -0,0 +1,383 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+// The built-ins searching strings, such as ?matches, ?replace and ?split,
+// take flags, a string of letters, as their last argument:
+//
+//	i	case insensitive
+//	r	the search string is a regular expression
+//	l	the search string is literal, the default except for ?matches
+//	m	multiline: ^ and $ match at the start and end of lines
+//	s	dot all: . matches line breaks
+//	c	white space and #-comments in the regular expression are ignored
+//	f	only the first match, for ?replace
+//
+// Regular expressions have the syntax of Java, as far as Go's regexp
+// supports it.
+
+// regexFlags are the parsed flags.
+type regexFlags struct {
+	text            string // the flags, for error messages and the cache
+	caseInsensitive bool
+	regex           bool
+	multiline       bool
+	dotAll          bool
+	comments        bool
+	first           bool
+}
+
+// parseRegexFlags parses the flags of the built-in n, which supports the
+// flags in allowed.
+func (s *state) parseRegexFlags(n *parse.BuiltinNode, flags, allowed string) regexFlags {
+	f := regexFlags{text: flags}
+	literal := false
+	for _, c := range flags {
+		if !strings.ContainsRune(allowed, c) {
+			if strings.ContainsRune("irlmscf", c) {
+				s.errorf("?%s doesn't support the flag %q", n.Name, c)
+			}
+			s.errorf("unknown flag %q in the flags %q of ?%s", c, flags, n.Name)
+		}
+		switch c {
+		case 'i':
+			f.caseInsensitive = true
+		case 'r':
+			f.regex = true
+		case 'l':
+			literal = true
+		case 'm':
+			f.multiline = true
+		case 's':
+			f.dotAll = true
+		case 'c':
+			f.comments = true
+		case 'f':
+			f.first = true
+		}
+	}
+	if literal && f.regex {
+		s.errorf("the flags r and l of ?%s exclude each other", n.Name)
+	}
+	if !f.regex && (f.multiline || f.dotAll || f.comments) {
+		// As in FreeMarker, these flags imply a regular expression.
+		f.regex = true
+	}
+	return f
+}
+
+// flagsArg evaluates the flags of the built-in n, its argument i if there
+// is one.
+func (s *state) flagsArg(n *parse.BuiltinNode, i int, allowed string) regexFlags {
+	if len(n.Args) <= i {
+		return regexFlags{}
+	}
+	return s.parseRegexFlags(n, s.stringArg(n, i), allowed)
+}
+
+// compiledRegex is a regular expression compiled for searching, and for
+// matching whole strings.
+type compiledRegex struct {
+	find  *regexp.Regexp
+	whole *regexp.Regexp
+}
+
+type regexKey struct {
+	pattern string
+	flags   regexFlags
+}
+
+// maxCachedRegexps bounds regexCache; when it is full, it is emptied.
+const maxCachedRegexps = 1000
+
+// regexCache caches the compiled regular expressions across executions.
+var regexCache = struct {
+	sync.Mutex
+	m map[regexKey]*compiledRegex
+}{m: make(map[regexKey]*compiledRegex)}
+
+// regex returns the compiled regular expression for the search string
+// pattern of the built-in n with the flags. A literal search string is
+// compiled too, as its regular expression.
+func (s *state) regex(n *parse.BuiltinNode, pattern string, f regexFlags) *compiledRegex {
+	key := regexKey{pattern, f}
+	regexCache.Lock()
+	re := regexCache.m[key]
+	regexCache.Unlock()
+	if re != nil {
+		return re
+	}
+	expr := pattern
+	if !f.regex {
+		expr = regexp.QuoteMeta(pattern)
+	} else if f.comments {
+		expr = stripRegexComments(pattern)
+	}
+	var prefix string
+	for _, opt := range []struct {
+		on   bool
+		flag string
+	}{{f.caseInsensitive, "i"}, {f.multiline, "m"}, {f.dotAll, "s"}} {
+		if opt.on {
+			prefix += opt.flag
+		}
+	}
+	if prefix != "" {
+		expr = "(?" + prefix + ")" + expr
+	}
+	find, err := regexp.Compile(expr)
+	if err != nil {
+		s.errorf("bad regular expression %q in ?%s: %s", pattern, n.Name, explainRegexError(err))
+	}
+	whole := regexp.MustCompile(`\A(?:` + expr + `)\z`)
+	re = &compiledRegex{find, whole}
+	regexCache.Lock()
+	if len(regexCache.m) >= maxCachedRegexps {
+		regexCache.m = make(map[regexKey]*compiledRegex)
+	}
+	regexCache.m[key] = re
+	regexCache.Unlock()
+	return re
+}
+
+// explainRegexError explains the error compiling a regular expression,
+// in particular the syntax of Java that Go doesn't support.
+func explainRegexError(err error) string {
+	e, ok := err.(*syntax.Error)
+	if !ok {
+		return err.Error()
+	}
+	switch {
+	case e.Code == syntax.ErrInvalidRepeatOp && strings.HasSuffix(e.Expr, "+"):
+		return fmt.Sprintf("possessive quantifiers, such as `%s`, are not supported", e.Expr)
+	case strings.HasPrefix(e.Expr, "(?<=") || strings.HasPrefix(e.Expr, "(?<!"):
+		return fmt.Sprintf("lookbehind, such as `%s`, is not supported", e.Expr)
+	case e.Code == syntax.ErrInvalidPerlOp && (strings.HasPrefix(e.Expr, "(?=") || strings.HasPrefix(e.Expr, "(?!")):
+		return fmt.Sprintf("lookahead, such as `%s`, is not supported", e.Expr)
+	case e.Code == syntax.ErrInvalidPerlOp && strings.HasPrefix(e.Expr, "(?>"):
+		return fmt.Sprintf("atomic groups, such as `%s`, are not supported", e.Expr)
+	case e.Code == syntax.ErrInvalidEscape && len(e.Expr) == 2 && '1' <= e.Expr[1] && e.Expr[1] <= '9':
+		return fmt.Sprintf("backreferences, such as `%s`, are not supported", e.Expr)
+	}
+	return e.Error()
+}
+
+// stripRegexComments removes the white space and the comments, from # to
+// the end of the line, from a regular expression, except in character
+// classes and where escaped, as Java's COMMENTS flag does.
+func stripRegexComments(pattern string) string {
+	var b strings.Builder
+	inClass, inComment, escaped := false, false, false
+	for _, r := range pattern {
+		switch {
+		case inComment:
+			inComment = r != '\n'
+		case escaped:
+			if !unicode.IsSpace(r) && r != '#' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case inClass:
+			b.WriteRune(r)
+			inClass = r != ']'
+		case r == '[':
+			b.WriteRune(r)
+			inClass = true
+		case unicode.IsSpace(r):
+		case r == '#':
+			inComment = true
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if escaped {
+		b.WriteByte('\\')
+	}
+	return b.String()
+}
+
+// goReplacement converts a replacement in the syntax of Java, where $1 and
+// ${name} refer to groups, and \ escapes, into a template for
+// regexp.Expand.
+func (s *state) goReplacement(repl string, re *regexp.Regexp) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		switch {
+		case c == '\\' && i+1 < len(repl):
+			i++
+			if repl[i] == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte(repl[i])
+			}
+		case c == '$' && i+1 < len(repl) && '0' <= repl[i+1] && repl[i+1] <= '9':
+			// As in Java, the group number is as long as there is such a group.
+			j := i + 2
+			group := int(repl[i+1] - '0')
+			for j < len(repl) && '0' <= repl[j] && repl[j] <= '9' && group*10+int(repl[j]-'0') <= re.NumSubexp() {
+				group = group*10 + int(repl[j]-'0')
+				j++
+			}
+			if group > re.NumSubexp() {
+				s.errorf("the replacement %q refers to the group %d, but there are %d groups", repl, group, re.NumSubexp())
+			}
+			fmt.Fprintf(&b, "${%d}", group)
+			i = j - 1
+		case c == '$' && i+1 < len(repl) && repl[i+1] == '{':
+			end := strings.IndexByte(repl[i:], '}')
+			if end < 0 {
+				s.errorf("unterminated group name in the replacement %q", repl)
+			}
+			b.WriteString(repl[i : i+end+1])
+			i += end
+		case c == '$':
+			s.errorf("illegal group reference in the replacement %q", repl)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// replace replaces the matches of re in str, or only the first one, with
+// repl, which refers to groups if re is a regular expression.
+func (s *state) replace(str string, re *regexp.Regexp, repl string, f regexFlags) string {
+	if f.regex {
+		repl = s.goReplacement(repl, re)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(str, -1) {
+		b.WriteString(str[last:m[0]])
+		if f.regex {
+			b.Write(re.ExpandString(nil, repl, str, m))
+		} else {
+			b.WriteString(repl)
+		}
+		last = m[1]
+		if f.first {
+			break
+		}
+	}
+	b.WriteString(str[last:])
+	return b.String()
+}
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"matches": builtinMatches,
+		"groups":  builtinGroups,
+	})
+}
+
+// regexMatches is the value of ?matches: true if the whole string matches,
+// and the sequence of the matches found in the string.
+type regexMatches struct {
+	str   string
+	re    *compiledRegex
+	found [][]int // the indexes of the matches and their groups, found lazily
+	done  bool
+}
+
+func (m *regexMatches) AsBool() (bool, error) {
+	return m.re.whole.MatchString(m.str), nil
+}
+
+func (m *regexMatches) Len() (int, error) {
+	m.findAll()
+	return len(m.found), nil
+}
+
+func (m *regexMatches) Index(i int) (interface{}, error) {
+	m.findAll()
+	if i < 0 || i >= len(m.found) {
+		return nil, nil
+	}
+	return groupsOf(m.str, m.found[i]), nil
+}
+
+func (m *regexMatches) findAll() {
+	if !m.done {
+		m.found = m.re.find.FindAllStringSubmatchIndex(m.str, -1)
+		m.done = true
+	}
+}
+
+// regexMatch is a match: the matched string, and its groups.
+type regexMatch []string
+
+func (m regexMatch) AsString() (string, error) {
+	return m[0], nil
+}
+
+func groupsOf(str string, loc []int) regexMatch {
+	groups := make(regexMatch, len(loc)/2)
+	for i := range groups {
+		if loc[2*i] >= 0 {
+			groups[i] = str[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	return groups
+}
+
+// builtinMatches evaluates ?matches(re, flags). As a boolean, its value
+// tells whether the whole string matches the regular expression; as a
+// sequence, it is the matches found in the string.
+func builtinMatches(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 2)
+	str := s.stringTarget(n)
+	pattern := s.stringArg(n, 0)
+	f := s.flagsArg(n, 1, "irmsc")
+	f.regex = true
+	return reflect.ValueOf(&regexMatches{str: str, re: s.regex(n, pattern, f)})
+}
+
+// builtinGroups evaluates ?groups, the sequence of the groups of a match,
+// or of the whole string matched by ?matches, empty if it didn't match.
+// The group 0 is the whole match.
+func builtinGroups(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	v := s.target(n)
+	switch m := modelOf(v).(type) {
+	case regexMatch:
+		return reflect.ValueOf([]string(m))
+	case *regexMatches:
+		loc := m.re.whole.FindStringSubmatchIndex(m.str)
+		if loc == nil {
+			return reflect.ValueOf([]string{})
+		}
+		return reflect.ValueOf([]string(groupsOf(m.str, loc)))
+	}
+	s.targetError(n, v, "the result of ?matches")
+	panic("not reached")
+}
@@ -0,0 +1,108 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegexBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"date":  "2017-03-04",
+		"text":  "Fruits: Apple, banana, CHERRY",
+		"lines": "one\ntwo\nthree",
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"matches", `<#if date?matches("\\d{4}-\\d\\d-\\d\\d")>date</#if><#if date?matches("\\d+")>number</#if>`, "date", ""},
+		{"groups", `${date?matches("(\\d+)-(\\d+)-(\\d+)")?groups[1]}`, "2017", ""},
+		{"whole groups", `<#list date?matches("(\\d+)-(\\d+)-(\\d+)")?groups as g>[${g}]</#list>`, "[2017-03-04][2017][03][04]", ""},
+		{"no groups", `<#list date?matches("x")?groups as g>${g}</#list>.`, ".", ""},
+		{"find all", `<#list text?matches("\\b(\\w)(\\w*)", "i") as m>${m}:${m?groups[1]} </#list>`,
+			"Fruits:F Apple:A banana:b CHERRY:C ", ""},
+		{"case insensitive", `<#if "CHERRY"?matches("cherry", "i")>ci</#if><#if !"CHERRY"?matches("cherry")>cs</#if>`, "cics", ""},
+		{"multiline", `<#list lines?matches("^t\\w+$", "m") as m>[${m}]</#list><#list lines?matches("^t\\w+$") as m>[${m}]</#list>`, "[two][three]", ""},
+		{"dot all", `<#if lines?matches("one.two.*", "s")>s</#if><#if lines?matches("one.two.*")>no</#if>`, "s", ""},
+		{"comments", `<#if date?matches("\\d{4} - \\d{2}  # month\n - \\d{2} # day", "c")>c</#if>`, "c", ""},
+		{"replace regex", `${date?replace("(\\d+)-(\\d+)-(\\d+)", "$3.$2.$1", "r")} ${text?replace("[aeiou]", "_", "ri")} ${text?replace("a", "4", "rf")}`,
+			"04.03.2017 Fr__ts: _ppl_, b_n_n_, CH_RRY Fruits: Apple, b4nana, CHERRY", ""},
+		{"replace literal", `${text?replace("a", "*")} ${text?replace("A", "*", "i")} ${text?replace("a", "*", "f")} ${"a.b.c"?replace(".", "$")}`,
+			"Fruits: Apple, b*n*n*, CHERRY Fruits: *pple, b*n*n*, CHERRY Fruits: Apple, b*nana, CHERRY a$b$c", ""},
+		{"replace escapes", `${"price: 5"?replace("(\\d+)", "\\$$1", "r")} ${"ab"?replace("(?<x>a)", "[${x}]", "r")}`, "price: $5 [a]b", ""},
+		{"split regex", `<#list text?split("[:,] *", "r") as p>[${p}]</#list> <#list "aXbxc"?split("x", "i") as p>${p}</#list>`,
+			"[Fruits][Apple][banana][CHERRY] abc", ""},
+		{"keep regex", `${text?keep_after(",\\s*", "r")}|${text?keep_before_last("[,:]", "r")}|${text?keep_after("apple", "i")}`,
+			"banana, CHERRY|Fruits: Apple, banana|, banana, CHERRY", ""},
+		{"cached", `<#list 1..3 as i><#list date?matches("\\d+") as m>${m}.</#list></#list>`, "2017.03.04.2017.03.04.2017.03.04.", ""},
+		{"possessive", `${date?matches("\\d++")}`, "", "possessive quantifiers, such as `++`, are not supported"},
+		{"lookbehind", `${date?replace("(?<=-)\\d+", "x", "r")}`, "", "lookbehind, such as"},
+		{"lookahead", `${date?split("-(?=0)", "r")}`, "", "lookahead, such as `(?=`, is not supported"},
+		{"backreference", `${date?matches("(\\d)\\1")}`, "", "backreferences, such as `\\1`, are not supported"},
+		{"position", `line 1
+${date?matches("a++")}`, "", "template: position:2:"},
+		{"bad group", `${date?replace("(\\d+)", "$2", "r")}`, "", "refers to the group 2, but there are 1 groups"},
+		{"unsupported flag", `${date?split("-", "f")}`, "", `?split doesn't support the flag 'f'`},
+		{"unknown flag", `${date?replace("-", "", "x")}`, "", `unknown flag 'x' in the flags "x" of ?replace`},
+		{"exclusive flags", `${date?replace("-", "", "rl")}`, "", "the flags r and l of ?replace exclude each other"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
+
+func TestRegexCache(t *testing.T) {
+	tmpl, err := New("cache").Parse(`${"abc"?replace("[bc]+", "x", "r")}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first *compiledRegex
+	for i := 0; i < 2; i++ {
+		if err := tmpl.Execute(new(bytes.Buffer), nil); err != nil {
+			t.Fatal(err)
+		}
+		regexCache.Lock()
+		re := regexCache.m[regexKey{"[bc]+", regexFlags{text: "r", regex: true}}]
+		regexCache.Unlock()
+		switch {
+		case re == nil:
+			t.Fatal("the regular expression isn't cached")
+		case first == nil:
+			first = re
+		case re != first:
+			t.Error("the regular expression was compiled again")
+		}
+	}
+}
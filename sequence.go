@@ -0,0 +1,545 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"size":              builtinSize,
+		"first":             builtinFirst,
+		"last":              builtinLast,
+		"reverse":           builtinReverse,
+		"sort":              builtinSort,
+		"sort_by":           builtinSortBy,
+		"chunk":             builtinChunk,
+		"join":              builtinJoin,
+		"seq_contains":      builtinSeqContains,
+		"seq_index_of":      seqIndexBuiltin(false),
+		"seq_last_index_of": seqIndexBuiltin(true),
+		"min":               extremumBuiltin(-1),
+		"max":               extremumBuiltin(+1),
+	})
+}
+
+// seq is a sequence the built-ins work on: a slice or an array, or a
+// sequence model. The built-ins returning sequences return views of seq
+// rather than copies where they can.
+type seq struct {
+	s *state
+	v reflect.Value // the slice or array if m is nil
+	m SequenceModel
+}
+
+// asSeq returns v as a sequence, and whether it is one. A collection model
+// is listed into a slice, as its items can't be got by index.
+func (s *state) asSeq(v reflect.Value) (seq, bool) {
+	switch m := modelOf(v).(type) {
+	case SequenceModel:
+		return seq{s: s, m: m}, true
+	case CollectionModel:
+		return seq{s: s, v: reflect.ValueOf(s.collect(m))}, true
+	}
+	if v, _ = indirect(v); isSequence(v) {
+		return seq{s: s, v: v}, true
+	}
+	return seq{}, false
+}
+
+// collect returns the items of the collection model m, unwrapped. Each
+// item counts as an iteration of a loop.
+func (s *state) collect(m CollectionModel) []interface{} {
+	it, err := m.Iterator()
+	if err != nil {
+		s.errorf("can't list the collection: %w", err)
+	}
+	var items []interface{}
+	for {
+		s.step()
+		more, err := it.HasNext()
+		if err != nil {
+			s.errorf("can't list the collection: %w", err)
+		}
+		if !more {
+			return items
+		}
+		x, err := it.Next()
+		if err != nil {
+			s.errorf("can't list the collection: %w", err)
+		}
+		items = append(items, x)
+	}
+}
+
+// seqTarget evaluates the target of the built-in n, which must be a
+// sequence.
+func (s *state) seqTarget(n *parse.BuiltinNode) seq {
+	v := s.target(n)
+	q, ok := s.asSeq(v)
+	if !ok {
+		s.targetError(n, v, "a sequence")
+	}
+	return q
+}
+
+func (q seq) len() int {
+	if q.m != nil {
+		return q.s.seqLen(q.m)
+	}
+	return q.v.Len()
+}
+
+// raw returns the item i as it is in the sequence, before it is wrapped.
+func (q seq) raw(i int) reflect.Value {
+	if q.m == nil {
+		return q.v.Index(i)
+	}
+	x, err := q.m.Index(i)
+	if err != nil {
+		q.s.errorf("can't get item %d: %w", i, err)
+	}
+	return valueOf(x)
+}
+
+// index returns the item i, as the template sees it.
+func (q seq) index(i int) reflect.Value {
+	return q.s.wrap(q.raw(i))
+}
+
+// interfaceOf returns the Go value of v, or nil if v has none that can be
+// used.
+func interfaceOf(v reflect.Value) interface{} {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// The views are the sequences returned by ?reverse, ?sort and ?chunk. Their
+// items are the raw items of the sequence they view, which get wrapped when
+// the template gets them.
+
+// reversedSeq is a sequence in reverse order.
+type reversedSeq struct{ q seq }
+
+func (r reversedSeq) Len() (int, error) { return r.q.len(), nil }
+
+func (r reversedSeq) Index(i int) (interface{}, error) {
+	return interfaceOf(r.q.raw(r.q.len() - 1 - i)), nil
+}
+
+// sortedSeq is a sequence in the order of the indexes.
+type sortedSeq struct {
+	q     seq
+	order []int
+}
+
+func (r sortedSeq) Len() (int, error) { return len(r.order), nil }
+
+func (r sortedSeq) Index(i int) (interface{}, error) {
+	return interfaceOf(r.q.raw(r.order[i])), nil
+}
+
+// chunkedSeq is a sequence split into sequences of size items.
+type chunkedSeq struct {
+	q      seq
+	size   int
+	filler interface{}
+	fill   bool // whether the last chunk is filled up with filler
+}
+
+func (r chunkedSeq) Len() (int, error) { return (r.q.len() + r.size - 1) / r.size, nil }
+
+func (r chunkedSeq) Index(i int) (interface{}, error) {
+	return chunk{r, i * r.size}, nil
+}
+
+// chunk is a sequence of a chunkedSeq.
+type chunk struct {
+	r    chunkedSeq
+	from int
+}
+
+func (c chunk) Len() (int, error) {
+	if c.r.fill {
+		return c.r.size, nil
+	}
+	return min(c.r.size, c.r.q.len()-c.from), nil
+}
+
+func (c chunk) Index(i int) (interface{}, error) {
+	if c.from+i >= c.r.q.len() {
+		return c.r.filler, nil
+	}
+	return interfaceOf(c.r.q.raw(c.from + i)), nil
+}
+
+// builtinSize evaluates ?size, the number of items of a sequence or of
+// keys of a hash.
+func builtinSize(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	v := s.target(n)
+	if q, ok := s.asSeq(v); ok {
+		return reflect.ValueOf(q.len())
+	}
+	if m, _ := indirect(v); m.Kind() == reflect.Map && modelOf(v) == nil {
+		return reflect.ValueOf(m.Len())
+	}
+	keys, _ := s.targetKeys(n, v, "a sequence or a hash")
+	return reflect.ValueOf(len(keys))
+}
+
+// builtinFirst evaluates ?first, the first item of a sequence, which is
+// missing if the sequence is empty. Only the first item of a collection,
+// such as the result of ?filter, is computed.
+func builtinFirst(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	next := s.source(n)()
+	x, _ := next()
+	return x
+}
+
+// builtinLast evaluates ?last, the last item of a sequence, which is
+// missing if the sequence is empty.
+func builtinLast(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	q := s.seqTarget(n)
+	if q.len() == 0 {
+		return zero
+	}
+	return q.index(q.len() - 1)
+}
+
+// builtinReverse evaluates ?reverse, the sequence in reverse order.
+func builtinReverse(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(reversedSeq{s.seqTarget(n)})
+}
+
+// builtinSort evaluates ?sort, the sequence sorted in ascending order. The
+// items must be all strings, all numbers, all dates or all booleans.
+func builtinSort(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	q := s.seqTarget(n)
+	var keys []reflect.Value
+	for i := 0; i < q.len(); i++ {
+		s.step()
+		keys = append(keys, q.index(i))
+	}
+	return reflect.ValueOf(sortedSeq{q, s.sortOrder(n, keys)})
+}
+
+// builtinSortBy evaluates ?sort_by(key), the sequence of hashes sorted by
+// the value of their key, or of a nested key given as a sequence of keys,
+// as in ?sort_by(["address", "city"]).
+func builtinSortBy(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	q := s.seqTarget(n)
+	var path []string
+	arg, _ := indirect(s.evalDefined(n.Args[0]))
+	s.at(n)
+	if p, ok := s.asSeq(arg); ok {
+		for i := 0; i < p.len(); i++ {
+			path = append(path, s.toString(n.Args[0], p.index(i)))
+		}
+	} else {
+		path = []string{s.toString(n.Args[0], arg)}
+	}
+	if len(path) == 0 {
+		s.errorf("?sort_by needs at least one key")
+	}
+	var keys []reflect.Value
+	for i := 0; i < q.len(); i++ {
+		s.step()
+		v := q.index(i)
+		for _, key := range path {
+			if !s.isHash(v) {
+				s.errorf("?sort_by can't get key %q of item %d of %s, which isn't a hash", key, i, n.Target)
+			}
+			v = s.member(v, key)
+		}
+		keys = append(keys, v)
+	}
+	return reflect.ValueOf(sortedSeq{q, s.sortOrder(n, keys)})
+}
+
+// isHash reports whether v is a hash: a hash model, a map or a struct.
+func (s *state) isHash(v reflect.Value) bool {
+	return s.typeOf(v)&typeHash != 0
+}
+
+// A sortKey is a value items are sorted by.
+type sortKey struct {
+	typ string // "a string", "a number", "a date" or "a boolean"
+	str string
+	num reflect.Value
+	t   time.Time
+	b   bool
+}
+
+// sortKeyOf returns the key the item i with value v is sorted by.
+func (s *state) sortKeyOf(n *parse.BuiltinNode, i int, v reflect.Value) sortKey {
+	if t, _, ok := s.asDate(v); ok {
+		return sortKey{typ: "a date", t: t}
+	}
+	u, isNil := indirect(s.unwrap(v, invalidKind))
+	if !u.IsValid() || isNil {
+		s.errorf("?%s can't sort %s: item %d is missing", n.Name, n.Target, i)
+	}
+	switch k, _ := basicKind(u); {
+	case k == stringKind:
+		return sortKey{typ: "a string", str: u.String()}
+	case isNumberKind(k):
+		return sortKey{typ: "a number", num: u}
+	case k == boolKind:
+		return sortKey{typ: "a boolean", b: u.Bool()}
+	}
+	s.errorf("?%s can't sort %s: item %d is %s", n.Name, n.Target, i, s.describe(v))
+	panic("not reached")
+}
+
+// compareKeys compares the sort keys x and y of the same type.
+func (s *state) compareKeys(x, y sortKey) int {
+	switch x.typ {
+	case "a string":
+		return s.settings.localeData().collate(x.str, y.str)
+	case "a number":
+		return compareNumbers(x.num, y.num)
+	case "a date":
+		return compareTime(x.t, y.t)
+	}
+	switch {
+	case x.b == y.b:
+		return 0
+	case y.b:
+		return -1
+	}
+	return 1
+}
+
+// sortOrder returns the indexes of the values in their ascending order,
+// keeping the order of equal values.
+func (s *state) sortOrder(n *parse.BuiltinNode, values []reflect.Value) []int {
+	keys := make([]sortKey, len(values))
+	order := make([]int, len(values))
+	for i, v := range values {
+		keys[i] = s.sortKeyOf(n, i, v)
+		if keys[i].typ != keys[0].typ {
+			s.errorf("?%s can't sort %s: item %d is %s, but item 0 is %s", n.Name, n.Target, i, keys[i].typ, keys[0].typ)
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return s.compareKeys(keys[order[i]], keys[order[j]]) < 0
+	})
+	return order
+}
+
+// builtinChunk evaluates ?chunk(size, filler), the sequence split into
+// sequences of size items. If filler is given, the last sequence is filled
+// up with it.
+func builtinChunk(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 2)
+	q := s.seqTarget(n)
+	size := s.intArg(n, 0)
+	if size < 1 {
+		s.errorf("the size of ?chunk must be at least 1, but got %d", size)
+	}
+	r := chunkedSeq{q: q, size: size}
+	if len(n.Args) == 2 {
+		r.filler, r.fill = interfaceOf(s.evalExpr(n.Args[1])), true
+		s.at(n)
+	}
+	return reflect.ValueOf(r)
+}
+
+// builtinJoin evaluates ?join(separator, whenEmpty, afterLast), which
+// concatenates the items of a sequence converted to strings, skipping the
+// missing ones. whenEmpty is the result if there are no items, and
+// afterLast is appended after the last item.
+func builtinJoin(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 3)
+	src := s.source(n)
+	sep := s.stringArg(n, 0)
+	var b strings.Builder
+	joined := 0
+	next := src()
+	for i := 0; ; i++ {
+		v, ok := next()
+		if !ok {
+			break
+		}
+		if u, isNil := indirect(v); !u.IsValid() || isNil {
+			continue
+		}
+		if _, ok := s.asSeq(v); ok || s.isHash(v) && modelOf(v) == nil {
+			s.errorf("?join can't join item %d of %s, which is %s", i, n.Target, s.describe(v))
+		}
+		if joined > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(s.toString(n, v))
+		joined++
+		s.checkSize(int64(b.Len()))
+	}
+	switch {
+	case joined == 0 && len(n.Args) >= 2:
+		return reflect.ValueOf(s.stringArg(n, 1))
+	case joined > 0 && len(n.Args) == 3:
+		b.WriteString(s.stringArg(n, 2))
+	}
+	return reflect.ValueOf(b.String())
+}
+
+// sameValue reports whether x and y are equal as with ==, except that
+// values that can't be compared are different rather than an error.
+func (s *state) sameValue(x, y reflect.Value) bool {
+	tx, _, xIsDate := s.asDate(x)
+	ty, _, yIsDate := s.asDate(y)
+	if xIsDate || yIsDate {
+		return xIsDate && yIsDate && compareTime(tx, ty) == 0
+	}
+	ky, _ := basicKind(indirectInterface(y))
+	x, _ = indirect(s.unwrap(x, ky))
+	kx, _ := basicKind(x)
+	y, _ = indirect(s.unwrap(y, kx))
+	ky, _ = basicKind(y)
+	switch {
+	case !x.IsValid() || !y.IsValid():
+		return false
+	case isNumberKind(kx) && isNumberKind(ky):
+		return compareNumbers(x, y) == 0
+	case kx != ky:
+		return false
+	case kx == stringKind:
+		return x.String() == y.String()
+	case kx == boolKind:
+		return x.Bool() == y.Bool()
+	}
+	return false
+}
+
+// builtinSeqContains evaluates ?seq_contains(value), which tells whether
+// the sequence has an item equal to value.
+func builtinSeqContains(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	src := s.source(n)
+	x := s.evalDefined(n.Args[0])
+	s.at(n)
+	next := src()
+	for {
+		v, ok := next()
+		if !ok {
+			return reflect.ValueOf(false)
+		}
+		if s.sameValue(v, x) {
+			return reflect.ValueOf(true)
+		}
+	}
+}
+
+// seqIndexBuiltin returns ?seq_index_of(value, start) or, if last is set,
+// ?seq_last_index_of(value, start), which return the index of the first or
+// last item equal to value from the index start on, searching backward for
+// the last one, or -1 if there's none.
+func seqIndexBuiltin(last bool) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 1, 2)
+		if !last {
+			return seqIndexOf(s, n)
+		}
+		q := s.seqTarget(n)
+		x := s.evalDefined(n.Args[0])
+		s.at(n)
+		from := q.len() - 1
+		if len(n.Args) == 2 {
+			from = min(s.intArg(n, 1), from)
+		}
+		for i := from; i >= 0; i-- {
+			s.step()
+			if s.sameValue(q.index(i), x) {
+				return reflect.ValueOf(i)
+			}
+		}
+		return reflect.ValueOf(-1)
+	}
+}
+
+// seqIndexOf evaluates ?seq_index_of(value, start), searching forward
+// through the items as they are listed, so that only the items up to the
+// one found are computed.
+func seqIndexOf(s *state, n *parse.BuiltinNode) reflect.Value {
+	src := s.source(n)
+	x := s.evalDefined(n.Args[0])
+	s.at(n)
+	from := 0
+	if len(n.Args) == 2 {
+		from = s.intArg(n, 1)
+	}
+	next := src()
+	for i := 0; ; i++ {
+		v, ok := next()
+		if !ok {
+			return reflect.ValueOf(-1)
+		}
+		if i >= from && s.sameValue(v, x) {
+			return reflect.ValueOf(i)
+		}
+	}
+}
+
+// extremumBuiltin returns ?min, with sign -1, or ?max, with sign +1, which
+// return the least or greatest of the numbers or dates of a sequence,
+// skipping the missing items. The result is missing if there is no item.
+func extremumBuiltin(sign int) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 0, 0)
+		next := s.source(n)()
+		var (
+			best    reflect.Value
+			bestKey sortKey
+		)
+		for i := 0; ; i++ {
+			v, ok := next()
+			if !ok {
+				break
+			}
+			if u, isNil := indirect(v); !u.IsValid() || isNil {
+				continue
+			}
+			key := s.sortKeyOf(n, i, v)
+			switch {
+			case key.typ != "a number" && key.typ != "a date":
+				s.errorf("?%s expects numbers or dates, but item %d of %s is %s", n.Name, i, n.Target, key.typ)
+			case !best.IsValid():
+			case key.typ != bestKey.typ:
+				s.errorf("?%s can't compare item %d of %s, which is %s, with %s", n.Name, i, n.Target, key.typ, bestKey.typ)
+			case s.compareKeys(key, bestKey)*sign <= 0:
+				continue
+			}
+			best, bestKey = v, key
+		}
+		return best
+	}
+}
@@ -0,0 +1,96 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSequenceBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"names":   []string{"Émile", "zoe", "Adam", "adam", "Ñu", "nube", "Olga"},
+		"nums":    []interface{}{3, 1.5, uint8(10), -2},
+		"days":    []day{"2020-05-01", "2019-01-01", "2019-12-31"},
+		"flags":   []bool{true, false},
+		"squares": squares(5),
+		"pages":   &pages{total: 5, size: 2},
+		"mixed":   []interface{}{1, "a"},
+		"holes":   []interface{}{"a", nil, "b"},
+		"empty":   []int{},
+		"people": []map[string]interface{}{
+			{"name": "Bob", "address": map[string]string{"city": "Zurich"}},
+			{"name": "Al", "address": map[string]string{"city": "Berlin"}},
+			{"name": "Cy", "address": map[string]string{"city": "Athens"}},
+			{"name": "Al", "address": map[string]string{"city": "Bern"}},
+		},
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"size", "${names?size} ${squares?size} ${pages?size} ${empty?size}", "7 5 5 0", ""},
+		{"first and last", "${squares?first} ${squares?last} ${names?first} ${empty?first!'none'} ${empty?last!'none'}", "0 16 Émile none none", ""},
+		{"reverse", "<#list squares?reverse as x>${x} </#list>${names?reverse[0]} ${names?reverse?reverse[0]}", "16 9 4 1 0 Olga Émile", ""},
+		{"sort strings", "${names?sort?join(' ')}", "adam Adam Émile Ñu nube Olga zoe", ""},
+		{"sort strings in Spanish", `<#setting locale="es">${names?sort?join(' ')}`, "adam Adam Émile nube Ñu Olga zoe", ""},
+		{"sort numbers", "${nums?sort?join(' ')}", "-2 1.5 3 10", ""},
+		{"sort dates", `${days?sort?first?string("yyyy-MM-dd")} ${days?sort?last?string("yyyy-MM-dd")}`, "2019-01-01 2020-05-01", ""},
+		{"sort booleans", "<#list flags?sort as f><#if f>t<#else>f</#if></#list>", "ft", ""},
+		{"sort by", "<#list people?sort_by('name') as p>${p.name}/${p.address.city} </#list>", "Al/Berlin Al/Bern Bob/Zurich Cy/Athens ", ""},
+		{"sort by nested key", "<#list people?sort_by(['address', 'city']) as p>${p.name} </#list>", "Cy Al Al Bob ", ""},
+		{"sort by reversed", "${people?sort_by('name')?reverse?first.name}", "Cy", ""},
+		{"chunk", "<#list squares?chunk(2) as row>[${row?join(',')}]</#list>", "[0,1][4,9][16]", ""},
+		{"chunk with filler", `<#list squares?chunk(2, "-") as row>[${row?join(',')}]</#list> ${squares?chunk(3)?last?size}`, "[0,1][4,9][16,-] 2", ""},
+		{"join", "${names?join(', ')}|${holes?join('-')}|${empty?join(', ', 'none')}|${nums?join(', ', 'none', '.')}|${pages?join(',')}",
+			"Émile, zoe, Adam, adam, Ñu, nube, Olga|a-b|none|3, 1.5, 10, -2.|0,1,2,3,4", ""},
+		{"join empty strings", `[${["", "a", "b"]?join(",")}] [${[""]?join(",", "EMPTY")}] [${["a", ""]?join(",", "E", "!")}]`,
+			"[,a,b] [] [a,!]", ""},
+		{"seq contains", `<#if names?seq_contains('zoe')>y</#if><#if !names?seq_contains('Zoe')>n</#if><#if nums?seq_contains(3.0)>3</#if><#if !nums?seq_contains("3")>s</#if><#if squares?seq_contains(16)>q</#if>`,
+			"yn3sq", ""},
+		{"seq index of", "${names?seq_index_of('adam')} ${squares?seq_index_of(4)} ${squares?seq_index_of(4, 3)} ${squares?seq_last_index_of(4)} ${squares?seq_last_index_of(9, 1)} ${squares?seq_last_index_of(9, 100)} ${squares?seq_index_of(2)}",
+			"3 2 -1 2 -1 3 -1", ""},
+		{"min and max", `${nums?min} ${nums?max} ${squares?max} ${empty?min!"-"} ${days?max?string("yyyy-MM-dd")}`, "-2 10 16 - 2020-05-01", ""},
+		{"concatenation", "${(squares + names)?size} ${(squares?reverse + [1])?join(',')}", "12 16,9,4,1,0,1", ""},
+		{"mixed types", "${mixed?sort}", "", "?sort can't sort mixed: item 1 is a string, but item 0 is a number"},
+		{"missing item", "${holes?sort}", "", "?sort can't sort holes: item 1 is missing"},
+		{"not a hash", "${names?sort_by('x')}", "", `?sort_by can't get key "x" of item 0 of names, which isn't a hash`},
+		{"not a sequence", "${names[0]?first}", "", "?first expects a sequence"},
+		{"bad chunk size", "${squares?chunk(0)}", "", "the size of ?chunk must be at least 1, but got 0"},
+		{"min of strings", "${names?min}", "", "?min expects numbers or dates, but item 0 of names is a string"},
+		{"bad args", "${names?size(1)}", "", "?size doesn't take arguments"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// settings are the settings that influence how templates present values,
+// such as date_format. They are set for a template set with SetSetting, and
+// for the rest of an execution with the <#setting> directive.
+type settings struct {
+	dateFormat     string         // "" for medium
+	timeFormat     string         // "" for medium
+	datetimeFormat string         // "" for medium
+	timeZone       *time.Location // nil for time.Local
+	numberFormat   string         // "" for number
+	locale         *localeData    // nil for en_US
+	arithmetic     int            // the arithmetic engine
+	urlCharset     string         // "" for output_encoding
+	outputEncoding string         // "" if unknown
+	outputFormat   string         // "" for undefined, or plainText or a key of outputFormats
+	booleanFormat  string         // "" to refuse printing booleans
+}
+
+// location returns the time zone dates are presented in.
+func (c *settings) location() *time.Location {
+	if c.timeZone == nil {
+		return time.Local
+	}
+	return c.timeZone
+}
+
+// localeData returns the data of the locale setting.
+func (c *settings) localeData() *localeData {
+	if c.locale == nil {
+		d, _ := localeFor(defaultLocale)
+		return d
+	}
+	return c.locale
+}
+
+// urlEscapingCharset returns the charset ?url encodes to.
+func (c *settings) urlEscapingCharset() string {
+	switch {
+	case c.urlCharset != "":
+		return c.urlCharset
+	case c.outputEncoding != "":
+		return c.outputEncoding
+	}
+	return "UTF-8"
+}
+
+// outputFormatName returns the name of the output format.
+func (c *settings) outputFormatName() string {
+	if c.outputFormat == "" {
+		return "undefined"
+	}
+	return c.outputFormat
+}
+
+// booleanStrings returns the strings true and false are printed as, or
+// ok false if the boolean_format setting isn't set.
+func (c *settings) booleanStrings() (t, f string, ok bool) {
+	switch c.booleanFormat {
+	case "":
+		return "", "", false
+	case "c":
+		return "true", "false", true
+	}
+	i := strings.IndexByte(c.booleanFormat, ',')
+	return c.booleanFormat[:i], c.booleanFormat[i+1:], true
+}
+
+// set changes the setting name. Names may be given in snake case, as
+// date_format, or camel case, as dateFormat.
+func (c *settings) set(name, value string) error {
+	switch name = snakeCase(name); name {
+	case "date_format", "time_format", "datetime_format":
+		if _, err := compileDateFormat(value, c.localeData()); err != nil {
+			return err
+		}
+		switch name {
+		case "date_format":
+			c.dateFormat = value
+		case "time_format":
+			c.timeFormat = value
+		default:
+			c.datetimeFormat = value
+		}
+	case "number_format":
+		if _, err := compileNumberFormat(value, c.localeData()); err != nil {
+			return err
+		}
+		c.numberFormat = value
+	case "boolean_format":
+		if value != "c" && strings.Count(value, ",") != 1 {
+			return fmt.Errorf("boolean_format must be \"c\" or two strings separated by a comma, such as \"yes,no\", but got %q", value)
+		}
+		c.booleanFormat = value
+	case "arithmetic_engine":
+		engine, ok := arithmeticEngines[value]
+		if !ok {
+			return fmt.Errorf("unknown arithmetic engine %q", value)
+		}
+		c.arithmetic = engine
+	case "locale":
+		d, err := localeFor(value)
+		if err != nil {
+			return err
+		}
+		c.locale = d
+	case "url_escaping_charset":
+		if err := checkCharset(value); err != nil {
+			return err
+		}
+		c.urlCharset = value
+	case "output_encoding":
+		if err := checkCharset(value); err != nil {
+			return err
+		}
+		c.outputEncoding = value
+	case "output_format":
+		if err := checkOutputFormat(value); err != nil {
+			return err
+		}
+		if value == "undefined" {
+			value = ""
+		}
+		c.outputFormat = value
+	case "time_zone":
+		loc, err := parseTimeZone(value)
+		if err != nil {
+			return err
+		}
+		c.timeZone = loc
+	default:
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	return nil
+}
+
+// snakeCase converts a camel case name to snake case.
+func snakeCase(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var zoneOffset = regexp.MustCompile(`^(?:GMT|UTC)([+-])(\d{1,2})(?::?(\d\d))?$`)
+
+// parseTimeZone returns the time zone with the name, which is an IANA name
+// such as Europe/Berlin, an offset such as GMT+02:00, or "default" for the
+// local time zone.
+func parseTimeZone(name string) (*time.Location, error) {
+	switch name {
+	case "", "default", "JVM default":
+		return time.Local, nil
+	case "GMT", "UTC":
+		return time.UTC, nil
+	}
+	if m := zoneOffset.FindStringSubmatch(name); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3] + "0")
+		offset := hours*3600 + minutes/10*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// SetSetting changes a setting of t and its associated templates, which
+// executions start with. The settings are:
+//
+//	arithmetic_engine
+//		how numbers are computed with: "bigdecimal", exactly in
+//		decimal, or "conservative", with int64 and float64. The default
+//		is "bigdecimal".
+//	boolean_format
+//		how ${flag} prints a boolean: "c", as true or false, or the two
+//		strings separated by a comma, such as "yes,no". By default,
+//		booleans are not printed, and ?c, ?string("yes", "no") or ?then
+//		must be used.
+//	date_format, time_format, datetime_format
+//		the format of dates, times and datetimes: "short", "medium",
+//		"long" or "full", a combination such as "short_medium" for
+//		datetimes, "iso", or a pattern such as "yyyy-MM-dd HH:mm" in the
+//		syntax of Java's SimpleDateFormat. The default is "medium".
+//	number_format
+//		the format of numbers: "number", "currency", "percent",
+//		"computer", or a pattern such as "#,##0.00;(#)" in the syntax of
+//		Java's DecimalFormat, optionally followed by options such as
+//		";; roundingMode=halfUp". The default is "number", which is
+//		"#,##0.###".
+//	locale
+//		the locale numbers and dates are formatted for, and templates
+//		are looked up for by <#include>, such as "de_DE" or "de". The
+//		default is "en_US".
+//	output_encoding
+//		the charset the output is encoded in: "UTF-8", "ISO-8859-1" or
+//		"US-ASCII". It is unknown by default.
+//	output_format
+//		the format of the output: "HTML", "XHTML", "XML" or "RTF", whose
+//		markup ${...} escapes strings in, or "plainText" or "undefined",
+//		the default, which escape nothing. The escaping built-ins, such
+//		as ?html, and ?no_esc give markup that is printed as it is.
+//	time_zone
+//		the time zone dates are presented in, such as "Europe/Berlin" or
+//		"GMT+02:00". The default is the local time zone.
+//	url_escaping_charset
+//		the charset ?url and ?url_path encode to: "UTF-8", "ISO-8859-1"
+//		or "US-ASCII". The default is output_encoding if it is known, or
+//		else UTF-8.
+//
+// Names may also be given in camel case, such as dateFormat.
+func (t *Template) SetSetting(name, value string) error {
+	t.init()
+	return t.settings.set(name, value)
+}
@@ -0,0 +1,431 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/moqmar/freemarker.go/parse"
+)
+
+// String built-ins count and index characters as runes.
+
+func init() {
+	addBuiltins(map[string]builtin{
+		"upper_case":       builtinUpperCase,
+		"lower_case":       builtinLowerCase,
+		"cap_first":        builtinCapFirst,
+		"uncap_first":      builtinUncapFirst,
+		"capitalize":       builtinCapitalize,
+		"trim":             builtinTrim,
+		"length":           builtinLength,
+		"substring":        builtinSubstring,
+		"keep_before":      keepBuiltin(false, false),
+		"keep_before_last": keepBuiltin(false, true),
+		"keep_after":       keepBuiltin(true, false),
+		"keep_after_last":  keepBuiltin(true, true),
+		"remove_beginning": builtinRemoveBeginning,
+		"remove_ending":    builtinRemoveEnding,
+		"contains":         stringTest(strings.Contains),
+		"starts_with":      stringTest(strings.HasPrefix),
+		"ends_with":        stringTest(strings.HasSuffix),
+		"index_of":         indexBuiltin(false),
+		"last_index_of":    indexBuiltin(true),
+		"replace":          builtinReplace,
+		"split":            builtinSplit,
+		"left_pad":         padBuiltin(true),
+		"right_pad":        padBuiltin(false),
+		"chop_linebreak":   builtinChopLinebreak,
+		"word_list":        builtinWordList,
+		"truncate":         truncateBuiltin(truncateAuto),
+		"truncate_w":       truncateBuiltin(truncateWords),
+		"truncate_c":       truncateBuiltin(truncateChars),
+	})
+}
+
+// stringTarget evaluates the target of the built-in n, which must be a
+// string, or a number or a date, which is converted as by ${}.
+func (s *state) stringTarget(n *parse.BuiltinNode) string {
+	str := s.toString(n.Target, s.target(n))
+	s.at(n)
+	return str
+}
+
+// builtinUpperCase evaluates ?upper_case, which converts a string to upper
+// case, as in the locale.
+func builtinUpperCase(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(s.settings.localeData().toUpper(s.stringTarget(n)))
+}
+
+// builtinLowerCase evaluates ?lower_case, which converts a string to lower
+// case, as in the locale.
+func builtinLowerCase(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(s.settings.localeData().toLower(s.stringTarget(n)))
+}
+
+// builtinCapFirst evaluates ?cap_first, which converts the first letter of
+// a string to upper case, as in the locale.
+func builtinCapFirst(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(mapFirstLetter(s.stringTarget(n), s.settings.localeData().toUpper))
+}
+
+// builtinUncapFirst evaluates ?uncap_first, which converts the first letter
+// of a string to lower case, as in the locale.
+func builtinUncapFirst(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(mapFirstLetter(s.stringTarget(n), s.settings.localeData().toLower))
+}
+
+// mapFirstLetter applies f to the first character of str that isn't white
+// space.
+func mapFirstLetter(str string, f func(string) string) string {
+	i := strings.IndexFunc(str, func(r rune) bool { return !unicode.IsSpace(r) })
+	if i < 0 {
+		return str
+	}
+	_, size := utf8.DecodeRuneInString(str[i:])
+	return str[:i] + f(str[i:i+size]) + str[i+size:]
+}
+
+// builtinCapitalize evaluates ?capitalize, which converts the first letter
+// of each word to upper case, and the others to lower case.
+func builtinCapitalize(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	loc := s.settings.localeData()
+	var b strings.Builder
+	inWord := false
+	for _, r := range s.stringTarget(n) {
+		switch {
+		case unicode.IsSpace(r):
+			b.WriteRune(r)
+			inWord = false
+		case inWord:
+			b.WriteString(loc.toLower(string(r)))
+		default:
+			b.WriteString(loc.toUpper(string(r)))
+			inWord = true
+		}
+	}
+	return reflect.ValueOf(b.String())
+}
+
+// builtinTrim evaluates ?trim, which removes the leading and trailing white
+// space.
+func builtinTrim(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(strings.TrimSpace(s.stringTarget(n)))
+}
+
+// builtinLength evaluates ?length, the number of characters of a string.
+func builtinLength(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(utf8.RuneCountInString(s.stringTarget(n)))
+}
+
+// builtinSubstring evaluates ?substring(from, to), the characters from the
+// index from up to, but not including, the index to, which defaults to the
+// length of the string. It is deprecated in favor of str[from..<to].
+func builtinSubstring(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 2)
+	runes := []rune(s.stringTarget(n))
+	from, to := s.intArg(n, 0), len(runes)
+	if len(n.Args) == 2 {
+		to = s.intArg(n, 1)
+	}
+	switch {
+	case from < 0 || from > len(runes):
+		s.errorf("?substring index %d is out of bounds for a string of length %d", from, len(runes))
+	case to < from || to > len(runes):
+		s.errorf("?substring index %d is out of bounds for a string of length %d, starting at %d", to, len(runes), from)
+	}
+	return reflect.ValueOf(string(runes[from:to]))
+}
+
+// keepBuiltin returns the built-in keeping the part of a string before or
+// after the first or the last occurrence of a separator: ?keep_before(sep,
+// flags), ?keep_after, ?keep_before_last and ?keep_after_last. Without the
+// separator, the part before is the whole string and the part after empty.
+func keepBuiltin(after, last bool) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 1, 2)
+		str := s.stringTarget(n)
+		sep := s.stringArg(n, 0)
+		var loc []int
+		if f := s.flagsArg(n, 1, "irmsc"); f.text != "" {
+			re := s.regex(n, sep, f).find
+			if last {
+				if all := re.FindAllStringIndex(str, -1); len(all) > 0 {
+					loc = all[len(all)-1]
+				}
+			} else {
+				loc = re.FindStringIndex(str)
+			}
+		} else {
+			i := strings.Index(str, sep)
+			if last {
+				i = strings.LastIndex(str, sep)
+			}
+			if i >= 0 {
+				loc = []int{i, i + len(sep)}
+			}
+		}
+		switch {
+		case loc == nil && after:
+			return reflect.ValueOf("")
+		case loc == nil:
+			return reflect.ValueOf(str)
+		case after:
+			return reflect.ValueOf(str[loc[1]:])
+		}
+		return reflect.ValueOf(str[:loc[0]])
+	}
+}
+
+// builtinRemoveBeginning evaluates ?remove_beginning(prefix), which removes
+// the prefix if the string starts with it.
+func builtinRemoveBeginning(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	return reflect.ValueOf(strings.TrimPrefix(s.stringTarget(n), s.stringArg(n, 0)))
+}
+
+// builtinRemoveEnding evaluates ?remove_ending(suffix), which removes the
+// suffix if the string ends with it.
+func builtinRemoveEnding(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 1)
+	return reflect.ValueOf(strings.TrimSuffix(s.stringTarget(n), s.stringArg(n, 0)))
+}
+
+// stringTest returns the built-in testing a string with a substring:
+// ?contains, ?starts_with and ?ends_with.
+func stringTest(test func(str, substr string) bool) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 1, 1)
+		return reflect.ValueOf(test(s.stringTarget(n), s.stringArg(n, 0)))
+	}
+}
+
+// indexBuiltin returns ?index_of(substr, from) or ?last_index_of(substr,
+// from): the index of the first occurrence of the substring at or after
+// the index from, or of the last one at or before it, or -1.
+func indexBuiltin(last bool) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 1, 2)
+		runes := []rune(s.stringTarget(n))
+		sub := []rune(s.stringArg(n, 0))
+		from := 0
+		if last {
+			from = len(runes) - len(sub)
+		}
+		if len(n.Args) == 2 {
+			from = s.intArg(n, 1)
+		}
+		if !last {
+			if from < 0 {
+				from = 0
+			} else if from > len(runes) {
+				from = len(runes)
+			}
+			for i := from; i+len(sub) <= len(runes); i++ {
+				if string(runes[i:i+len(sub)]) == string(sub) {
+					return reflect.ValueOf(i)
+				}
+			}
+			return reflect.ValueOf(-1)
+		}
+		if from > len(runes)-len(sub) {
+			from = len(runes) - len(sub)
+		}
+		for i := from; i >= 0; i-- {
+			if string(runes[i:i+len(sub)]) == string(sub) {
+				return reflect.ValueOf(i)
+			}
+		}
+		return reflect.ValueOf(-1)
+	}
+}
+
+// builtinReplace evaluates ?replace(old, new, flags), which replaces all
+// the occurrences of old, or only the first one with the flag f. With the
+// flag r, old is a regular expression, and new refers to its groups as $1.
+func builtinReplace(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 2, 3)
+	str := s.stringTarget(n)
+	old, repl := s.stringArg(n, 0), s.stringArg(n, 1)
+	f := s.flagsArg(n, 2, "irlmscf")
+	if f.regex || f.caseInsensitive {
+		return reflect.ValueOf(s.replace(str, s.regex(n, old, f).find, repl, f))
+	}
+	count := -1
+	if f.first {
+		count = 1
+	}
+	return reflect.ValueOf(strings.Replace(str, old, repl, count))
+}
+
+// builtinSplit evaluates ?split(sep, flags), the sequence of the parts of a
+// string separated by sep, a regular expression with the flag r.
+func builtinSplit(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 1, 2)
+	str := s.stringTarget(n)
+	sep := s.stringArg(n, 0)
+	if f := s.flagsArg(n, 1, "irlmsc"); f.regex || f.caseInsensitive {
+		return reflect.ValueOf(s.regex(n, sep, f).find.Split(str, -1))
+	}
+	return reflect.ValueOf(strings.Split(str, sep))
+}
+
+// padBuiltin returns ?left_pad(length, padding) or ?right_pad(length,
+// padding), which pad a string to the length with the padding, a space by
+// default. The padding repeats as if it started at the left of the padded
+// string, so "a"?left_pad(5, "-+") is "-+-+a" and "a"?right_pad(5, "-+")
+// is "a+-+-".
+func padBuiltin(left bool) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 1, 2)
+		str := s.stringTarget(n)
+		length := s.intArg(n, 0)
+		pad := []rune(" ")
+		if len(n.Args) == 2 {
+			if pad = []rune(s.stringArg(n, 1)); len(pad) == 0 {
+				s.errorf("the padding of ?%s can't be empty", n.Name)
+			}
+		}
+		count := utf8.RuneCountInString(str)
+		if count >= length {
+			return reflect.ValueOf(str)
+		}
+		s.checkSize(int64(len(str)) + int64(length-count))
+		var b strings.Builder
+		start := 0
+		if !left {
+			b.WriteString(str)
+			start = count
+		}
+		for i := start; i < start+length-count; i++ {
+			b.WriteRune(pad[i%len(pad)])
+		}
+		if left {
+			b.WriteString(str)
+		}
+		return reflect.ValueOf(b.String())
+	}
+}
+
+// builtinChopLinebreak evaluates ?chop_linebreak, which removes the line
+// break at the end of a string, if there is one.
+func builtinChopLinebreak(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	str := s.stringTarget(n)
+	switch {
+	case strings.HasSuffix(str, "\r\n"):
+		str = str[:len(str)-2]
+	case strings.HasSuffix(str, "\n"), strings.HasSuffix(str, "\r"):
+		str = str[:len(str)-1]
+	}
+	return reflect.ValueOf(str)
+}
+
+// builtinWordList evaluates ?word_list, the sequence of the words of a
+// string, which are separated by white space.
+func builtinWordList(s *state, n *parse.BuiltinNode) reflect.Value {
+	s.checkArgs(n, 0, 0)
+	return reflect.ValueOf(strings.Fields(s.stringTarget(n)))
+}
+
+// Where ?truncate cuts a string.
+const (
+	truncateAuto  = iota // at a word boundary, unless it drops too much
+	truncateWords        // at a word boundary
+	truncateChars        // anywhere
+)
+
+// defaultTerminator ends a truncated string, unless ?truncate is given
+// another terminator.
+const defaultTerminator = "[...]"
+
+// minWordBoundary is the least part of the length left for the text that
+// ?truncate keeps when cutting at a word boundary.
+const minWordBoundary = 0.75
+
+// truncateBuiltin returns ?truncate(length, terminator, terminatorLength),
+// ?truncate_w or ?truncate_c, which shorten a string longer than length to
+// length characters, with the terminator, counted as terminatorLength
+// characters, at the end. ?truncate_w cuts at a word boundary, ?truncate_c
+// anywhere, and ?truncate at a word boundary unless that would drop more
+// than a quarter of the text.
+func truncateBuiltin(mode int) builtin {
+	return func(s *state, n *parse.BuiltinNode) reflect.Value {
+		s.checkArgs(n, 1, 3)
+		runes := []rune(s.stringTarget(n))
+		length := s.intArg(n, 0)
+		if length < 0 {
+			s.errorf("?%s can't truncate to a negative length %d", n.Name, length)
+		}
+		terminator := defaultTerminator
+		if len(n.Args) >= 2 {
+			terminator = s.stringArg(n, 1)
+		}
+		termLength := utf8.RuneCountInString(terminator)
+		if len(n.Args) == 3 {
+			termLength = s.intArg(n, 2)
+		}
+		if len(runes) <= length {
+			return reflect.ValueOf(string(runes))
+		}
+		return reflect.ValueOf(truncate(runes, length-termLength, terminator, mode))
+	}
+}
+
+// truncate cuts runes to at most max runes and adds the terminator. When cut
+// at a word boundary, a space separates the terminator, unless it starts
+// with a dot or an ellipsis.
+func truncate(runes []rune, max int, terminator string, mode int) string {
+	if max < 0 {
+		max = 0
+	}
+	if mode != truncateChars {
+		space := " "
+		if strings.HasPrefix(terminator, ".") || strings.HasPrefix(terminator, "…") {
+			space = ""
+		}
+		// The last word boundary, leaving room for the space: white space
+		// at that length, or before.
+		end := -1
+		for i := max - len(space); i >= 0; i-- {
+			if i < len(runes) && unicode.IsSpace(runes[i]) {
+				end = i
+				break
+			}
+		}
+		for end > 0 && unicode.IsSpace(runes[end-1]) {
+			end--
+		}
+		if mode == truncateWords || end > 0 && float64(end) >= minWordBoundary*float64(max) {
+			if end <= 0 {
+				return terminator
+			}
+			return string(runes[:end]) + space + terminator
+		}
+	}
+	return strings.TrimRightFunc(string(runes[:max]), unicode.IsSpace) + terminator
+}
@@ -0,0 +1,89 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStringBuiltins(t *testing.T) {
+	data := map[string]interface{}{
+		"s":      "  hello wORLD  ",
+		"path":   "docs/api/index.html",
+		"long":   "This is a too long name",
+		"word":   "This isoneveryverylongword",
+		"short":  "This is short",
+		"line":   "text\r\n",
+		"umlaut": "ärger",
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    string
+	}{
+		{"case", "${s?upper_case}|${s?lower_case}|${s?cap_first}|${'Hello'?uncap_first}|${s?capitalize}|${umlaut?cap_first}",
+			"  HELLO WORLD  |  hello world  |  Hello wORLD  |hello|  Hello World  |Ärger", ""},
+		{"trim", "[${s?trim}]", "[hello wORLD]", ""},
+		{"length", "${s?length} ${umlaut?length} ${''?length}", "15 5 0", ""},
+		{"substring", "${path?substring(5)}|${path?substring(5, 8)}|${umlaut?substring(0, 1)}|${path?substring(19)}", "api/index.html|api|ä|", ""},
+		{"keep", "${path?keep_before('/')}|${path?keep_before_last('/')}|${path?keep_after('/')}|${path?keep_after_last('/')}",
+			"docs|docs/api|api/index.html|index.html", ""},
+		{"keep missing", "[${path?keep_before('#')}][${path?keep_after('#')}][${path?keep_before_last('#')}][${path?keep_after_last('#')}]",
+			"[docs/api/index.html][][docs/api/index.html][]", ""},
+		{"remove", "${path?remove_beginning('docs/')} ${path?remove_ending('.html')} ${path?remove_beginning('x')}",
+			"api/index.html docs/api/index docs/api/index.html", ""},
+		{"tests", "<#if path?contains('api')>c</#if><#if path?starts_with('docs')>s</#if><#if path?ends_with('.html')>e</#if><#if path?contains(\"#\")>x</#if>",
+			"cse", ""},
+		{"index", "${path?index_of('/')} ${path?index_of('/', 5)} ${path?last_index_of('/')} ${path?last_index_of('/', 8)} ${path?index_of(\"#\")} ${umlaut?index_of('g')}",
+			"4 8 8 8 -1 2", ""},
+		{"index bounds", "${'abc'?index_of('', 100)} ${'abc'?index_of('', -1)} ${'abc'?index_of('c', 100)} ${'abc'?last_index_of('', 100)}",
+			"3 0 -1 3", ""},
+		{"replace", "${path?replace('/', ' > ')} ${'ab'?replace('', '-')}", "docs > api > index.html -a-b-", ""},
+		{"split", "<#list path?split('/') as part>[${part}]</#list>", "[docs][api][index.html]", ""},
+		{"pad", "[${'a'?left_pad(5, '-+')}][${'ab'?left_pad(5, '-+')}][${'a'?right_pad(5, '-+')}][${'ab'?right_pad(5, '-+')}][${'abc'?left_pad(2)}][${'a'?left_pad(3)}]",
+			"[-+-+a][-+-ab][a+-+-][ab-+-][abc][  a]", ""},
+		{"chop linebreak", "[${line?chop_linebreak}][${\"a\\n\"?chop_linebreak}][${\"a\"?chop_linebreak}]", "[text][a][a]", ""},
+		{"word list", "<#list s?word_list as w>[${w}]</#list>", "[hello][wORLD]", ""},
+		{"truncate", "${short?truncate(16)}|${long?truncate(16)}|${word?truncate(16)}|${long?truncate(15, '...')}|${long?truncate(15, '…', 1)}",
+			"This is short|This is a [...]|This isonev[...]|This is a...|This is a too…", ""},
+		{"truncate variants", "${word?truncate_w(16)}|${long?truncate_c(16)}|${long?truncate_w(12)}", "This [...]|This is a t[...]|This [...]", ""},
+		{"numbers", "${1234?length} ${3.5?replace('.', ',')}", "5 3,5", ""},
+		{"bad index", "${path?substring(3, 1)}", "", "?substring index 1 is out of bounds"},
+		{"bad padding", "${path?left_pad(30, '')}", "", "the padding of ?left_pad can't be empty"},
+		{"bad args", "${path?contains}", "", "?contains takes 1 argument(s), but got 0"},
+		{"not a string", "${path?split('/')?trim}", "", "expected a string, but path?split(\"/\") has evaluated to a sequence"},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}
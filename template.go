@@ -17,6 +17,7 @@
 package template
 
 import (
+	"log"
 	"reflect"
 	"sync"
 
@@ -40,6 +41,14 @@ type common struct {
 	// expose reflection to the client.
 	muFuncs   sync.RWMutex // protects parseFuncs and execFuncs
 	execFuncs map[string]reflect.Value
+
+	exceptionHandler ExceptionHandler // nil for RethrowHandler
+	attemptLogger    *log.Logger      // nil for the standard logger
+	limits           Limits
+	wrapper          ObjectWrapper // nil for DefaultObjectWrapper
+	lowerCamelCase   bool
+	policy           MemberAccessPolicy // nil if all members are accessible
+	settings         settings
 }
 
 // Template is the representation of a parsed template.
@@ -85,6 +94,79 @@ func (t *Template) init() {
 	}
 }
 
+// SetExceptionHandler sets the handler deciding what happens when an
+// instruction fails to execute, for t and its associated templates. The
+// default is RethrowHandler, which stops execution at the first error.
+// It returns the template, so calls can be chained.
+func (t *Template) SetExceptionHandler(h ExceptionHandler) *Template {
+	t.init()
+	if h == RethrowHandler {
+		h = nil
+	}
+	t.exceptionHandler = h
+	return t
+}
+
+// SetAttemptLogger sets the logger of the errors recovered from by the
+// <#attempt> directive, for t and its associated templates. The errors are
+// logged with their FTL stack trace. The default is the standard logger of
+// package log. It returns the template, so calls can be chained.
+func (t *Template) SetAttemptLogger(l *log.Logger) *Template {
+	t.init()
+	t.attemptLogger = l
+	return t
+}
+
+// SetObjectWrapper sets the wrapper converting the values of the data model
+// into template values, for t and its associated templates. The default is
+// DefaultObjectWrapper. It returns the template, so calls can be chained.
+func (t *Template) SetObjectWrapper(w ObjectWrapper) *Template {
+	t.init()
+	if w == DefaultObjectWrapper {
+		w = nil
+	}
+	t.wrapper = w
+	return t
+}
+
+// SetLowerCamelCase sets whether the methods and fields of Go values are
+// also exposed to t and its associated templates by their names in lower
+// camel case, such as user.userName for the field UserName, as in templates
+// written for Java beans. It returns the template, so calls can be chained.
+func (t *Template) SetLowerCamelCase(on bool) *Template {
+	t.init()
+	t.lowerCamelCase = on
+	return t
+}
+
+// SetMemberAccessPolicy sets the policy deciding which members of the
+// values of the data model t and its associated templates may access. By
+// default, all exported methods and fields are accessible and func values
+// can be called. It returns the template, so calls can be chained.
+func (t *Template) SetMemberAccessPolicy(p MemberAccessPolicy) *Template {
+	t.init()
+	t.policy = p
+	return t
+}
+
+// SetLimits sets the resource limits of executions of t and its associated
+// templates. It returns the template, so calls can be chained.
+func (t *Template) SetLimits(l Limits) *Template {
+	t.init()
+	t.limits = l
+	return t
+}
+
+// logAttemptError logs an error recovered from by <#attempt>.
+func (t *Template) logAttemptError(err ExecError) {
+	msg := "error executing <#attempt>, continuing with <#recover>: " + err.Error()
+	if t.attemptLogger == nil {
+		log.Print(msg)
+		return
+	}
+	t.attemptLogger.Print(msg)
+}
+
 // AddParseTree adds parse tree for template with given name and associates it with t.
 // If the template does not already exist, it will create a new one.
 // If the template does exist, it will be replaced.
@@ -153,6 +235,25 @@ func (t *Template) Parse(text string) (*Template, error) {
 	return t, nil
 }
 
+// ParseAll is like Parse but does not stop at the first syntax error: it
+// returns every error in text, in input order, along with the parse tree
+// of t, which holds what could be parsed. The tree is meant for tools such
+// as linters and editors. The templates are only defined if there are no
+// errors, so t never executes a partial tree.
+func (t *Template) ParseAll(text string) (*parse.Tree, []*parse.Error) {
+	t.init()
+	t.muFuncs.RLock()
+	trees, errs := parse.ParseAll(t.name, text)
+	t.muFuncs.RUnlock()
+	if len(errs) > 0 {
+		return trees[t.name], errs
+	}
+	for name, tree := range trees {
+		t.AddParseTree(name, tree)
+	}
+	return t.Tree, nil
+}
+
 // associate installs the new template into the group of templates associated
 // with t. The two are already known to share the common structure.
 // The boolean return value reports whether to store this tree as t.Tree.
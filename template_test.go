@@ -24,20 +24,37 @@ import (
 )
 
 func ExampleTemplate() {
+	// Define a template.
 	const letter = `
-It's a simple ${thing}.
+Dear ${name},
+<#if attended>
+It was a pleasure to see you at the wedding.<#else>
+It is a shame you couldn't make it to the wedding.</#if><#if gift??>
+Thank you for the lovely ${gift}.</#if>
+
+Best wishes,
+Josie
 `
 
+	// Prepare some data to insert into the template.
+	recipients := []map[string]interface{}{
+		{"name": "Aunt Mildred", "gift": "bone china tea set", "attended": true},
+		{"name": "Uncle John", "gift": "moleskin pants", "attended": false},
+		{"name": "Cousin Rodney", "attended": false},
+	}
+
 	// Create a new template and parse the letter into it.
 	t, err := template.New("letter").Parse(letter)
 	if nil != err {
 		panic(err)
 	}
 
-	dataModel := map[string]interface{}{}
-	err = t.Execute(os.Stdout, dataModel)
-	if err != nil {
-		log.Println("executing template:", err)
+	// Execute the template for each recipient.
+	for _, r := range recipients {
+		err := t.Execute(os.Stdout, r)
+		if err != nil {
+			log.Println("executing template:", err)
+		}
 	}
 
 	// Output:
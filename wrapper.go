@@ -0,0 +1,178 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"time"
+)
+
+// An ObjectWrapper converts the Go values of the data model into the values
+// templates see. Every value a template gets from the data model goes
+// through it: the data passed to Execute, the members of hashes, the items
+// of sequences and the results of methods and functions. Values created by
+// the template itself, such as literals, do not.
+//
+// Wrap returns either a value implementing one or more of the model
+// interfaces, such as HashModel, or a Go value that is adapted by
+// reflection; nil is a missing value. The result is not wrapped again, but
+// the values it gives access to are.
+//
+// A wrapper that handles some types specially, such as a decimal type,
+// usually delegates the other values to DefaultObjectWrapper or
+// SimpleObjectWrapper.
+type ObjectWrapper interface {
+	Wrap(v interface{}) (interface{}, error)
+}
+
+// ObjectWrapperFunc is an adapter to allow the use of ordinary functions as
+// object wrappers.
+type ObjectWrapperFunc func(v interface{}) (interface{}, error)
+
+// Wrap calls f(v).
+func (f ObjectWrapperFunc) Wrap(v interface{}) (interface{}, error) {
+	return f(v)
+}
+
+var (
+	// DefaultObjectWrapper exposes values by reflection: the methods of any
+	// value, the exported fields of structs, the entries of maps and the
+	// items of slices and arrays. This is the default.
+	DefaultObjectWrapper ObjectWrapper = defaultWrapper{}
+
+	// SimpleObjectWrapper exposes only maps with string keys, slices,
+	// arrays, strings, numbers, booleans and times, without their methods,
+	// and the values implementing a model interface. Other values, such as
+	// structs and functions, are an error.
+	SimpleObjectWrapper ObjectWrapper = simpleWrapper{}
+)
+
+type defaultWrapper struct{}
+
+func (defaultWrapper) Wrap(v interface{}) (interface{}, error) {
+	return v, nil
+}
+
+type simpleWrapper struct{}
+
+func (simpleWrapper) Wrap(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case HashModel, SequenceModel, CollectionModel, ScalarModel, NumberModel, BooleanModel, DateModel, MethodModel:
+		return v, nil
+	case time.Time:
+		return simpleDate(v), nil
+	case *big.Int, *big.Float, *big.Rat:
+		return v, nil
+	}
+	val, isNil := indirect(reflect.ValueOf(v))
+	if isNil {
+		return nil, nil
+	}
+	switch val.Kind() {
+	case reflect.Map:
+		if val.Type().Key().Kind() == reflect.String {
+			return simpleHash{val}, nil
+		}
+	case reflect.Slice, reflect.Array:
+		return simpleSequence{val}, nil
+	case reflect.String:
+		return val.String(), nil
+	case reflect.Bool:
+		return val.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return val.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), nil
+	}
+	return nil, fmt.Errorf("SimpleObjectWrapper can't wrap a value of type %T", v)
+}
+
+// simpleHash is a map as wrapped by SimpleObjectWrapper.
+type simpleHash struct {
+	m reflect.Value
+}
+
+func (h simpleHash) Get(key string) (interface{}, error) {
+	v := h.m.MapIndex(reflect.ValueOf(key).Convert(h.m.Type().Key()))
+	if !v.IsValid() {
+		return nil, nil
+	}
+	return v.Interface(), nil
+}
+
+func (h simpleHash) Keys() ([]string, error) {
+	keys := sortKeys(h.m.MapKeys())
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.String()
+	}
+	return names, nil
+}
+
+// simpleSequence is a slice or an array as wrapped by SimpleObjectWrapper.
+type simpleSequence struct {
+	s reflect.Value
+}
+
+func (s simpleSequence) Len() (int, error) {
+	return s.s.Len(), nil
+}
+
+func (s simpleSequence) Index(i int) (interface{}, error) {
+	return s.s.Index(i).Interface(), nil
+}
+
+// simpleDate is a time as wrapped by SimpleObjectWrapper.
+type simpleDate time.Time
+
+func (d simpleDate) AsDate() (time.Time, error) {
+	return time.Time(d), nil
+}
+
+func (d simpleDate) DateType() DateType {
+	return UnknownDateType
+}
+
+// wrap converts the value v got from the data model with the object
+// wrapper. A func value is disabled if the member access policy doesn't
+// allow calling it.
+func (s *state) wrap(v reflect.Value) reflect.Value {
+	v = indirectInterface(v)
+	if v.Kind() == reflect.Func && !s.canCallFuncs() {
+		return reflect.ValueOf(disabledFunc{v.Type()})
+	}
+	return s.wrapObject(v)
+}
+
+// wrapObject converts the value v with the object wrapper.
+func (s *state) wrapObject(v reflect.Value) reflect.Value {
+	v = indirectInterface(v)
+	if s.wrapper == nil || !v.IsValid() || !v.CanInterface() {
+		return v
+	}
+	x, err := s.wrapper.Wrap(v.Interface())
+	if err != nil {
+		s.errorf("%w", err)
+	}
+	return valueOf(x)
+}
@@ -0,0 +1,75 @@
+// freemarker.go - FreeMarker template engine in golang.
+// Copyright (C) 2017, b3log.org & hacpai.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type shout string
+
+func (s shout) Loud() string { return strings.ToUpper(string(s)) }
+
+type cents int
+
+func TestObjectWrapper(t *testing.T) {
+	moneyWrapper := ObjectWrapperFunc(func(v interface{}) (interface{}, error) {
+		if c, ok := v.(cents); ok {
+			return money{int(c)}, nil
+		}
+		return DefaultObjectWrapper.Wrap(v)
+	})
+	data := map[string]interface{}{
+		"name":   shout("joe"),
+		"user":   &T{Name: "Joe"},
+		"items":  []interface{}{1, "two", []int{3}},
+		"hash":   map[string]int{"b": 2, "a": 1},
+		"prices": []cents{1250, 99},
+	}
+	tests := []struct {
+		name    string
+		input   string
+		wrapper ObjectWrapper
+		output  string
+		err     string
+	}{
+		{"default", "${name.Loud()}${user.Name}", DefaultObjectWrapper, "JOEJoe", ""},
+		{"simple values", "${name}<#list items as x><#if x??>.</#if></#list>${items[2][0]}", SimpleObjectWrapper, "joe...3", ""},
+		{"simple hash", "<#list hash as k, v>${k}=${v};</#list>${hash.b}", SimpleObjectWrapper, "a=1;b=2;2", ""},
+		{"simple hides methods", "${name.Loud()}", SimpleObjectWrapper, "", "can't get member of name"},
+		{"simple rejects structs", "${user.Name}", SimpleObjectWrapper, "", "can't wrap a value of type *template.T"},
+		{"custom", "<#list prices as p>${p} </#list>${prices[0] * 2}", moneyWrapper, "$12.50 $0.99 25", ""},
+	}
+	for _, test := range tests {
+		tmpl, err := New(test.name).SetObjectWrapper(test.wrapper).Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		err = tmpl.Execute(b, data)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		case test.err == "" && b.String() != test.output:
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.output, b.String())
+		}
+	}
+}